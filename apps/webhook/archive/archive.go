@@ -0,0 +1,251 @@
+// Package archive keeps every SNS message the webhook receives, as it was received,
+// so what SES told us can be checked and replayed later. Records are stored in gzipped
+// newline delimited json files partitioned by the day they were received and their campaign:
+//
+//	dt=2024-03-11/campaign=<campaign id>/<opened at>-<random>.ndjson.gz
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Record is an SNS message body as it was received
+type Record struct {
+	ReceivedAt   time.Time
+	SnsMessageId string
+	// TopicArn is the topic which published the message, records archived before it was
+	// kept have none
+	TopicArn string
+	// CampaignId is empty for messages which aren't events for a campaign,
+	// e.g. subscription confirmations and events which failed to parse
+	CampaignId string
+	Body       []byte
+}
+
+// line is a record as it's written to a file. The body is kept as a string rather than
+// as json so it's stored byte for byte as it was received.
+type line struct {
+	ReceivedAt   time.Time `json:"receivedAt"`
+	SnsMessageId string    `json:"snsMessageId"`
+	TopicArn     string    `json:"topicArn,omitempty"`
+	CampaignId   string    `json:"campaignId,omitempty"`
+	Body         string    `json:"body"`
+}
+
+// ArchiveSink appends records to files. A file is completed once it reaches the sink's
+// max size or age, or when the sink is closed.
+type ArchiveSink interface {
+	Write(ctx context.Context, record Record) error
+	// Close completes every file
+	Close(ctx context.Context) error
+	// HandleErrors calls fn with the errors of files completed or uploaded in the
+	// background, which no Write returns. They're dropped until it's called.
+	HandleErrors(fn func(err error))
+}
+
+// ErrFileDropped is passed to a sink's error handler when a completed file is dropped
+// before it's stored, its records are lost
+var ErrFileDropped = errors.New("archive file dropped")
+
+// Reader reads archived records back, e.g. to replay them
+type Reader interface {
+	// Read calls fn with each record matching the query, ordered by the day they were
+	// received, then by campaign and then in the order they were written to each file.
+	// Files which are still being written are read up to their last complete record.
+	Read(ctx context.Context, query Query, fn func(Record) error) error
+}
+
+// Query selects archived records, its zero value selects every record
+type Query struct {
+	// CampaignId selects the campaign's records if it's set
+	CampaignId string
+	// From and To select records received at or after From and before To if they're set
+	From time.Time
+	To   time.Time
+}
+
+const (
+	dateLayout     = "2006-01-02"
+	fileTimeLayout = "20060102T150405.000000000Z"
+	fileExtension  = ".ndjson.gz"
+)
+
+// partition returns the directory of the records received on the day for the campaign
+func partition(receivedAt time.Time, campaignId string) string {
+	return "dt=" + receivedAt.UTC().Format(dateLayout) + "/campaign=" + url.PathEscape(campaignId)
+}
+
+// fileName returns a new file name in the partition, files sort by when they were opened
+// and the random suffix stops instances writing to the same bucket from colliding
+func fileName(partition string, openedAt time.Time) string {
+	return partition + "/" + openedAt.UTC().Format(fileTimeLayout) + "-" + uuid.NewString()[:8] + fileExtension
+}
+
+// matchesDate reports whether records received on the partition's day may match
+func (query Query) matchesDate(dir string) bool {
+	date, err := time.Parse(dateLayout, strings.TrimPrefix(dir, "dt="))
+	if err != nil || !strings.HasPrefix(dir, "dt=") {
+		return false
+	}
+	if !query.From.IsZero() && date.Before(query.From.UTC().Truncate(24*time.Hour)) {
+		return false
+	}
+	return query.To.IsZero() || date.Before(query.To)
+}
+
+// matchesCampaign reports whether the campaign partition's records may match
+func (query Query) matchesCampaign(dir string) bool {
+	campaignId, err := url.PathUnescape(strings.TrimPrefix(dir, "campaign="))
+	if err != nil || !strings.HasPrefix(dir, "campaign=") {
+		return false
+	}
+	return query.CampaignId == "" || campaignId == query.CampaignId
+}
+
+func (query Query) matches(record Record) bool {
+	return (query.CampaignId == "" || record.CampaignId == query.CampaignId) &&
+		(query.From.IsZero() || !record.ReceivedAt.Before(query.From)) &&
+		(query.To.IsZero() || record.ReceivedAt.Before(query.To))
+}
+
+// segment is a file being written
+type segment struct {
+	name     string
+	gzip     *gzip.Writer
+	size     int64
+	openedAt time.Time
+}
+
+// write appends the record as a line and flushes it so it can be read before the file
+// is completed
+func (seg *segment) write(record Record) error {
+	encoded, err := json.Marshal(line{
+		ReceivedAt:   record.ReceivedAt,
+		SnsMessageId: record.SnsMessageId,
+		TopicArn:     record.TopicArn,
+		CampaignId:   record.CampaignId,
+		Body:         string(record.Body),
+	})
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+	if _, err := seg.gzip.Write(encoded); err != nil {
+		return err
+	}
+	seg.size += int64(len(encoded))
+	return seg.gzip.Flush()
+}
+
+func (seg *segment) full(maxBytes int64, maxAge time.Duration, now time.Time) bool {
+	return seg.size >= maxBytes || now.Sub(seg.openedAt) >= maxAge
+}
+
+// maxRecordSize is the longest line read, SNS messages are at most 256KiB
+const maxRecordSize = 1 << 20
+
+// readRecords calls fn with each record in a gzipped ndjson file which matches the query.
+// Files which are still being written, or which were cut short, end at their last
+// complete record.
+func readRecords(reader io.Reader, query Query, fn func(Record) error) error {
+	gzipReader, err := gzip.NewReader(reader)
+	if errors.Is(err, io.EOF) {
+		// nothing has been flushed to the file yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	scanner := bufio.NewScanner(gzipReader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var decoded line
+		if err := json.Unmarshal(scanner.Bytes(), &decoded); err != nil {
+			// a record cut short by a crash ends the file
+			if !scanner.Scan() && errors.Is(scanner.Err(), io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		record := Record{
+			ReceivedAt:   decoded.ReceivedAt,
+			SnsMessageId: decoded.SnsMessageId,
+			TopicArn:     decoded.TopicArn,
+			CampaignId:   decoded.CampaignId,
+			Body:         []byte(decoded.Body),
+		}
+		if !query.matches(record) {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return nil
+}
+
+// errorHandler passes the errors of a sink's background work to the handler set by HandleErrors
+type errorHandler struct {
+	lock    sync.Mutex
+	handler func(err error)
+}
+
+func (errs *errorHandler) HandleErrors(fn func(err error)) {
+	errs.lock.Lock()
+	defer errs.lock.Unlock()
+	errs.handler = fn
+}
+
+func (errs *errorHandler) report(err error) {
+	if err == nil {
+		return
+	}
+	errs.lock.Lock()
+	handler := errs.handler
+	errs.lock.Unlock()
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// startRotation calls rotate every interval, and whenever wake is signalled, until stop is
+// closed, done is closed once it returns. A nil wake only rotates on the interval.
+func startRotation(interval time.Duration, rotate func(now time.Time), wake <-chan struct{}, stop, done chan struct{}) {
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				rotate(now)
+			case <-wake:
+				rotate(time.Now())
+			}
+		}
+	}()
+}
+
+// rotationInterval checks for files which are too old often enough that files
+// are completed soon after reaching maxAge
+func rotationInterval(maxAge time.Duration) time.Duration {
+	return min(max(maxAge/4, time.Second), time.Minute)
+}
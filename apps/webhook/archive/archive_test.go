@@ -0,0 +1,424 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type readableSink interface {
+	ArchiveSink
+	Reader
+}
+
+func newFileTester(test *testing.T, maxBytes int64, maxAge time.Duration) readableSink {
+	test.Helper()
+	sink, err := NewFileSink(test.TempDir(), maxBytes, maxAge)
+	if err != nil {
+		test.Fatalf("failed to create sink: %s", err)
+	}
+	return sink
+}
+
+func newS3Tester(test *testing.T, maxBytes int64, maxAge time.Duration) readableSink {
+	return NewS3Sink(newMemoryObjects(), "archive", maxBytes, maxAge)
+}
+
+// newMinioTester uses the bucket TEST_S3_BUCKET at TEST_S3_ENDPOINT, e.g. a local MinIO,
+// the test is skipped if it isn't set. Tests share the bucket so they use random prefixes.
+func newMinioTester(test *testing.T, maxBytes int64, maxAge time.Duration) readableSink {
+	test.Helper()
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		test.Skip("TEST_S3_ENDPOINT not set")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(os.Getenv("TEST_S3_ACCESS_KEY"), os.Getenv("TEST_S3_SECRET_KEY"), ""),
+	})
+	if err != nil {
+		test.Fatalf("failed to create client: %s", err)
+	}
+	bucket := os.Getenv("TEST_S3_BUCKET")
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		test.Fatalf("failed to check bucket: %s", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			test.Fatalf("failed to create bucket: %s", err)
+		}
+	}
+	return NewS3Sink(NewMinioStore(client, bucket), "test-"+uuid.NewString(), maxBytes, maxAge)
+}
+
+var sinkTesters = map[string]func(test *testing.T, maxBytes int64, maxAge time.Duration) readableSink{
+	"file":  newFileTester,
+	"s3":    newS3Tester,
+	"minio": newMinioTester,
+}
+
+// memoryObjects is an in memory ObjectStore, failures makes the next puts fail and
+// puts wait for blocked to be closed when it's set
+type memoryObjects struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	failures atomic.Int32
+	blocked  chan struct{}
+}
+
+func newMemoryObjects() *memoryObjects {
+	return &memoryObjects{objects: make(map[string][]byte)}
+}
+
+func (objects *memoryObjects) PutObject(ctx context.Context, key string, body []byte) error {
+	if objects.blocked != nil {
+		<-objects.blocked
+	}
+	if objects.failures.Add(-1) >= 0 {
+		return errors.New("put failed")
+	}
+	objects.lock.Lock()
+	defer objects.lock.Unlock()
+	objects.objects[key] = bytes.Clone(body)
+	return nil
+}
+
+func (objects *memoryObjects) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	objects.lock.Lock()
+	defer objects.lock.Unlock()
+	var keys []string
+	for key := range objects.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (objects *memoryObjects) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	objects.lock.Lock()
+	defer objects.lock.Unlock()
+	body, ok := objects.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("no object %s", key)
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+func testRecord(campaignId string, receivedAt time.Time) Record {
+	id := uuid.NewString()
+	return Record{
+		ReceivedAt:   receivedAt,
+		SnsMessageId: id,
+		TopicArn:     "arn:aws:sns:us-west-2:123456789012:test-topic",
+		CampaignId:   campaignId,
+		Body:         []byte(fmt.Sprintf(`{"MessageId": %q, "Html": "<p>"}`, id)),
+	}
+}
+
+func readIds(test *testing.T, ctx context.Context, reader Reader, query Query) []string {
+	test.Helper()
+	var ids []string
+	err := reader.Read(ctx, query, func(record Record) error {
+		ids = append(ids, record.SnsMessageId)
+		return nil
+	})
+	if err != nil {
+		test.Fatalf("failed to read: %s", err)
+	}
+	return ids
+}
+
+func assertIds(test *testing.T, expected []string, actual []string) {
+	test.Helper()
+	if strings.Join(expected, ",") != strings.Join(actual, ",") {
+		test.Errorf("expected records %v but got %v", expected, actual)
+	}
+}
+
+func TestArchiveSink(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range sinkTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// small files so records are spread over several of them
+			sink := newTester(test, 256, time.Hour)
+			day := time.Date(2024, 3, 11, 12, 0, 0, 0, time.UTC)
+			for i := 0; i < 10; i++ {
+				for _, record := range []Record{
+					testRecord("campaign/1", day.Add(time.Duration(i)*time.Minute)),
+					testRecord("campaign-2", day.Add(time.Duration(i)*time.Minute)),
+					testRecord("campaign/1", day.Add(24*time.Hour+time.Duration(i)*time.Minute)),
+					testRecord("", day.Add(time.Duration(i)*time.Minute)),
+				} {
+					if err := sink.Write(ctx, record); err != nil {
+						test.Fatalf("failed to write: %s", err)
+					}
+				}
+			}
+			if err := sink.Close(ctx); err != nil {
+				test.Fatalf("failed to close: %s", err)
+			}
+
+			// records are read in the order they were written within a partition
+			all := readIds(test, ctx, sink, Query{})
+			if len(all) != 40 {
+				test.Fatalf("expected 40 records but got %d", len(all))
+			}
+			var first, second, nextDay, subscription []string
+			err := sink.Read(ctx, Query{}, func(record Record) error {
+				switch {
+				case record.CampaignId == "":
+					subscription = append(subscription, record.SnsMessageId)
+				case record.CampaignId == "campaign-2":
+					second = append(second, record.SnsMessageId)
+				case record.ReceivedAt.Day() == 11:
+					first = append(first, record.SnsMessageId)
+				default:
+					nextDay = append(nextDay, record.SnsMessageId)
+				}
+				if string(record.Body) != fmt.Sprintf(`{"MessageId": %q, "Html": "<p>"}`, record.SnsMessageId) {
+					test.Errorf("expected the body to be kept but got %s", record.Body)
+				}
+				if record.TopicArn != "arn:aws:sns:us-west-2:123456789012:test-topic" {
+					test.Errorf("expected the topic to be kept but got %q", record.TopicArn)
+				}
+				return nil
+			})
+			if err != nil {
+				test.Fatalf("failed to read: %s", err)
+			}
+			assertIds(test, append(append(append(subscription, first...), second...), nextDay...), all)
+
+			assertIds(test, append(first, nextDay...), readIds(test, ctx, sink, Query{CampaignId: "campaign/1"}))
+			assertIds(test, first[:5], readIds(test, ctx, sink, Query{CampaignId: "campaign/1", To: day.Add(5 * time.Minute)}))
+			assertIds(test, nextDay[2:], readIds(test, ctx, sink, Query{CampaignId: "campaign/1", From: day.Add(24*time.Hour + 2*time.Minute)}))
+			assertIds(test, nil, readIds(test, ctx, sink, Query{CampaignId: "campaign-3"}))
+
+			// fn's errors stop the read
+			stop := errors.New("stop")
+			err = sink.Read(ctx, Query{}, func(record Record) error { return stop })
+			if !errors.Is(err, stop) {
+				test.Errorf("expected the read to stop but got %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveSinkRotation(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range sinkTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			sink := newTester(test, 1<<20, time.Hour)
+			now := time.Now()
+			var ids []string
+			for i := 0; i < 3; i++ {
+				record := testRecord("test-campaign", now)
+				if err := sink.Write(ctx, record); err != nil {
+					test.Fatalf("failed to write: %s", err)
+				}
+				ids = append(ids, record.SnsMessageId)
+			}
+
+			// files are completed once they're too old
+			switch sink := sink.(type) {
+			case *FileSink:
+				if err := sink.rotate(time.Now().Add(time.Hour)); err != nil {
+					test.Fatalf("failed to rotate: %s", err)
+				}
+			case *S3Sink:
+				if err := sink.rotate(ctx, time.Now().Add(time.Hour)); err != nil {
+					test.Fatalf("failed to rotate: %s", err)
+				}
+			}
+			record := testRecord("test-campaign", now)
+			if err := sink.Write(ctx, record); err != nil {
+				test.Fatalf("failed to write: %s", err)
+			}
+			ids = append(ids, record.SnsMessageId)
+			if err := sink.Close(ctx); err != nil {
+				test.Fatalf("failed to close: %s", err)
+			}
+			assertIds(test, ids, readIds(test, ctx, sink, Query{}))
+		})
+	}
+}
+
+func TestFileSinkPartialFiles(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := test.TempDir()
+	sink, err := NewFileSink(dir, 1<<20, time.Hour)
+	if err != nil {
+		test.Fatalf("failed to create sink: %s", err)
+	}
+	defer sink.Close(ctx)
+
+	// files being written are read up to their last record
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		record := testRecord("test-campaign", now)
+		if err := sink.Write(ctx, record); err != nil {
+			test.Fatalf("failed to write: %s", err)
+		}
+		ids = append(ids, record.SnsMessageId)
+	}
+	assertIds(test, ids, readIds(test, ctx, sink, Query{}))
+
+	// as are files cut short by a crash
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*", "*"+fileExtension))
+	if err != nil || len(paths) != 1 {
+		test.Fatalf("expected one file but got %v, %v", paths, err)
+	}
+	contents, err := os.ReadFile(paths[0])
+	if err != nil {
+		test.Fatalf("failed to read file: %s", err)
+	}
+	truncated := filepath.Join(test.TempDir(), "truncated"+fileExtension)
+	if err := os.WriteFile(truncated, contents[:len(contents)-10], 0o644); err != nil {
+		test.Fatalf("failed to write file: %s", err)
+	}
+	var read []string
+	err = readFile(truncated, Query{}, func(record Record) error {
+		read = append(read, record.SnsMessageId)
+		return nil
+	})
+	if err != nil {
+		test.Fatalf("failed to read truncated file: %s", err)
+	}
+	assertIds(test, ids[:2], read)
+}
+
+func TestS3SinkFailedUploads(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objects := newMemoryObjects()
+	sink := NewS3Sink(objects, "archive", 1<<20, time.Hour)
+	now := time.Now()
+	record := testRecord("test-campaign", now)
+	if err := sink.Write(ctx, record); err != nil {
+		test.Fatalf("failed to write: %s", err)
+	}
+
+	// files which fail to upload are kept until they're uploaded
+	objects.failures.Store(1)
+	if err := sink.rotate(ctx, time.Now().Add(time.Hour)); err == nil {
+		test.Errorf("expected the upload to fail")
+	}
+	assertIds(test, nil, readIds(test, ctx, sink, Query{}))
+	if err := sink.Close(ctx); err != nil {
+		test.Fatalf("failed to close: %s", err)
+	}
+	assertIds(test, []string{record.SnsMessageId}, readIds(test, ctx, sink, Query{}))
+}
+
+func TestS3SinkBackgroundUploads(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objects := newMemoryObjects()
+	objects.blocked = make(chan struct{})
+	// every record completes the file before it
+	sink := NewS3Sink(objects, "archive", 1, time.Hour)
+	now := time.Now()
+
+	// writes which complete files don't wait for their uploads
+	var ids []string
+	for i := 0; i < 3; i++ {
+		record := testRecord("test-campaign", now)
+		if err := sink.Write(ctx, record); err != nil {
+			test.Fatalf("failed to write: %s", err)
+		}
+		ids = append(ids, record.SnsMessageId)
+	}
+	close(objects.blocked)
+	if err := sink.Close(ctx); err != nil {
+		test.Fatalf("failed to close: %s", err)
+	}
+	assertIds(test, ids, readIds(test, ctx, sink, Query{}))
+}
+
+func TestS3SinkDroppedFiles(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objects := newMemoryObjects()
+	objects.failures.Store(1000)
+	// every record completes the file before it and only the newest file is kept
+	sink := NewS3Sink(objects, "archive", 1, time.Hour)
+	sink.maxPendingBytes = 1
+	var lock sync.Mutex
+	var failures []error
+	sink.HandleErrors(func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		failures = append(failures, err)
+	})
+
+	// the oldest files are dropped while uploads fail
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		record := testRecord("test-campaign", now)
+		if err := sink.Write(ctx, record); err != nil {
+			test.Fatalf("failed to write: %s", err)
+		}
+		ids = append(ids, record.SnsMessageId)
+	}
+	objects.failures.Store(0)
+	sink.lock.Lock()
+	sink.maxPendingBytes = maxPendingBytes
+	sink.lock.Unlock()
+	if err := sink.Close(ctx); err != nil {
+		test.Fatalf("failed to close: %s", err)
+	}
+	assertIds(test, ids[1:], readIds(test, ctx, sink, Query{}))
+
+	lock.Lock()
+	defer lock.Unlock()
+	dropped := 0
+	for _, err := range failures {
+		if errors.Is(err, ErrFileDropped) {
+			dropped++
+		}
+	}
+	if dropped != 1 {
+		test.Errorf("expected 1 dropped file but got %v", failures)
+	}
+}
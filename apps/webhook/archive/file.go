@@ -0,0 +1,187 @@
+package archive
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSink archives records to files on local disk
+type FileSink struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	lock     sync.Mutex
+	// segments are the open files by partition
+	segments map[string]*fileSegment
+	stop     chan struct{}
+	done     chan struct{}
+	errorHandler
+}
+
+type fileSegment struct {
+	segment
+	file *os.File
+}
+
+// NewFileSink archives records under dir. Files are completed once maxBytes of records
+// have been written to them or they're maxAge old.
+func NewFileSink(dir string, maxBytes int64, maxAge time.Duration) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	sink := &FileSink{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		segments: make(map[string]*fileSegment),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	startRotation(rotationInterval(maxAge), func(now time.Time) { sink.report(sink.rotate(now)) }, nil, sink.stop, sink.done)
+	return sink, nil
+}
+
+func (sink *FileSink) Write(ctx context.Context, record Record) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	now := time.Now()
+	key := partition(record.ReceivedAt, record.CampaignId)
+	seg, ok := sink.segments[key]
+	if ok && seg.full(sink.maxBytes, sink.maxAge, now) {
+		delete(sink.segments, key)
+		if err := seg.close(); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		var err error
+		seg, err = sink.open(key, now)
+		if err != nil {
+			return err
+		}
+		sink.segments[key] = seg
+	}
+	return seg.write(record)
+}
+
+func (sink *FileSink) open(partition string, now time.Time) (*fileSegment, error) {
+	name := fileName(partition, now)
+	path := filepath.Join(sink.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// files are never reopened, a name which exists already is a bug
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSegment{segment: segment{name: name, gzip: gzip.NewWriter(file), openedAt: now}, file: file}, nil
+}
+
+func (seg *fileSegment) close() error {
+	return errors.Join(seg.gzip.Close(), seg.file.Sync(), seg.file.Close())
+}
+
+// rotate completes the files which are older than the sink's max age
+func (sink *FileSink) rotate(now time.Time) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	var errs []error
+	for key, seg := range sink.segments {
+		if now.Sub(seg.openedAt) >= sink.maxAge {
+			delete(sink.segments, key)
+			errs = append(errs, seg.close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (sink *FileSink) Close(ctx context.Context) error {
+	select {
+	case <-sink.stop:
+	default:
+		close(sink.stop)
+	}
+	<-sink.done
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	var errs []error
+	for key, seg := range sink.segments {
+		delete(sink.segments, key)
+		errs = append(errs, seg.close())
+	}
+	return errors.Join(errs...)
+}
+
+func (sink *FileSink) Read(ctx context.Context, query Query, fn func(Record) error) error {
+	dates, err := readDirNames(sink.dir)
+	if err != nil {
+		return err
+	}
+	for _, date := range dates {
+		if !query.matchesDate(date) {
+			continue
+		}
+		campaigns, err := readDirNames(filepath.Join(sink.dir, date))
+		if err != nil {
+			return err
+		}
+		for _, campaign := range campaigns {
+			if !query.matchesCampaign(campaign) {
+				continue
+			}
+			files, err := readDirNames(filepath.Join(sink.dir, date, campaign))
+			if err != nil {
+				return err
+			}
+			for _, name := range files {
+				if !strings.HasSuffix(name, fileExtension) {
+					continue
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := readFile(filepath.Join(sink.dir, date, campaign, name), query, fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func readFile(path string, query Query, fn func(Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readRecords(file, query, fn)
+}
+
+// readDirNames returns the sorted names in the directory, or none if it doesn't exist
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
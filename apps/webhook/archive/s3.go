@@ -0,0 +1,247 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ObjectStore is the part of an S3 compatible bucket the archive uses
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, body []byte) error
+	// ListObjects returns the sorted keys starting with prefix
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+	GetObject(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+type minioStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewMinioStore stores objects in the bucket through an S3 compatible client
+func NewMinioStore(client *minio.Client, bucket string) ObjectStore {
+	return &minioStore{client: client, bucket: bucket}
+}
+
+func (objects *minioStore) PutObject(ctx context.Context, key string, body []byte) error {
+	// the content type rather than a content encoding, so clients don't decompress the files
+	_, err := objects.client.PutObject(ctx, objects.bucket, key, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{ContentType: "application/gzip"})
+	return err
+}
+
+func (objects *minioStore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for object := range objects.client.ListObjects(ctx, objects.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (objects *minioStore) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	return objects.client.GetObject(ctx, objects.bucket, key, minio.GetObjectOptions{})
+}
+
+// S3Sink archives records to an S3 compatible bucket. Objects can't be appended to, so
+// files are buffered in memory and uploaded in the background once they're completed.
+// Uploads which fail are kept and retried when the next files are completed, at the next
+// rotation and when the sink is closed. At most maxPendingBytes of files are kept waiting,
+// the oldest files are dropped to make room for newer ones.
+type S3Sink struct {
+	objects  ObjectStore
+	prefix   string
+	maxBytes int64
+	maxAge   time.Duration
+	lock     sync.Mutex
+	// segments are the files being written by partition
+	segments map[string]*bufferSegment
+	// pending are the completed files which haven't been uploaded yet
+	pending []*bufferSegment
+	// maxPendingBytes bounds the size of the pending files
+	maxPendingBytes int64
+	// upload is held while uploading so files are uploaded in the order they were completed
+	upload sync.Mutex
+	// uploads wakes the rotation goroutine to upload the files completed by writes
+	uploads chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	errorHandler
+}
+
+// maxPendingBytes is how much of the completed files, compressed, can wait to be uploaded,
+// e.g. while the bucket is down
+const maxPendingBytes = 64 << 20
+
+type bufferSegment struct {
+	segment
+	buffer bytes.Buffer
+}
+
+// NewS3Sink archives records to objects under prefix. Files are completed once maxBytes
+// of records have been written to them or they're maxAge old.
+func NewS3Sink(objects ObjectStore, prefix string, maxBytes int64, maxAge time.Duration) *S3Sink {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	sink := &S3Sink{
+		objects:         objects,
+		prefix:          prefix,
+		maxBytes:        maxBytes,
+		maxAge:          maxAge,
+		segments:        make(map[string]*bufferSegment),
+		maxPendingBytes: maxPendingBytes,
+		uploads:         make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	rotate := func(now time.Time) { sink.report(sink.rotate(context.Background(), now)) }
+	startRotation(rotationInterval(maxAge), rotate, sink.uploads, sink.stop, sink.done)
+	return sink
+}
+
+// Write only buffers the record, files it completes are uploaded by the rotation goroutine
+// so writers never wait on the bucket
+func (sink *S3Sink) Write(ctx context.Context, record Record) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	now := time.Now()
+	key := partition(record.ReceivedAt, record.CampaignId)
+	seg, ok := sink.segments[key]
+	if ok && seg.full(sink.maxBytes, sink.maxAge, now) {
+		if err := sink.complete(key, seg); err != nil {
+			return err
+		}
+		select {
+		case sink.uploads <- struct{}{}:
+		default:
+			// an upload is already due
+		}
+		ok = false
+	}
+	if !ok {
+		seg = &bufferSegment{segment: segment{name: fileName(key, now), openedAt: now}}
+		seg.gzip = gzip.NewWriter(&seg.buffer)
+		sink.segments[key] = seg
+	}
+	return seg.write(record)
+}
+
+// complete moves the partition's file to the pending uploads, the lock must be held
+func (sink *S3Sink) complete(key string, seg *bufferSegment) error {
+	delete(sink.segments, key)
+	if err := seg.gzip.Close(); err != nil {
+		return err
+	}
+	sink.pending = append(sink.pending, seg)
+	sink.dropPending()
+	return nil
+}
+
+// dropPending drops the oldest pending files while they're over maxPendingBytes, always
+// keeping the newest, the lock must be held
+func (sink *S3Sink) dropPending() {
+	var size int64
+	for _, seg := range sink.pending {
+		size += int64(seg.buffer.Len())
+	}
+	for size > sink.maxPendingBytes && len(sink.pending) > 1 {
+		dropped := sink.pending[0]
+		sink.pending = sink.pending[1:]
+		size -= int64(dropped.buffer.Len())
+		sink.report(fmt.Errorf("%w: %s wasn't uploaded", ErrFileDropped, dropped.name))
+	}
+}
+
+// flush uploads the completed files, outside of the lock so writes carry on meanwhile
+func (sink *S3Sink) flush(ctx context.Context) error {
+	sink.upload.Lock()
+	defer sink.upload.Unlock()
+
+	sink.lock.Lock()
+	pending := sink.pending
+	sink.pending = nil
+	sink.lock.Unlock()
+
+	for i, seg := range pending {
+		if err := sink.objects.PutObject(ctx, sink.prefix+seg.name, seg.buffer.Bytes()); err != nil {
+			sink.lock.Lock()
+			sink.pending = append(pending[i:], sink.pending...)
+			sink.dropPending()
+			sink.lock.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// rotate completes and uploads the files which are older than the sink's max age
+func (sink *S3Sink) rotate(ctx context.Context, now time.Time) error {
+	sink.lock.Lock()
+	var errs []error
+	for key, seg := range sink.segments {
+		if now.Sub(seg.openedAt) >= sink.maxAge {
+			errs = append(errs, sink.complete(key, seg))
+		}
+	}
+	sink.lock.Unlock()
+	return errors.Join(append(errs, sink.flush(ctx))...)
+}
+
+func (sink *S3Sink) Close(ctx context.Context) error {
+	select {
+	case <-sink.stop:
+	default:
+		close(sink.stop)
+	}
+	<-sink.done
+
+	sink.lock.Lock()
+	var errs []error
+	for key, seg := range sink.segments {
+		errs = append(errs, sink.complete(key, seg))
+	}
+	sink.lock.Unlock()
+	return errors.Join(append(errs, sink.flush(ctx))...)
+}
+
+// Read reads the uploaded files, records which are still buffered by a sink aren't read
+func (sink *S3Sink) Read(ctx context.Context, query Query, fn func(Record) error) error {
+	keys, err := sink.objects.ListObjects(ctx, sink.prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, sink.prefix), "/")
+		if len(parts) != 3 || !strings.HasSuffix(parts[2], fileExtension) ||
+			!query.matchesDate(parts[0]) || !query.matchesCampaign(parts[1]) {
+			continue
+		}
+		if err := sink.readObject(ctx, key, query, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sink *S3Sink) readObject(ctx context.Context, key string, query Query, fn func(Record) error) error {
+	body, err := sink.objects.GetObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return readRecords(body, query, fn)
+}
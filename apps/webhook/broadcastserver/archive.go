@@ -0,0 +1,63 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"webhook/archive"
+	"webhook/events"
+)
+
+// archiveRetryAfter is the Retry-After in seconds sent with messages the archive refused
+const archiveRetryAfter = 5
+
+// WithArchive keeps the body of every verified SNS message from an allowed topic in the sink, by default they aren't kept.
+// The sink is closed by Shutdown once in-flight writes have finished.
+func WithArchive(sink archive.ArchiveSink) Option {
+	return func(server *BroadcastServer) {
+		server.archive = sink
+	}
+}
+
+// archiveBody appends the body to the archive and reports whether it was archived. Bodies
+// the archive refuses are logged and counted and the request is answered with a 503 so SNS
+// redelivers the message, it isn't applied until it's been archived. Only messages from
+// allowed topics are archived. campaignId is empty for messages which aren't a campaign's events.
+func (server *BroadcastServer) archiveBody(ctx context.Context, writer http.ResponseWriter, envelope *events.SnsEventStruct, campaignId string, rawBody []byte) bool {
+	if server.archive == nil {
+		return true
+	}
+	// bodies received while draining are refused, SNS redelivers them to another instance
+	if err := server.beginWrite(); err != nil {
+		refuseWhileDraining(writer)
+		return false
+	}
+	defer server.endWrite()
+	err := server.archive.Write(ctx, archive.Record{
+		ReceivedAt:   time.Now(),
+		SnsMessageId: envelope.MessageId,
+		TopicArn:     envelope.TopicArn,
+		CampaignId:   campaignId,
+		Body:         rawBody,
+	})
+	if err != nil {
+		server.metrics.archiveErrors.Inc()
+		server.log(ctx).Error("failed to archive sns message", slog.String("sns_message_id", envelope.MessageId), errAttr(err))
+		retryLater(writer, archiveRetryAfter)
+		return false
+	}
+	return true
+}
+
+// archiveFileFailed logs and counts the failures of the archive's background work. Failed
+// uploads are retried but the records of dropped files are lost.
+func (server *BroadcastServer) archiveFileFailed(err error) {
+	server.metrics.archiveFileErrors.Inc()
+	if errors.Is(err, archive.ErrFileDropped) {
+		server.metrics.archiveDroppedFiles.Inc()
+	}
+	server.logger.Error("archive file failed", errAttr(err))
+}
@@ -0,0 +1,149 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook/archive"
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingSink fails every write, its errors are the handler set by the server
+type failingSink struct {
+	errors func(err error)
+}
+
+func (*failingSink) Write(ctx context.Context, record archive.Record) error {
+	return errors.New("archive unavailable")
+}
+
+func (*failingSink) Close(ctx context.Context) error { return nil }
+
+func (sink *failingSink) HandleErrors(fn func(err error)) { sink.errors = fn }
+
+func Test_archive(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	sink, err := archive.NewFileSink(test.TempDir(), 1<<20, time.Hour)
+	assertSuccess(test, err)
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second, WithArchive(sink))
+
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusNotSent})
+	delivery, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, delivery)
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+	}
+	// events which fail to parse are archived too, without a campaign
+	envelope := events.SnsEventStruct{
+		Type:             "Notification",
+		MessageId:        "bad-payload",
+		TopicArn:         snsArn,
+		Message:          json.RawMessage(`"not an ses event"`),
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: "1",
+	}
+	invalid, err := signEnvelope(&envelope)
+	assertSuccess(test, err)
+	_, err = tester.postPublish(ctx, invalid)
+	assertSuccess(test, err)
+	// but not bodies which failed verification
+	_, err = tester.postPublish(ctx, generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	// or messages from topics which aren't allowed
+	otherArn := "arn:aws:sns:us-west-2:123456789012:OtherTopic"
+	foreign, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, otherArn))
+	assertSuccess(test, err)
+	statusCode, err = tester.postPublishForTopic(ctx, foreign, otherArn)
+	assertSuccess(test, err)
+	if statusCode != http.StatusBadRequest {
+		test.Fatalf("expected %d but got %d", http.StatusBadRequest, statusCode)
+	}
+	_, err = tester.postPublishForTopic(ctx, subscriptionMessage(test, "SubscriptionConfirmation", otherArn, "other-token"), otherArn)
+	assertSuccess(test, err)
+
+	// shutting down completes the archive's files
+	tester.close()
+	var records []archive.Record
+	err = sink.Read(ctx, archive.Query{}, func(record archive.Record) error {
+		records = append(records, record)
+		return nil
+	})
+	assertSuccess(test, err)
+	if len(records) != 2 {
+		test.Fatalf("expected 2 records but got %+v", records)
+	}
+	if records[0].CampaignId != "" || string(records[0].Body) != invalid {
+		test.Errorf("expected the invalid event without a campaign but got %+v", records[0])
+	}
+	if records[1].CampaignId != campaignId || string(records[1].Body) != delivery {
+		test.Errorf("expected the delivery in its campaign but got %+v", records[1])
+	}
+	for _, record := range records {
+		if record.TopicArn != snsArn {
+			test.Errorf("expected the record's topic to be kept but got %+v", record)
+		}
+	}
+}
+
+func Test_archiveFailures(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	memoryStore := store.NewMemoryStore()
+	sink := &failingSink{}
+	tester := setupStoreTester(test, memoryStore, 30*time.Second, WithArchive(sink))
+	defer tester.close()
+
+	// events which can't be archived are refused so SNS redelivers them, they aren't applied
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusNotSent})
+	msg, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusServiceUnavailable {
+		test.Fatalf("expected %d but got %d", http.StatusServiceUnavailable, statusCode)
+	}
+	receipt, err := memoryStore.Receipt(ctx, campaignId, "test-donor")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusNotSent {
+		test.Errorf("expected status %s but got %s", events.StatusNotSent, receipt.Status)
+	}
+	// as are subscription messages, they aren't confirmed
+	statusCode, err = tester.postPublish(ctx, subscriptionMessage(test, "SubscriptionConfirmation", snsArn, "test-token"))
+	assertSuccess(test, err)
+	if statusCode != http.StatusServiceUnavailable {
+		test.Fatalf("expected %d but got %d", http.StatusServiceUnavailable, statusCode)
+	}
+	if failures := testutil.ToFloat64(tester.broadcastServer.metrics.archiveErrors); failures != 2 {
+		test.Errorf("expected 2 archive errors but got %v", failures)
+	}
+
+	// failures of the archive's files are counted too
+	sink.errors(errors.New("upload failed"))
+	sink.errors(fmt.Errorf("%w: test-file", archive.ErrFileDropped))
+	if failures := testutil.ToFloat64(tester.broadcastServer.metrics.archiveFileErrors); failures != 2 {
+		test.Errorf("expected 2 archive file errors but got %v", failures)
+	}
+	if dropped := testutil.ToFloat64(tester.broadcastServer.metrics.archiveDroppedFiles); dropped != 1 {
+		test.Errorf("expected 1 dropped archive file but got %v", dropped)
+	}
+}
@@ -0,0 +1,168 @@
+package broadcastserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+var (
+	ErrUnauthenticated = errors.New("subscriber not authenticated")
+	ErrForbidden       = errors.New("not allowed to subscribe to campaign")
+)
+
+// close codes sent to WebSocket subscribers which fail authorization, browsers can't
+// read the status of a failed upgrade so the connection is accepted and then closed
+const (
+	StatusUnauthenticated websocket.StatusCode = 4401
+	StatusForbidden       websocket.StatusCode = 4403
+)
+
+// Authorizer decides who may subscribe to a campaign's events
+type Authorizer interface {
+	// Authorize returns ErrUnauthenticated if the request doesn't say who made it
+	// and ErrForbidden if they may not subscribe to the campaign, any other error
+	// means they couldn't be looked up
+	Authorize(req *http.Request, campaignId string) error
+}
+
+// WithAuthorizer sets the authorizer for subscribers. Every subscriber is rejected
+// if no authorizer is set.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(server *BroadcastServer) {
+		server.authorizer = authorizer
+	}
+}
+
+// authorize runs the server's authorizer, rejecting the request if there isn't one
+func (server *BroadcastServer) authorize(req *http.Request, campaignId string) error {
+	if server.authorizer == nil {
+		return ErrUnauthenticated
+	}
+	return server.authorizer.Authorize(req, campaignId)
+}
+
+// SubscribeClaims are the claims of a subscribe token
+type SubscribeClaims struct {
+	// the campaigns the bearer may subscribe to
+	Campaigns []string `json:"campaigns"`
+	// unix seconds after which the token can't be used to subscribe
+	Exp int64 `json:"exp"`
+	// who the token was minted for, it's only logged
+	Sub string `json:"sub,omitempty"`
+}
+
+// TokenAuthorizer authorizes subscribers with a JWT signed with HS256 by the web app.
+// The token is read from the token query param, since browsers can't set headers on
+// WebSocket or EventSource requests, or from a bearer Authorization header.
+// Tokens are only checked when subscribing, connections outlive the token's expiry.
+type TokenAuthorizer struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewTokenAuthorizer(secret []byte) *TokenAuthorizer {
+	return &TokenAuthorizer{secret: secret, now: time.Now}
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (authorizer *TokenAuthorizer) sign(unsigned string) []byte {
+	mac := hmac.New(sha256.New, authorizer.secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+// Mint returns a token for the claims, the web app mints its own with the same secret
+func (authorizer *TokenAuthorizer) Mint(claims SubscribeClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(authorizer.sign(unsigned)), nil
+}
+
+// Verify checks the token's signature and expiry and returns its claims
+func (authorizer *TokenAuthorizer) Verify(token string) (SubscribeClaims, error) {
+	var claims SubscribeClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed header", ErrUnauthenticated)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	// only HS256 is accepted so tokens can't pick a weaker algorithm, e.g. none
+	if err := json.Unmarshal(rawHeader, &header); err != nil || header.Alg != "HS256" {
+		return claims, fmt.Errorf("%w: unsupported algorithm", ErrUnauthenticated)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, authorizer.sign(parts[0]+"."+parts[1])) {
+		return claims, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("%w: malformed claims", ErrUnauthenticated)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("%w: malformed claims", ErrUnauthenticated)
+	}
+	if claims.Exp == 0 || !authorizer.now().Before(time.Unix(claims.Exp, 0)) {
+		return claims, fmt.Errorf("%w: expired token", ErrUnauthenticated)
+	}
+	return claims, nil
+}
+
+// requestToken returns the token from the query or the Authorization header
+func requestToken(req *http.Request) string {
+	if token := req.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+func (authorizer *TokenAuthorizer) Authorize(req *http.Request, campaignId string) error {
+	token := requestToken(req)
+	if token == "" || len(authorizer.secret) == 0 {
+		return ErrUnauthenticated
+	}
+	claims, err := authorizer.Verify(token)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(claims.Campaigns, campaignId) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authStatus returns the http status and WebSocket close code for an authorization error,
+// errors other than ErrUnauthenticated and ErrForbidden are failed lookups
+func authStatus(err error) (int, websocket.StatusCode) {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized, StatusUnauthenticated
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, StatusForbidden
+	default:
+		return http.StatusInternalServerError, websocket.StatusInternalError
+	}
+}
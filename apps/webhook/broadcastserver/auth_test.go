@@ -0,0 +1,121 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"webhook/store"
+)
+
+func Test_tokenAuthorizerVerify(test *testing.T) {
+	test.Parallel()
+
+	valid := SubscribeClaims{Campaigns: []string{"test-campaign"}, Exp: time.Now().Add(time.Minute).Unix()}
+	mint := func(authorizer *TokenAuthorizer, claims SubscribeClaims) string {
+		token, err := authorizer.Mint(claims)
+		assertSuccess(test, err)
+		return token
+	}
+	validToken := mint(testAuthorizer, valid)
+	parts := strings.Split(validToken, ".")
+	unsignedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	claims, err := testAuthorizer.Verify(validToken)
+	assertSuccess(test, err)
+	if len(claims.Campaigns) != 1 || claims.Campaigns[0] != "test-campaign" {
+		test.Errorf("unexpected claims %+v", claims)
+	}
+
+	for name, token := range map[string]string{
+		"empty":           "",
+		"malformed":       "not-a-token",
+		"wrong secret":    mint(NewTokenAuthorizer([]byte("another-secret")), valid),
+		"tampered claims": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"campaigns":["other"],"exp":9999999999}`)) + "." + parts[2],
+		"alg none":        unsignedHeader + "." + parts[1] + ".",
+		"expired":         mint(testAuthorizer, SubscribeClaims{Campaigns: valid.Campaigns, Exp: time.Now().Add(-time.Second).Unix()}),
+		"no expiry":       mint(testAuthorizer, SubscribeClaims{Campaigns: valid.Campaigns}),
+	} {
+		if _, err := testAuthorizer.Verify(token); !errors.Is(err, ErrUnauthenticated) {
+			test.Errorf("%s: expected %v but got %v", name, ErrUnauthenticated, err)
+		}
+	}
+}
+
+func Test_subscribeAuthorization(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tester := setupStoreTester(test, store.NewMemoryStore(), 30*time.Second)
+	defer tester.close()
+
+	otherCampaignUrl := func(route string) string {
+		return strings.Replace(tester.subscribeUrl(route, "other-campaign"), "other-campaign", "test-campaign", 1)
+	}
+	expiredToken, err := testAuthorizer.Mint(SubscribeClaims{Campaigns: []string{"test-campaign"}, Exp: time.Now().Add(-time.Minute).Unix()})
+	assertSuccess(test, err)
+
+	for _, testCase := range []struct {
+		name       string
+		path       string
+		statusCode int
+		closeCode  websocket.StatusCode
+	}{
+		{name: "missing token", path: "test-campaign", statusCode: http.StatusUnauthorized, closeCode: StatusUnauthenticated},
+		{name: "expired token", path: "test-campaign?token=" + expiredToken, statusCode: http.StatusUnauthorized, closeCode: StatusUnauthenticated},
+		{name: "invalid token", path: "test-campaign?token=not-a-token", statusCode: http.StatusUnauthorized, closeCode: StatusUnauthenticated},
+	} {
+		client, err := newClient(ctx, tester.url+"/subscribe/"+testCase.path)
+		assertSuccess(test, err)
+		_, _, err = client.connection.Read(ctx)
+		if websocket.CloseStatus(err) != testCase.closeCode {
+			test.Errorf("%s: expected close code %d but got %v", testCase.name, testCase.closeCode, err)
+		}
+		client.Close()
+
+		res, err := http.Get(tester.url + "/events/" + testCase.path)
+		assertSuccess(test, err)
+		res.Body.Close()
+		if res.StatusCode != testCase.statusCode {
+			test.Errorf("%s: expected %d from events but got %d", testCase.name, testCase.statusCode, res.StatusCode)
+		}
+	}
+
+	// a valid token for another campaign is forbidden
+	client, err := newClient(ctx, otherCampaignUrl("/subscribe/"))
+	assertSuccess(test, err)
+	_, _, err = client.connection.Read(ctx)
+	if websocket.CloseStatus(err) != StatusForbidden {
+		test.Errorf("expected close code %d for another campaign but got %v", StatusForbidden, err)
+	}
+	client.Close()
+	res, err := http.Get(otherCampaignUrl("/events/"))
+	assertSuccess(test, err)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		test.Errorf("expected %d from events for another campaign but got %d", http.StatusForbidden, res.StatusCode)
+	}
+
+	// the token can also be sent as a bearer token
+	token, err := testAuthorizer.Mint(SubscribeClaims{Campaigns: []string{"test-campaign"}, Exp: time.Now().Add(time.Minute).Unix()})
+	assertSuccess(test, err)
+	connection, _, err := websocket.Dial(ctx, tester.url+"/subscribe/test-campaign?snapshot=1", &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Bearer " + token}},
+	})
+	assertSuccess(test, err)
+	bearerClient := &Client{connection: connection}
+	defer bearerClient.Close()
+	var snapshot SnapshotMessage
+	err = bearerClient.nextJson(ctx, &snapshot)
+	assertSuccess(test, err)
+	if snapshot.Type != messageSnapshot {
+		test.Errorf("expected a snapshot with a bearer token but got %+v", snapshot)
+	}
+}
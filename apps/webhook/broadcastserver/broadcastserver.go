@@ -2,153 +2,240 @@ package broadcastserver
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"webhook/archive"
 	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
 
 	"nhooyr.io/websocket"
 )
 
 type SubscriberGroupEvent struct {
-	donorId   string
-	status    string
+	// position of the event in its group, starting at 1
+	seq        uint64
+	campaignId string
+	donorId    string
+	status     string
+	// when SES says the event happened
+	timestamp time.Time
+	// when the event was received, used to expire events
 	createdAt time.Time
 }
 
+// subscriberGroup is the campaign's subscribers connected to this instance
 type subscriberGroup struct {
 	subscribersLock sync.Mutex
 	subscribers     map[*subscriber]struct{}
-	eventsLock      sync.Mutex
-	events          []SubscriberGroupEvent
-	maxEventAge     time.Duration
-	lastFlushed     time.Time
 	updatedAt       time.Time
 	createdAt       time.Time
 }
 
-func newSubscriberGroup(maxEventAge time.Duration) *subscriberGroup {
+func newSubscriberGroup() *subscriberGroup {
 	return &subscriberGroup{
 		subscribersLock: sync.Mutex{},
 		subscribers:     make(map[*subscriber]struct{}),
-		eventsLock:      sync.Mutex{},
-		events:          make([]SubscriberGroupEvent, 0),
-		maxEventAge:     maxEventAge,
-		lastFlushed:     time.Now(),
 		createdAt:       time.Now(),
 		updatedAt:       time.Now(),
 	}
 }
 
-func (subGroup *subscriberGroup) addEvent(event SubscriberGroupEvent) {
-	subGroup.eventsLock.Lock()
-	subGroup.flush()
-	subGroup.events = append(subGroup.events, event)
-	subGroup.eventsLock.Unlock()
-
-	// if buffer is full the subscriber is closed
-	subEvent := SubscriberEvent{DonorId: event.donorId, Status: event.status}
+// deliver sends the event to all subscribers, closing those whose buffer is full,
+// and returns how many were sent the event and how many were closed. Closing a WebSocket
+// waits for the client's close frame and deliver may be called with the broker's lock
+// held, so slow subscribers are closed in the background once the group is unlocked.
+func (subGroup *subscriberGroup) deliver(event SubscriberGroupEvent) (int, int) {
 	subGroup.subscribersLock.Lock()
 	count := 0
+	var slow []*subscriber
 	for sub := range subGroup.subscribers {
 		if sub.events == nil {
 			continue
 		}
 		select {
-		case sub.events <- subEvent:
+		case sub.events <- event:
 			{
 				count++
 			}
 		default:
-			sub.closeSlow()
+			slow = append(slow, sub)
 		}
 	}
 	subGroup.subscribersLock.Unlock()
-	fmt.Printf("[debug] %d subscribers were sent an event \n", count)
-}
-
-// user must lock eventsLock before calling this
-func (subGroup *subscriberGroup) flush() {
-	now := time.Now()
-	minEventTime := now.Add(-1 * subGroup.maxEventAge)
-	if subGroup.lastFlushed.After(minEventTime) {
-		return
-	}
-
-	subGroup.lastFlushed = now
-	var i int
-	for i = 0; i < len(subGroup.events); i++ {
-		if subGroup.events[i].createdAt.After(minEventTime) {
-			break
-		}
-	}
 
-	if i == 0 {
-		return
-	}
-	eventsLen := len(subGroup.events)
-	if i == eventsLen {
-		subGroup.events = subGroup.events[:0]
-		return
+	for _, sub := range slow {
+		go sub.close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
 	}
+	return count, len(slow)
+}
 
-	copy(subGroup.events, subGroup.events[i:])
-	subGroup.events = subGroup.events[:(eventsLen - i)]
+func (subGroup *subscriberGroup) addSubscriber(sub *subscriber) {
+	subGroup.subscribersLock.Lock()
+	defer subGroup.subscribersLock.Unlock()
+	subGroup.subscribers[sub] = struct{}{}
 }
 
 type BroadcastServer struct {
-	// logf controls where logs are sent.
-	// Defaults to log.Printf.
-	logf                func(f string, v ...interface{})
+	// logger defaults to slog.Default(), see WithLogger
+	logger              *slog.Logger
 	serveMux            http.ServeMux
 	subscriberGroupLock sync.Mutex
 	subscriberGroupMap  map[string]*subscriberGroup
 	snsArn              string
-	db                  *sql.DB
+	store               store.ReceiptStore
 	maxEventAge         time.Duration
+	verifier            *events.Verifier
+	allowedTopics       map[string]struct{}
+	autoConfirm         bool
+	httpClient          *http.Client
+	ignoredTransitions  atomic.Int64
+	apiToken            string
+	adminToken          string
+	writeAttempts       int
+	writeBackoff        time.Duration
+	pendingTTL          time.Duration
+	pendingStats        pendingStats
+	dedupeTTL           time.Duration
+	processed           *dedupeWindow
+	pool                *workerPool
+	// instanceId owns the events this instance queued or recovered
+	instanceId        string
+	heartbeatInterval time.Duration
+	authorizer        Authorizer
+	broker            Broker
+	archive           archive.ArchiveSink
+	drain             drain
+	metrics           *metrics
 }
 
-func NewBroadcastServer(snsArn string, db *sql.DB, maxEventAge time.Duration) (*BroadcastServer, error) {
+// Option configures optional behaviour of the BroadcastServer
+type Option func(server *BroadcastServer)
+
+// WithVerifier replaces the default sns signature verifier,
+// which fetches signing certs from aws over https.
+func WithVerifier(verifier *events.Verifier) Option {
+	return func(server *BroadcastServer) {
+		server.verifier = verifier
+	}
+}
+
+// NewBroadcastServer returns a server which persists events to the store,
+// any of the store package's implementations can be used.
+func NewBroadcastServer(snsArn string, receiptStore store.ReceiptStore, maxEventAge time.Duration, options ...Option) (*BroadcastServer, error) {
 	server := &BroadcastServer{
-		db:                 db,
+		store:              receiptStore,
 		snsArn:             snsArn,
-		logf:               log.Printf,
+		logger:             slog.Default(),
 		subscriberGroupMap: make(map[string]*subscriberGroup),
 		maxEventAge:        maxEventAge,
+		allowedTopics:      map[string]struct{}{snsArn: {}},
+		autoConfirm:        true,
+		httpClient:         &http.Client{Timeout: 10 * time.Second},
+		writeAttempts:      defaultWriteAttempts,
+		writeBackoff:       defaultWriteBackoff,
+		pendingTTL:         defaultPendingTTL,
+		dedupeTTL:          defaultDedupeTTL,
+		processed:          newDedupeWindow(defaultDedupeWindow),
+		heartbeatInterval:  defaultHeartbeatInterval,
+		instanceId:         uuid.NewString(),
+	}
+	for _, option := range options {
+		option(server)
+	}
+	if server.broker == nil {
+		server.broker = NewMemoryBroker(maxEventAge)
+	}
+	server.metrics = newMetrics(server)
+	if server.archive != nil {
+		server.archive.HandleErrors(server.archiveFileFailed)
+	}
+	err := server.broker.Subscribe(context.Background(), server.deliverEvent, server.dropSubscribers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to broker: %w", err)
+	}
+	if server.verifier == nil {
+		fetchCert := events.HttpCertFetcher(&http.Client{Timeout: 10 * time.Second})
+		server.verifier = events.NewVerifier(fetchCert, events.DefaultCertHostPattern)
 	}
 	server.serveMux.HandleFunc("/", func(writer http.ResponseWriter, req *http.Request) {
-		writer.Write([]byte("Go to wss:*/subscribe/campaignId to connect"))
+		writer.Write([]byte("Go to wss:*/subscribe/campaignId or wss:*/subscribe to connect"))
 	})
+	server.serveMux.HandleFunc("/subscribe", server.SubscribeHandler)
 	server.serveMux.HandleFunc("/subscribe/", server.SubscribeHandler)
+	server.serveMux.HandleFunc("GET /events/{campaignId}", server.EventsHandler)
 	server.serveMux.HandleFunc("/publish", server.PublishHandler)
 	server.serveMux.HandleFunc("/ping", server.PingHandler)
+	server.serveMux.HandleFunc(
+		"GET /campaigns/{campaignId}/donors/{donorId}/events",
+		requireToken(server.apiToken, server.HistoryHandler),
+	)
+	server.serveMux.HandleFunc("GET /suppressions/{email}", requireToken(server.apiToken, server.GetSuppressionHandler))
+	server.serveMux.HandleFunc("POST /suppressions/check", requireToken(server.apiToken, server.CheckSuppressionsHandler))
+	server.serveMux.HandleFunc("GET /suppressions", requireToken(server.adminToken, server.ListSuppressionsHandler))
+	server.serveMux.HandleFunc("DELETE /suppressions/{email}", requireToken(server.adminToken, server.DeleteSuppressionHandler))
+	server.serveMux.HandleFunc("GET /pending", requireToken(server.adminToken, server.PendingHandler))
+	server.serveMux.HandleFunc("GET /subscriptions", requireToken(server.adminToken, server.SubscriptionRecordsHandler))
 
 	return server, nil
 }
 
+// message types sent to subscribers
+const (
+	messageEvent    = "event"
+	messageResync   = "resync"
+	messageSnapshot = "snapshot"
+)
+
 type SubscriberEvent struct {
-	DonorId string `json:"donorId"`
-	Status  string `json:"status"`
+	Type       string    `json:"type"`
+	Seq        uint64    `json:"seq"`
+	CampaignId string    `json:"campaignId"`
+	DonorId    string    `json:"donorId"`
+	Status     string    `json:"status"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func (event *SubscriberGroupEvent) toSubscriberEvent() SubscriberEvent {
+	return SubscriberEvent{
+		Type:       messageEvent,
+		Seq:        event.seq,
+		CampaignId: event.campaignId,
+		DonorId:    event.donorId,
+		Status:     event.status,
+		Timestamp:  event.timestamp,
+	}
 }
 
+// subscriberBuffer is the number of events which can be queued for a subscriber
+// before it's closed for being too slow
+const subscriberBuffer = 10
+
 type subscriber struct {
 	campaignId string
-	events     chan SubscriberEvent
-	closeSlow  func()
+	events     chan SubscriberGroupEvent
+	// close disconnects the subscriber, e.g. when it's too slow
+	close func(code websocket.StatusCode, reason string)
+	// latest status sent for each donor, only set for snapshot subscribers
+	// and only used by the goroutine writing to the subscriber
+	statuses map[string]string
+	// seq of the last message sent before live events, see connection.run
+	seq uint64
 }
 
 func (server *BroadcastServer) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
-	server.serveMux.ServeHTTP(writer, req)
+	server.withRequestId(&server.serveMux).ServeHTTP(writer, req)
 }
 
 func (server *BroadcastServer) PingHandler(writer http.ResponseWriter, req *http.Request) {
@@ -167,7 +254,6 @@ func (server *BroadcastServer) PingHandler(writer http.ResponseWriter, req *http
 		Ping bool `json:"ping"`
 	}
 	err2 := json.Unmarshal(msg, &parsedBody)
-	fmt.Println(parsedBody.Ping)
 	if err2 != nil || !parsedBody.Ping {
 		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
@@ -186,18 +272,6 @@ func (server *BroadcastServer) PingHandler(writer http.ResponseWriter, req *http
 	writer.Write(response)
 }
 
-func dumpMap(space string, m map[string]interface{}) {
-	for k, v := range m {
-		if mv, ok := v.(map[string]interface{}); ok {
-			fmt.Printf("{ \"%v\": \n", k)
-			dumpMap(space+"\t", mv)
-			fmt.Printf("}\n")
-		} else {
-			fmt.Printf("%v %v : %v\n", space, k, v)
-		}
-	}
-}
-
 // publishHandler reads the request body with a limit of 8192 bytes and then publishes
 // the received message.
 func (server *BroadcastServer) PublishHandler(writer http.ResponseWriter, req *http.Request) {
@@ -206,12 +280,8 @@ func (server *BroadcastServer) PublishHandler(writer http.ResponseWriter, req *h
 		return
 	}
 
+	logger := server.log(req.Context())
 	reqSnsArn := req.Header.Get("x-amz-sns-topic-arn")
-	if reqSnsArn != server.snsArn {
-		fmt.Fprintf(os.Stderr, "[error] invalid topic arn %s", reqSnsArn)
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
 
 	bodyReader := http.MaxBytesReader(writer, req.Body, 8192)
 	rawBody, err := io.ReadAll(bodyReader)
@@ -220,72 +290,265 @@ func (server *BroadcastServer) PublishHandler(writer http.ResponseWriter, req *h
 		return
 	}
 
-	campaignId, donorId, emailId, status, err := events.ParseSnsEvent(rawBody)
+	var envelope events.SnsEventStruct
+	err = json.Unmarshal(rawBody, &envelope)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[error] failed to parse sns event: %s", err)
-		fmt.Fprintf(os.Stderr, "[error] rawBody: %s", string(rawBody))
+		logger.Error("failed to parse sns envelope", errAttr(err))
 		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	if envelope.TopicArn != reqSnsArn {
+		logger.Error("topic arn header does not match the message's topic arn", slog.String("header_topic_arn", reqSnsArn), slog.String("topic_arn", envelope.TopicArn))
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err = server.verifier.Verify(req.Context(), &envelope)
+	if errors.Is(err, events.ErrCertFetch) {
+		logger.Error("failed to verify sns signature", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logger.Warn("invalid sns signature", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	switch envelope.Type {
+	case "Notification":
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		if server.isAllowedTopic(envelope.TopicArn) && !server.archiveBody(contextWithLogger(req.Context(), logger), writer, &envelope, "", rawBody) {
+			return
+		}
+		server.handleSubscriptionMessage(writer, req, &envelope)
+		return
+	default:
+		logger.Error("unknown sns message type", slog.String("type", envelope.Type))
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !server.isAllowedTopic(envelope.TopicArn) {
+		logger.Error("topic arn isn't allowed", slog.String("topic_arn", envelope.TopicArn))
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// events which fail to parse are archived too, without a campaign
+	parsedEvent, parseErr := events.ParseSnsEvent(rawBody)
+	if !server.archiveBody(contextWithLogger(req.Context(), logger), writer, &envelope, parsedEvent.CampaignId, rawBody) {
+		return
+	}
+	if parseErr != nil {
+		server.metrics.eventsReceived.WithLabelValues("unknown", outcomeInvalid).Inc()
+		// the body isn't logged, it has the donor's email address
+		logger.Error("failed to parse sns event", slog.String("sns_message_id", envelope.MessageId), errAttr(parseErr))
+		// it's kept to be replayed once the parser is fixed, SNS won't redeliver it
+		if server.beginWrite() == nil {
+			server.deadLetter(contextWithLogger(req.Context(), logger), envelope.MessageId, store.DeadLetterParse, rawBody, parseErr)
+			server.endWrite()
+		}
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// the write path adds the event's attributes itself
+	ctx := req.Context()
+	logger = logger.With(campaignAttr(parsedEvent.CampaignId), donorAttr(parsedEvent.DonorId))
+	logger.Debug(
+		"event received",
+		slog.String("status", parsedEvent.Status),
+		slog.String("email_id", parsedEvent.EmailId),
+		slog.String("sns_message_id", parsedEvent.SnsMessageId),
+	)
+
+	// SNS redelivers events answered with a 5xx, a 4xx drops the event
+	ctx = contextWithLogger(ctx, logger)
+	if server.pool != nil {
+		server.enqueueEvent(ctx, writer, parsedEvent)
+		return
+	}
+	if err := server.beginWrite(); err != nil {
+		refuseWhileDraining(writer)
+		return
+	}
+	defer server.endWrite()
+	err = server.applyEvent(ctx, parsedEvent)
+	switch {
+	case errors.Is(err, store.ErrEventInProgress):
+		retryLater(writer, claimRetryAfter)
+	case err != nil:
+		// SNS redelivers it too, each failed redelivery counts as another attempt
+		server.deadLetter(ctx, parsedEvent.SnsMessageId, store.DeadLetterWrite, parsedEvent.Raw, err)
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		writer.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// applyEvent persists and broadcasts the event unless it has been processed already.
+// It returns nil once the event's effects are visible, including when it's a duplicate,
+// an ignored transition or parked until its receipt exists. store.ErrEventInProgress is
+// returned while another request processes it and any other error means the event
+// should be applied again later.
+func (server *BroadcastServer) applyEvent(ctx context.Context, parsedEvent events.ParsedEvent) error {
+	logger := server.log(ctx)
+	key := dedupeKey(parsedEvent)
+	err := server.claimEvent(ctx, key)
+	switch {
+	case errors.Is(err, store.ErrEventProcessed):
+		server.metrics.eventsReceived.WithLabelValues(string(parsedEvent.EventType), outcomeDuplicate).Inc()
+		logger.Debug("dropping duplicate event", slog.String("sns_message_id", parsedEvent.SnsMessageId))
+		return nil
+	case errors.Is(err, store.ErrEventInProgress):
+		server.metrics.eventsReceived.WithLabelValues(string(parsedEvent.EventType), outcomeDuplicate).Inc()
+		logger.Info("event is being processed by another request", slog.String("sns_message_id", parsedEvent.SnsMessageId))
+		return err
+	case err != nil:
+		logger.Error("failed to claim event", errAttr(err))
+		return err
+	}
+	server.metrics.eventsReceived.WithLabelValues(string(parsedEvent.EventType), outcomeParsed).Inc()
+
+	err = server.persistEvent(ctx, parsedEvent)
+	switch {
+	case errors.Is(err, store.ErrTransitionIgnored):
+		server.completeEvent(ctx, key)
+		return nil
+	case errors.Is(err, store.ErrReceiptNotFound):
+		// the event beat the receipt's insert, it's reapplied by the reconciler once the receipt exists
+		err = server.parkEvent(ctx, parsedEvent)
+		if err != nil {
+			server.releaseEvent(ctx, key)
+			logger.Error("failed to park event", errAttr(err))
+			return err
+		}
+		server.completeEvent(ctx, key)
+		return nil
+	case err != nil:
+		server.releaseEvent(ctx, key)
+		logger.Error("failed to persist event", errAttr(err))
+		return err
+	}
 
-	fmt.Printf("[debug] event received: campaignId: %s, donorId: %s, status: %s, emailId: %s \n", campaignId, donorId, status, emailId)
+	server.broadcastEvent(ctx, parsedEvent)
+	server.completeEvent(ctx, key)
+	return nil
+}
+
+func (server *BroadcastServer) broadcastEvent(ctx context.Context, parsedEvent events.ParsedEvent) {
+	event := SubscriberGroupEvent{
+		campaignId: parsedEvent.CampaignId,
+		donorId:    parsedEvent.DonorId,
+		status:     parsedEvent.Status,
+		timestamp:  parsedEvent.Timestamp,
+		createdAt:  time.Now(),
+	}
 
-	event := SubscriberGroupEvent{donorId: donorId, status: status, createdAt: time.Now()}
+	published, err := server.broker.Publish(ctx, event)
+	if err != nil {
+		// the event is persisted so subscribers see it once they resync
+		server.log(ctx).Error("failed to publish event", campaignAttr(parsedEvent.CampaignId), donorAttr(parsedEvent.DonorId), errAttr(err))
+		return
+	}
+	if !published {
+		server.ignoreTransition(ctx, parsedEvent, "broker")
+		return
+	}
+	if !parsedEvent.Timestamp.IsZero() {
+		server.metrics.broadcastLag.Observe(time.Since(parsedEvent.Timestamp).Seconds())
+	}
+}
 
+// deliverEvent sends an event published by any instance to this instance's subscribers
+func (server *BroadcastServer) deliverEvent(event SubscriberGroupEvent) {
 	server.subscriberGroupLock.Lock()
-	subGroup, ok := server.subscriberGroupMap[campaignId]
-	if !ok {
-		subGroup = newSubscriberGroup(server.maxEventAge)
-		server.subscriberGroupMap[campaignId] = subGroup
+	subGroup, ok := server.subscriberGroupMap[event.campaignId]
+	server.subscriberGroupLock.Unlock()
+	if ok {
+		sent, closed := subGroup.deliver(event)
+		server.metrics.slowDisconnects.Add(float64(closed))
+		server.logger.Debug("delivered event", campaignAttr(event.campaignId), slog.Uint64("seq", event.seq), slog.Int("sent", sent), slog.Int("closed", closed))
+	}
+}
+
+// dropSubscribers disconnects every subscriber after the broker may have missed events,
+// they reconnect and resume from the broker's buffer
+func (server *BroadcastServer) dropSubscribers() {
+	server.subscriberGroupLock.Lock()
+	subGroups := make([]*subscriberGroup, 0, len(server.subscriberGroupMap))
+	for _, subGroup := range server.subscriberGroupMap {
+		subGroups = append(subGroups, subGroup)
 	}
 	server.subscriberGroupLock.Unlock()
 
-	subGroup.addEvent(event)
-	server.WriteEventToDb(donorId, campaignId, status, emailId)
+	var subs []*subscriber
+	for _, subGroup := range subGroups {
+		subGroup.subscribersLock.Lock()
+		for sub := range subGroup.subscribers {
+			subs = append(subs, sub)
+		}
+		subGroup.subscribersLock.Unlock()
+	}
+	for _, sub := range subs {
+		go sub.close(websocket.StatusTryAgainLater, "events may have been missed, resume to catch up")
+	}
+}
 
-	writer.WriteHeader(http.StatusAccepted)
+// IgnoredTransitions returns the number of events which were ignored because they
+// would have moved a receipt's status backwards
+func (server *BroadcastServer) IgnoredTransitions() int64 {
+	return server.ignoredTransitions.Load()
 }
 
-func (server *BroadcastServer) WriteEventToDb(donorId, campaignId, status, emailId string) error {
-	const sqlStatement = `
-UPDATE receipts
-		SET email_status = $emailStatus,
-			email_id = $emailId
-		WHERE campaign_id = $campaignId AND donor_id = $donorId;
-`
+func (server *BroadcastServer) ignoreTransition(ctx context.Context, event events.ParsedEvent, where string) {
+	count := server.ignoredTransitions.Add(1)
+	server.log(ctx).Info(
+		"ignored status transition",
+		slog.String("where", where),
+		slog.String("status", event.Status),
+		campaignAttr(event.CampaignId),
+		donorAttr(event.DonorId),
+		slog.Int64("ignored_transitions", count),
+	)
+}
 
-	res, err := server.db.Exec(sqlStatement, sql.Named("emailStatus", status), sql.Named("emailId", emailId), sql.Named("campaignId", campaignId), sql.Named("donorId", donorId))
-	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"[error] an error occured writing to the db:\n%s\nemailStatus: %s\nemailId: %s\n campaignId: %s\ndonorId: %s",
-			err,
-			status,
-			emailId,
-			campaignId,
-			donorId,
-		)
+// WriteEventToDb updates the receipt's status. The update only applies if the
+// receipt's current status may move to the event's status, otherwise
+// store.ErrTransitionIgnored is returned. store.ErrReceiptNotFound is returned if the receipt
+// doesn't exist.
+func (server *BroadcastServer) WriteEventToDb(ctx context.Context, event events.ParsedEvent) error {
+	err := server.store.UpdateStatus(ctx, event)
+	if errors.Is(err, store.ErrTransitionIgnored) {
+		server.ignoreTransition(ctx, event, "db")
 		return err
 	}
-
-	affected, err := res.RowsAffected()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "[error] an error occured unwrapping the rows affected %s", err)
+	if errors.Is(err, store.ErrReceiptNotFound) {
+		server.log(ctx).Info("no receipt yet", campaignAttr(event.CampaignId), donorAttr(event.DonorId), slog.String("status", event.Status))
 		return err
 	}
-	if affected == 0 {
-		fmt.Printf("[error] donorId: %s, campaignId: %s, emailStatus: %s \n", donorId, campaignId, status)
-		fmt.Fprintln(os.Stderr, "[error] no rows affected by update query")
-		return errors.New("no rows affected")
+	if err != nil {
+		server.log(ctx).Error(
+			"failed to write the receipt's status",
+			slog.String("event_type", string(event.EventType)),
+			slog.String("status", event.Status),
+			slog.String("email_id", event.EmailId),
+			campaignAttr(event.CampaignId),
+			donorAttr(event.DonorId),
+			errAttr(err),
+		)
+		return err
 	}
 	return nil
 }
 
+// originPatterns are the origins allowed to subscribe from a browser
+var originPatterns = []string{"*.donationreceipt.online", "donationreceipt.online", "*babyccino.vercel.app"}
+
 // subscribeHandler accepts the WebSocket connection and then subscribes
 // it to all future messages.
 func (server *BroadcastServer) SubscribeHandler(writer http.ResponseWriter, req *http.Request) {
 	err := server.Subscribe(req.Context(), writer, req)
-	if errors.Is(err, context.Canceled) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrShuttingDown) {
 		return
 	}
 	if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
@@ -293,51 +556,52 @@ func (server *BroadcastServer) SubscribeHandler(writer http.ResponseWriter, req
 		return
 	}
 	if err != nil {
-		server.logf("%v", err)
+		server.log(req.Context()).Warn("subscriber disconnected", errAttr(err))
 		return
 	}
 }
 
-func getId(writer http.ResponseWriter, req *http.Request) (string, error) {
-	id := strings.TrimPrefix(req.URL.Path, "/subscribe/")
-	if id == "" {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return "", errors.New("no campaign id in request")
-	}
-
-	return id, nil
-}
-
 // subscribe subscribes the given WebSocket to all broadcast messages.
-// It creates a subscriber with a buffered msgs chan to give some room to slower
-// connections and then registers the subscriber. It then listens for all messages
-// and writes them to the WebSocket. If the context is cancelled or
-// an error occurs, it returns and deletes the subscription.
+// The campaign in the path, if any, is subscribed to when the connection opens and
+// the client may follow more campaigns with control messages, see ControlMessage.
+// Events are queued on a buffered chan to give some room to slower connections.
+// If the context is cancelled or an error occurs, it returns and deletes the subscriptions.
 //
-// It uses CloseRead to keep reading from the connection to process control
-// messages and cancel the context if the connection drops.
+// A reader loop handles the client's control messages and cancels the context
+// if the connection drops.
 func (server *BroadcastServer) Subscribe(ctx context.Context, writer http.ResponseWriter, req *http.Request) error {
 	var mu sync.Mutex
 	var wsConn *websocket.Conn
 	var closed bool
-	sub := &subscriber{
-		events: make(chan SubscriberEvent, 10),
-		closeSlow: func() {
-			mu.Lock()
-			defer mu.Unlock()
-			closed = true
-			if wsConn != nil {
-				wsConn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
-			}
-		},
+	closeConn := func(code websocket.StatusCode, reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		if wsConn != nil {
+			wsConn.Close(code, reason)
+		}
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/subscribe"), "/")
+	var options subscribeOptions
+	var authErr error
+	if id != "" {
+		var err error
+		options, err = parseSubscribeOptions(req)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return err
+		}
+		authErr = server.authorize(req, id)
 	}
-	id, err := getId(writer, req)
+	sock, err := server.openSocket(closeConn)
 	if err != nil {
+		refuseWhileDraining(writer)
 		return err
 	}
+	defer server.closeSocket(sock)
 
 	wsConn2, err := websocket.Accept(writer, req, &websocket.AcceptOptions{
-		OriginPatterns: []string{"*.donationreceipt.online", "donationreceipt.online", "*babyccino.vercel.app"},
+		OriginPatterns: originPatterns,
 	})
 	if err != nil {
 		return err
@@ -351,63 +615,71 @@ func (server *BroadcastServer) Subscribe(ctx context.Context, writer http.Respon
 	mu.Unlock()
 	defer wsConn.CloseNow()
 
-	ctx = wsConn.CloseRead(ctx)
-
-	fmt.Printf("[debug] client subscribed to events from campaign %s\n", id)
-
-	server.AddSubscriber(ctx, sub, id, wsConn)
-	defer server.DeleteSubscriber(sub)
+	if authErr != nil {
+		_, closeCode := authStatus(authErr)
+		reason := authErr.Error()
+		if closeCode == websocket.StatusInternalError {
+			reason = "failed to authorize"
+		}
+		wsConn.Close(closeCode, reason)
+		return fmt.Errorf("failed to authorize subscriber to campaign %s: %w", id, authErr)
+	}
 
-	for {
-		select {
-		case event := <-sub.events:
-			resp, err := json.Marshal(event)
+	conn := newConnection(server, req, wsConn, closeConn)
+	defer conn.unsubscribeAll()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	commands := make(chan command)
+	go conn.read(ctx, cancel, commands)
+
+	if id != "" {
+		server.log(ctx).Debug("client subscribed to events", campaignAttr(id))
+		messages, err := conn.subscribe(ctx, id, options)
+		if err != nil {
+			wsConn.Close(websocket.StatusInternalError, "failed to load the campaign")
+			return err
+		}
+		for _, message := range messages {
+			err := writeMessage(ctx, wsConn, message.body)
 			if err != nil {
 				return err
 			}
-
-			err2 := writeTimeout(ctx, time.Second*5, wsConn, resp)
-			if err2 != nil {
-				return err2
-			}
-		case <-ctx.Done():
-			return ctx.Err()
 		}
 	}
+	return conn.run(ctx, commands)
 }
 
-// addSubscriber registers a subscriber.
-func (server *BroadcastServer) AddSubscriber(ctx context.Context, sub *subscriber, campaignId string, wsConn *websocket.Conn) {
+func writeMessage(ctx context.Context, wsConn *websocket.Conn, message any) error {
+	resp, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return writeTimeout(ctx, time.Second*5, wsConn, resp)
+}
+
+// AddSubscriber registers a subscriber with its campaign's group and returns the events
+// from the broker's buffer which it should be sent before those on its channel.
+// The buffer is read after the subscriber is registered so no events are missed,
+// events on its channel which were also replayed must be skipped by their seq.
+func (server *BroadcastServer) AddSubscriber(ctx context.Context, sub *subscriber, since uint64, resume bool) (replay, error) {
+	// the subscriber is added while the map is locked so the janitor can't evict its group first
 	server.subscriberGroupLock.Lock()
-	subGroup, found := server.subscriberGroupMap[campaignId]
+	subGroup, found := server.subscriberGroupMap[sub.campaignId]
 	if !found {
-		subGroup = newSubscriberGroup(server.maxEventAge)
-		server.subscriberGroupMap[campaignId] = subGroup
-	}
-	defer server.subscriberGroupLock.Unlock()
-
-	// lock events until the subscriber is added
-	// and send all events from the past minute to the subscriber
-	// to make sure they are up to date
-	subGroup.eventsLock.Lock()
-	var eventsToSend = make([]SubscriberGroupEvent, len(subGroup.events))
-	copy(eventsToSend, subGroup.events)
-	go func() {
-		for _, event := range eventsToSend {
-			jsonEvent := SubscriberEvent{DonorId: event.donorId, Status: event.status}
-			resp, err := json.Marshal(jsonEvent)
-			if err != nil {
-				return
-			}
+		subGroup = newSubscriberGroup()
+		server.subscriberGroupMap[sub.campaignId] = subGroup
+	}
+	subGroup.addSubscriber(sub)
+	server.subscriberGroupLock.Unlock()
 
-			err2 := writeTimeout(ctx, time.Second*5, wsConn, resp)
-			if err2 != nil {
-				return
-			}
-		}
-	}()
-	subGroup.subscribers[sub] = struct{}{}
-	subGroup.eventsLock.Unlock()
+	buffered, seq, err := server.broker.Buffer(ctx, sub.campaignId)
+	if err != nil {
+		server.DeleteSubscriber(sub)
+		return replay{}, err
+	}
+	ret := newReplay(buffered, seq, since, resume)
+	server.metrics.replayEvents.Observe(float64(len(ret.events)))
+	return ret, nil
 }
 
 // deleteSubscriber deletes the given subscriber.
@@ -431,7 +703,3 @@ func writeTimeout(ctx context.Context, timeout time.Duration, wsConn *websocket.
 
 	return wsConn.Write(ctx, websocket.MessageText, msg)
 }
-
-func (server *BroadcastServer) OnShutdown() {
-	server.db.Close()
-}
@@ -15,6 +15,8 @@ import (
 	"testing"
 	"time"
 	"webhook/events"
+	"webhook/internal/snstest"
+	"webhook/store"
 
 	"github.com/google/uuid"
 	_ "github.com/tursodatabase/go-libsql"
@@ -47,7 +49,7 @@ func Test_chatServer(test *testing.T) {
 		defer cancel()
 
 		campaignId := "test-campaign"
-		subscribeUrl := testBroadcastServer.url + "/subscribe/" + campaignId
+		subscribeUrl := testBroadcastServer.subscribeUrl("/subscribe/", campaignId)
 		client, err := newClient(ctx, subscribeUrl)
 		assertSuccess(test, err)
 		defer client.Close()
@@ -91,7 +93,7 @@ func Test_chatServer(test *testing.T) {
 		err = testBroadcastServer.publishEvent(ctx, campaignId, donorId1, emailId1, emailStatus1)
 		assertSuccess(test, err)
 
-		subscribeUrl := testBroadcastServer.url + "/subscribe/" + campaignId
+		subscribeUrl := testBroadcastServer.subscribeUrl("/subscribe/", campaignId)
 		client1, err := newClient(ctx, subscribeUrl)
 		assertSuccess(test, err)
 		defer client1.Close()
@@ -138,6 +140,87 @@ func Test_chatServer(test *testing.T) {
 		assertSuccess(test, err)
 	})
 
+	test.Run("unsigned messages are rejected", func(test *testing.T) {
+		test.Parallel()
+
+		testBroadcastServer := setupBroadcastServerTester(test, 30*time.Second)
+		defer testBroadcastServer.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		campaignId := "test-campaign"
+		donorId := randAlphaNumericString(10)
+		emailId := randAlphaNumericString(10)
+		err := testBroadcastServer.generateDbEntriesForEvent(campaignId, donorId, emailId)
+		assertSuccess(test, err)
+
+		// the template's placeholder signature
+		msg := generateResponseBody(campaignId, donorId, emailId, events.Send, snsArn)
+		statusCode, err := testBroadcastServer.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		if statusCode != http.StatusForbidden {
+			test.Fatalf("expected %d but got %d", http.StatusForbidden, statusCode)
+		}
+
+		// a valid signature over a different message
+		signed, err := signBody(msg)
+		assertSuccess(test, err)
+		forged := strings.Replace(signed, `\"eventType\":\"Send\"`, `\"eventType\":\"Bounce\"`, 1)
+		if forged == signed {
+			test.Fatal("failed to tamper with message")
+		}
+		statusCode, err = testBroadcastServer.postPublish(ctx, forged)
+		assertSuccess(test, err)
+		if statusCode != http.StatusForbidden {
+			test.Fatalf("expected %d but got %d", http.StatusForbidden, statusCode)
+		}
+
+		err = testBroadcastServer.testDbForReceipt(campaignId, donorId, emailId, "not_sent")
+		assertSuccess(test, err)
+	})
+
+	test.Run("late events don't regress statuses", func(test *testing.T) {
+		test.Parallel()
+
+		testBroadcastServer := setupBroadcastServerTester(test, 30*time.Second)
+		defer testBroadcastServer.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		campaignId := "test-campaign"
+		subscribeUrl := testBroadcastServer.subscribeUrl("/subscribe/", campaignId)
+		client, err := newClient(ctx, subscribeUrl)
+		assertSuccess(test, err)
+		defer client.Close()
+
+		donorId := randAlphaNumericString(10)
+		emailId := randAlphaNumericString(10)
+		err = testBroadcastServer.generateDbEntriesForEvent(campaignId, donorId, emailId)
+		assertSuccess(test, err)
+
+		// delivery overtakes send, the open overtakes a delay, and nothing follows a complaint
+		for _, eventType := range []string{events.Delivery, events.Send, events.Open, events.DeliveryDelay, events.Click, events.Open, events.Complaint, events.Click} {
+			err = testBroadcastServer.publishEvent(ctx, campaignId, donorId, emailId, eventType)
+			assertSuccess(test, err)
+		}
+
+		for _, expectedStatus := range []string{events.StatusDelivered, events.StatusOpened, events.StatusClicked, events.StatusComplained} {
+			message, err := client.nextMessage(ctx)
+			assertSuccess(test, err)
+			if message.DonorId != donorId || message.Status != expectedStatus {
+				test.Fatalf("expected %v but got %v", messageHash(donorId, expectedStatus), messageHash(message.DonorId, message.Status))
+			}
+		}
+
+		err = testBroadcastServer.testDbForReceipt(campaignId, donorId, emailId, events.StatusComplained)
+		assertSuccess(test, err)
+		if ignored := testBroadcastServer.broadcastServer.IgnoredTransitions(); ignored != 4 {
+			test.Errorf("expected 4 ignored transitions but got %d", ignored)
+		}
+	})
+
 	// This test is a complex concurrency test.
 	// 16 clients listening to 4 separate campaigns
 	// and 128 messages are split between the campaigns.
@@ -164,7 +247,7 @@ func Test_chatServer(test *testing.T) {
 
 		for i := 0; i < nClients; i++ {
 			campaignId := getCampaignId(i)
-			subscribeUrl := broadcastServerTester.url + "/subscribe/" + campaignId
+			subscribeUrl := broadcastServerTester.subscribeUrl("/subscribe/", campaignId)
 			cl, err := newClient(ctx, subscribeUrl)
 			assertSuccess(test, err)
 			defer cl.Close()
@@ -237,7 +320,7 @@ func Test_chatServer(test *testing.T) {
 		// new subscribers are supposed to be sent all messages
 		i := 1
 		campaignId := getCampaignId(i)
-		subscribeUrl := broadcastServerTester.url + "/subscribe/" + campaignId
+		subscribeUrl := broadcastServerTester.subscribeUrl("/subscribe/", campaignId)
 		client, err := newClient(ctx, subscribeUrl)
 		messages := getCampaignMessages(campaignId)
 		err = client.testAllMessagesReceived(test, ctx, i, getMessageCount(nMessages, nCampaigns, i), messages)
@@ -276,9 +359,64 @@ func Test_getMessageCount(test *testing.T) {
 }
 
 const (
-	snsArn = "arn:aws:sns:us-west-2:123456789012:MyTopic"
+	snsArn         = "arn:aws:sns:us-west-2:123456789012:MyTopic"
+	testApiToken   = "test-api-token"
+	testAdminToken = "test-admin-token"
 )
 
+var testAuthorizer = NewTokenAuthorizer([]byte("test-subscribe-secret"))
+
+// subscribeUrl returns the url of the route for the campaign with a token for it,
+// more query params can be appended with &
+func (tester *BroadcastServerTester) subscribeUrl(route, campaignId string) string {
+	token, err := testAuthorizer.Mint(SubscribeClaims{Campaigns: []string{campaignId}, Exp: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		panic(err)
+	}
+	return tester.url + route + campaignId + "?token=" + token
+}
+
+var testSigner = func() *snstest.Signer {
+	signer, err := snstest.NewSigner()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create sns signer: %v", err))
+	}
+	return signer
+}()
+
+// signBody replaces the placeholder signature in an sns message
+// with one the test verifier accepts
+func signBody(body string) (string, error) {
+	var envelope events.SnsEventStruct
+	err := json.Unmarshal([]byte(body), &envelope)
+	if err != nil {
+		return "", err
+	}
+	return signEnvelope(&envelope)
+}
+
+func signEnvelope(envelope *events.SnsEventStruct) (string, error) {
+	envelope.SigningCertURL = snstest.CertUrl
+	canonical, err := events.CanonicalString(envelope)
+	if err != nil {
+		return "", err
+	}
+	envelope.Signature, err = testSigner.Sign(canonical, envelope.SignatureVersion)
+	if err != nil {
+		return "", err
+	}
+	// the message is unescaped by events.Truncate which doesn't understand
+	// html escapes
+	var signed strings.Builder
+	encoder := json.NewEncoder(&signed)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(envelope)
+	if err != nil {
+		return "", err
+	}
+	return signed.String(), nil
+}
+
 type BroadcastServerTester struct {
 	db              *sql.DB
 	dbPath          string
@@ -289,7 +427,7 @@ type BroadcastServerTester struct {
 
 // Defer closeFn to ensure everything is cleaned up at
 // the end of the test.
-func setupBroadcastServerTester(test *testing.T, maxEventAge time.Duration) *BroadcastServerTester {
+func setupBroadcastServerTester(test *testing.T, maxEventAge time.Duration, options ...Option) *BroadcastServerTester {
 	test.Helper()
 	newUuid := uuid.New().String()
 	dbPath := fmt.Sprintf("./%s.db", newUuid)
@@ -301,6 +439,8 @@ func setupBroadcastServerTester(test *testing.T, maxEventAge time.Duration) *Bro
 		os.Remove(dbPath)
 		test.Fatalf("[error] failed to open db %s: %s", dbUrl, err)
 	}
+	// a local sqlite file only allows one writer at a time
+	db.SetMaxOpenConns(1)
 
 	// 	_, err = db.Exec(`CREATE TABLE campaigns (
 	// 	id text(191) PRIMARY KEY NOT NULL,
@@ -338,13 +478,20 @@ func setupBroadcastServerTester(test *testing.T, maxEventAge time.Duration) *Bro
 		test.Fatalf("[error] failed to create indices: %s", err)
 	}
 
-	broadcastServer, err := NewBroadcastServer(snsArn, db, maxEventAge)
+	receiptStore := store.NewLibsqlStore(db)
+	err = receiptStore.Migrate(context.Background())
 	if err != nil {
 		os.Remove(dbPath)
-		test.Fatalf("[error] failed to open db %s: %s", dbUrl, err)
+		test.Fatalf("[error] failed to migrate db: %s", err)
 	}
 
-	broadcastServer.logf = test.Logf
+	verifier := events.NewVerifier(testSigner.Fetch, events.DefaultCertHostPattern)
+	options = append([]Option{WithVerifier(verifier), WithApiToken(testApiToken), WithAdminToken(testAdminToken), WithAuthorizer(testAuthorizer)}, options...)
+	broadcastServer, err := NewBroadcastServer(snsArn, receiptStore, maxEventAge, options...)
+	if err != nil {
+		os.Remove(dbPath)
+		test.Fatalf("[error] failed to open db %s: %s", dbUrl, err)
+	}
 
 	// To ensure tests run quickly under even -race.
 	httpServer := httptest.NewServer(broadcastServer)
@@ -435,31 +582,46 @@ func (server *BroadcastServerTester) testDbForReceipt(expectedCampaignId, expect
 // Make sure to run generateDbEntriesForEvent before calling this function
 // for the first time for a given campaignId and donorId
 func (server *BroadcastServerTester) publishEvent(ctx context.Context, campaignId, donorId, emailId, emailStatus string) error {
-	msg := generateResponseBody(campaignId, donorId, emailId, emailStatus, snsArn)
+	msg, err := signBody(generateResponseBody(campaignId, donorId, emailId, emailStatus, snsArn))
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+	statusCode, err := server.postPublish(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusAccepted {
+		return fmt.Errorf("publish request failed: %v", statusCode)
+	}
+	return nil
+}
+
+// postPublish posts the body to the publish endpoint and returns the response status code
+func (server *BroadcastServerTester) postPublish(ctx context.Context, msg string) (int, error) {
+	return server.postPublishForTopic(ctx, msg, snsArn)
+}
+
+func (server *BroadcastServerTester) postPublishForTopic(ctx context.Context, msg, topicArn string) (int, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.url+"/publish", strings.NewReader(msg))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return 0, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("x-amz-sns-topic-arn", snsArn)
+	req.Header.Set("x-amz-sns-topic-arn", topicArn)
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("publish request failed: %v", err)
+		return 0, fmt.Errorf("publish request failed: %v", err)
 	}
 	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("publish request failed: %v", res.StatusCode)
-	}
-	return nil
+	return res.StatusCode, nil
 }
 
 func (server *BroadcastServerTester) close() {
 	server.httpServer.Close()
-	server.db.Close()
+	server.broadcastServer.Shutdown(context.Background())
 	os.Remove(server.dbPath)
 }
 
@@ -530,22 +692,27 @@ func (client *Client) testAllMessagesReceived(test *testing.T, ctx context.Conte
 }
 
 func (client *Client) nextMessage(ctx context.Context) (SubscriberEvent, error) {
-	msgType, msg, err := client.connection.Read(ctx)
+	var parsedJson SubscriberEvent
+	err := client.nextJson(ctx, &parsedJson)
 	if err != nil {
 		return SubscriberEvent{}, err
 	}
+	return parsedJson, nil
+}
+
+// nextJson decodes the next message into message
+func (client *Client) nextJson(ctx context.Context, message any) error {
+	msgType, msg, err := client.connection.Read(ctx)
+	if err != nil {
+		return err
+	}
 
 	if msgType != websocket.MessageText {
 		client.connection.Close(websocket.StatusUnsupportedData, "expected text message")
-		return SubscriberEvent{}, fmt.Errorf("expected text message but got %v", msgType)
+		return fmt.Errorf("expected text message but got %v", msgType)
 	}
 
-	var parsedJson SubscriberEvent
-	err = json.Unmarshal(msg, &parsedJson)
-	if err != nil {
-		return SubscriberEvent{}, err
-	}
-	return parsedJson, nil
+	return json.Unmarshal(msg, message)
 }
 
 func (client *Client) Close() error {
@@ -599,10 +766,10 @@ func randInt(max int) int {
 
 const baseResponseMessage = `{
 "Type" : "Notification",
-"MessageId" : "test-message-id",
+"MessageId" : "test-sns-message-id",
 "TopicArn" : "test-topic-arn",
 "Subject" : "Amazon SES Email Event Notification",
-"Message" : "{\"eventType\":\"Send\",\"mail\":{\"timestamp\":\"2024-03-11T14:47:59.955Z\",\"source\":\"email@test.online\",\"sourceArn\":\"arn:aws:ses:test-region:test:identity/test.online\",\"sendingAccountId\":\"test\",\"messageId\":\"test-message-id\",\"destination\":[\"email@simulator.amazonses.com\"],\"headersTruncated\":false,\"headers\":[{\"name\":\"Content-Type\",\"value\":\"text/plain; charset=utf-8\"},{\"name\":\"X-Ses-Configuration-Set\",\"value\":\"test-sns-config-set\"},{\"name\":\"X-Data-Campaign-ID\",\"value\":\"test-campaign-id\"},{\"name\":\"X-Data-Donor-ID\",\"value\":\"test-donor-id\"},{\"name\":\"From\",\"value\":\"contact@test.online\"},{\"name\":\"To\",\"value\":\"success@simulator.amazonses.com\"},{\"name\":\"Subject\",\"value\":\"test\"},{\"name\":\"Message-ID\",\"value\":\"<test-email-id@test.online>\"},{\"name\":\"Content-Transfer-Encoding\",\"value\":\"7bit\"},{\"name\":\"Date\",\"value\":\"Mon, 11 Mar 2024 14:47:59 +0000\"},{\"name\":\"MIME-Version\",\"value\":\"1.0\"}],\"commonHeaders\":{\"from\":[\"contact@test.online\"],\"date\":\"Mon, 11 Mar 2024 14:47:59 +0000\",\"to\":[\"success@simulator.amazonses.com\"],\"messageId\":\"test-message-id\",\"subject\":\"test\"},\"tags\":{\"ses:source-tls-version\":[\"TLSv1.3\"],\"ses:operation\":[\"SendRawEmail\"],\"ses:configuration-set\":[\"test-sns-config-set\"],\"ses:source-ip\":[\"92.22.4.86\"],\"ses:from-domain\":[\"test.online\"],\"ses:caller-identity\":[\"root\"]}},\"send\":{}}\n",
+"Message" : "{\"eventType\":\"test-email-status\",\"mail\":{\"timestamp\":\"2024-03-11T14:47:59.955Z\",\"source\":\"email@test.online\",\"sourceArn\":\"arn:aws:ses:test-region:test:identity/test.online\",\"sendingAccountId\":\"test\",\"messageId\":\"test-message-id\",\"destination\":[\"email@simulator.amazonses.com\"],\"headersTruncated\":false,\"headers\":[{\"name\":\"Content-Type\",\"value\":\"text/plain; charset=utf-8\"},{\"name\":\"X-Ses-Configuration-Set\",\"value\":\"test-sns-config-set\"},{\"name\":\"X-Data-Campaign-ID\",\"value\":\"test-campaign-id\"},{\"name\":\"X-Data-Donor-ID\",\"value\":\"test-donor-id\"},{\"name\":\"From\",\"value\":\"contact@test.online\"},{\"name\":\"To\",\"value\":\"success@simulator.amazonses.com\"},{\"name\":\"Subject\",\"value\":\"test\"},{\"name\":\"Message-ID\",\"value\":\"<test-email-id@test.online>\"},{\"name\":\"Content-Transfer-Encoding\",\"value\":\"7bit\"},{\"name\":\"Date\",\"value\":\"Mon, 11 Mar 2024 14:47:59 +0000\"},{\"name\":\"MIME-Version\",\"value\":\"1.0\"}],\"commonHeaders\":{\"from\":[\"contact@test.online\"],\"date\":\"Mon, 11 Mar 2024 14:47:59 +0000\",\"to\":[\"success@simulator.amazonses.com\"],\"messageId\":\"test-message-id\",\"subject\":\"test\"},\"tags\":{\"ses:source-tls-version\":[\"TLSv1.3\"],\"ses:operation\":[\"SendRawEmail\"],\"ses:configuration-set\":[\"test-sns-config-set\"],\"ses:source-ip\":[\"92.22.4.86\"],\"ses:from-domain\":[\"test.online\"],\"ses:caller-identity\":[\"root\"]}},test-event-detail}\n",
 "Timestamp" : "2024-03-11T14:48:00.136Z",
 "SignatureVersion" : "1",
 "Signature" : "test.signature.png",
@@ -612,11 +779,37 @@ const baseResponseMessage = `{
 
 func generateResponseBody(campaignId, donorId, emailId, emailStatus, arn string) string {
 	replacer := strings.NewReplacer(
+		// each notification has its own id, redeliveries reuse it
+		"test-sns-message-id", uuid.NewString(),
 		"test-campaign-id", campaignId,
 		"test-donor-id", donorId,
 		"test-message-id", emailId,
 		"test-email-status", emailStatus,
 		"test-topic-arn", arn,
+		"test-event-detail", eventDetail(emailStatus, time.Now()),
 	)
 	return replacer.Replace(baseResponseMessage)
 }
+
+// eventDetail returns the escaped detail object SES attaches to events of the given type
+func eventDetail(eventType string, timestamp time.Time) string {
+	ts := timestamp.UTC().Format(time.RFC3339Nano)
+	var detail string
+	switch events.EventType(eventType) {
+	case events.Bounce:
+		detail = `"bounce":{"bounceType":"Permanent","bounceSubType":"General","bouncedRecipients":[{"emailAddress":"success@simulator.amazonses.com","action":"failed","status":"5.1.1","diagnosticCode":"smtp; 550 5.1.1 user unknown"}],"timestamp":"` + ts + `","feedbackId":"test-feedback-id"}`
+	case events.Complaint:
+		detail = `"complaint":{"complainedRecipients":[{"emailAddress":"success@simulator.amazonses.com"}],"timestamp":"` + ts + `","feedbackId":"test-feedback-id","complaintFeedbackType":"abuse"}`
+	case events.Delivery:
+		detail = `"delivery":{"timestamp":"` + ts + `","processingTimeMillis":100,"recipients":["success@simulator.amazonses.com"],"smtpResponse":"250 2.6.0 Message received","reportingMTA":"test.smtp-out.amazonses.com"}`
+	case events.DeliveryDelay:
+		detail = `"deliveryDelay":{"delayType":"TransientCommunicationFailure","delayedRecipients":[{"emailAddress":"success@simulator.amazonses.com","status":"4.4.1","diagnosticCode":"smtp; 421 4.4.1 unable to connect"}],"expirationTime":"` + ts + `","timestamp":"` + ts + `"}`
+	case events.Open:
+		detail = `"open":{"ipAddress":"192.0.2.1","timestamp":"` + ts + `","userAgent":"test-user-agent"}`
+	case events.Click:
+		detail = `"click":{"ipAddress":"192.0.2.1","timestamp":"` + ts + `","userAgent":"test-user-agent","link":"https://donationreceipt.online","linkTags":[]}`
+	default:
+		detail = `"send":{}`
+	}
+	return strings.ReplaceAll(detail, `"`, `\"`)
+}
@@ -0,0 +1,179 @@
+package broadcastserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"webhook/events"
+)
+
+// Broker carries events between every instance of the webhook. Each campaign's events
+// are numbered by the broker and buffered for maxEventAge so subscribers can be sent
+// the same replay whichever instance they're connected to.
+type Broker interface {
+	// Publish numbers the event and delivers it to every instance. Events which would move
+	// a donor's status backwards are dropped and false is returned.
+	Publish(ctx context.Context, event SubscriberGroupEvent) (bool, error)
+	// Buffer returns the campaign's buffered events, oldest first,
+	// and the seq of the campaign's latest event
+	Buffer(ctx context.Context, campaignId string) ([]SubscriberGroupEvent, uint64, error)
+	// Subscribe calls deliver with every event published by any instance, in seq order for
+	// each campaign, until the broker is closed. dropped is called if events may have been
+	// missed, e.g. when the connection to the broker was lost.
+	Subscribe(ctx context.Context, deliver func(event SubscriberGroupEvent), dropped func()) error
+	// ForgetStatuses drops the latest statuses kept for the campaign's donors, e.g. once a
+	// rebuild has moved their receipts backwards, so their next events aren't dropped for
+	// moving backwards from a status the receipts no longer have
+	ForgetStatuses(ctx context.Context, campaignId string, donorIds []string) error
+	Close() error
+}
+
+// WithBroker sets the broker events are published to, by default events only reach
+// subscribers connected to the same instance
+func WithBroker(broker Broker) Option {
+	return func(server *BroadcastServer) {
+		server.broker = broker
+	}
+}
+
+// campaignStream is a campaign's events in the memory broker
+type campaignStream struct {
+	events []SubscriberGroupEvent
+	// latest status sent for each donor
+	statuses    map[string]string
+	seq         uint64
+	lastFlushed time.Time
+}
+
+// MemoryBroker delivers events to subscribers of a single instance
+type MemoryBroker struct {
+	lock        sync.Mutex
+	streams     map[string]*campaignStream
+	maxEventAge time.Duration
+	deliver     func(event SubscriberGroupEvent)
+	// floor is the highest seq of any evicted stream, new streams are numbered from it
+	// so a recreated stream never reuses seqs its subscribers may resume from
+	floor uint64
+}
+
+func NewMemoryBroker(maxEventAge time.Duration) *MemoryBroker {
+	return &MemoryBroker{streams: make(map[string]*campaignStream), maxEventAge: maxEventAge}
+}
+
+// Publish delivers the event before returning. The lock is held until it's delivered
+// so subscribers receive events in seq order and Buffer never returns an event which
+// hasn't been delivered.
+func (broker *MemoryBroker) Publish(ctx context.Context, event SubscriberGroupEvent) (bool, error) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	stream, ok := broker.streams[event.campaignId]
+	if !ok {
+		stream = &campaignStream{statuses: make(map[string]string), seq: broker.floor, lastFlushed: time.Now()}
+		broker.streams[event.campaignId] = stream
+	}
+	if currentStatus, ok := stream.statuses[event.donorId]; ok && !events.CanTransition(currentStatus, event.status) {
+		return false, nil
+	}
+	stream.statuses[event.donorId] = event.status
+	stream.flush(broker.maxEventAge)
+	stream.seq++
+	event.seq = stream.seq
+	stream.events = append(stream.events, event)
+	if broker.deliver != nil {
+		broker.deliver(event)
+	}
+	return true, nil
+}
+
+func (broker *MemoryBroker) Buffer(ctx context.Context, campaignId string) ([]SubscriberGroupEvent, uint64, error) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	stream, ok := broker.streams[campaignId]
+	if !ok {
+		return nil, broker.floor, nil
+	}
+	return append([]SubscriberGroupEvent(nil), stream.events...), stream.seq, nil
+}
+
+func (broker *MemoryBroker) ForgetStatuses(ctx context.Context, campaignId string, donorIds []string) error {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	stream, ok := broker.streams[campaignId]
+	if !ok {
+		return nil
+	}
+	for _, donorId := range donorIds {
+		delete(stream.statuses, donorId)
+	}
+	return nil
+}
+
+// Subscribe sets deliver, events are never dropped
+func (broker *MemoryBroker) Subscribe(ctx context.Context, deliver func(event SubscriberGroupEvent), dropped func()) error {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.deliver = deliver
+	return nil
+}
+
+func (broker *MemoryBroker) Close() error {
+	return nil
+}
+
+// EvictIdle removes the streams of campaigns whose events are older than maxEventAge
+// and which aren't subscribed to, returning how many were removed
+func (broker *MemoryBroker) EvictIdle(now time.Time, subscribed func(campaignId string) bool) int {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	minEventTime := now.Add(-1 * broker.maxEventAge)
+	evicted := 0
+	for campaignId, stream := range broker.streams {
+		if len(stream.events) > 0 && stream.events[len(stream.events)-1].createdAt.After(minEventTime) {
+			continue
+		}
+		if subscribed(campaignId) {
+			continue
+		}
+		broker.floor = max(broker.floor, stream.seq)
+		delete(broker.streams, campaignId)
+		evicted++
+	}
+	return evicted
+}
+
+// Streams returns the number of campaigns the broker holds events for
+func (broker *MemoryBroker) Streams() int {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	return len(broker.streams)
+}
+
+// flush removes the events older than maxEventAge, at most once every maxEventAge
+func (stream *campaignStream) flush(maxEventAge time.Duration) {
+	now := time.Now()
+	minEventTime := now.Add(-1 * maxEventAge)
+	if stream.lastFlushed.After(minEventTime) {
+		return
+	}
+
+	stream.lastFlushed = now
+	var i int
+	for i = 0; i < len(stream.events); i++ {
+		if stream.events[i].createdAt.After(minEventTime) {
+			break
+		}
+	}
+
+	if i == 0 {
+		return
+	}
+	eventsLen := len(stream.events)
+	if i == eventsLen {
+		stream.events = stream.events[:0]
+		return
+	}
+
+	copy(stream.events, stream.events[i:])
+	stream.events = stream.events[:(eventsLen - i)]
+}
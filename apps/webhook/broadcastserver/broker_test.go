@@ -0,0 +1,317 @@
+package broadcastserver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"nhooyr.io/websocket"
+)
+
+func newRedisTestBroker(test *testing.T, redisServer *miniredis.Miniredis, maxEventAge time.Duration) *RedisBroker {
+	test.Helper()
+	broker := NewRedisBroker(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), "test:", maxEventAge)
+	test.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+var brokerTesters = map[string]func(test *testing.T, maxEventAge time.Duration) Broker{
+	"memory": func(test *testing.T, maxEventAge time.Duration) Broker {
+		return NewMemoryBroker(maxEventAge)
+	},
+	"redis": func(test *testing.T, maxEventAge time.Duration) Broker {
+		return newRedisTestBroker(test, miniredis.RunT(test), maxEventAge)
+	},
+}
+
+// deliveries collects delivered events
+type deliveries struct {
+	lock   sync.Mutex
+	events []SubscriberGroupEvent
+	added  chan struct{}
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{added: make(chan struct{}, 100)}
+}
+
+func (deliveries *deliveries) deliver(event SubscriberGroupEvent) {
+	deliveries.lock.Lock()
+	deliveries.events = append(deliveries.events, event)
+	deliveries.lock.Unlock()
+	deliveries.added <- struct{}{}
+}
+
+// wait returns once n events have been delivered
+func (deliveries *deliveries) wait(test *testing.T, ctx context.Context, n int) []SubscriberGroupEvent {
+	test.Helper()
+	for {
+		deliveries.lock.Lock()
+		if len(deliveries.events) >= n {
+			delivered := append([]SubscriberGroupEvent(nil), deliveries.events...)
+			deliveries.lock.Unlock()
+			return delivered
+		}
+		deliveries.lock.Unlock()
+		select {
+		case <-deliveries.added:
+		case <-ctx.Done():
+			test.Fatalf("expected %d deliveries: %s", n, ctx.Err())
+		}
+	}
+}
+
+func Test_broker(test *testing.T) {
+	test.Parallel()
+
+	for name, newBroker := range brokerTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			broker := newBroker(test, time.Hour)
+			delivered := newDeliveries()
+			err := broker.Subscribe(ctx, delivered.deliver, func() {})
+			assertSuccess(test, err)
+
+			publish := func(campaignId, donorId, status string) bool {
+				published, err := broker.Publish(ctx, SubscriberGroupEvent{
+					campaignId: campaignId,
+					donorId:    donorId,
+					status:     status,
+					timestamp:  time.Now().UTC().Truncate(time.Millisecond),
+					createdAt:  time.Now(),
+				})
+				assertSuccess(test, err)
+				return published
+			}
+
+			buffered, seq, err := broker.Buffer(ctx, "first-campaign")
+			assertSuccess(test, err)
+			if len(buffered) != 0 || seq != 0 {
+				test.Fatalf("expected an empty buffer but got %d events and seq %d", len(buffered), seq)
+			}
+
+			publish("first-campaign", "first-donor", events.StatusSent)
+			publish("second-campaign", "first-donor", events.StatusSent)
+			publish("first-campaign", "first-donor", events.StatusOpened)
+			if publish("first-campaign", "first-donor", events.StatusDelivered) {
+				test.Errorf("expected the status not to move backwards")
+			}
+			publish("first-campaign", "second-donor", events.StatusDelivered)
+
+			// each campaign is numbered separately
+			expected := []struct {
+				campaignId string
+				seq        uint64
+				status     string
+			}{
+				{"first-campaign", 1, events.StatusSent},
+				{"second-campaign", 1, events.StatusSent},
+				{"first-campaign", 2, events.StatusOpened},
+				{"first-campaign", 3, events.StatusDelivered},
+			}
+			all := delivered.wait(test, ctx, len(expected))
+			for i, event := range all {
+				if event.campaignId != expected[i].campaignId || event.seq != expected[i].seq || event.status != expected[i].status {
+					test.Errorf("delivery %d: expected %+v but got %+v", i, expected[i], event)
+				}
+			}
+
+			buffered, seq, err = broker.Buffer(ctx, "first-campaign")
+			assertSuccess(test, err)
+			if len(buffered) != 3 || seq != 3 || buffered[0].seq != 1 || buffered[2].donorId != "second-donor" || !buffered[2].timestamp.Equal(all[3].timestamp) {
+				test.Errorf("unexpected buffer %d %+v", seq, buffered)
+			}
+		})
+	}
+}
+
+func Test_brokerFlush(test *testing.T) {
+	test.Parallel()
+
+	for name, newBroker := range brokerTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			ctx := context.Background()
+			broker := newBroker(test, 100*time.Millisecond)
+			err := broker.Subscribe(ctx, func(SubscriberGroupEvent) {}, func() {})
+			assertSuccess(test, err)
+
+			for _, donorId := range []string{"first-donor", "second-donor"} {
+				_, err := broker.Publish(ctx, SubscriberGroupEvent{campaignId: "test-campaign", donorId: donorId, status: events.StatusSent, createdAt: time.Now()})
+				assertSuccess(test, err)
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			// events older than maxEventAge are flushed by the next event
+			_, err = broker.Publish(ctx, SubscriberGroupEvent{campaignId: "test-campaign", donorId: "third-donor", status: events.StatusSent, createdAt: time.Now()})
+			assertSuccess(test, err)
+			buffered, seq, err := broker.Buffer(ctx, "test-campaign")
+			assertSuccess(test, err)
+			if len(buffered) != 1 || buffered[0].seq != 3 || seq != 3 {
+				test.Errorf("expected only the latest event to be buffered but got %d %+v", seq, buffered)
+			}
+		})
+	}
+}
+
+func Test_brokerForgetStatuses(test *testing.T) {
+	test.Parallel()
+
+	for name, newBroker := range brokerTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			broker := newBroker(test, time.Hour)
+			err := broker.Subscribe(ctx, func(SubscriberGroupEvent) {}, func() {})
+			assertSuccess(test, err)
+
+			publish := func(donorId, status string) bool {
+				published, err := broker.Publish(ctx, SubscriberGroupEvent{campaignId: "test-campaign", donorId: donorId, status: status, createdAt: time.Now()})
+				assertSuccess(test, err)
+				return published
+			}
+			publish("first-donor", events.StatusComplained)
+			publish("second-donor", events.StatusComplained)
+			if publish("first-donor", events.StatusDelivered) {
+				test.Fatalf("expected the status not to move backwards")
+			}
+
+			// once a donor's status is forgotten any status follows it
+			assertSuccess(test, broker.ForgetStatuses(ctx, "test-campaign", []string{"first-donor"}))
+			assertSuccess(test, broker.ForgetStatuses(ctx, "other-campaign", []string{"first-donor"}))
+			if !publish("first-donor", events.StatusDelivered) {
+				test.Errorf("expected the forgotten status to be replaced")
+			}
+			if publish("second-donor", events.StatusDelivered) {
+				test.Errorf("expected the other donor's status to be kept")
+			}
+		})
+	}
+}
+
+func Test_redisBrokerDropped(test *testing.T) {
+	test.Parallel()
+
+	redisServer := miniredis.RunT(test)
+	broker := newRedisTestBroker(test, redisServer, time.Hour)
+	dropped := make(chan struct{}, 1)
+	err := broker.Subscribe(context.Background(), func(SubscriberGroupEvent) {}, func() {
+		select {
+		case dropped <- struct{}{}:
+		default:
+		}
+	})
+	assertSuccess(test, err)
+
+	redisServer.Close()
+	err = redisServer.Restart()
+	assertSuccess(test, err)
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		test.Fatalf("expected subscribers to be dropped after reconnecting")
+	}
+}
+
+func Test_brokerAcrossInstances(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	redisServer := miniredis.RunT(test)
+	memoryStore := store.NewMemoryStore()
+	first := setupStoreTester(test, memoryStore, 30*time.Second, WithBroker(newRedisTestBroker(test, redisServer, 30*time.Second)))
+	defer first.close()
+	second := setupStoreTester(test, memoryStore, 30*time.Second, WithBroker(newRedisTestBroker(test, redisServer, 30*time.Second)))
+	defer second.close()
+
+	campaignId := "test-campaign"
+	publish := func(tester *BroadcastServerTester, donorId string) {
+		memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		err := tester.publishEvent(ctx, campaignId, donorId, "email-"+donorId, events.Send)
+		assertSuccess(test, err)
+	}
+
+	client, err := newClient(ctx, second.subscribeUrl("/subscribe/", campaignId))
+	assertSuccess(test, err)
+	defer client.Close()
+
+	// sns delivers to the first instance and the subscriber is connected to the second
+	publish(first, "first-donor")
+	message, err := client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Seq != 1 || message.DonorId != "first-donor" {
+		test.Errorf("expected the event published on the other instance but got %+v", message)
+	}
+
+	// the replay is the same whichever instance the subscriber connects to
+	publish(second, "second-donor")
+	for _, tester := range []*BroadcastServerTester{first, second} {
+		resumed, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId)+"&since=1")
+		assertSuccess(test, err)
+		message, err := resumed.nextMessage(ctx)
+		assertSuccess(test, err)
+		if message.Seq != 2 || message.DonorId != "second-donor" {
+			test.Errorf("expected to resume from seq 2 but got %+v", message)
+		}
+		resumed.Close()
+	}
+}
+
+func Test_slowSubscriberClose(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	tester := setupStoreTester(test, store.NewMemoryStore(), 30*time.Second)
+	defer tester.close()
+	server := tester.broadcastServer
+
+	// closing the slow subscriber blocks like a WebSocket waiting for the client's close frame
+	closing := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	slow := &subscriber{campaignId: campaignId, events: make(chan SubscriberGroupEvent), close: func(websocket.StatusCode, string) {
+		closing <- struct{}{}
+		<-release
+	}}
+	_, err := server.AddSubscriber(ctx, slow, 0, false)
+	assertSuccess(test, err)
+
+	published := make(chan error, 1)
+	go func() {
+		_, err := server.broker.Publish(ctx, SubscriberGroupEvent{campaignId: campaignId, donorId: "test-donor", status: events.StatusSent, createdAt: time.Now()})
+		published <- err
+	}()
+	select {
+	case <-closing:
+	case <-ctx.Done():
+		test.Fatal("expected the slow subscriber to be closed")
+	}
+	// neither the broker nor the group are locked while the subscriber closes
+	select {
+	case err := <-published:
+		assertSuccess(test, err)
+	case <-ctx.Done():
+		test.Fatal("expected the publish to return while the subscriber closes")
+	}
+	_, seq, err := server.broker.Buffer(ctx, campaignId)
+	assertSuccess(test, err)
+	if seq != 1 {
+		test.Errorf("expected seq 1 but got %d", seq)
+	}
+	server.DeleteSubscriber(slow)
+}
@@ -0,0 +1,263 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// control message types sent by subscribers
+const (
+	controlSubscribe   = "subscribe"
+	controlUnsubscribe = "unsubscribe"
+	controlPing        = "ping"
+)
+
+// replies to control messages
+const (
+	messageAck   = "ack"
+	messageError = "error"
+)
+
+// error codes sent in error replies
+const (
+	errorBadRequest           = "bad_request"
+	errorUnauthenticated      = "unauthenticated"
+	errorForbidden            = "forbidden"
+	errorTooManySubscriptions = "too_many_subscriptions"
+	errorInternal             = "internal"
+)
+
+const (
+	// connectionBuffer is the number of events which can be queued for a connection,
+	// across all of its campaigns, before it's closed for being too slow
+	connectionBuffer = 256
+	// maxSubscriptions is the number of campaigns a connection may follow
+	maxSubscriptions = 100
+	// maxControlMessageSize is the largest control message read from a subscriber
+	maxControlMessageSize = 4096
+)
+
+// ControlMessage is sent by subscribers to follow campaigns. Each is answered with an
+// AckMessage or an ErrorMessage with the same id. A subscribe's ack is followed by the
+// campaign's replay or snapshot, as if it were subscribed to with those query params.
+type ControlMessage struct {
+	Type       string `json:"type"`
+	Id         string `json:"id,omitempty"`
+	CampaignId string `json:"campaignId,omitempty"`
+	// since resumes the subscription after the campaign's seq
+	Since    *uint64 `json:"since,omitempty"`
+	Snapshot bool    `json:"snapshot,omitempty"`
+}
+
+type AckMessage struct {
+	Type       string `json:"type"`
+	Id         string `json:"id,omitempty"`
+	CampaignId string `json:"campaignId,omitempty"`
+}
+
+type ErrorMessage struct {
+	Type       string `json:"type"`
+	Id         string `json:"id,omitempty"`
+	CampaignId string `json:"campaignId,omitempty"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+// command is a control message read from the connection, err is set if it couldn't be parsed
+type command struct {
+	message ControlMessage
+	err     error
+}
+
+// connection is a WebSocket following any number of campaigns. Each campaign has
+// its own subscriber but they share the connection's channel, events are told apart
+// by their campaign id.
+//
+// Subscriptions are only used by the goroutine running the connection.
+type connection struct {
+	server *BroadcastServer
+	// the upgrade request, subscriptions are authorized with its token or cookie
+	req           *http.Request
+	wsConn        *websocket.Conn
+	events        chan SubscriberGroupEvent
+	close         func(code websocket.StatusCode, reason string)
+	subscriptions map[string]*subscriber
+}
+
+func newConnection(server *BroadcastServer, req *http.Request, wsConn *websocket.Conn, close func(code websocket.StatusCode, reason string)) *connection {
+	wsConn.SetReadLimit(maxControlMessageSize)
+	return &connection{
+		server:        server,
+		req:           req,
+		wsConn:        wsConn,
+		events:        make(chan SubscriberGroupEvent, connectionBuffer),
+		close:         close,
+		subscriptions: make(map[string]*subscriber),
+	}
+}
+
+// subscribe follows the campaign, replacing any existing subscription to it, and returns
+// the messages to send before its live events
+func (conn *connection) subscribe(ctx context.Context, campaignId string, options subscribeOptions) ([]outboundMessage, error) {
+	conn.unsubscribe(campaignId)
+	sub := &subscriber{
+		campaignId: campaignId,
+		events:     conn.events,
+		close:      conn.close,
+	}
+	messages, err := conn.server.subscribe(ctx, sub, options)
+	if err != nil {
+		return nil, err
+	}
+	conn.subscriptions[campaignId] = sub
+	return messages, nil
+}
+
+func (conn *connection) unsubscribe(campaignId string) {
+	if sub, ok := conn.subscriptions[campaignId]; ok {
+		conn.server.DeleteSubscriber(sub)
+		delete(conn.subscriptions, campaignId)
+	}
+}
+
+// unsubscribeAll removes all of the connection's subscriptions
+func (conn *connection) unsubscribeAll() {
+	for campaignId := range conn.subscriptions {
+		conn.unsubscribe(campaignId)
+	}
+}
+
+// read sends the subscriber's control messages to commands until the connection is closed,
+// then cancels the connection's context
+func (conn *connection) read(ctx context.Context, cancel context.CancelFunc, commands chan<- command) {
+	defer cancel()
+	for {
+		messageType, data, err := conn.wsConn.Read(ctx)
+		if err != nil {
+			return
+		}
+		if messageType != websocket.MessageText {
+			conn.wsConn.Close(websocket.StatusUnsupportedData, "control messages must be text")
+			return
+		}
+		var cmd command
+		cmd.err = json.Unmarshal(data, &cmd.message)
+		select {
+		case commands <- cmd:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run writes the events of the connection's campaigns and handles its control messages
+// until ctx is done or a write fails
+func (conn *connection) run(ctx context.Context, commands <-chan command) error {
+	for {
+		select {
+		case event := <-conn.events:
+			sub, ok := conn.subscriptions[event.campaignId]
+			// events queued before the campaign was unsubscribed from, or resubscribed to,
+			// were either sent already or aren't wanted
+			if !ok || event.seq <= sub.seq || !sub.accept(event) {
+				continue
+			}
+			sub.seq = event.seq
+			if err := writeMessage(ctx, conn.wsConn, event.toSubscriberEvent()); err != nil {
+				return err
+			}
+		case cmd := <-commands:
+			if err := conn.handle(ctx, cmd); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (conn *connection) reply(ctx context.Context, message ControlMessage, code string, reason string) error {
+	return writeMessage(ctx, conn.wsConn, ErrorMessage{
+		Type:       messageError,
+		Id:         message.Id,
+		CampaignId: message.CampaignId,
+		Code:       code,
+		Message:    reason,
+	})
+}
+
+func (conn *connection) ack(ctx context.Context, message ControlMessage) error {
+	return writeMessage(ctx, conn.wsConn, AckMessage{Type: messageAck, Id: message.Id, CampaignId: message.CampaignId})
+}
+
+// handle answers a control message, only failed writes are returned
+func (conn *connection) handle(ctx context.Context, cmd command) error {
+	message := cmd.message
+	if cmd.err != nil {
+		return conn.reply(ctx, message, errorBadRequest, "invalid control message")
+	}
+
+	switch message.Type {
+	case controlPing:
+		return conn.ack(ctx, message)
+	case controlUnsubscribe:
+		if message.CampaignId == "" {
+			return conn.reply(ctx, message, errorBadRequest, "campaignId is required")
+		}
+		conn.unsubscribe(message.CampaignId)
+		return conn.ack(ctx, message)
+	case controlSubscribe:
+		return conn.handleSubscribe(ctx, message)
+	default:
+		return conn.reply(ctx, message, errorBadRequest, fmt.Sprintf("unknown control message type %q", message.Type))
+	}
+}
+
+func (conn *connection) handleSubscribe(ctx context.Context, message ControlMessage) error {
+	campaignId := message.CampaignId
+	if campaignId == "" {
+		return conn.reply(ctx, message, errorBadRequest, "campaignId is required")
+	}
+	if _, ok := conn.subscriptions[campaignId]; !ok && len(conn.subscriptions) >= maxSubscriptions {
+		return conn.reply(ctx, message, errorTooManySubscriptions, fmt.Sprintf("a connection may follow at most %d campaigns", maxSubscriptions))
+	}
+
+	if err := conn.server.authorize(conn.req, campaignId); err != nil {
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			return conn.reply(ctx, message, errorUnauthenticated, err.Error())
+		case errors.Is(err, ErrForbidden):
+			return conn.reply(ctx, message, errorForbidden, err.Error())
+		default:
+			conn.server.log(ctx).Error("failed to authorize subscriber", campaignAttr(campaignId), errAttr(err))
+			return conn.reply(ctx, message, errorInternal, "failed to authorize")
+		}
+	}
+
+	options := subscribeOptions{snapshot: message.Snapshot}
+	if message.Since != nil {
+		options.since = *message.Since
+		options.resume = true
+	}
+	messages, err := conn.subscribe(ctx, campaignId, options)
+	if err != nil {
+		conn.server.log(ctx).Error("failed to subscribe", campaignAttr(campaignId), errAttr(err))
+		return conn.reply(ctx, message, errorInternal, "failed to load the campaign")
+	}
+
+	conn.server.log(ctx).Debug("client subscribed to events", campaignAttr(campaignId))
+	if err := conn.ack(ctx, message); err != nil {
+		return err
+	}
+	for _, outbound := range messages {
+		if err := writeMessage(ctx, conn.wsConn, outbound.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
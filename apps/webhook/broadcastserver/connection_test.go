@@ -0,0 +1,134 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"webhook/events"
+	"webhook/store"
+)
+
+// connectionMessage has the fields of every message sent on a connection
+type connectionMessage struct {
+	Type       string           `json:"type"`
+	Id         string           `json:"id"`
+	CampaignId string           `json:"campaignId"`
+	Code       string           `json:"code"`
+	Seq        uint64           `json:"seq"`
+	DonorId    string           `json:"donorId"`
+	Status     string           `json:"status"`
+	Statuses   []SnapshotStatus `json:"statuses"`
+}
+
+func (client *Client) send(ctx context.Context, message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return client.connection.Write(ctx, websocket.MessageText, data)
+}
+
+func Test_multiplexedConnection(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second)
+	defer tester.close()
+
+	publish := func(campaignId, donorId string) {
+		memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		err := tester.publishEvent(ctx, campaignId, donorId, "email-"+donorId, events.Send)
+		assertSuccess(test, err)
+	}
+	next := func(client *Client) connectionMessage {
+		test.Helper()
+		var message connectionMessage
+		err := client.nextJson(ctx, &message)
+		assertSuccess(test, err)
+		return message
+	}
+	expect := func(client *Client, messageType, id, campaignId string) connectionMessage {
+		test.Helper()
+		message := next(client)
+		if message.Type != messageType || message.Id != id || message.CampaignId != campaignId {
+			test.Fatalf("expected %s %s for %s but got %+v", messageType, id, campaignId, message)
+		}
+		return message
+	}
+
+	publish("first-campaign", "buffered-donor")
+
+	token, err := testAuthorizer.Mint(SubscribeClaims{Campaigns: []string{"first-campaign", "second-campaign"}, Exp: time.Now().Add(time.Minute).Unix()})
+	assertSuccess(test, err)
+	client, err := newClient(ctx, tester.url+"/subscribe?token="+token)
+	assertSuccess(test, err)
+	defer client.Close()
+
+	err = client.send(ctx, ControlMessage{Type: controlPing, Id: "1"})
+	assertSuccess(test, err)
+	expect(client, messageAck, "1", "")
+
+	// subscribing is acked before the replay
+	err = client.send(ctx, ControlMessage{Type: controlSubscribe, Id: "2", CampaignId: "first-campaign"})
+	assertSuccess(test, err)
+	expect(client, messageAck, "2", "first-campaign")
+	replayed := expect(client, messageEvent, "", "first-campaign")
+	if replayed.DonorId != "buffered-donor" || replayed.Seq != 1 {
+		test.Errorf("expected the buffered event but got %+v", replayed)
+	}
+
+	err = client.send(ctx, ControlMessage{Type: controlSubscribe, Id: "3", CampaignId: "second-campaign", Snapshot: true})
+	assertSuccess(test, err)
+	expect(client, messageAck, "3", "second-campaign")
+	expect(client, messageSnapshot, "", "second-campaign")
+
+	// events of both campaigns are sent on the connection
+	publish("first-campaign", "first-donor")
+	publish("second-campaign", "second-donor")
+	first := expect(client, messageEvent, "", "first-campaign")
+	second := expect(client, messageEvent, "", "second-campaign")
+	if first.DonorId != "first-donor" || first.Seq != 2 || second.DonorId != "second-donor" || second.Seq != 1 {
+		test.Errorf("unexpected events %+v %+v", first, second)
+	}
+
+	err = client.send(ctx, ControlMessage{Type: controlUnsubscribe, Id: "4", CampaignId: "first-campaign"})
+	assertSuccess(test, err)
+	expect(client, messageAck, "4", "first-campaign")
+	publish("first-campaign", "unsubscribed-donor")
+	publish("second-campaign", "another-donor")
+	if message := expect(client, messageEvent, "", "second-campaign"); message.DonorId != "another-donor" {
+		test.Errorf("expected only the subscribed campaign's event but got %+v", message)
+	}
+
+	// resubscribing resumes from since
+	since := uint64(2)
+	err = client.send(ctx, ControlMessage{Type: controlSubscribe, Id: "5", CampaignId: "first-campaign", Since: &since})
+	assertSuccess(test, err)
+	expect(client, messageAck, "5", "first-campaign")
+	if message := expect(client, messageEvent, "", "first-campaign"); message.DonorId != "unsubscribed-donor" || message.Seq != 3 {
+		test.Errorf("expected the event missed while unsubscribed but got %+v", message)
+	}
+
+	for _, testCase := range []struct {
+		message any
+		id      string
+		code    string
+	}{
+		{message: ControlMessage{Type: controlSubscribe, Id: "6", CampaignId: "unowned-campaign"}, id: "6", code: errorForbidden},
+		{message: ControlMessage{Type: controlSubscribe, Id: "7"}, id: "7", code: errorBadRequest},
+		{message: ControlMessage{Type: "publish", Id: "8"}, id: "8", code: errorBadRequest},
+		{message: "not a control message", code: errorBadRequest},
+	} {
+		err = client.send(ctx, testCase.message)
+		assertSuccess(test, err)
+		if message := next(client); message.Type != messageError || message.Id != testCase.id || message.Code != testCase.code {
+			test.Errorf("expected error %s for %+v but got %+v", testCase.code, testCase.message, message)
+		}
+	}
+}
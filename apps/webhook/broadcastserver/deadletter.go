@@ -0,0 +1,67 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
+)
+
+// maxApplyAttempts is how many times a worker tries to apply a queued event before it's
+// moved to the dead letters so the campaign's later events aren't held up
+const maxApplyAttempts = 10
+
+// deadLetter records an event which failed so it can be replayed once the parser or the
+// data is fixed. id is the sns message id, redeliveries which fail again count as attempts.
+func (server *BroadcastServer) deadLetter(ctx context.Context, id string, reason store.DeadLetterReason, raw []byte, cause error) error {
+	if id == "" {
+		id = uuid.NewString()
+	}
+	letter := store.DeadLetter{Id: id, Reason: reason, Error: cause.Error(), Raw: raw}
+	err := server.withRetries(ctx, "dead letter", func(ctx context.Context) error {
+		return server.store.RecordDeadLetter(ctx, letter)
+	})
+	if err != nil {
+		server.log(ctx).Error("failed to record dead letter", slog.String("dead_letter_id", id), errAttr(err))
+		return err
+	}
+	server.metrics.deadLetters.WithLabelValues(string(reason)).Inc()
+	server.log(ctx).Warn("recorded dead letter", slog.String("dead_letter_id", id), slog.String("reason", string(reason)), errAttr(cause))
+	return nil
+}
+
+// ReplayDeadLetter parses the dead letter's event again and applies it like a publish,
+// removing the dead letter once it's applied. If it fails again the failure is recorded
+// as another attempt. Events which SNS redelivered successfully since they failed are
+// duplicates by now and are removed without being applied twice.
+func (server *BroadcastServer) ReplayDeadLetter(ctx context.Context, id string) error {
+	letter, err := server.store.DeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := server.beginWrite(); err != nil {
+		return err
+	}
+	defer server.endWrite()
+
+	parsedEvent, err := events.ParseSnsEvent(letter.Raw)
+	if err != nil {
+		server.deadLetter(ctx, id, store.DeadLetterParse, letter.Raw, err)
+		return fmt.Errorf("failed to parse event: %w", err)
+	}
+	err = server.applyEvent(ctx, parsedEvent)
+	if errors.Is(err, store.ErrEventInProgress) {
+		return err
+	}
+	if err != nil {
+		server.deadLetter(ctx, id, store.DeadLetterWrite, letter.Raw, err)
+		return fmt.Errorf("failed to apply event: %w", err)
+	}
+	_, err = server.store.DeleteDeadLetter(ctx, id)
+	return err
+}
@@ -0,0 +1,142 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+func Test_deadLetters(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	flaky := &flakyStore{MemoryStore: store.NewMemoryStore()}
+	tester := setupStoreTester(test, flaky, 30*time.Second, WithWriteRetries(1, time.Millisecond))
+	defer tester.close()
+	server := tester.broadcastServer
+
+	// events which can't be parsed are kept
+	envelope := events.SnsEventStruct{
+		Type:             "Notification",
+		MessageId:        "bad-payload",
+		TopicArn:         snsArn,
+		Message:          json.RawMessage(`"not an ses event"`),
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: "1",
+	}
+	msg, err := signEnvelope(&envelope)
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusBadRequest {
+		test.Fatalf("expected %d but got %d", http.StatusBadRequest, statusCode)
+	}
+	letter, err := flaky.DeadLetter(ctx, "bad-payload")
+	assertSuccess(test, err)
+	if letter.Reason != store.DeadLetterParse || string(letter.Raw) != msg {
+		test.Errorf("expected the unparseable body to be kept but got %+v", letter)
+	}
+	// replaying it before the parser is fixed counts another attempt
+	if err := server.ReplayDeadLetter(ctx, "bad-payload"); err == nil {
+		test.Errorf("expected the replay to fail")
+	}
+	letter, err = flaky.DeadLetter(ctx, "bad-payload")
+	assertSuccess(test, err)
+	if letter.Attempts != 2 {
+		test.Errorf("expected 2 attempts but got %d", letter.Attempts)
+	}
+
+	// as are events which couldn't be written
+	flaky.MemoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "failed-donor", Status: events.StatusNotSent})
+	body := generateResponseBody(campaignId, "failed-donor", "email-failed-donor", events.Delivery, snsArn)
+	msg, err = signBody(body)
+	assertSuccess(test, err)
+	var failed events.SnsEventStruct
+	assertSuccess(test, json.Unmarshal([]byte(msg), &failed))
+	flaky.failures.Store(1)
+	statusCode, err = tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusInternalServerError {
+		test.Fatalf("expected %d but got %d", http.StatusInternalServerError, statusCode)
+	}
+	letter, err = flaky.DeadLetter(ctx, failed.MessageId)
+	assertSuccess(test, err)
+	if letter.Reason != store.DeadLetterWrite || letter.Attempts != 1 {
+		test.Errorf("expected a write failure but got %+v", letter)
+	}
+
+	// and replayed through the normal pipeline once the db is back
+	assertSuccess(test, server.ReplayDeadLetter(ctx, failed.MessageId))
+	receipt, err := flaky.Receipt(ctx, campaignId, "failed-donor")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusDelivered {
+		test.Errorf("expected status %s but got %s", events.StatusDelivered, receipt.Status)
+	}
+	if _, err := flaky.DeadLetter(ctx, failed.MessageId); !errors.Is(err, store.ErrDeadLetterNotFound) {
+		test.Errorf("expected the replayed dead letter to be removed but got %v", err)
+	}
+	// a redelivery of the replayed event is a duplicate
+	statusCode, err = tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	history, err := flaky.History(ctx, campaignId, "failed-donor")
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted || len(history) != 1 {
+		test.Errorf("expected the redelivery to be dropped but got %d and %+v", statusCode, history)
+	}
+}
+
+func Test_deadLetterQueued(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	flaky := &flakyStore{MemoryStore: store.NewMemoryStore()}
+	tester := setupStoreTester(test, flaky, 30*time.Second, WithWriteRetries(1, time.Millisecond), WithWorkerPool(1, 10))
+	defer tester.close()
+	assertSuccess(test, tester.broadcastServer.StartWorkers(ctx))
+
+	// an event which keeps failing stops holding up the campaign's later events
+	flaky.failures.Store(maxApplyAttempts)
+	var stuck events.SnsEventStruct
+	for _, donorId := range []string{"stuck-donor", "later-donor"} {
+		flaky.MemoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		msg, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Delivery, snsArn))
+		assertSuccess(test, err)
+		if stuck.MessageId == "" {
+			assertSuccess(test, json.Unmarshal([]byte(msg), &stuck))
+		}
+		statusCode, err := tester.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		if statusCode != http.StatusAccepted {
+			test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+		}
+	}
+	waitForQueue(test, ctx, tester.broadcastServer)
+
+	receipt, err := flaky.Receipt(ctx, campaignId, "later-donor")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusDelivered {
+		test.Errorf("expected the later event to be applied but the status is %s", receipt.Status)
+	}
+	letter, err := flaky.DeadLetter(ctx, stuck.MessageId)
+	assertSuccess(test, err)
+	if letter.Reason != store.DeadLetterWrite {
+		test.Errorf("expected a write failure but got %+v", letter)
+	}
+	queued, err := flaky.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 0 {
+		test.Errorf("expected the dead letter to be removed from the queue but got %+v", queued)
+	}
+}
@@ -0,0 +1,133 @@
+package broadcastserver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+const (
+	defaultDedupeTTL = 24 * time.Hour
+	// defaultDedupeWindow is how many processed events are remembered in memory
+	defaultDedupeWindow = 10_000
+	// claimTimeout is how long a claimed event blocks redeliveries before the claim is
+	// taken over, e.g. after the instance processing it crashed
+	claimTimeout = time.Minute
+	// claimRetryAfter is the Retry-After in seconds sent with redeliveries of events
+	// which are still being processed
+	claimRetryAfter = 5
+)
+
+// WithDedupe sets how long processed events are remembered so SNS redeliveries are
+// dropped, and how many of them are remembered in memory in front of the store.
+// Defaults to 24 hours and 10,000 events.
+func WithDedupe(ttl time.Duration, window int) Option {
+	return func(server *BroadcastServer) {
+		server.dedupeTTL = ttl
+		server.processed = newDedupeWindow(window)
+	}
+}
+
+// dedupeKey identifies an event across redeliveries. SNS keeps the MessageId when it
+// redelivers, events without one fall back to the SES message id, event type and timestamp.
+func dedupeKey(event events.ParsedEvent) string {
+	if event.SnsMessageId != "" {
+		return "sns:" + event.SnsMessageId
+	}
+	return "ses:" + event.EmailId + ":" + string(event.EventType) + ":" + strconv.FormatInt(event.Timestamp.UnixMilli(), 10)
+}
+
+// dedupeWindow remembers the most recently processed events so most redeliveries
+// are dropped without a db query
+type dedupeWindow struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newDedupeWindow(size int) *dedupeWindow {
+	return &dedupeWindow{size: max(size, 1), order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+// seen reports whether the event is in the window
+func (window *dedupeWindow) seen(key string) bool {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	element, ok := window.keys[key]
+	if ok {
+		window.order.MoveToFront(element)
+	}
+	return ok
+}
+
+// add remembers the event, forgetting the least recently seen one if the window is full
+func (window *dedupeWindow) add(key string) {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	if element, ok := window.keys[key]; ok {
+		window.order.MoveToFront(element)
+		return
+	}
+	window.keys[key] = window.order.PushFront(key)
+	if window.order.Len() > window.size {
+		oldest := window.order.Back()
+		window.order.Remove(oldest)
+		delete(window.keys, oldest.Value.(string))
+	}
+}
+
+// claimEvent claims the event for this request. It returns store.ErrEventProcessed for
+// events which have been processed, by this or another instance, and
+// store.ErrEventInProgress for events another request is processing.
+func (server *BroadcastServer) claimEvent(ctx context.Context, key string) error {
+	if server.processed.seen(key) {
+		return store.ErrEventProcessed
+	}
+	now := time.Now()
+	err := server.withRetries(ctx, "dedupe claim", func(ctx context.Context) error {
+		return server.store.ClaimEvent(ctx, key, now, now.Add(-claimTimeout))
+	})
+	if errors.Is(err, store.ErrEventProcessed) {
+		server.processed.add(key)
+	}
+	return err
+}
+
+// completeEvent records that the claimed event's effects are visible so
+// redeliveries are dropped
+func (server *BroadcastServer) completeEvent(ctx context.Context, key string) {
+	server.processed.add(key)
+	// the effects are visible even if the request was cancelled
+	ctx = context.WithoutCancel(ctx)
+	err := server.withRetries(ctx, "dedupe complete", func(ctx context.Context) error {
+		return server.store.CompleteEvent(ctx, key, time.Now())
+	})
+	if err != nil {
+		// other instances may process a redelivery once the claim times out
+		server.log(ctx).Error("failed to mark event as processed", errAttr(err))
+	}
+}
+
+// releaseEvent removes the claim of an event which failed so its redelivery is processed
+func (server *BroadcastServer) releaseEvent(ctx context.Context, key string) {
+	err := server.store.ReleaseEvent(context.WithoutCancel(ctx), key)
+	if err != nil {
+		// the redelivery is processed once the claim times out
+		server.log(ctx).Error("failed to release event", errAttr(err))
+	}
+}
+
+// retryLater answers events which can't be processed yet, e.g. redeliveries of events
+// which are still being processed, so SNS backs off
+func retryLater(writer http.ResponseWriter, retryAfter int) {
+	writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
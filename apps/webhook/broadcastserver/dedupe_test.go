@@ -0,0 +1,156 @@
+package broadcastserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+func Test_dedupeKey(test *testing.T) {
+	test.Parallel()
+
+	timestamp := time.UnixMilli(1710168479955)
+	event := events.ParsedEvent{EmailId: "test-email", EventType: events.Delivery, Timestamp: timestamp, SnsMessageId: "test-sns-message"}
+	if key := dedupeKey(event); key != "sns:test-sns-message" {
+		test.Errorf("expected the sns message id to be the key but got %s", key)
+	}
+	event.SnsMessageId = ""
+	if key := dedupeKey(event); key != "ses:test-email:Delivery:1710168479955" {
+		test.Errorf("expected the ses message id, event type and timestamp to be the key but got %s", key)
+	}
+}
+
+func Test_dedupeWindow(test *testing.T) {
+	test.Parallel()
+
+	window := newDedupeWindow(2)
+	window.add("first")
+	window.add("second")
+	// seeing the first event makes the second the least recently seen
+	if !window.seen("first") {
+		test.Errorf("expected the first event to be seen")
+	}
+	window.add("third")
+	if window.seen("second") || !window.seen("first") || !window.seen("third") {
+		test.Errorf("expected the least recently seen event to be forgotten")
+	}
+}
+
+func Test_dedupe(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	donorId := "duplicated-donor"
+	receiptStore := store.NewMemoryStore()
+	receiptStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+	// the window only remembers the latest event so the store is checked too
+	tester := setupStoreTester(test, receiptStore, 30*time.Second, WithDedupe(time.Hour, 1))
+	defer tester.httpServer.Close()
+
+	client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId))
+	assertSuccess(test, err)
+	defer client.Close()
+	waitForSubscribers(test, ctx, tester.broadcastServer, campaignId, 1)
+
+	post := func(tester *BroadcastServerTester, msg string) {
+		test.Helper()
+		statusCode, err := tester.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		if statusCode != http.StatusAccepted {
+			test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+		}
+	}
+	delivery, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Delivery, snsArn))
+	assertSuccess(test, err)
+	open, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Open, snsArn))
+	assertSuccess(test, err)
+
+	// redeliveries are accepted without being broadcast again
+	post(tester, delivery)
+	post(tester, delivery)
+	post(tester, open)
+	post(tester, delivery)
+	for _, expectedStatus := range []string{events.StatusDelivered, events.StatusOpened} {
+		message, err := client.nextMessage(ctx)
+		assertSuccess(test, err)
+		if message.Status != expectedStatus {
+			test.Fatalf("expected %s but got %s", expectedStatus, message.Status)
+		}
+	}
+
+	// or by another instance, or after a restart
+	restarted := setupStoreTester(test, receiptStore, 30*time.Second)
+	defer restarted.httpServer.Close()
+	post(restarted, delivery)
+	post(restarted, open)
+
+	history, err := receiptStore.History(ctx, campaignId, donorId)
+	assertSuccess(test, err)
+	if len(history) != 2 {
+		test.Errorf("expected each event to be recorded once but got %+v", history)
+	}
+}
+
+func Test_dedupeRedeliveries(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	flaky := &flakyStore{MemoryStore: store.NewMemoryStore()}
+	flaky.MemoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "failed-donor", Status: events.StatusNotSent})
+	tester := setupStoreTester(test, flaky, 30*time.Second, WithWriteRetries(1, time.Millisecond))
+	defer tester.close()
+
+	// a failed event is processed when SNS redelivers it
+	msg, err := signBody(generateResponseBody(campaignId, "failed-donor", "email-failed-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	flaky.failures.Store(1)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusInternalServerError {
+		test.Fatalf("expected %d but got %d", http.StatusInternalServerError, statusCode)
+	}
+	statusCode, err = tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted {
+		test.Fatalf("expected the redelivery to be processed but got %d", statusCode)
+	}
+	receipt, err := flaky.Receipt(ctx, campaignId, "failed-donor")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusDelivered {
+		test.Errorf("expected status %s but got %s", events.StatusDelivered, receipt.Status)
+	}
+
+	// a redelivery while the event is being processed is retried later
+	blocking := newBlockingStore()
+	blocking.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "slow-donor", Status: events.StatusNotSent})
+	slow := setupStoreTester(test, blocking, 30*time.Second)
+	defer slow.close()
+	msg, err = signBody(generateResponseBody(campaignId, "slow-donor", "email-slow-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	published := make(chan int, 1)
+	go func() {
+		statusCode, _ := slow.postPublish(ctx, msg)
+		published <- statusCode
+	}()
+	<-blocking.entered
+
+	statusCode, err = slow.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusServiceUnavailable {
+		test.Errorf("expected %d for a concurrent redelivery but got %d", http.StatusServiceUnavailable, statusCode)
+	}
+	close(blocking.release)
+	if statusCode := <-published; statusCode != http.StatusAccepted {
+		test.Errorf("expected the first delivery to be processed but got %d", statusCode)
+	}
+}
@@ -0,0 +1,61 @@
+package broadcastserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+// WithApiToken sets the bearer token required by the read endpoints, e.g. the
+// receipt history. The endpoints reject every request if no token is set.
+func WithApiToken(token string) Option {
+	return func(server *BroadcastServer) {
+		server.apiToken = token
+	}
+}
+
+// requireToken only calls the handler if the request carries the bearer token
+func requireToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		reqToken, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+// WriteEventHistory records the event in the receipt's history.
+// Every event is recorded, even those which didn't change the receipt's status.
+func (server *BroadcastServer) WriteEventHistory(ctx context.Context, event events.ParsedEvent) error {
+	err := server.store.AppendHistory(ctx, event)
+	if err != nil {
+		server.log(ctx).Error("failed to write the event history", campaignAttr(event.CampaignId), donorAttr(event.DonorId), errAttr(err))
+		return err
+	}
+	return nil
+}
+
+// HistoryHandler responds with the donor's events in a campaign
+func (server *BroadcastServer) HistoryHandler(writer http.ResponseWriter, req *http.Request) {
+	campaignId := req.PathValue("campaignId")
+	donorId := req.PathValue("donorId")
+
+	history, err := server.store.History(req.Context(), campaignId, donorId)
+	if err != nil {
+		server.log(req.Context()).Error("failed to read the event history", campaignAttr(campaignId), donorAttr(donorId), errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(writer, http.StatusOK, struct {
+		CampaignId string               `json:"campaignId"`
+		DonorId    string               `json:"donorId"`
+		Events     []store.HistoryEvent `json:"events"`
+	}{CampaignId: campaignId, DonorId: donorId, Events: history})
+}
@@ -0,0 +1,117 @@
+package broadcastserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+func (server *BroadcastServerTester) getJson(ctx context.Context, path, token string, response any) (int, error) {
+	return server.requestJson(ctx, http.MethodGet, path, token, nil, response)
+}
+
+// requestJson sends the body as json and decodes successful responses into response
+func (server *BroadcastServerTester) requestJson(ctx context.Context, method, path, token string, body, response any) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		rawBody, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(rawBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, server.url+path, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || response == nil {
+		return res.StatusCode, nil
+	}
+	return res.StatusCode, json.NewDecoder(res.Body).Decode(response)
+}
+
+func historyPath(campaignId, donorId string) string {
+	return fmt.Sprintf("/campaigns/%s/donors/%s/events", url.PathEscape(campaignId), url.PathEscape(donorId))
+}
+
+func Test_history(test *testing.T) {
+	test.Parallel()
+
+	tester := setupBroadcastServerTester(test, 30*time.Second)
+	defer tester.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	donorId := randAlphaNumericString(10)
+	emailId := randAlphaNumericString(10)
+	err := tester.generateDbEntriesForEvent(campaignId, donorId, emailId)
+	assertSuccess(test, err)
+	otherDonorId := randAlphaNumericString(10)
+	otherEmailId := randAlphaNumericString(10)
+	err = tester.generateDbEntriesForEvent(campaignId, otherDonorId, otherEmailId)
+	assertSuccess(test, err)
+
+	// the late send is still recorded, ordered by when SES sent the email
+	for _, eventType := range []string{events.Delivery, events.Send, events.Open, events.Click} {
+		err = tester.publishEvent(ctx, campaignId, donorId, emailId, eventType)
+		assertSuccess(test, err)
+	}
+	err = tester.publishEvent(ctx, campaignId, otherDonorId, otherEmailId, events.Send)
+	assertSuccess(test, err)
+
+	var history struct {
+		Events []store.HistoryEvent `json:"events"`
+	}
+	statusCode, err := tester.getJson(ctx, historyPath(campaignId, donorId), testApiToken, &history)
+	assertSuccess(test, err)
+	if statusCode != http.StatusOK {
+		test.Fatalf("expected %d but got %d", http.StatusOK, statusCode)
+	}
+
+	expectedTypes := []events.EventType{events.Send, events.Delivery, events.Open, events.Click}
+	if len(history.Events) != len(expectedTypes) {
+		test.Fatalf("expected %d events but got %+v", len(expectedTypes), history.Events)
+	}
+	for i, event := range history.Events {
+		if event.EventType != expectedTypes[i] || event.EmailId != emailId {
+			test.Errorf("event %d: expected %s for email %s but got %+v", i, expectedTypes[i], emailId, event)
+		}
+	}
+
+	var click events.ClickObject
+	err = json.Unmarshal(history.Events[3].Detail, &click)
+	assertSuccess(test, err)
+	if click.Link != "https://donationreceipt.online" || click.UserAgent != "test-user-agent" {
+		test.Errorf("unexpected click detail %s", history.Events[3].Detail)
+	}
+
+	statusCode, err = tester.getJson(ctx, historyPath(campaignId, donorId), "", nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusUnauthorized {
+		test.Errorf("expected %d without a token but got %d", http.StatusUnauthorized, statusCode)
+	}
+	statusCode, err = tester.getJson(ctx, historyPath(campaignId, donorId), "wrong-token", nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusUnauthorized {
+		test.Errorf("expected %d with the wrong token but got %d", http.StatusUnauthorized, statusCode)
+	}
+}
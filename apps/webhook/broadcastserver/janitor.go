@@ -0,0 +1,90 @@
+package broadcastserver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// idleEvicter is implemented by brokers which keep every campaign's events in memory,
+// the redis broker's buffers expire by themselves
+type idleEvicter interface {
+	EvictIdle(now time.Time, subscribed func(campaignId string) bool) int
+}
+
+// StartJanitor removes idle subscriber groups and broker streams every interval
+// until the context is cancelled
+func (server *BroadcastServer) StartJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				groups, streams := server.CollectGarbage(time.Now())
+				if groups > 0 || streams > 0 {
+					server.logger.Debug("janitor evicted idle campaigns", slog.Int("subscriber_groups", groups), slog.Int("broker_streams", streams))
+				}
+			}
+		}
+	}()
+}
+
+// CollectGarbage removes the subscriber groups without subscribers and, if the broker
+// keeps events in memory, the streams whose events have expired and which aren't
+// subscribed to. It returns how many groups and streams were removed.
+func (server *BroadcastServer) CollectGarbage(now time.Time) (int, int) {
+	groups := 0
+	server.subscriberGroupLock.Lock()
+	for campaignId, subGroup := range server.subscriberGroupMap {
+		subGroup.subscribersLock.Lock()
+		empty := len(subGroup.subscribers) == 0
+		subGroup.subscribersLock.Unlock()
+		if empty {
+			delete(server.subscriberGroupMap, campaignId)
+			groups++
+		}
+	}
+	server.subscriberGroupLock.Unlock()
+
+	streams := 0
+	if evicter, ok := server.broker.(idleEvicter); ok {
+		streams = evicter.EvictIdle(now, server.subscribed)
+	}
+	return groups, streams
+}
+
+// subscribed reports whether the campaign has subscribers on this instance
+func (server *BroadcastServer) subscribed(campaignId string) bool {
+	server.subscriberGroupLock.Lock()
+	defer server.subscriberGroupLock.Unlock()
+	subGroup, ok := server.subscriberGroupMap[campaignId]
+	if !ok {
+		return false
+	}
+	subGroup.subscribersLock.Lock()
+	defer subGroup.subscribersLock.Unlock()
+	return len(subGroup.subscribers) > 0
+}
+
+// SubscriberGroups returns the number of campaigns with a subscriber group on this instance
+func (server *BroadcastServer) SubscriberGroups() int {
+	server.subscriberGroupLock.Lock()
+	defer server.subscriberGroupLock.Unlock()
+	return len(server.subscriberGroupMap)
+}
+
+// Subscribers returns the number of subscribers to the campaign on this instance
+func (server *BroadcastServer) Subscribers(campaignId string) int {
+	server.subscriberGroupLock.Lock()
+	defer server.subscriberGroupLock.Unlock()
+	subGroup, ok := server.subscriberGroupMap[campaignId]
+	if !ok {
+		return 0
+	}
+	subGroup.subscribersLock.Lock()
+	defer subGroup.subscribersLock.Unlock()
+	return len(subGroup.subscribers)
+}
@@ -0,0 +1,117 @@
+package broadcastserver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+// waitForSubscribers returns once the campaign has n subscribers, subscribers are removed
+// after their connection's handler returns
+func waitForSubscribers(test *testing.T, ctx context.Context, server *BroadcastServer, campaignId string, n int) {
+	test.Helper()
+	for server.Subscribers(campaignId) != n {
+		select {
+		case <-ctx.Done():
+			test.Fatalf("expected %d subscribers to %s but got %d", n, campaignId, server.Subscribers(campaignId))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func Test_collectGarbage(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	maxEventAge := 100 * time.Millisecond
+	memoryStore := store.NewMemoryStore()
+	broker := NewMemoryBroker(maxEventAge)
+	tester := setupStoreTester(test, memoryStore, maxEventAge, WithBroker(broker))
+	defer tester.close()
+	server := tester.broadcastServer
+
+	publish := func(campaignId, donorId string) {
+		memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		err := tester.publishEvent(ctx, campaignId, donorId, "email-"+donorId, events.Send)
+		assertSuccess(test, err)
+	}
+
+	// every round subscribes to new campaigns, the groups and streams of the previous
+	// rounds are evicted so they don't grow with every campaign ever seen
+	nCampaigns := 20
+	for round := 0; round < 3; round++ {
+		for i := 0; i < nCampaigns; i++ {
+			campaignId := fmt.Sprintf("campaign-%d-%d", round, i)
+			client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId))
+			assertSuccess(test, err)
+			waitForSubscribers(test, ctx, server, campaignId, 1)
+			publish(campaignId, "test-donor")
+			_, err = client.nextMessage(ctx)
+			assertSuccess(test, err)
+			client.Close()
+			waitForSubscribers(test, ctx, server, campaignId, 0)
+		}
+		if groups := server.SubscriberGroups(); groups != nCampaigns {
+			test.Fatalf("round %d: expected %d groups before collecting but got %d", round, nCampaigns, groups)
+		}
+
+		groups, streams := server.CollectGarbage(time.Now().Add(maxEventAge))
+		if groups != nCampaigns || streams != nCampaigns || server.SubscriberGroups() != 0 || broker.Streams() != 0 {
+			test.Fatalf("round %d: expected every group and stream to be evicted but evicted %d and %d and kept %d and %d",
+				round, groups, streams, server.SubscriberGroups(), broker.Streams())
+		}
+	}
+
+	// groups with subscribers and streams with unexpired events are kept
+	subscribed, err := newClient(ctx, tester.subscribeUrl("/subscribe/", "subscribed-campaign"))
+	assertSuccess(test, err)
+	defer subscribed.Close()
+	waitForSubscribers(test, ctx, server, "subscribed-campaign", 1)
+	publish("subscribed-campaign", "test-donor")
+	publish("unsubscribed-campaign", "first-donor")
+	publish("unsubscribed-campaign", "second-donor")
+
+	groups, streams := server.CollectGarbage(time.Now())
+	if groups != 0 || streams != 0 || server.Subscribers("subscribed-campaign") != 1 || broker.Streams() != 2 {
+		test.Errorf("expected nothing to be evicted but evicted %d and %d", groups, streams)
+	}
+	_, streams = server.CollectGarbage(time.Now().Add(maxEventAge))
+	if streams != 1 || broker.Streams() != 1 {
+		test.Errorf("expected only the unsubscribed stream to be evicted but evicted %d", streams)
+	}
+
+	// the subscriber still receives events after collecting
+	first, err := subscribed.nextMessage(ctx)
+	assertSuccess(test, err)
+	publish("subscribed-campaign", "another-donor")
+	message, err := subscribed.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.DonorId != "another-donor" || message.Seq != first.Seq+1 {
+		test.Errorf("expected the event published after collecting but got %+v", message)
+	}
+
+	// subscribers resuming an evicted stream resync instead of missing events,
+	// the second event was evicted before it could be replayed
+	publish("unsubscribed-campaign", "another-donor")
+	// both streams were created from the same floor so the first events have the same seq
+	since := first.Seq
+	resumed, err := newClient(ctx, tester.subscribeUrl("/subscribe/", "unsubscribed-campaign")+fmt.Sprintf("&since=%d", since))
+	assertSuccess(test, err)
+	defer resumed.Close()
+	message, err = resumed.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Type != messageResync {
+		test.Errorf("expected a resync after the stream was evicted but got %+v", message)
+	}
+	message, err = resumed.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.DonorId != "another-donor" || message.Seq <= since+1 {
+		test.Errorf("expected the event published after eviction but got %+v", message)
+	}
+}
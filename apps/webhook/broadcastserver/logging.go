@@ -0,0 +1,156 @@
+package broadcastserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// WithLogger sets the logger, by default slog.Default() is used.
+// Wrap its handler with NewRedactingHandler to mask donors' details.
+func WithLogger(logger *slog.Logger) Option {
+	return func(server *BroadcastServer) {
+		server.logger = logger
+	}
+}
+
+// requestIdHeader is read from requests, e.g. when set by a load balancer,
+// and set on every response
+const requestIdHeader = "X-Request-Id"
+
+// maxRequestIdLength stops clients from filling the logs with their request ids
+const maxRequestIdLength = 128
+
+type loggerKey struct{}
+
+// withRequestId gives each request an id, which is added to everything logged for it
+func (server *BroadcastServer) withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(requestIdHeader)
+		if requestId == "" || len(requestId) > maxRequestIdLength {
+			requestId = uuid.NewString()
+		}
+		writer.Header().Set(requestIdHeader, requestId)
+		logger := server.logger.With(slog.String("request_id", requestId))
+		next.ServeHTTP(writer, req.WithContext(contextWithLogger(req.Context(), logger)))
+	})
+}
+
+// contextWithLogger returns a ctx whose work is logged with the logger
+func contextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// log returns the logger of the request ctx belongs to, or the server's logger
+// for background work
+func (server *BroadcastServer) log(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return server.logger
+}
+
+// attributes logged with events
+func campaignAttr(campaignId string) slog.Attr {
+	return slog.String("campaign_id", campaignId)
+}
+
+func donorAttr(donorId string) slog.Attr {
+	return slog.String("donor_id", donorId)
+}
+
+func errAttr(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+)`)
+	ipv4Pattern  = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// candidates are checked with net.ParseIP so times like 14:47:59 aren't masked
+	ipv6Pattern = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`)
+)
+
+// Redact masks email addresses, keeping their domain, and ip addresses
+func Redact(value string) string {
+	value = emailPattern.ReplaceAllString(value, "***@$1")
+	value = ipv4Pattern.ReplaceAllStringFunc(value, func(candidate string) string {
+		if net.ParseIP(candidate) == nil {
+			return candidate
+		}
+		return "[ip]"
+	})
+	return ipv6Pattern.ReplaceAllStringFunc(value, func(candidate string) string {
+		if net.ParseIP(candidate) == nil {
+			return candidate
+		}
+		return "[ip]"
+	})
+}
+
+// redactingHandler masks email and ip addresses in messages and attributes
+// before passing records on
+type redactingHandler struct {
+	next slog.Handler
+}
+
+// NewRedactingHandler wraps a handler so donors' email addresses and clients' ip
+// addresses aren't logged, see Redact
+func NewRedactingHandler(next slog.Handler) slog.Handler {
+	return &redactingHandler{next: next}
+}
+
+func (handler *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return handler.next.Enabled(ctx, level)
+}
+
+func (handler *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return handler.next.Handle(ctx, redacted)
+}
+
+func (handler *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, redactAttr(attr))
+	}
+	return &redactingHandler{next: handler.next.WithAttrs(redacted)}
+}
+
+func (handler *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: handler.next.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, 0, len(group))
+		for _, groupAttr := range group {
+			redacted = append(redacted, redactAttr(groupAttr))
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		// anything else could be marshalled with an address in it
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, Redact(v.Error()))
+		case []byte:
+			return slog.String(attr.Key, Redact(string(v)))
+		default:
+			return slog.String(attr.Key, Redact(fmt.Sprint(v)))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
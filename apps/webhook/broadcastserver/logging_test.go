@@ -0,0 +1,141 @@
+package broadcastserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"webhook/store"
+)
+
+// logBuffer collects json logs written by any goroutine
+type logBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (logs *logBuffer) Write(p []byte) (int, error) {
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+	return logs.buffer.Write(p)
+}
+
+// records returns every record logged so far
+func (logs *logBuffer) records(test *testing.T) []map[string]any {
+	test.Helper()
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.buffer.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		err := json.Unmarshal([]byte(line), &record)
+		assertSuccess(test, err)
+		records = append(records, record)
+	}
+	return records
+}
+
+func Test_redact(test *testing.T) {
+	test.Parallel()
+
+	for _, testCase := range []struct {
+		value    string
+		expected string
+	}{
+		{"bounced for jane.doe+receipts@example.co.uk", "bounced for ***@example.co.uk"},
+		{"from 203.0.113.7:443", "from [ip]:443"},
+		{"from 2001:db8::1 and ::ffff:10.0.0.1", "from [ip] and ::ffff:[ip]"},
+		{"at 2024-03-11T14:47:59.955Z", "at 2024-03-11T14:47:59.955Z"},
+		{"version 1.2.3.4567 of 1f0e8a4c-9b1d-4c5e-8f3a-2b6d7e9c0a1b", "version 1.2.3.4567 of 1f0e8a4c-9b1d-4c5e-8f3a-2b6d7e9c0a1b"},
+	} {
+		if redacted := Redact(testCase.value); redacted != testCase.expected {
+			test.Errorf("expected %q to be redacted as %q but got %q", testCase.value, testCase.expected, redacted)
+		}
+	}
+}
+
+func Test_redactingHandler(test *testing.T) {
+	test.Parallel()
+
+	logs := &logBuffer{}
+	logger := slog.New(NewRedactingHandler(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logger.
+		With(slog.String("client", "198.51.100.23")).
+		WithGroup("event").
+		Info(
+			"complaint from donor@example.com",
+			slog.Any("error", errors.New("failed to suppress donor@example.com")),
+			slog.Group("mail", slog.String("source", "sender@example.org")),
+			slog.Any("destination", []string{"donor@example.com"}),
+			slog.Int("attempt", 2),
+		)
+
+	records := logs.records(test)
+	if len(records) != 1 {
+		test.Fatalf("expected 1 record but got %d", len(records))
+	}
+	raw, err := json.Marshal(records[0])
+	assertSuccess(test, err)
+	for _, leaked := range []string{"donor@", "sender@", "198.51.100.23"} {
+		if strings.Contains(string(raw), leaked) {
+			test.Errorf("expected %s to be redacted from %s", leaked, raw)
+		}
+	}
+	event, _ := records[0]["event"].(map[string]any)
+	if records[0]["msg"] != "complaint from ***@example.com" || event["attempt"] != float64(2) {
+		test.Errorf("unexpected record %s", raw)
+	}
+}
+
+func Test_requestIds(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	logs := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(logs, nil))
+	tester := setupStoreTester(test, store.NewMemoryStore(), 30*time.Second, WithLogger(logger))
+	defer tester.close()
+
+	post := func(requestId string) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, tester.url+"/publish", strings.NewReader("not an sns envelope"))
+		assertSuccess(test, err)
+		if requestId != "" {
+			req.Header.Set(requestIdHeader, requestId)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assertSuccess(test, err)
+		res.Body.Close()
+		return res
+	}
+
+	// the caller's request id is kept and one is generated otherwise
+	if res := post("test-request"); res.Header.Get(requestIdHeader) != "test-request" {
+		test.Errorf("expected the request id to be echoed but got %q", res.Header.Get(requestIdHeader))
+	}
+	generated := post("").Header.Get(requestIdHeader)
+	if generated == "" {
+		test.Errorf("expected a request id to be generated")
+	}
+
+	var requestIds []any
+	for _, record := range logs.records(test) {
+		if record["msg"] == "failed to parse sns envelope" {
+			requestIds = append(requestIds, record["request_id"])
+		}
+	}
+	if len(requestIds) != 2 || requestIds[0] != "test-request" || requestIds[1] != generated {
+		test.Errorf("expected the errors to be logged with their request ids but got %v", requestIds)
+	}
+}
@@ -0,0 +1,157 @@
+package broadcastserver
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// outcomes of received events
+const (
+	outcomeParsed  = "parsed"
+	outcomeInvalid = "invalid"
+	// redeliveries of events which were or are being processed
+	outcomeDuplicate = "duplicate"
+)
+
+// metrics are registered on the server's own registry so several servers,
+// e.g. in tests, don't collide
+type metrics struct {
+	registry            *prometheus.Registry
+	eventsReceived      *prometheus.CounterVec
+	dbWriteDuration     *prometheus.HistogramVec
+	dbWriteErrors       *prometheus.CounterVec
+	slowDisconnects     prometheus.Counter
+	replayEvents        prometheus.Histogram
+	broadcastLag        prometheus.Histogram
+	subscribers         prometheus.GaugeFunc
+	subscriberGroups    prometheus.GaugeFunc
+	ignoredTransitions  prometheus.CounterFunc
+	expiredPending      prometheus.CounterFunc
+	queuedEvents        prometheus.GaugeFunc
+	deadLetters         *prometheus.CounterVec
+	archiveErrors       prometheus.Counter
+	archiveFileErrors   prometheus.Counter
+	archiveDroppedFiles prometheus.Counter
+}
+
+func newMetrics(server *BroadcastServer) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		eventsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_events_received_total",
+			Help: "SES events received from SNS by event type and outcome.",
+		}, []string{"type", "outcome"}),
+		dbWriteDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "webhook_db_write_duration_seconds",
+			Help:    "Duration of each attempt to write an event to the db.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		dbWriteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_db_write_errors_total",
+			Help: "Failed attempts to write an event to the db.",
+		}, []string{"operation"}),
+		slowDisconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_slow_consumer_disconnects_total",
+			Help: "Subscribers closed for not keeping up with events.",
+		}),
+		replayEvents: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "webhook_replay_events",
+			Help:    "Buffered events replayed to each new subscription.",
+			Buckets: []float64{0, 1, 5, 10, 50, 100, 500, 1000},
+		}),
+		broadcastLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "webhook_broadcast_lag_seconds",
+			Help:    "Time from the SES event's timestamp to it being published to subscribers.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+		}),
+		subscribers: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "webhook_subscribers",
+			Help: "Campaign subscriptions connected to this instance.",
+		}, func() float64 { return float64(server.totalSubscribers()) }),
+		subscriberGroups: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "webhook_subscriber_groups",
+			Help: "Campaigns with a subscriber group on this instance.",
+		}, func() float64 { return float64(server.SubscriberGroups()) }),
+		ignoredTransitions: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "webhook_ignored_transitions_total",
+			Help: "Events ignored because they would move a receipt's status backwards.",
+		}, func() float64 { return float64(server.IgnoredTransitions()) }),
+		expiredPending: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "webhook_expired_pending_events_total",
+			Help: "Pending events which expired before their receipt was inserted.",
+		}, func() float64 { return float64(server.ExpiredPendingEvents()) }),
+		queuedEvents: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "webhook_queued_events",
+			Help: "Accepted events waiting for a worker on this instance.",
+		}, func() float64 { return float64(server.QueuedEvents()) }),
+		deadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_dead_letters_total",
+			Help: "Events recorded as dead letters by failure reason.",
+		}, []string{"reason"}),
+		archiveErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_archive_errors_total",
+			Help: "SNS messages which failed to be archived.",
+		}),
+		archiveFileErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_archive_file_errors_total",
+			Help: "Archive files which failed to be completed, uploaded or kept.",
+		}),
+		archiveDroppedFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_archive_dropped_files_total",
+			Help: "Completed archive files dropped before they were stored, their records are lost.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.eventsReceived,
+		m.dbWriteDuration,
+		m.dbWriteErrors,
+		m.slowDisconnects,
+		m.replayEvents,
+		m.broadcastLag,
+		m.subscribers,
+		m.subscriberGroups,
+		m.ignoredTransitions,
+		m.expiredPending,
+		m.queuedEvents,
+		m.deadLetters,
+		m.archiveErrors,
+		m.archiveFileErrors,
+		m.archiveDroppedFiles,
+	)
+	return m
+}
+
+// observeWrite records an attempt to write to the db, what is as passed to withRetries
+func (m *metrics) observeWrite(what string, duration time.Duration, err error) {
+	operation := strings.ReplaceAll(what, " ", "_")
+	m.dbWriteDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if err != nil && retryable(err) {
+		m.dbWriteErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// MetricsHandler serves the server's metrics in the prometheus text format. It isn't
+// routed by ServeHTTP so it can be served on a listener which isn't public.
+func (server *BroadcastServer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(server.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// totalSubscribers returns the number of campaign subscriptions on this instance
+func (server *BroadcastServer) totalSubscribers() int {
+	server.subscriberGroupLock.Lock()
+	defer server.subscriberGroupLock.Unlock()
+	total := 0
+	for _, subGroup := range server.subscriberGroupMap {
+		subGroup.subscribersLock.Lock()
+		total += len(subGroup.subscribers)
+		subGroup.subscribersLock.Unlock()
+	}
+	return total
+}
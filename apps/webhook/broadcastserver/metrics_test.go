@@ -0,0 +1,97 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+func Test_metrics(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second)
+	defer tester.close()
+	server := tester.broadcastServer
+
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusNotSent})
+	msg, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+	}
+
+	envelope := events.SnsEventStruct{
+		Type:             "Notification",
+		MessageId:        "bad-payload",
+		TopicArn:         snsArn,
+		Message:          json.RawMessage(`"not an ses event"`),
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: "1",
+	}
+	msg, err = signEnvelope(&envelope)
+	assertSuccess(test, err)
+	_, err = tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+
+	if received := testutil.ToFloat64(server.metrics.eventsReceived.WithLabelValues(events.Delivery, outcomeParsed)); received != 1 {
+		test.Errorf("expected 1 parsed delivery but got %v", received)
+	}
+	if received := testutil.ToFloat64(server.metrics.eventsReceived.WithLabelValues("unknown", outcomeInvalid)); received != 1 {
+		test.Errorf("expected 1 invalid event but got %v", received)
+	}
+
+	// the subscriber is replayed the buffered event
+	client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId))
+	assertSuccess(test, err)
+	defer client.Close()
+	_, err = client.nextMessage(ctx)
+	assertSuccess(test, err)
+
+	// a subscriber which can't take any events is closed as too slow, it was also replayed the event
+	slow := &subscriber{campaignId: campaignId, events: make(chan SubscriberGroupEvent), close: func(websocket.StatusCode, string) {}}
+	_, err = server.AddSubscriber(ctx, slow, 0, false)
+	assertSuccess(test, err)
+	server.deliverEvent(SubscriberGroupEvent{seq: 2, campaignId: campaignId, donorId: "test-donor", status: events.StatusOpened})
+	if disconnects := testutil.ToFloat64(server.metrics.slowDisconnects); disconnects != 1 {
+		test.Errorf("expected 1 slow consumer disconnect but got %v", disconnects)
+	}
+
+	metricsServer := httptest.NewServer(server.MetricsHandler())
+	defer metricsServer.Close()
+	res, err := http.Get(metricsServer.URL)
+	assertSuccess(test, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assertSuccess(test, err)
+	for _, expected := range []string{
+		`webhook_events_received_total{outcome="parsed",type="Delivery"} 1`,
+		`webhook_db_write_duration_seconds_count{operation="receipt_status"} 1`,
+		`webhook_subscribers 2`,
+		`webhook_subscriber_groups 1`,
+		`webhook_replay_events_sum 2`,
+		`webhook_broadcast_lag_seconds_count 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			test.Errorf("expected the metrics to contain %s", expected)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPendingTTL = 15 * time.Minute
+	// maxReconcileBatch is the most pending events reapplied in one pass
+	maxReconcileBatch = 100
+)
+
+// pendingStats is reported by the pending endpoint
+type pendingStats struct {
+	reapplied atomic.Int64
+	expired   atomic.Int64
+}
+
+// WithPendingTTL sets how long events whose receipt doesn't exist yet are kept
+// before they expire. Defaults to 15 minutes.
+func WithPendingTTL(ttl time.Duration) Option {
+	return func(server *BroadcastServer) {
+		server.pendingTTL = ttl
+	}
+}
+
+// parkEvent stores an event which arrived before its receipt so the reconciler can reapply it
+func (server *BroadcastServer) parkEvent(ctx context.Context, event events.ParsedEvent) error {
+	now := time.Now()
+	pendingEvent := store.PendingEvent{
+		Id:           uuid.New().String(),
+		CampaignId:   event.CampaignId,
+		DonorId:      event.DonorId,
+		SnsMessageId: event.SnsMessageId,
+		Raw:          event.Raw,
+		ExpiresAt:    now.Add(server.pendingTTL),
+		CreatedAt:    now,
+	}
+	err := server.withRetries(ctx, "pending event", func(ctx context.Context) error {
+		return server.store.ParkPendingEvent(ctx, pendingEvent)
+	})
+	if err != nil {
+		return err
+	}
+	server.log(ctx).Info("parked event until its receipt exists", campaignAttr(event.CampaignId), donorAttr(event.DonorId))
+	return nil
+}
+
+// StartReconciler reapplies pending events every interval until the context is cancelled
+func (server *BroadcastServer) StartReconciler(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := server.ReconcilePending(ctx); err != nil && ctx.Err() == nil && !errors.Is(err, ErrShuttingDown) {
+					server.logger.Error("failed to reconcile pending events", errAttr(err))
+				}
+			}
+		}
+	}()
+}
+
+// ReconcilePending expires old pending and processed events and then reapplies those whose receipt
+// now exists, returning how many were reapplied. Events whose receipt still doesn't
+// exist are left for the next pass.
+func (server *BroadcastServer) ReconcilePending(ctx context.Context) (int, error) {
+	if err := server.beginWrite(); err != nil {
+		return 0, err
+	}
+	defer server.endWrite()
+	now := time.Now()
+	expired, err := server.store.ExpirePendingEvents(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	if expired > 0 {
+		total := server.pendingStats.expired.Add(expired)
+		server.log(ctx).Error("pending events expired before their receipt existed", slog.Int64("expired", expired), slog.Int64("total_expired", total))
+	}
+
+	// redeliveries of events older than the dedupe ttl are processed again
+	if _, err := server.store.ExpireProcessedEvents(ctx, now.Add(-server.dedupeTTL)); err != nil {
+		return 0, err
+	}
+
+	pending, err := server.store.PendingEvents(ctx, now, maxReconcileBatch)
+	if err != nil {
+		return 0, err
+	}
+	reapplied := 0
+	for _, pendingEvent := range pending {
+		parsedEvent, err := events.ParseSnsEvent(pendingEvent.Raw)
+		if err != nil {
+			// it was parsed before it was parked so this shouldn't happen
+			server.log(ctx).Error("moving pending event which failed to parse to the dead letters", slog.String("pending_event_id", pendingEvent.Id), errAttr(err))
+			if err := server.deadLetter(ctx, pendingEvent.SnsMessageId, store.DeadLetterParse, pendingEvent.Raw, err); err != nil {
+				return reapplied, err
+			}
+			if err := server.store.DeletePendingEvent(ctx, pendingEvent.Id); err != nil {
+				return reapplied, err
+			}
+			continue
+		}
+
+		err = server.persistEvent(ctx, parsedEvent)
+		if errors.Is(err, store.ErrReceiptNotFound) {
+			continue
+		}
+		if err != nil && !errors.Is(err, store.ErrTransitionIgnored) {
+			return reapplied, err
+		}
+		if err == nil {
+			server.broadcastEvent(ctx, parsedEvent)
+		}
+		if err := server.store.DeletePendingEvent(ctx, pendingEvent.Id); err != nil {
+			return reapplied, err
+		}
+		reapplied++
+		server.pendingStats.reapplied.Add(1)
+	}
+	return reapplied, nil
+}
+
+// ExpiredPendingEvents returns the number of pending events which expired
+// before their receipt was inserted
+func (server *BroadcastServer) ExpiredPendingEvents() int64 {
+	return server.pendingStats.expired.Load()
+}
+
+// PendingHandler responds with the number of pending events and what happened to
+// those which are no longer pending
+func (server *BroadcastServer) PendingHandler(writer http.ResponseWriter, req *http.Request) {
+	count, err := server.store.CountPendingEvents(req.Context())
+	if err != nil {
+		server.log(req.Context()).Error("failed to count pending events", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJson(writer, http.StatusOK, struct {
+		Pending   int64 `json:"pending"`
+		Reapplied int64 `json:"reapplied"`
+		Expired   int64 `json:"expired"`
+	}{
+		Pending:   count,
+		Reapplied: server.pendingStats.reapplied.Load(),
+		Expired:   server.pendingStats.expired.Load(),
+	})
+}
@@ -0,0 +1,113 @@
+package broadcastserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+func Test_pendingEvents(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second)
+	defer tester.close()
+
+	campaignId := "test-campaign"
+	subscribeUrl := tester.subscribeUrl("/subscribe/", campaignId)
+	client, err := newClient(ctx, subscribeUrl)
+	assertSuccess(test, err)
+	defer client.Close()
+
+	// the send beats the receipt's insert
+	err = tester.publishEvent(ctx, campaignId, "early-donor", "early-email", events.Send)
+	assertSuccess(test, err)
+	_, err = memoryStore.Receipt(ctx, campaignId, "early-donor")
+	if err != store.ErrReceiptNotFound {
+		test.Fatalf("expected the receipt not to exist but got %v", err)
+	}
+
+	// nothing is reapplied until the receipt exists
+	reapplied, err := tester.broadcastServer.ReconcilePending(ctx)
+	assertSuccess(test, err)
+	if reapplied != 0 {
+		test.Fatalf("expected nothing to be reapplied but %d events were", reapplied)
+	}
+
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "early-donor", Status: events.StatusNotSent})
+	reapplied, err = tester.broadcastServer.ReconcilePending(ctx)
+	assertSuccess(test, err)
+	if reapplied != 1 {
+		test.Fatalf("expected 1 event to be reapplied but %d were", reapplied)
+	}
+	receipt, err := memoryStore.Receipt(ctx, campaignId, "early-donor")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusSent || receipt.EmailId != "early-email" {
+		test.Errorf("unexpected receipt after reconciling %+v", receipt)
+	}
+	history, err := memoryStore.History(ctx, campaignId, "early-donor")
+	assertSuccess(test, err)
+	if len(history) != 1 || history[0].EventType != events.Send {
+		test.Errorf("expected the send in the history but got %+v", history)
+	}
+
+	// subscribers are sent reapplied events
+	message, err := client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.DonorId != "early-donor" || message.Status != events.StatusSent {
+		test.Errorf("unexpected message %+v", message)
+	}
+
+	var stats struct {
+		Pending   int64 `json:"pending"`
+		Reapplied int64 `json:"reapplied"`
+		Expired   int64 `json:"expired"`
+	}
+	statusCode, err := tester.getJson(ctx, "/pending", testAdminToken, &stats)
+	assertSuccess(test, err)
+	if statusCode != http.StatusOK || stats.Pending != 0 || stats.Reapplied != 1 || stats.Expired != 0 {
+		test.Errorf("unexpected pending stats %d %+v", statusCode, stats)
+	}
+}
+
+func Test_pendingEventsExpire(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second, WithPendingTTL(time.Millisecond))
+	defer tester.close()
+
+	err := tester.publishEvent(ctx, "test-campaign", "orphan-donor", "orphan-email", events.Send)
+	assertSuccess(test, err)
+	count, err := memoryStore.CountPendingEvents(ctx)
+	assertSuccess(test, err)
+	if count != 1 {
+		test.Fatalf("expected 1 pending event but got %d", count)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: "test-campaign", DonorId: "orphan-donor", Status: events.StatusNotSent})
+	reapplied, err := tester.broadcastServer.ReconcilePending(ctx)
+	assertSuccess(test, err)
+	if reapplied != 0 {
+		test.Errorf("expected the expired event not to be reapplied but %d were", reapplied)
+	}
+	if expired := tester.broadcastServer.ExpiredPendingEvents(); expired != 1 {
+		test.Errorf("expected 1 expired event but got %d", expired)
+	}
+	count, err = memoryStore.CountPendingEvents(ctx)
+	assertSuccess(test, err)
+	if count != 0 {
+		test.Errorf("expected no pending events but got %d", count)
+	}
+}
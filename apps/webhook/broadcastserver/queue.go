@@ -0,0 +1,311 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// queueRetryAfter is the Retry-After in seconds sent with publishes refused while
+	// a campaign's queue is full
+	queueRetryAfter = 5
+	// maxApplyBackoff caps the wait between attempts to apply a queued event
+	maxApplyBackoff = 30 * time.Second
+	// queueLease is how long other instances leave this instance's queued events alone,
+	// leases are renewed every third of it while the workers run
+	queueLease = time.Minute
+)
+
+// WithWorkerPool makes the publish handler acknowledge events once they're queued in the
+// store rather than once they're applied. Each campaign's events are applied in the order
+// they were queued by one of the workers. Once a worker has queueSize events waiting,
+// publishes for its campaigns are answered with 503 so SNS backs off.
+// Queued events are applied once StartWorkers is called.
+func WithWorkerPool(workers, queueSize int) Option {
+	return func(server *BroadcastServer) {
+		server.pool = nil
+		if workers > 0 {
+			server.pool = newWorkerPool(workers, queueSize)
+		}
+	}
+}
+
+// queuedEvent is an event a worker applies and then deletes from the store
+type queuedEvent struct {
+	id    string
+	event events.ParsedEvent
+}
+
+// workerQueue holds the events waiting for one worker
+type workerQueue struct {
+	events chan queuedEvent
+	// reserved counts the events being queued and waiting so a reserved send never blocks
+	reserved atomic.Int64
+	size     int64
+}
+
+// reserve makes room for an event, it returns false if the queue is full
+func (queue *workerQueue) reserve() bool {
+	if queue.reserved.Add(1) > queue.size {
+		queue.reserved.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (queue *workerQueue) unreserve() {
+	queue.reserved.Add(-1)
+}
+
+type workerPool struct {
+	queues []*workerQueue
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	queueSize = max(queueSize, 1)
+	pool := &workerPool{queues: make([]*workerQueue, workers)}
+	for i := range pool.queues {
+		pool.queues[i] = &workerQueue{events: make(chan queuedEvent, queueSize), size: int64(queueSize)}
+	}
+	return pool
+}
+
+// queueFor returns the queue of the worker which applies the campaign's events
+func (pool *workerPool) queueFor(campaignId string) *workerQueue {
+	hash := fnv.New32a()
+	hash.Write([]byte(campaignId))
+	return pool.queues[hash.Sum32()%uint32(len(pool.queues))]
+}
+
+// depth returns the number of events waiting to be applied
+func (pool *workerPool) depth() int {
+	depth := int64(0)
+	for _, queue := range pool.queues {
+		depth += queue.reserved.Load()
+	}
+	return int(depth)
+}
+
+// QueuedEvents returns the number of events waiting to be applied by the worker pool
+func (server *BroadcastServer) QueuedEvents() int {
+	if server.pool == nil {
+		return 0
+	}
+	return server.pool.depth()
+}
+
+// enqueueEvent stores the event and hands it to its campaign's worker, answering 202 once
+// it's stored or 503 if the worker's queue is full
+func (server *BroadcastServer) enqueueEvent(ctx context.Context, writer http.ResponseWriter, parsedEvent events.ParsedEvent) {
+	logger := server.log(ctx)
+	if server.processed.seen(dedupeKey(parsedEvent)) {
+		server.metrics.eventsReceived.WithLabelValues(string(parsedEvent.EventType), outcomeDuplicate).Inc()
+		logger.Debug("dropping duplicate event", slog.String("sns_message_id", parsedEvent.SnsMessageId))
+		writer.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	queue := server.pool.queueFor(parsedEvent.CampaignId)
+	if !queue.reserve() {
+		logger.Warn("queue full, asking sns to retry", slog.Int64("queue_size", queue.size))
+		retryLater(writer, queueRetryAfter)
+		return
+	}
+	if err := server.beginWrite(); err != nil {
+		queue.unreserve()
+		refuseWhileDraining(writer)
+		return
+	}
+	defer server.endWrite()
+
+	now := time.Now()
+	queued := store.QueuedEvent{
+		Id:           uuid.Must(uuid.NewV7()).String(),
+		CampaignId:   parsedEvent.CampaignId,
+		DonorId:      parsedEvent.DonorId,
+		SnsMessageId: parsedEvent.SnsMessageId,
+		Raw:          parsedEvent.Raw,
+		ClaimedBy:    server.instanceId,
+		LeaseUntil:   now.Add(queueLease),
+		CreatedAt:    now,
+	}
+	err := server.withRetries(ctx, "queued event", func(ctx context.Context) error {
+		return server.store.EnqueueEvent(ctx, queued)
+	})
+	if err != nil {
+		queue.unreserve()
+		logger.Error("failed to queue event", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	queue.events <- queuedEvent{id: queued.Id, event: parsedEvent}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// StartWorkers starts the worker pool, which applies queued events until the context is
+// cancelled, and hands it the events still queued in the store, e.g. from before a restart.
+// Only events no instance owns, because they were released on shutdown, or whose owner
+// stopped renewing their lease, e.g. because it crashed, are recovered. The recovered
+// events' leases are renewed with this instance's own until the context is cancelled.
+// It does nothing without WithWorkerPool.
+func (server *BroadcastServer) StartWorkers(ctx context.Context) error {
+	if server.pool == nil {
+		return nil
+	}
+	now := time.Now()
+	recovered, err := server.store.ClaimQueuedEvents(ctx, server.instanceId, now, now.Add(queueLease))
+	if err != nil {
+		return err
+	}
+	for _, queue := range server.pool.queues {
+		go server.work(ctx, queue)
+	}
+	go server.renewLeases(ctx)
+
+	// recovered events are handed over before any new ones so each campaign's stay in order
+	for _, queued := range recovered {
+		parsedEvent, err := events.ParseSnsEvent(queued.Raw)
+		if err != nil {
+			// it was parsed before it was queued so this shouldn't happen
+			server.logger.Error("moving queued event which failed to parse to the dead letters", slog.String("queued_event_id", queued.Id), errAttr(err))
+			if err := server.deadLetter(ctx, queued.SnsMessageId, store.DeadLetterParse, queued.Raw, err); err != nil {
+				return err
+			}
+			if err := server.store.DeleteQueuedEvent(ctx, queued.Id); err != nil {
+				return err
+			}
+			continue
+		}
+		queue := server.pool.queueFor(parsedEvent.CampaignId)
+		// the queue may be over its size until the recovered events are applied
+		queue.reserved.Add(1)
+		select {
+		case queue.events <- queuedEvent{id: queued.Id, event: parsedEvent}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if len(recovered) > 0 {
+		server.logger.Info("recovered queued events", slog.Int("events", len(recovered)))
+	}
+	return nil
+}
+
+// renewLeases keeps other instances from recovering this instance's queued events
+// until the context is cancelled or the server shuts down
+func (server *BroadcastServer) renewLeases(ctx context.Context) {
+	ticker := time.NewTicker(queueLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := server.beginWrite(); err != nil {
+			return
+		}
+		err := server.withRetries(ctx, "queue lease", func(ctx context.Context) error {
+			return server.store.RenewQueuedEvents(ctx, server.instanceId, time.Now().Add(queueLease))
+		})
+		server.endWrite()
+		if err != nil {
+			server.logger.Error("failed to renew queued events' lease", errAttr(err))
+		}
+	}
+}
+
+// releaseQueued gives up this instance's queued events on shutdown so the next instance
+// to start recovers them without waiting for their lease to expire
+func (server *BroadcastServer) releaseQueued(ctx context.Context) error {
+	if server.pool == nil {
+		return nil
+	}
+	return server.store.ReleaseQueuedEvents(ctx, server.instanceId)
+}
+
+// work applies the queue's events one at a time until the context is cancelled
+func (server *BroadcastServer) work(ctx context.Context, queue *workerQueue) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case queued := <-queue.events:
+			server.applyQueued(ctx, queued)
+			queue.unreserve()
+		}
+	}
+}
+
+// applyQueued applies the event and deletes it from the queue, retrying so the campaign's
+// later events wait for it. After maxApplyAttempts it's moved to the dead letters instead.
+// Events left when the server shuts down stay queued in the store and are recovered
+// by StartWorkers.
+func (server *BroadcastServer) applyQueued(ctx context.Context, queued queuedEvent) {
+	logger := server.logger.With(
+		campaignAttr(queued.event.CampaignId),
+		donorAttr(queued.event.DonorId),
+		slog.String("queued_event_id", queued.id),
+	)
+	ctx = contextWithLogger(ctx, logger)
+	backoff := max(server.writeBackoff, time.Millisecond)
+	failures := 0
+	for attempt := 1; ; attempt++ {
+		err := server.applyOnce(ctx, queued)
+		if err == nil || errors.Is(err, ErrShuttingDown) || ctx.Err() != nil {
+			return
+		}
+		// another instance applying the event isn't a failure
+		if !errors.Is(err, store.ErrEventInProgress) {
+			failures++
+		}
+		if failures >= maxApplyAttempts && server.deadLetterQueued(ctx, queued, err) == nil {
+			return
+		}
+		logger.Warn("failed to apply queued event, retrying", slog.Int("attempt", attempt), slog.Duration("backoff", backoff), errAttr(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxApplyBackoff)
+	}
+}
+
+func (server *BroadcastServer) applyOnce(ctx context.Context, queued queuedEvent) error {
+	if err := server.beginWrite(); err != nil {
+		return err
+	}
+	defer server.endWrite()
+	if err := server.applyEvent(ctx, queued.event); err != nil {
+		return err
+	}
+	// deleting it again after a failure is fine, the event is a duplicate by then
+	return server.withRetries(ctx, "dequeue event", func(ctx context.Context) error {
+		return server.store.DeleteQueuedEvent(ctx, queued.id)
+	})
+}
+
+// deadLetterQueued moves an event which keeps failing from the queue to the dead letters
+func (server *BroadcastServer) deadLetterQueued(ctx context.Context, queued queuedEvent, cause error) error {
+	if err := server.beginWrite(); err != nil {
+		return err
+	}
+	defer server.endWrite()
+	if err := server.deadLetter(ctx, queued.event.SnsMessageId, store.DeadLetterWrite, queued.event.Raw, cause); err != nil {
+		return err
+	}
+	return server.withRetries(ctx, "dequeue event", func(ctx context.Context) error {
+		return server.store.DeleteQueuedEvent(ctx, queued.id)
+	})
+}
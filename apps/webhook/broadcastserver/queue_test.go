@@ -0,0 +1,250 @@
+package broadcastserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
+)
+
+// waitForQueue waits until the worker pool has applied every queued event
+func waitForQueue(test *testing.T, ctx context.Context, server *BroadcastServer) {
+	test.Helper()
+	for server.QueuedEvents() != 0 {
+		select {
+		case <-ctx.Done():
+			test.Fatalf("expected the queue to be empty but %d events are waiting", server.QueuedEvents())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func Test_workerPool(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	blocking := newBlockingStore()
+	tester := setupStoreTester(test, blocking, 30*time.Second, WithWorkerPool(1, 2))
+	defer tester.close()
+	assertSuccess(test, tester.broadcastServer.StartWorkers(ctx))
+	publish := func(donorId string) int {
+		blocking.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		msg, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Delivery, snsArn))
+		assertSuccess(test, err)
+		statusCode, err := tester.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		return statusCode
+	}
+
+	// events are acknowledged once they're queued, before they're applied
+	if statusCode := publish("applying-donor"); statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+	}
+	<-blocking.entered
+	if statusCode := publish("queued-donor"); statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+	}
+	// SNS is asked to back off once the queue is full
+	if statusCode := publish("refused-donor"); statusCode != http.StatusServiceUnavailable {
+		test.Errorf("expected %d with a full queue but got %d", http.StatusServiceUnavailable, statusCode)
+	}
+	queued, err := blocking.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 2 {
+		test.Errorf("expected the accepted events to be queued in the store but got %+v", queued)
+	}
+
+	close(blocking.release)
+	waitForQueue(test, ctx, tester.broadcastServer)
+	for donorId, expectedStatus := range map[string]string{
+		"applying-donor": events.StatusDelivered,
+		"queued-donor":   events.StatusDelivered,
+		"refused-donor":  events.StatusNotSent,
+	} {
+		receipt, err := blocking.Receipt(ctx, campaignId, donorId)
+		assertSuccess(test, err)
+		if receipt.Status != expectedStatus {
+			test.Errorf("expected %s to be %s but got %s", donorId, expectedStatus, receipt.Status)
+		}
+	}
+	queued, err = blocking.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 0 {
+		test.Errorf("expected applied events to be removed from the queue but got %+v", queued)
+	}
+}
+
+func Test_workerPoolOrder(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	donorId := "ordered-donor"
+	receiptStore := store.NewMemoryStore()
+	receiptStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+	tester := setupStoreTester(test, receiptStore, 30*time.Second, WithWorkerPool(4, 100))
+	defer tester.close()
+	assertSuccess(test, tester.broadcastServer.StartWorkers(ctx))
+
+	client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId))
+	assertSuccess(test, err)
+	defer client.Close()
+	waitForSubscribers(test, ctx, tester.broadcastServer, campaignId, 1)
+
+	// out of order events would be ignored transitions and not broadcast
+	for _, eventType := range []string{events.Send, events.Delivery, events.Open, events.Click} {
+		msg, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, eventType, snsArn))
+		assertSuccess(test, err)
+		statusCode, err := tester.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		if statusCode != http.StatusAccepted {
+			test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+		}
+	}
+	for _, expectedStatus := range []string{events.StatusSent, events.StatusDelivered, events.StatusOpened, events.StatusClicked} {
+		message, err := client.nextMessage(ctx)
+		assertSuccess(test, err)
+		if message.Status != expectedStatus {
+			test.Fatalf("expected %s but got %s", expectedStatus, message.Status)
+		}
+	}
+	if ignored := tester.broadcastServer.IgnoredTransitions(); ignored != 0 {
+		test.Errorf("expected no ignored transitions but got %d", ignored)
+	}
+}
+
+func Test_workerRecovery(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// events were accepted before the last instance stopped, or by instances still running
+	campaignId := "test-campaign"
+	receiptStore := store.NewMemoryStore()
+	now := time.Now()
+	for donorId, queued := range map[string]store.QueuedEvent{
+		"recovered-donor": {},
+		"expired-donor":   {ClaimedBy: "crashed-instance", LeaseUntil: now.Add(-time.Second)},
+		"leased-donor":    {ClaimedBy: "running-instance", LeaseUntil: now.Add(time.Hour)},
+	} {
+		receiptStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		msg, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Delivery, snsArn))
+		assertSuccess(test, err)
+		queued.Id = uuid.Must(uuid.NewV7()).String()
+		queued.CampaignId = campaignId
+		queued.DonorId = donorId
+		queued.Raw = []byte(msg)
+		assertSuccess(test, receiptStore.EnqueueEvent(ctx, queued))
+	}
+
+	tester := setupStoreTester(test, receiptStore, 30*time.Second, WithWorkerPool(2, 10))
+	defer tester.close()
+	assertSuccess(test, tester.broadcastServer.StartWorkers(ctx))
+	waitForQueue(test, ctx, tester.broadcastServer)
+
+	// events another instance holds a lease on are left to it
+	for donorId, expectedStatus := range map[string]string{
+		"recovered-donor": events.StatusDelivered,
+		"expired-donor":   events.StatusDelivered,
+		"leased-donor":    events.StatusNotSent,
+	} {
+		receipt, err := receiptStore.Receipt(ctx, campaignId, donorId)
+		assertSuccess(test, err)
+		if receipt.Status != expectedStatus {
+			test.Errorf("expected %s to be %s but got %s", donorId, expectedStatus, receipt.Status)
+		}
+	}
+	queued, err := receiptStore.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 1 || queued[0].DonorId != "leased-donor" || queued[0].ClaimedBy != "running-instance" {
+		test.Errorf("expected only the leased event to be left in the queue but got %+v", queued)
+	}
+}
+
+func Test_workerRelease(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	receiptStore := store.NewMemoryStore()
+	receiptStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusNotSent})
+	// the workers aren't started so the event stays queued
+	tester := setupStoreTester(test, receiptStore, 30*time.Second, WithWorkerPool(1, 10))
+	msg, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+	}
+	queued, err := receiptStore.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 1 || queued[0].ClaimedBy != tester.broadcastServer.instanceId || !queued[0].LeaseUntil.After(time.Now()) {
+		test.Fatalf("expected the event to be leased to the instance which queued it but got %+v", queued)
+	}
+
+	// shutting down releases it to the next instance
+	tester.close()
+	queued, err = receiptStore.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 1 || queued[0].ClaimedBy != "" {
+		test.Fatalf("expected the event to be released but got %+v", queued)
+	}
+	next := setupStoreTester(test, receiptStore, 30*time.Second, WithWorkerPool(1, 10))
+	defer next.close()
+	assertSuccess(test, next.broadcastServer.StartWorkers(ctx))
+	waitForQueue(test, ctx, next.broadcastServer)
+	receipt, err := receiptStore.Receipt(ctx, campaignId, "test-donor")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusDelivered {
+		test.Errorf("expected the released event to be applied but the status is %s", receipt.Status)
+	}
+}
+
+func Test_workerReleaseAfterTimeout(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	blocking := newBlockingStore()
+	blocking.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusNotSent})
+	tester := setupStoreTester(test, blocking, 30*time.Second, WithWorkerPool(1, 10))
+	defer tester.httpServer.Close()
+	assertSuccess(test, tester.broadcastServer.StartWorkers(ctx))
+	msg, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d but got %d", http.StatusAccepted, statusCode)
+	}
+	<-blocking.entered
+	defer close(blocking.release)
+
+	// the shutdown times out while the worker is still applying the event
+	expired, cancelExpired := context.WithCancel(ctx)
+	cancelExpired()
+	if err := tester.broadcastServer.Shutdown(expired); err == nil {
+		test.Errorf("expected the shutdown to time out")
+	}
+	queued, err := blocking.QueuedEvents(ctx)
+	assertSuccess(test, err)
+	if len(queued) != 1 || queued[0].ClaimedBy != "" {
+		test.Errorf("expected the event to be released anyway but got %+v", queued)
+	}
+}
@@ -0,0 +1,273 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"webhook/events"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBufferTTL is how long an idle campaign's buffer and statuses are kept,
+// its seq is kept forever so resuming subscribers never see seqs go backwards
+const redisBufferTTL = 24 * time.Hour
+
+// redisReconnectDelay is how long to wait before receiving again after an error
+const redisReconnectDelay = time.Second
+
+// publishScript numbers the event and buffers and publishes it in one step so every
+// instance agrees on the order of a campaign's events.
+//
+// KEYS: seq, events by seq, events by creation time, donor statuses
+// ARGV: donor id, status, json array of statuses which may move to status,
+// json array of known statuses, event json, now ms, min event time ms, buffer ttl ms, channel
+//
+// It returns the event's seq or 0 if it would move the donor's status backwards.
+// Buffered events and published messages are "<seq>:<event json>".
+var publishScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[4], ARGV[1])
+if current then
+	local allowed = {}
+	for _, status in ipairs(cjson.decode(ARGV[3])) do allowed[status] = true end
+	local known = {}
+	for _, status in ipairs(cjson.decode(ARGV[4])) do known[status] = true end
+	if known[current] and not allowed[current] then
+		return 0
+	end
+end
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[2])
+
+local flushed = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', '(' .. ARGV[7])
+for _, member in ipairs(flushed) do
+	redis.call('ZREM', KEYS[2], member)
+	redis.call('ZREM', KEYS[3], member)
+end
+
+local seq = redis.call('INCR', KEYS[1])
+local member = seq .. ':' .. ARGV[5]
+redis.call('ZADD', KEYS[2], seq, member)
+redis.call('ZADD', KEYS[3], ARGV[6], member)
+for i = 2, 4 do
+	redis.call('PEXPIRE', KEYS[i], ARGV[8])
+end
+redis.call('PUBLISH', ARGV[9], member)
+return seq
+`)
+
+// redisEvent is how events are encoded in redis, the seq is kept outside of the json
+type redisEvent struct {
+	CampaignId string    `json:"campaignId"`
+	DonorId    string    `json:"donorId"`
+	Status     string    `json:"status"`
+	Timestamp  time.Time `json:"timestamp"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func decodeRedisEvent(member string) (SubscriberGroupEvent, error) {
+	rawSeq, rawEvent, ok := strings.Cut(member, ":")
+	if !ok {
+		return SubscriberGroupEvent{}, fmt.Errorf("malformed event %q", member)
+	}
+	seq, err := strconv.ParseUint(rawSeq, 10, 64)
+	if err != nil {
+		return SubscriberGroupEvent{}, err
+	}
+	var event redisEvent
+	if err := json.Unmarshal([]byte(rawEvent), &event); err != nil {
+		return SubscriberGroupEvent{}, err
+	}
+	return SubscriberGroupEvent{
+		seq:        seq,
+		campaignId: event.CampaignId,
+		donorId:    event.DonorId,
+		status:     event.Status,
+		timestamp:  event.Timestamp,
+		createdAt:  event.CreatedAt,
+	}, nil
+}
+
+// RedisBroker shares events between instances with redis pub/sub. Each campaign's
+// buffer is kept in redis so every instance sends subscribers the same replay.
+type RedisBroker struct {
+	client        *redis.Client
+	prefix        string
+	maxEventAge   time.Duration
+	knownStatuses string
+	logger        *slog.Logger
+	pubsub        *redis.PubSub
+	// done is closed once the pubsub stops receiving
+	done      chan struct{}
+	closing   atomic.Bool
+	closeOnce sync.Once
+}
+
+// NewRedisBroker returns a broker which uses keys starting with prefix, the client is
+// closed with the broker. It logs to slog.Default().
+func NewRedisBroker(client *redis.Client, prefix string, maxEventAge time.Duration) *RedisBroker {
+	knownStatuses, _ := json.Marshal(events.KnownStatuses())
+	return &RedisBroker{
+		client:        client,
+		prefix:        prefix,
+		maxEventAge:   maxEventAge,
+		knownStatuses: string(knownStatuses),
+		logger:        slog.Default(),
+		done:          make(chan struct{}),
+	}
+}
+
+func (broker *RedisBroker) channel() string {
+	return broker.prefix + "events"
+}
+
+// keys returns the campaign's seq, events by seq, events by creation time and statuses keys
+func (broker *RedisBroker) keys(campaignId string) []string {
+	key := broker.prefix + "campaign:{" + campaignId + "}:"
+	return []string{key + "seq", key + "events", key + "times", key + "statuses"}
+}
+
+func (broker *RedisBroker) Publish(ctx context.Context, event SubscriberGroupEvent) (bool, error) {
+	encoded, err := json.Marshal(redisEvent{
+		CampaignId: event.campaignId,
+		DonorId:    event.donorId,
+		Status:     event.status,
+		Timestamp:  event.timestamp,
+		CreatedAt:  event.createdAt,
+	})
+	if err != nil {
+		return false, err
+	}
+	previous := events.PreviousStatuses(event.status)
+	if previous == nil {
+		// unknown statuses can't follow any status, and cjson decodes null as a userdata
+		previous = []string{}
+	}
+	previousStatuses, err := json.Marshal(previous)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	seq, err := publishScript.Run(
+		ctx,
+		broker.client,
+		broker.keys(event.campaignId),
+		event.donorId,
+		event.status,
+		string(previousStatuses),
+		broker.knownStatuses,
+		string(encoded),
+		now.UnixMilli(),
+		now.Add(-broker.maxEventAge).UnixMilli(),
+		redisBufferTTL.Milliseconds(),
+		broker.channel(),
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+	return seq != 0, nil
+}
+
+func (broker *RedisBroker) Buffer(ctx context.Context, campaignId string) ([]SubscriberGroupEvent, uint64, error) {
+	keys := broker.keys(campaignId)
+	var seqCmd *redis.StringCmd
+	var eventsCmd *redis.StringSliceCmd
+	_, err := broker.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		seqCmd = pipe.Get(ctx, keys[0])
+		eventsCmd = pipe.ZRange(ctx, keys[1], 0, -1)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, 0, err
+	}
+
+	var seq uint64
+	if rawSeq, err := seqCmd.Result(); err == nil {
+		seq, err = strconv.ParseUint(rawSeq, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	members, err := eventsCmd.Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	buffered := make([]SubscriberGroupEvent, 0, len(members))
+	for _, member := range members {
+		event, err := decodeRedisEvent(member)
+		if err != nil {
+			return nil, 0, err
+		}
+		buffered = append(buffered, event)
+	}
+	return buffered, seq, nil
+}
+
+func (broker *RedisBroker) ForgetStatuses(ctx context.Context, campaignId string, donorIds []string) error {
+	if len(donorIds) == 0 {
+		return nil
+	}
+	return broker.client.HDel(ctx, broker.keys(campaignId)[3], donorIds...).Err()
+}
+
+// Subscribe waits until the broker is subscribed to the channel and then delivers
+// events in the background. dropped is called when the connection to redis is
+// re-established since messages published while it was down are lost.
+func (broker *RedisBroker) Subscribe(ctx context.Context, deliver func(event SubscriberGroupEvent), dropped func()) error {
+	broker.pubsub = broker.client.Subscribe(ctx, broker.channel())
+	if _, err := broker.pubsub.Receive(ctx); err != nil {
+		broker.pubsub.Close()
+		return err
+	}
+
+	go func() {
+		defer close(broker.done)
+		for {
+			message, err := broker.pubsub.Receive(context.Background())
+			if broker.closing.Load() || errors.Is(err, redis.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// the pubsub reconnects on the next receive
+				broker.logger.Error("failed to receive from redis", errAttr(err))
+				time.Sleep(redisReconnectDelay)
+				continue
+			}
+			switch message := message.(type) {
+			case *redis.Subscription:
+				broker.logger.Warn("resubscribed to redis, dropping subscribers which may have missed events")
+				dropped()
+			case *redis.Message:
+				event, err := decodeRedisEvent(message.Payload)
+				if err != nil {
+					broker.logger.Error("failed to decode event from redis", errAttr(err))
+					continue
+				}
+				deliver(event)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops delivering events and closes the client
+func (broker *RedisBroker) Close() error {
+	var err error
+	broker.closeOnce.Do(func() {
+		broker.closing.Store(true)
+		if broker.pubsub != nil {
+			broker.pubsub.Close()
+			<-broker.done
+		}
+		err = broker.client.Close()
+	})
+	return err
+}
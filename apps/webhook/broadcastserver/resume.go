@@ -0,0 +1,93 @@
+package broadcastserver
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// replay is what a new subscriber is sent before the events on its channel
+type replay struct {
+	events []SubscriberGroupEvent
+	// gap is set when a resuming subscriber missed events which are no longer
+	// buffered, it must resync, e.g. by refetching the campaign's statuses
+	gap bool
+	// seq is the seq of the last event before those replayed
+	seq uint64
+}
+
+// newReplay returns the buffered events a subscriber should be sent, seq is the seq of
+// the campaign's latest event. Resuming subscribers are only sent the events after since,
+// unless some of them have been flushed.
+func newReplay(buffered []SubscriberGroupEvent, seq uint64, since uint64, resume bool) replay {
+	ret := replay{events: make([]SubscriberGroupEvent, 0, len(buffered))}
+	if len(buffered) > 0 {
+		ret.seq = buffered[0].seq - 1
+	} else {
+		ret.seq = seq
+	}
+	if resume {
+		// since is ahead of the campaign if it's from before its stream was recreated,
+		// e.g. after a restart, and behind the buffer if events have been flushed
+		ret.gap = since > seq || since < ret.seq
+		if !ret.gap {
+			ret.seq = since
+		}
+	}
+	for _, event := range buffered {
+		if event.seq > ret.seq {
+			ret.events = append(ret.events, event)
+		}
+	}
+	return ret
+}
+
+// ResyncMessage tells a resuming subscriber it missed events which can't be replayed.
+// It's followed by the events after seq.
+type ResyncMessage struct {
+	Type       string `json:"type"`
+	Seq        uint64 `json:"seq"`
+	CampaignId string `json:"campaignId"`
+}
+
+func (replay *replay) resyncMessage(campaignId string) ResyncMessage {
+	return ResyncMessage{Type: messageResync, Seq: replay.seq, CampaignId: campaignId}
+}
+
+// subscribeOptions are set by a subscriber's query params and headers
+type subscribeOptions struct {
+	// since is the seq of the last event a resuming subscriber received,
+	// resume is false for new subscribers
+	since  uint64
+	resume bool
+	// snapshot subscribers are sent every receipt's status before live events
+	snapshot bool
+}
+
+// parseSubscribeOptions reads since from the since query param or EventSource's
+// Last-Event-ID header and snapshot from the snapshot query param
+func parseSubscribeOptions(req *http.Request) (subscribeOptions, error) {
+	var options subscribeOptions
+	query := req.URL.Query()
+	if value := query.Get("snapshot"); value != "" {
+		snapshot, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, err
+		}
+		options.snapshot = snapshot
+	}
+
+	value := query.Get("since")
+	if value == "" {
+		value = req.Header.Get("Last-Event-ID")
+	}
+	if value == "" {
+		return options, nil
+	}
+	since, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return options, err
+	}
+	options.since = since
+	options.resume = true
+	return options, nil
+}
@@ -0,0 +1,127 @@
+package broadcastserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+func Test_newReplay(test *testing.T) {
+	test.Parallel()
+
+	broker := NewMemoryBroker(time.Hour)
+	for i := 0; i < 5; i++ {
+		_, err := broker.Publish(context.Background(), SubscriberGroupEvent{campaignId: "test-campaign", donorId: randAlphaNumericString(10), status: events.StatusSent, createdAt: time.Now()})
+		assertSuccess(test, err)
+	}
+	buffered, seq, err := broker.Buffer(context.Background(), "test-campaign")
+	assertSuccess(test, err)
+	// flush the first 2 events
+	buffered = buffered[2:]
+
+	replaySeqs := func(replay replay) []uint64 {
+		seqs := make([]uint64, 0, len(replay.events))
+		for _, event := range replay.events {
+			seqs = append(seqs, event.seq)
+		}
+		return seqs
+	}
+	for _, testCase := range []struct {
+		name   string
+		since  uint64
+		resume bool
+		gap    bool
+		seq    uint64
+		seqs   []uint64
+	}{
+		{name: "new subscribers get the buffer", seqs: []uint64{3, 4, 5}, seq: 2},
+		{name: "resume within the buffer", since: 3, resume: true, seqs: []uint64{4, 5}, seq: 3},
+		{name: "resume just before the buffer", since: 2, resume: true, seqs: []uint64{3, 4, 5}, seq: 2},
+		{name: "resume up to date", since: 5, resume: true, seqs: []uint64{}, seq: 5},
+		{name: "resume after flushed events", since: 1, resume: true, gap: true, seqs: []uint64{3, 4, 5}, seq: 2},
+		{name: "resume from before a restart", since: 10, resume: true, gap: true, seqs: []uint64{3, 4, 5}, seq: 2},
+	} {
+		replay := newReplay(buffered, seq, testCase.since, testCase.resume)
+		seqs := replaySeqs(replay)
+		if replay.gap != testCase.gap || replay.seq != testCase.seq || len(seqs) != len(testCase.seqs) {
+			test.Errorf("%s: expected gap %t, seq %d and events %v but got %t, %d and %v", testCase.name, testCase.gap, testCase.seq, testCase.seqs, replay.gap, replay.seq, seqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != testCase.seqs[i] {
+				test.Errorf("%s: expected events %v but got %v", testCase.name, testCase.seqs, seqs)
+				break
+			}
+		}
+	}
+}
+
+func Test_resumeSubscription(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 200*time.Millisecond)
+	defer tester.close()
+
+	campaignId := "test-campaign"
+	publish := func(donorId string) {
+		memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		err := tester.publishEvent(ctx, campaignId, donorId, "email-"+donorId, events.Send)
+		assertSuccess(test, err)
+	}
+	subscribe := func(query string) *Client {
+		client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId)+query)
+		assertSuccess(test, err)
+		return client
+	}
+
+	publish("first-donor")
+	publish("second-donor")
+
+	client := subscribe("&since=1")
+	message, err := client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Type != messageEvent || message.Seq != 2 || message.DonorId != "second-donor" {
+		test.Errorf("expected only the event after since but got %+v", message)
+	}
+	client.Close()
+
+	// events older than maxEventAge are flushed by the next event
+	time.Sleep(300 * time.Millisecond)
+	publish("third-donor")
+
+	client = subscribe("&since=2")
+	message, err = client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Seq != 3 || message.DonorId != "third-donor" {
+		test.Errorf("expected the event after since but got %+v", message)
+	}
+	client.Close()
+
+	client = subscribe("&since=1")
+	defer client.Close()
+	message, err = client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Type != messageResync || message.Seq != 2 {
+		test.Errorf("expected a resync from seq 2 but got %+v", message)
+	}
+	message, err = client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Type != messageEvent || message.Seq != 3 {
+		test.Errorf("expected the buffered event after the resync but got %+v", message)
+	}
+
+	res, err := http.Get(tester.subscribeUrl("/events/", campaignId) + "&since=not-a-seq")
+	assertSuccess(test, err)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		test.Errorf("expected %d for an invalid since but got %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
@@ -0,0 +1,101 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+const (
+	defaultWriteAttempts = 3
+	defaultWriteBackoff  = 100 * time.Millisecond
+)
+
+// WithWriteRetries sets how many times a failed write is attempted before the publish
+// request fails and SNS is left to redeliver the event. The wait between attempts
+// starts at backoff and doubles after each attempt.
+func WithWriteRetries(attempts int, backoff time.Duration) Option {
+	return func(server *BroadcastServer) {
+		server.writeAttempts = max(attempts, 1)
+		server.writeBackoff = backoff
+	}
+}
+
+// retryable reports whether a failed write might succeed if it's attempted again.
+// Ignored transitions, missing receipts and claimed events are answers from the store, not failures.
+func retryable(err error) bool {
+	return !errors.Is(err, store.ErrTransitionIgnored) &&
+		!errors.Is(err, store.ErrReceiptNotFound) &&
+		!errors.Is(err, store.ErrEventProcessed) &&
+		!errors.Is(err, store.ErrEventInProgress) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// withRetries calls write until it succeeds, returns an error which isn't retryable
+// or runs out of attempts
+func (server *BroadcastServer) withRetries(ctx context.Context, what string, write func(ctx context.Context) error) error {
+	backoff := server.writeBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err = write(ctx)
+		server.metrics.observeWrite(what, time.Since(start), err)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= server.writeAttempts {
+			break
+		}
+		server.log(ctx).Warn(
+			"write failed, retrying",
+			slog.String("what", what),
+			slog.Int("attempt", attempt),
+			slog.Int("attempts", server.writeAttempts),
+			slog.Duration("backoff", backoff),
+			errAttr(err),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("writing the %s failed after %d attempts: %w", what, server.writeAttempts, err)
+}
+
+// persistEvent writes everything recorded for an event. The history and suppressions
+// are written even if the status transition is ignored, in which case
+// store.ErrTransitionIgnored is returned. Nothing is written for missing receipts.
+// Every write is safe to repeat when SNS redelivers an event which partly failed.
+func (server *BroadcastServer) persistEvent(ctx context.Context, event events.ParsedEvent) error {
+	statusErr := server.withRetries(ctx, "receipt status", func(ctx context.Context) error {
+		return server.WriteEventToDb(ctx, event)
+	})
+	if statusErr != nil && !errors.Is(statusErr, store.ErrTransitionIgnored) {
+		return statusErr
+	}
+
+	err := server.withRetries(ctx, "event history", func(ctx context.Context) error {
+		return server.WriteEventHistory(ctx, event)
+	})
+	if err != nil {
+		return err
+	}
+	err = server.withRetries(ctx, "suppressions", func(ctx context.Context) error {
+		return server.WriteSuppressions(ctx, event)
+	})
+	if err != nil {
+		return err
+	}
+	return statusErr
+}
@@ -0,0 +1,175 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+// flakyStore fails the first failures status updates and the first suppressionFailures
+// suppression writes as if the db were unreachable
+type flakyStore struct {
+	*store.MemoryStore
+	failures            atomic.Int64
+	attempts            atomic.Int64
+	suppressionFailures atomic.Int64
+}
+
+func (flaky *flakyStore) UpdateStatus(ctx context.Context, event events.ParsedEvent) error {
+	flaky.attempts.Add(1)
+	if flaky.failures.Add(-1) >= 0 {
+		return errors.New("db unavailable")
+	}
+	return flaky.MemoryStore.UpdateStatus(ctx, event)
+}
+
+func (flaky *flakyStore) UpsertSuppression(ctx context.Context, suppression store.Suppression) error {
+	if flaky.suppressionFailures.Add(-1) >= 0 {
+		return errors.New("db unavailable")
+	}
+	return flaky.MemoryStore.UpsertSuppression(ctx, suppression)
+}
+
+// setupStoreTester serves a broadcast server backed by the given store rather than a libsql db
+func setupStoreTester(test *testing.T, receiptStore store.ReceiptStore, maxEventAge time.Duration, options ...Option) *BroadcastServerTester {
+	test.Helper()
+	verifier := events.NewVerifier(testSigner.Fetch, events.DefaultCertHostPattern)
+	options = append([]Option{WithVerifier(verifier), WithApiToken(testApiToken), WithAdminToken(testAdminToken), WithAuthorizer(testAuthorizer)}, options...)
+	broadcastServer, err := NewBroadcastServer(snsArn, receiptStore, maxEventAge, options...)
+	if err != nil {
+		test.Fatalf("[error] failed to create broadcast server: %s", err)
+	}
+	httpServer := httptest.NewServer(broadcastServer)
+	return &BroadcastServerTester{
+		url:             httpServer.URL,
+		broadcastServer: broadcastServer,
+		httpServer:      httpServer,
+	}
+}
+
+func Test_writeRetries(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	publish := func(tester *BroadcastServerTester, donorId string) int {
+		msg, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Delivery, snsArn))
+		assertSuccess(test, err)
+		statusCode, err := tester.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		return statusCode
+	}
+
+	flaky := &flakyStore{MemoryStore: store.NewMemoryStore()}
+	tester := setupStoreTester(test, flaky, 30*time.Second, WithWriteRetries(3, time.Millisecond))
+	defer tester.close()
+
+	// transient failures are retried within the request
+	flaky.MemoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "recovers", Status: events.StatusNotSent})
+	flaky.failures.Store(2)
+	if statusCode := publish(tester, "recovers"); statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d after transient failures but got %d", http.StatusAccepted, statusCode)
+	}
+	if attempts := flaky.attempts.Swap(0); attempts != 3 {
+		test.Errorf("expected 3 attempts but got %d", attempts)
+	}
+	receipt, err := flaky.Receipt(ctx, campaignId, "recovers")
+	assertSuccess(test, err)
+	if receipt.Status != events.StatusDelivered {
+		test.Errorf("expected status %s but got %s", events.StatusDelivered, receipt.Status)
+	}
+
+	// persistent failures are left to SNS to redeliver and nothing else is written
+	flaky.MemoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "fails", Status: events.StatusNotSent})
+	flaky.failures.Store(10)
+	if statusCode := publish(tester, "fails"); statusCode != http.StatusInternalServerError {
+		test.Fatalf("expected %d after persistent failures but got %d", http.StatusInternalServerError, statusCode)
+	}
+	if attempts := flaky.attempts.Swap(0); attempts != 3 {
+		test.Errorf("expected 3 attempts but got %d", attempts)
+	}
+	history, err := flaky.History(ctx, campaignId, "fails")
+	assertSuccess(test, err)
+	if len(history) != 0 {
+		test.Errorf("expected no history for a failed write but got %+v", history)
+	}
+
+	// missing receipts aren't retried in process, they're parked for the reconciler
+	flaky.failures.Store(0)
+	if statusCode := publish(tester, "missing"); statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d for a missing receipt but got %d", http.StatusAccepted, statusCode)
+	}
+	if attempts := flaky.attempts.Swap(0); attempts != 1 {
+		test.Errorf("expected 1 attempt but got %d", attempts)
+	}
+
+	// bad payloads won't get any better so SNS shouldn't redeliver them
+	envelope := events.SnsEventStruct{
+		Type:             "Notification",
+		MessageId:        "bad-payload",
+		TopicArn:         snsArn,
+		Message:          json.RawMessage(`"not an ses event"`),
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: "1",
+	}
+	msg, err := signEnvelope(&envelope)
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusBadRequest {
+		test.Fatalf("expected %d for a bad payload but got %d", http.StatusBadRequest, statusCode)
+	}
+	if attempts := flaky.attempts.Load(); attempts != 0 {
+		test.Errorf("expected no writes for a bad payload but got %d", attempts)
+	}
+}
+
+func Test_partialWriteRedelivery(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	flaky := &flakyStore{MemoryStore: store.NewMemoryStore()}
+	tester := setupStoreTester(test, flaky, 30*time.Second, WithWriteRetries(3, time.Millisecond))
+	defer tester.close()
+
+	// the status and history are written but the suppression isn't
+	flaky.MemoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusNotSent})
+	flaky.suppressionFailures.Store(3)
+	msg, err := signBody(generateResponseBody(campaignId, "test-donor", "email-test-donor", string(events.Bounce), snsArn))
+	assertSuccess(test, err)
+	statusCode, err := tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusInternalServerError {
+		test.Fatalf("expected %d after the suppression failed but got %d", http.StatusInternalServerError, statusCode)
+	}
+
+	// SNS's redelivery writes the suppression without recording the event twice
+	statusCode, err = tester.postPublish(ctx, msg)
+	assertSuccess(test, err)
+	if statusCode != http.StatusAccepted {
+		test.Fatalf("expected %d for the redelivery but got %d", http.StatusAccepted, statusCode)
+	}
+	history, err := flaky.History(ctx, campaignId, "test-donor")
+	assertSuccess(test, err)
+	if len(history) != 1 || history[0].EventType != events.Bounce {
+		test.Errorf("expected the bounce once in the history but got %+v", history)
+	}
+	suppressions, err := flaky.Suppressions(ctx, nil)
+	assertSuccess(test, err)
+	if len(suppressions) != 1 {
+		test.Errorf("expected the address to be suppressed but got %+v", suppressions)
+	}
+}
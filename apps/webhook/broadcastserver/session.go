@@ -0,0 +1,143 @@
+package broadcastserver
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"webhook/store"
+)
+
+const (
+	DefaultSessionCacheTTL = 30 * time.Second
+	// maxSessionCache is how many lookups are cached before expired ones are dropped
+	maxSessionCache = 10_000
+)
+
+// the web app's NextAuth session cookie, prefixed with __Secure- when served over https
+var sessionCookies = []string{"__Secure-next-auth.session-token", "next-auth.session-token"}
+
+type cachedLookup[T any] struct {
+	value   T
+	err     error
+	expires time.Time
+}
+
+// lookupCache caches lookups until they're older than the ttl. Lookups of missing
+// sessions are cached too so reconnects with a stale cookie don't reach the db.
+type lookupCache[K comparable, T any] struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[K]cachedLookup[T]
+}
+
+func newLookupCache[K comparable, T any](ttl time.Duration) *lookupCache[K, T] {
+	return &lookupCache[K, T]{ttl: ttl, entries: make(map[K]cachedLookup[T])}
+}
+
+// get returns the cached lookup or calls lookup and caches its result,
+// errors other than those in cacheErrs aren't cached
+func (cache *lookupCache[K, T]) get(key K, now time.Time, lookup func() (T, error), cacheErrs ...error) (T, error) {
+	cache.lock.Lock()
+	entry, ok := cache.entries[key]
+	cache.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.value, entry.err
+	}
+
+	value, err := lookup()
+	if err != nil && !errorIn(err, cacheErrs) {
+		return value, err
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if len(cache.entries) >= maxSessionCache {
+		for key, entry := range cache.entries {
+			if !now.Before(entry.expires) {
+				delete(cache.entries, key)
+			}
+		}
+		// every entry is fresh so there are more clients than the cache holds
+		if len(cache.entries) >= maxSessionCache {
+			clear(cache.entries)
+		}
+	}
+	cache.entries[key] = cachedLookup[T]{value: value, err: err, expires: now.Add(cache.ttl)}
+	return value, err
+}
+
+func errorIn(err error, errs []error) bool {
+	for _, target := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type userCampaign struct {
+	userId     string
+	campaignId string
+}
+
+// SessionAuthorizer authorizes subscribers with the web app's session cookie, allowing
+// them to subscribe to campaigns owned by one of their accounts. It reads the web app's
+// tables so the webhook has to share the web app's db.
+//
+// Lookups are cached for the ttl so signing out or losing a campaign may take up to
+// the ttl to stop new subscriptions.
+type SessionAuthorizer struct {
+	store     store.ReceiptStore
+	now       func() time.Time
+	sessions  *lookupCache[string, string]
+	campaigns *lookupCache[userCampaign, bool]
+}
+
+func NewSessionAuthorizer(receiptStore store.ReceiptStore, ttl time.Duration) *SessionAuthorizer {
+	return &SessionAuthorizer{
+		store:     receiptStore,
+		now:       time.Now,
+		sessions:  newLookupCache[string, string](ttl),
+		campaigns: newLookupCache[userCampaign, bool](ttl),
+	}
+}
+
+func requestSessionToken(req *http.Request) string {
+	for _, name := range sessionCookies {
+		if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func (authorizer *SessionAuthorizer) Authorize(req *http.Request, campaignId string) error {
+	sessionToken := requestSessionToken(req)
+	if sessionToken == "" {
+		return ErrUnauthenticated
+	}
+
+	now := authorizer.now()
+	userId, err := authorizer.sessions.get(sessionToken, now, func() (string, error) {
+		return authorizer.store.SessionUser(req.Context(), sessionToken, now)
+	}, store.ErrSessionNotFound)
+	if errors.Is(err, store.ErrSessionNotFound) {
+		return ErrUnauthenticated
+	}
+	if err != nil {
+		return err
+	}
+
+	owns, err := authorizer.campaigns.get(userCampaign{userId, campaignId}, now, func() (bool, error) {
+		return authorizer.store.UserOwnsCampaign(req.Context(), userId, campaignId)
+	})
+	if err != nil {
+		return err
+	}
+	if !owns {
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"webhook/store"
+)
+
+// countingStore counts session lookups to check they're cached
+type countingStore struct {
+	*store.MemoryStore
+	sessionLookups  atomic.Int64
+	campaignLookups atomic.Int64
+}
+
+func (counting *countingStore) SessionUser(ctx context.Context, sessionToken string, now time.Time) (string, error) {
+	counting.sessionLookups.Add(1)
+	return counting.MemoryStore.SessionUser(ctx, sessionToken, now)
+}
+
+func (counting *countingStore) UserOwnsCampaign(ctx context.Context, userId, campaignId string) (bool, error) {
+	counting.campaignLookups.Add(1)
+	return counting.MemoryStore.UserOwnsCampaign(ctx, userId, campaignId)
+}
+
+func sessionRequest(sessionToken string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/subscribe/test-campaign", nil)
+	if sessionToken != "" {
+		req.AddCookie(&http.Cookie{Name: "next-auth.session-token", Value: sessionToken})
+	}
+	return req
+}
+
+func Test_sessionAuthorizer(test *testing.T) {
+	test.Parallel()
+
+	counting := &countingStore{MemoryStore: store.NewMemoryStore()}
+	counting.InsertSession(store.Session{SessionToken: "valid-session", UserId: "user", Expires: time.Now().Add(time.Hour)})
+	counting.InsertSession(store.Session{SessionToken: "expired-session", UserId: "user", Expires: time.Now().Add(-time.Hour)})
+	counting.InsertCampaign("test-campaign", "account", "user")
+	counting.InsertCampaign("other-campaign", "other-account", "other-user")
+	authorizer := NewSessionAuthorizer(counting, time.Minute)
+
+	for _, testCase := range []struct {
+		name         string
+		sessionToken string
+		campaignId   string
+		err          error
+	}{
+		{name: "owned campaign", sessionToken: "valid-session", campaignId: "test-campaign"},
+		{name: "another user's campaign", sessionToken: "valid-session", campaignId: "other-campaign", err: ErrForbidden},
+		{name: "missing campaign", sessionToken: "valid-session", campaignId: "missing-campaign", err: ErrForbidden},
+		{name: "no cookie", campaignId: "test-campaign", err: ErrUnauthenticated},
+		{name: "expired session", sessionToken: "expired-session", campaignId: "test-campaign", err: ErrUnauthenticated},
+		{name: "unknown session", sessionToken: "unknown-session", campaignId: "test-campaign", err: ErrUnauthenticated},
+	} {
+		err := authorizer.Authorize(sessionRequest(testCase.sessionToken), testCase.campaignId)
+		if !errors.Is(err, testCase.err) || (testCase.err == nil && err != nil) {
+			test.Errorf("%s: expected %v but got %v", testCase.name, testCase.err, err)
+		}
+	}
+
+	// reconnects are answered from the cache, including for unknown sessions
+	sessionLookups, campaignLookups := counting.sessionLookups.Load(), counting.campaignLookups.Load()
+	for i := 0; i < 10; i++ {
+		if err := authorizer.Authorize(sessionRequest("valid-session"), "test-campaign"); err != nil {
+			test.Fatal(err)
+		}
+		if err := authorizer.Authorize(sessionRequest("unknown-session"), "test-campaign"); !errors.Is(err, ErrUnauthenticated) {
+			test.Fatalf("expected %v but got %v", ErrUnauthenticated, err)
+		}
+	}
+	if counting.sessionLookups.Load() != sessionLookups || counting.campaignLookups.Load() != campaignLookups {
+		test.Errorf("expected cached lookups but the store was queried %d more times", counting.sessionLookups.Load()-sessionLookups+counting.campaignLookups.Load()-campaignLookups)
+	}
+
+	// lookups are repeated once they're older than the ttl
+	authorizer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := authorizer.Authorize(sessionRequest("valid-session"), "test-campaign"); err != nil {
+		test.Fatal(err)
+	}
+	if counting.sessionLookups.Load() != sessionLookups+1 {
+		test.Errorf("expected the session to be looked up again after the ttl")
+	}
+}
+
+func Test_subscribeWithSession(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	memoryStore.InsertSession(store.Session{SessionToken: "valid-session", UserId: "user", Expires: time.Now().Add(time.Hour)})
+	memoryStore.InsertCampaign("test-campaign", "account", "user")
+	tester := setupStoreTester(test, memoryStore, 30*time.Second, WithAuthorizer(NewSessionAuthorizer(memoryStore, time.Minute)))
+	defer tester.close()
+
+	dial := func(campaignId string) (*Client, error) {
+		connection, _, err := websocket.Dial(ctx, tester.url+"/subscribe/"+campaignId+"?snapshot=1", &websocket.DialOptions{
+			HTTPHeader: http.Header{"Cookie": {"__Secure-next-auth.session-token=valid-session"}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Client{connection: connection}, nil
+	}
+
+	client, err := dial("test-campaign")
+	assertSuccess(test, err)
+	defer client.Close()
+	var snapshot SnapshotMessage
+	err = client.nextJson(ctx, &snapshot)
+	assertSuccess(test, err)
+	if snapshot.Type != messageSnapshot {
+		test.Errorf("expected a snapshot but got %+v", snapshot)
+	}
+
+	forbidden, err := dial("other-campaign")
+	assertSuccess(test, err)
+	defer forbidden.Close()
+	_, _, err = forbidden.connection.Read(ctx)
+	if websocket.CloseStatus(err) != StatusForbidden {
+		test.Errorf("expected close code %d for another campaign but got %v", StatusForbidden, err)
+	}
+}
@@ -0,0 +1,149 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// ErrShuttingDown is returned for work which is refused while the server drains
+var ErrShuttingDown = errors.New("server shutting down")
+
+// goingAwayReason tells subscribers closed on shutdown to reconnect, the load balancer
+// sends them to another instance
+const goingAwayReason = "server shutting down, reconnect"
+
+// shutdownRetryAfter is the Retry-After in seconds sent with requests refused while draining
+const shutdownRetryAfter = 5
+
+// releaseTimeout bounds releasing the queued events on shutdown, which happens even once
+// Shutdown's context is done
+const releaseTimeout = 5 * time.Second
+
+// socket is an open WebSocket or event stream
+type socket struct {
+	close func(code websocket.StatusCode, reason string)
+}
+
+// drain tracks the sockets and db writes which must finish before the store is closed
+type drain struct {
+	lock     sync.Mutex
+	draining bool
+	sockets  map[*socket]struct{}
+	writes   int
+	// idle is closed once draining and no writes are in flight
+	idle chan struct{}
+}
+
+// openSocket registers a socket to be closed on shutdown, it returns ErrShuttingDown
+// once the server is draining
+func (server *BroadcastServer) openSocket(close func(code websocket.StatusCode, reason string)) (*socket, error) {
+	server.drain.lock.Lock()
+	defer server.drain.lock.Unlock()
+	if server.drain.draining {
+		return nil, ErrShuttingDown
+	}
+	if server.drain.sockets == nil {
+		server.drain.sockets = make(map[*socket]struct{})
+	}
+	sock := &socket{close: close}
+	server.drain.sockets[sock] = struct{}{}
+	return sock, nil
+}
+
+func (server *BroadcastServer) closeSocket(sock *socket) {
+	server.drain.lock.Lock()
+	defer server.drain.lock.Unlock()
+	delete(server.drain.sockets, sock)
+}
+
+// beginWrite registers an in-flight write, it returns ErrShuttingDown once the server
+// is draining. Each successful call must be followed by endWrite.
+func (server *BroadcastServer) beginWrite() error {
+	server.drain.lock.Lock()
+	defer server.drain.lock.Unlock()
+	if server.drain.draining {
+		return ErrShuttingDown
+	}
+	server.drain.writes++
+	return nil
+}
+
+func (server *BroadcastServer) endWrite() {
+	server.drain.lock.Lock()
+	defer server.drain.lock.Unlock()
+	server.drain.writes--
+	if server.drain.draining && server.drain.writes == 0 {
+		close(server.drain.idle)
+	}
+}
+
+// refuseWhileDraining answers requests refused while draining so they're retried
+// against another instance
+func refuseWhileDraining(writer http.ResponseWriter) {
+	writer.Header().Set("Retry-After", strconv.Itoa(shutdownRetryAfter))
+	http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// Drain stops accepting subscribers and publishes and closes every open socket with
+// StatusGoingAway. It returns without waiting for the sockets to close so it can be
+// registered with http.Server.RegisterOnShutdown, which doesn't track hijacked connections.
+func (server *BroadcastServer) Drain() {
+	server.drain.lock.Lock()
+	if server.drain.draining {
+		server.drain.lock.Unlock()
+		return
+	}
+	server.drain.draining = true
+	server.drain.idle = make(chan struct{})
+	if server.drain.writes == 0 {
+		close(server.drain.idle)
+	}
+	sockets := make([]*socket, 0, len(server.drain.sockets))
+	for sock := range server.drain.sockets {
+		sockets = append(sockets, sock)
+	}
+	server.drain.lock.Unlock()
+
+	server.logger.Info("draining", slog.Int("sockets", len(sockets)))
+	for _, sock := range sockets {
+		// closing a WebSocket waits for the client's close frame
+		go sock.close(websocket.StatusGoingAway, goingAwayReason)
+	}
+}
+
+// Shutdown drains the server, waits for in-flight db writes to finish, releases the events
+// still queued for the workers and then closes the broker, the archive and the store.
+// If ctx is done first the store is closed anyway and ctx's error is returned.
+func (server *BroadcastServer) Shutdown(ctx context.Context) error {
+	server.Drain()
+	var err error
+	select {
+	case <-server.drain.idle:
+	case <-ctx.Done():
+		server.drain.lock.Lock()
+		writes := server.drain.writes
+		server.drain.lock.Unlock()
+		server.logger.Error("closing the db with writes in flight", slog.Int("writes", writes), errAttr(ctx.Err()))
+		err = ctx.Err()
+	}
+	// released even if writes are still in flight, an event a worker is still applying
+	// is protected by its dedupe claim. ctx may be done so the release has its own.
+	releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if releaseErr := server.releaseQueued(releaseCtx); releaseErr != nil {
+		server.logger.Error("failed to release queued events, they're recovered once their lease expires", errAttr(releaseErr))
+		err = errors.Join(err, releaseErr)
+	}
+	if server.archive != nil {
+		// completing the archive's files may upload them, ctx bounds how long that takes
+		err = errors.Join(err, server.archive.Close(ctx))
+	}
+	return errors.Join(err, server.broker.Close(), server.store.Close())
+}
@@ -0,0 +1,142 @@
+package broadcastserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"nhooyr.io/websocket"
+)
+
+// blockingStore holds status updates until they're released and records when it's closed
+type blockingStore struct {
+	*store.MemoryStore
+	entered chan struct{}
+	release chan struct{}
+	closed  atomic.Bool
+	// closedEarly is set if a write finished after the store was closed
+	closedEarly atomic.Bool
+}
+
+func newBlockingStore() *blockingStore {
+	return &blockingStore{MemoryStore: store.NewMemoryStore(), entered: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (blocking *blockingStore) UpdateStatus(ctx context.Context, event events.ParsedEvent) error {
+	blocking.entered <- struct{}{}
+	<-blocking.release
+	if blocking.closed.Load() {
+		blocking.closedEarly.Store(true)
+	}
+	return blocking.MemoryStore.UpdateStatus(ctx, event)
+}
+
+func (blocking *blockingStore) Close() error {
+	blocking.closed.Store(true)
+	return blocking.MemoryStore.Close()
+}
+
+func Test_shutdown(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	blocking := newBlockingStore()
+	tester := setupStoreTester(test, blocking, 30*time.Second)
+	defer tester.httpServer.Close()
+	publish := func(donorId string) int {
+		blocking.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		msg, err := signBody(generateResponseBody(campaignId, donorId, "email-"+donorId, events.Delivery, snsArn))
+		assertSuccess(test, err)
+		statusCode, err := tester.postPublish(ctx, msg)
+		assertSuccess(test, err)
+		return statusCode
+	}
+
+	client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId))
+	assertSuccess(test, err)
+	defer client.Close()
+	stream, err := newSseClient(ctx, tester.subscribeUrl("/events/", campaignId), "")
+	assertSuccess(test, err)
+	defer stream.Close()
+	waitForSubscribers(test, ctx, tester.broadcastServer, campaignId, 2)
+
+	// a publish is writing to the db when the server shuts down
+	published := make(chan int, 1)
+	go func() { published <- publish("in-flight-donor") }()
+	<-blocking.entered
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- tester.broadcastServer.Shutdown(ctx) }()
+
+	// subscribers are told to reconnect
+	_, err = client.nextMessage(ctx)
+	if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+		test.Errorf("expected the subscriber to be closed with %d but got %s", websocket.StatusGoingAway, err)
+	}
+	if _, _, err := stream.nextEvent(); err == nil {
+		test.Errorf("expected the event stream to end")
+	}
+
+	// new subscribers and publishes are refused until the instance stops
+	_, res, err := websocket.Dial(ctx, tester.subscribeUrl("/subscribe/", campaignId), nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		test.Errorf("expected new subscribers to be refused with a retry after but got %v", err)
+	}
+	if statusCode := publish("refused-donor"); statusCode != http.StatusServiceUnavailable {
+		test.Errorf("expected %d for a publish while draining but got %d", http.StatusServiceUnavailable, statusCode)
+	}
+
+	// the store is only closed once the in-flight write finishes
+	select {
+	case err := <-shutdown:
+		test.Fatalf("expected shutdown to wait for the in-flight write but it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(blocking.release)
+	if statusCode := <-published; statusCode != http.StatusAccepted {
+		test.Errorf("expected the in-flight publish to succeed but got %d", statusCode)
+	}
+	assertSuccess(test, <-shutdown)
+	if !blocking.closed.Load() || blocking.closedEarly.Load() {
+		test.Errorf("expected the store to be closed after the in-flight write")
+	}
+}
+
+func Test_shutdownDeadline(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	blocking := newBlockingStore()
+	tester := setupStoreTester(test, blocking, 30*time.Second)
+	defer tester.httpServer.Close()
+
+	blocking.InsertReceipt(store.Receipt{CampaignId: "test-campaign", DonorId: "stuck-donor", Status: events.StatusNotSent})
+	msg, err := signBody(generateResponseBody("test-campaign", "stuck-donor", "email-stuck-donor", events.Delivery, snsArn))
+	assertSuccess(test, err)
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		tester.postPublish(ctx, msg)
+	}()
+	<-blocking.entered
+
+	// the store is closed anyway once the deadline passes
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shutdownCancel()
+	err = tester.broadcastServer.Shutdown(shutdownCtx)
+	if !errors.Is(err, context.DeadlineExceeded) || !blocking.closed.Load() {
+		test.Errorf("expected the store to be closed at the deadline but got %v", err)
+	}
+	close(blocking.release)
+	<-published
+}
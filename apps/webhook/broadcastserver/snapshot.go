@@ -0,0 +1,107 @@
+package broadcastserver
+
+import (
+	"context"
+
+	"webhook/events"
+
+	"nhooyr.io/websocket"
+)
+
+// snapshotSubscriberBuffer is the number of events which can be queued for a snapshot
+// subscriber, it's larger since events queue up while the snapshot is loaded
+const snapshotSubscriberBuffer = 256
+
+type SnapshotStatus struct {
+	DonorId string `json:"donorId"`
+	Status  string `json:"status"`
+}
+
+// SnapshotMessage has the status of every receipt in the campaign as of seq.
+// It's followed by the events after seq.
+type SnapshotMessage struct {
+	Type       string           `json:"type"`
+	Seq        uint64           `json:"seq"`
+	CampaignId string           `json:"campaignId"`
+	Statuses   []SnapshotStatus `json:"statuses"`
+}
+
+// outboundMessage is a message for a subscriber, seq is used as the id of server-sent events
+type outboundMessage struct {
+	seq  uint64
+	body any
+}
+
+// accept reports whether a live event should be sent to the subscriber. Snapshot
+// subscribers aren't sent events which would move a status in their snapshot backwards,
+// e.g. an event which was persisted before the snapshot was loaded but broadcast after.
+func (sub *subscriber) accept(event SubscriberGroupEvent) bool {
+	if sub.statuses == nil {
+		return true
+	}
+	if currentStatus, ok := sub.statuses[event.donorId]; ok && !events.CanTransition(currentStatus, event.status) {
+		return false
+	}
+	sub.statuses[event.donorId] = event.status
+	return true
+}
+
+// newSubscriber creates a subscriber whose channel is large enough for its options
+func newSubscriber(campaignId string, options subscribeOptions, close func(code websocket.StatusCode, reason string)) *subscriber {
+	buffer := subscriberBuffer
+	if options.snapshot {
+		buffer = snapshotSubscriberBuffer
+	}
+	return &subscriber{
+		campaignId: campaignId,
+		events:     make(chan SubscriberGroupEvent, buffer),
+		close:      close,
+	}
+}
+
+// subscribe registers the subscriber and returns the messages it should be sent before
+// the events on its channel. Snapshot subscribers are sent the snapshot, which is loaded
+// after the subscriber is registered so no events are missed between the two. Every
+// event persisted before the subscriber was registered is in the snapshot so the buffered
+// events aren't replayed. Other subscribers are sent the replay.
+func (server *BroadcastServer) subscribe(ctx context.Context, sub *subscriber, options subscribeOptions) ([]outboundMessage, error) {
+	if !options.snapshot {
+		replay, err := server.AddSubscriber(ctx, sub, options.since, options.resume)
+		if err != nil {
+			return nil, err
+		}
+		messages := make([]outboundMessage, 0, len(replay.events)+1)
+		if replay.gap {
+			messages = append(messages, outboundMessage{seq: replay.seq, body: replay.resyncMessage(sub.campaignId)})
+		}
+		sub.seq = replay.seq
+		for _, event := range replay.events {
+			messages = append(messages, outboundMessage{seq: event.seq, body: event.toSubscriberEvent()})
+			sub.seq = event.seq
+		}
+		return messages, nil
+	}
+
+	replay, err := server.AddSubscriber(ctx, sub, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	seq := replay.seq
+	if len(replay.events) > 0 {
+		seq = replay.events[len(replay.events)-1].seq
+	}
+	receipts, err := server.store.CampaignReceipts(ctx, sub.campaignId)
+	if err != nil {
+		server.DeleteSubscriber(sub)
+		return nil, err
+	}
+
+	sub.statuses = make(map[string]string, len(receipts))
+	sub.seq = seq
+	snapshot := SnapshotMessage{Type: messageSnapshot, Seq: seq, CampaignId: sub.campaignId, Statuses: make([]SnapshotStatus, 0, len(receipts))}
+	for _, receipt := range receipts {
+		sub.statuses[receipt.DonorId] = receipt.Status
+		snapshot.Statuses = append(snapshot.Statuses, SnapshotStatus{DonorId: receipt.DonorId, Status: receipt.Status})
+	}
+	return []outboundMessage{{seq: seq, body: snapshot}}, nil
+}
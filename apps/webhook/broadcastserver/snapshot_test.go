@@ -0,0 +1,88 @@
+package broadcastserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+func Test_snapshotSubscription(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second)
+	defer tester.close()
+
+	campaignId := "test-campaign"
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "delivered-donor", Status: events.StatusDelivered})
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "unsent-donor", Status: events.StatusNotSent})
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: "other-campaign", DonorId: "other-donor", Status: events.StatusNotSent})
+	memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "sent-donor", Status: events.StatusNotSent})
+	err := tester.publishEvent(ctx, campaignId, "sent-donor", "email-sent-donor", events.Send)
+	assertSuccess(test, err)
+
+	client, err := newClient(ctx, tester.subscribeUrl("/subscribe/", campaignId)+"&snapshot=1")
+	assertSuccess(test, err)
+	defer client.Close()
+
+	var snapshot SnapshotMessage
+	err = client.nextJson(ctx, &snapshot)
+	assertSuccess(test, err)
+	expected := []SnapshotStatus{
+		{DonorId: "delivered-donor", Status: events.StatusDelivered},
+		{DonorId: "sent-donor", Status: events.StatusSent},
+		{DonorId: "unsent-donor", Status: events.StatusNotSent},
+	}
+	if snapshot.Type != messageSnapshot || snapshot.Seq != 1 || len(snapshot.Statuses) != len(expected) {
+		test.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	for i := range expected {
+		if snapshot.Statuses[i] != expected[i] {
+			test.Errorf("expected %+v in the snapshot but got %+v", expected[i], snapshot.Statuses[i])
+		}
+	}
+
+	// the buffered send is in the snapshot so the next message is the next event
+	err = tester.publishEvent(ctx, campaignId, "unsent-donor", "email-unsent-donor", events.Delivery)
+	assertSuccess(test, err)
+	message, err := client.nextMessage(ctx)
+	assertSuccess(test, err)
+	if message.Type != messageEvent || message.Seq != 2 || message.DonorId != "unsent-donor" || message.Status != events.StatusDelivered {
+		test.Errorf("expected the delivery after the snapshot but got %+v", message)
+	}
+}
+
+func Test_subscriberAccept(test *testing.T) {
+	test.Parallel()
+
+	// events which were persisted before the snapshot was loaded but broadcast after it
+	// can't move the snapshot's statuses backwards
+	sub := &subscriber{statuses: map[string]string{"donor": events.StatusOpened}}
+	for _, testCase := range []struct {
+		status string
+		accept bool
+	}{
+		{events.StatusDelivered, false},
+		{events.StatusOpened, true},
+		{events.StatusClicked, true},
+		{events.StatusOpened, false},
+	} {
+		if accepted := sub.accept(SubscriberGroupEvent{donorId: "donor", status: testCase.status}); accepted != testCase.accept {
+			test.Errorf("expected accept(%s) to be %t", testCase.status, testCase.accept)
+		}
+	}
+	if !sub.accept(SubscriberGroupEvent{donorId: "new-donor", status: events.StatusSent}) {
+		test.Errorf("expected events for donors outside the snapshot to be accepted")
+	}
+
+	// subscribers without a snapshot are sent every event
+	if !(&subscriber{}).accept(SubscriberGroupEvent{donorId: "donor", status: events.StatusSent}) {
+		test.Errorf("expected subscribers without a snapshot to accept every event")
+	}
+}
@@ -0,0 +1,199 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
+)
+
+type SubscriptionOutcome = store.SubscriptionOutcome
+
+const (
+	SubscriptionConfirmed       SubscriptionOutcome = "confirmed"
+	SubscriptionConfirmFailed   SubscriptionOutcome = "confirm_failed"
+	SubscriptionConfirmDisabled SubscriptionOutcome = "confirm_disabled"
+	SubscriptionTopicNotAllowed SubscriptionOutcome = "topic_not_allowed"
+	SubscriptionUnsubscribed    SubscriptionOutcome = "unsubscribed"
+)
+
+// defaultSubscriptionRecords is the number of subscription records listed when no limit is given
+const defaultSubscriptionRecords = 100
+
+// SubscriptionRecord is the outcome of handling a SubscriptionConfirmation
+// or UnsubscribeConfirmation message
+type SubscriptionRecord = store.SubscriptionRecord
+
+// WithAutoConfirm controls whether SubscriptionConfirmation messages from allowed
+// topics are confirmed automatically. Enabled by default.
+func WithAutoConfirm(enabled bool) Option {
+	return func(server *BroadcastServer) {
+		server.autoConfirm = enabled
+	}
+}
+
+// WithAllowedTopics allows topics other than the server's snsArn to publish
+// to and subscribe the server.
+func WithAllowedTopics(topicArns ...string) Option {
+	return func(server *BroadcastServer) {
+		for _, topicArn := range topicArns {
+			server.allowedTopics[topicArn] = struct{}{}
+		}
+	}
+}
+
+// WithHttpClient sets the client used to visit SubscribeURLs
+func WithHttpClient(client *http.Client) Option {
+	return func(server *BroadcastServer) {
+		server.httpClient = client
+	}
+}
+
+func (server *BroadcastServer) isAllowedTopic(topicArn string) bool {
+	_, ok := server.allowedTopics[topicArn]
+	return ok
+}
+
+// SubscriptionRecords returns the outcomes of the most recent limit subscription messages,
+// oldest first.
+func (server *BroadcastServer) SubscriptionRecords(ctx context.Context, limit int) ([]SubscriptionRecord, error) {
+	return server.store.SubscriptionRecords(ctx, limit)
+}
+
+// SubscriptionRecordsHandler responds with the most recent subscription records, up to
+// the limit query parameter
+func (server *BroadcastServer) SubscriptionRecordsHandler(writer http.ResponseWriter, req *http.Request) {
+	limit := defaultSubscriptionRecords
+	if value := req.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(writer, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	records, err := server.SubscriptionRecords(req.Context(), limit)
+	if err != nil {
+		server.log(req.Context()).Error("failed to read subscription records", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJson(writer, http.StatusOK, struct {
+		Subscriptions []SubscriptionRecord `json:"subscriptions"`
+	}{Subscriptions: records})
+}
+
+// recordSubscription stores the outcome, failures are logged since SNS doesn't care
+// whether it was recorded
+func (server *BroadcastServer) recordSubscription(ctx context.Context, record SubscriptionRecord) {
+	if err := server.beginWrite(); err != nil {
+		server.log(ctx).Error("failed to record subscription message", errAttr(err))
+		return
+	}
+	defer server.endWrite()
+	err := server.withRetries(ctx, "subscription record", func(ctx context.Context) error {
+		return server.store.RecordSubscription(ctx, record)
+	})
+	if err != nil {
+		server.log(ctx).Error("failed to record subscription message", errAttr(err))
+	}
+}
+
+// handleSubscriptionMessage handles SubscriptionConfirmation and UnsubscribeConfirmation
+// messages. Subscriptions to allowed topics are confirmed by visiting the SubscribeURL.
+// Unsubscriptions are only recorded, visiting their SubscribeURL would undo them.
+func (server *BroadcastServer) handleSubscriptionMessage(writer http.ResponseWriter, req *http.Request, envelope *events.SnsEventStruct) {
+	logger := server.log(req.Context())
+	record := SubscriptionRecord{
+		Id:        uuid.Must(uuid.NewV7()).String(),
+		Type:      envelope.Type,
+		TopicArn:  envelope.TopicArn,
+		MessageId: envelope.MessageId,
+		CreatedAt: time.Now(),
+	}
+	statusCode := http.StatusOK
+
+	switch {
+	case !server.isAllowedTopic(envelope.TopicArn):
+		record.Outcome = SubscriptionTopicNotAllowed
+		statusCode = http.StatusForbidden
+	case envelope.Type == "UnsubscribeConfirmation":
+		record.Outcome = SubscriptionUnsubscribed
+	case !server.autoConfirm:
+		record.Outcome = SubscriptionConfirmDisabled
+	default:
+		subscriptionArn, err := server.confirmSubscription(req.Context(), envelope)
+		if err != nil {
+			record.Outcome = SubscriptionConfirmFailed
+			record.Error = err.Error()
+			statusCode = http.StatusBadGateway
+		} else {
+			record.Outcome = SubscriptionConfirmed
+			record.SubscriptionArn = subscriptionArn
+		}
+	}
+
+	server.recordSubscription(req.Context(), record)
+	if record.Outcome == SubscriptionConfirmDisabled {
+		logger.Info("auto confirm disabled, confirm the subscription manually", slog.String("topic_arn", envelope.TopicArn), slog.String("subscribe_url", envelope.SubscribeURL))
+	} else if record.Error != "" {
+		logger.Error("failed to handle subscription message", slog.String("type", envelope.Type), slog.String("topic_arn", envelope.TopicArn), slog.String("outcome", string(record.Outcome)), slog.String("error", record.Error))
+	} else {
+		logger.Info("handled subscription message", slog.String("type", envelope.Type), slog.String("topic_arn", envelope.TopicArn), slog.String("outcome", string(record.Outcome)))
+	}
+
+	if statusCode != http.StatusOK {
+		http.Error(writer, http.StatusText(statusCode), statusCode)
+		return
+	}
+	writer.WriteHeader(statusCode)
+}
+
+// confirmSubscription visits the SubscribeURL and returns the arn of the confirmed subscription
+func (server *BroadcastServer) confirmSubscription(ctx context.Context, envelope *events.SnsEventStruct) (string, error) {
+	subscribeUrl, err := url.Parse(envelope.SubscribeURL)
+	if err != nil {
+		return "", err
+	}
+	if subscribeUrl.Scheme != "https" || !events.DefaultCertHostPattern.MatchString(subscribeUrl.Hostname()) {
+		return "", fmt.Errorf("untrusted subscribe url %q", envelope.SubscribeURL)
+	}
+	if subscribeUrl.Query().Get("Token") != envelope.Token {
+		return "", errors.New("subscribe url token does not match message token")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subscribeUrl.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := server.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d: %s", res.StatusCode, body)
+	}
+
+	var response struct {
+		SubscriptionArn string `xml:"ConfirmSubscriptionResult>SubscriptionArn"`
+	}
+	// the arn is only informational so a malformed body isn't an error
+	xml.Unmarshal(body, &response)
+	return response.SubscriptionArn, nil
+}
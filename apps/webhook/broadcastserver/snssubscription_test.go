@@ -0,0 +1,209 @@
+package broadcastserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"webhook/events"
+)
+
+// standInClient returns a client which sends every request to the stand-in server
+// regardless of the request's host
+func standInClient(standIn *httptest.Server) *http.Client {
+	standInUrl, _ := url.Parse(standIn.URL)
+	return &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.URL.Scheme = standInUrl.Scheme
+			req.URL.Host = standInUrl.Host
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func subscriptionMessage(test *testing.T, messageType, topicArn, token string) string {
+	test.Helper()
+	subscribeUrl := "https://sns.us-west-2.amazonaws.com/?Action=ConfirmSubscription&TopicArn=" +
+		url.QueryEscape(topicArn) + "&Token=" + url.QueryEscape(token)
+	envelope := &events.SnsEventStruct{
+		Type:             messageType,
+		MessageId:        randAlphaNumericString(10),
+		Token:            token,
+		TopicArn:         topicArn,
+		Message:          []byte(`"You have chosen to subscribe to the topic"`),
+		SubscribeURL:     subscribeUrl,
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+		SignatureVersion: "2",
+	}
+	msg, err := signEnvelope(envelope)
+	assertSuccess(test, err)
+	return msg
+}
+
+func Test_subscriptionConfirmation(test *testing.T) {
+	test.Parallel()
+
+	var confirmLock sync.Mutex
+	var confirmedTokens []string
+	standIn := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		confirmLock.Lock()
+		confirmedTokens = append(confirmedTokens, req.URL.Query().Get("Token"))
+		confirmLock.Unlock()
+		writer.Write([]byte(`<ConfirmSubscriptionResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/">
+  <ConfirmSubscriptionResult>
+    <SubscriptionArn>arn:aws:sns:us-west-2:123456789012:MyTopic:test-subscription</SubscriptionArn>
+  </ConfirmSubscriptionResult>
+</ConfirmSubscriptionResponse>`))
+	}))
+	defer standIn.Close()
+
+	getConfirmedTokens := func() []string {
+		confirmLock.Lock()
+		defer confirmLock.Unlock()
+		return append([]string(nil), confirmedTokens...)
+	}
+
+	test.Run("confirms allowed topics", func(test *testing.T) {
+		tester := setupBroadcastServerTester(test, 30*time.Second, WithHttpClient(standInClient(standIn)))
+		defer tester.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		statusCode, err := tester.postPublish(ctx, subscriptionMessage(test, "SubscriptionConfirmation", snsArn, "allowed-token"))
+		assertSuccess(test, err)
+		if statusCode != http.StatusOK {
+			test.Fatalf("expected %d but got %d", http.StatusOK, statusCode)
+		}
+		tokens := getConfirmedTokens()
+		if len(tokens) != 1 || tokens[0] != "allowed-token" {
+			test.Fatalf("expected the subscription to be confirmed once, confirmed tokens: %v", tokens)
+		}
+
+		records, err := tester.broadcastServer.SubscriptionRecords(ctx, 100)
+		assertSuccess(test, err)
+		if len(records) != 1 || records[0].Outcome != SubscriptionConfirmed {
+			test.Fatalf("expected one confirmed record but got %+v", records)
+		}
+		if records[0].SubscriptionArn != "arn:aws:sns:us-west-2:123456789012:MyTopic:test-subscription" {
+			test.Errorf("unexpected subscription arn %s", records[0].SubscriptionArn)
+		}
+	})
+
+	test.Run("ignores other topics", func(test *testing.T) {
+		tester := setupBroadcastServerTester(test, 30*time.Second, WithHttpClient(standInClient(standIn)))
+		defer tester.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		otherArn := "arn:aws:sns:us-west-2:123456789012:OtherTopic"
+		statusCode, err := tester.postPublishForTopic(ctx, subscriptionMessage(test, "SubscriptionConfirmation", otherArn, "other-token"), otherArn)
+		assertSuccess(test, err)
+		if statusCode != http.StatusForbidden {
+			test.Fatalf("expected %d but got %d", http.StatusForbidden, statusCode)
+		}
+		for _, token := range getConfirmedTokens() {
+			if token == "other-token" {
+				test.Fatal("subscription to a topic which isn't allowed was confirmed")
+			}
+		}
+
+		records, err := tester.broadcastServer.SubscriptionRecords(ctx, 100)
+		assertSuccess(test, err)
+		if len(records) != 1 || records[0].Outcome != SubscriptionTopicNotAllowed {
+			test.Fatalf("expected one not allowed record but got %+v", records)
+		}
+	})
+
+	test.Run("confirmation can be disabled", func(test *testing.T) {
+		tester := setupBroadcastServerTester(test, 30*time.Second, WithHttpClient(standInClient(standIn)), WithAutoConfirm(false))
+		defer tester.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		statusCode, err := tester.postPublish(ctx, subscriptionMessage(test, "SubscriptionConfirmation", snsArn, "disabled-token"))
+		assertSuccess(test, err)
+		if statusCode != http.StatusOK {
+			test.Fatalf("expected %d but got %d", http.StatusOK, statusCode)
+		}
+		for _, token := range getConfirmedTokens() {
+			if token == "disabled-token" {
+				test.Fatal("subscription was confirmed with auto confirm disabled")
+			}
+		}
+
+		statusCode, err = tester.postPublish(ctx, subscriptionMessage(test, "UnsubscribeConfirmation", snsArn, "unsubscribe-token"))
+		assertSuccess(test, err)
+		if statusCode != http.StatusOK {
+			test.Fatalf("expected %d but got %d", http.StatusOK, statusCode)
+		}
+
+		records, err := tester.broadcastServer.SubscriptionRecords(ctx, 100)
+		assertSuccess(test, err)
+		if len(records) != 2 || records[0].Outcome != SubscriptionConfirmDisabled || records[1].Outcome != SubscriptionUnsubscribed {
+			test.Fatalf("unexpected records %+v", records)
+		}
+	})
+}
+
+func Test_subscriptionRecordsHandler(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tester := setupBroadcastServerTester(test, 30*time.Second, WithAutoConfirm(false))
+	defer tester.close()
+
+	otherArn := "arn:aws:sns:us-west-2:123456789012:OtherTopic"
+	_, err := tester.postPublishForTopic(ctx, subscriptionMessage(test, "SubscriptionConfirmation", otherArn, "other-token"), otherArn)
+	assertSuccess(test, err)
+	_, err = tester.postPublish(ctx, subscriptionMessage(test, "SubscriptionConfirmation", snsArn, "disabled-token"))
+	assertSuccess(test, err)
+	_, err = tester.postPublish(ctx, subscriptionMessage(test, "UnsubscribeConfirmation", snsArn, "unsubscribe-token"))
+	assertSuccess(test, err)
+
+	var response struct {
+		Subscriptions []SubscriptionRecord `json:"subscriptions"`
+	}
+	statusCode, err := tester.getJson(ctx, "/subscriptions?limit=2", testAdminToken, &response)
+	assertSuccess(test, err)
+	if statusCode != http.StatusOK {
+		test.Fatalf("expected %d but got %d", http.StatusOK, statusCode)
+	}
+	records := response.Subscriptions
+	if len(records) != 2 || records[0].Outcome != SubscriptionConfirmDisabled || records[1].Outcome != SubscriptionUnsubscribed {
+		test.Fatalf("expected the 2 most recent records but got %+v", records)
+	}
+
+	statusCode, err = tester.getJson(ctx, "/subscriptions", testAdminToken, &response)
+	assertSuccess(test, err)
+	if statusCode != http.StatusOK || len(response.Subscriptions) != 3 || response.Subscriptions[0].TopicArn != otherArn {
+		test.Errorf("expected every record but got %d %+v", statusCode, response.Subscriptions)
+	}
+
+	statusCode, err = tester.getJson(ctx, "/subscriptions?limit=none", testAdminToken, &response)
+	assertSuccess(test, err)
+	if statusCode != http.StatusBadRequest {
+		test.Errorf("expected %d but got %d", http.StatusBadRequest, statusCode)
+	}
+	// records are only listed to admins
+	statusCode, err = tester.getJson(ctx, "/subscriptions", testApiToken, &response)
+	assertSuccess(test, err)
+	if statusCode != http.StatusUnauthorized {
+		test.Errorf("expected %d but got %d", http.StatusUnauthorized, statusCode)
+	}
+}
@@ -0,0 +1,154 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	// sseWriteTimeout is how long a single write to an event stream may take
+	sseWriteTimeout = 5 * time.Second
+	// sseRetry is how long browsers wait before reconnecting, in milliseconds
+	sseRetry = 3000
+)
+
+// WithHeartbeatInterval sets how often a comment is sent on idle event streams
+// so proxies don't close them. Defaults to 15 seconds.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(server *BroadcastServer) {
+		server.heartbeatInterval = interval
+	}
+}
+
+// allowedOrigin reports whether a browser on the origin may read the event stream,
+// using the same patterns as the WebSocket subscribe
+func allowedOrigin(origin string) bool {
+	originUrl, err := url.Parse(origin)
+	if err != nil || originUrl.Host == "" {
+		return false
+	}
+	for _, pattern := range originPatterns {
+		if matched, _ := path.Match(pattern, strings.ToLower(originUrl.Host)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// EventsHandler streams a campaign's events as server-sent events, for clients
+// which can't open a WebSocket. Each event's id is its seq so EventSource can resume
+// from the last event it received when it reconnects, see parseSubscribeOptions.
+func (server *BroadcastServer) EventsHandler(writer http.ResponseWriter, req *http.Request) {
+	campaignId := req.PathValue("campaignId")
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if !allowedOrigin(origin) {
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Add("Vary", "Origin")
+	}
+
+	if err := server.authorize(req, campaignId); err != nil {
+		statusCode, _ := authStatus(err)
+		if statusCode == http.StatusInternalServerError {
+			server.log(req.Context()).Error("failed to authorize subscriber", campaignAttr(campaignId), errAttr(err))
+		}
+		http.Error(writer, http.StatusText(statusCode), statusCode)
+		return
+	}
+
+	options, err := parseSubscribeOptions(req)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	closeStream := func(websocket.StatusCode, string) { cancel() }
+	sock, err := server.openSocket(closeStream)
+	if err != nil {
+		refuseWhileDraining(writer)
+		return
+	}
+	defer server.closeSocket(sock)
+	sub := newSubscriber(campaignId, options, closeStream)
+
+	server.log(ctx).Debug("client subscribed to server-sent events", campaignAttr(campaignId))
+	messages, err := server.subscribe(ctx, sub, options)
+	if err != nil {
+		server.log(ctx).Error("failed to subscribe", campaignAttr(campaignId), errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer server.DeleteSubscriber(sub)
+
+	responseController := http.NewResponseController(writer)
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	// stops nginx from buffering the stream
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	// the server's write timeout would otherwise end the stream, so each write gets its own deadline
+	write := func(message string) error {
+		err := responseController.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write([]byte(message))
+		if err != nil {
+			return err
+		}
+		return responseController.Flush()
+	}
+	writeMessage := func(seq uint64, body any) error {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		return write(fmt.Sprintf("id: %d\ndata: %s\n\n", seq, data))
+	}
+
+	if err := write(fmt.Sprintf("retry: %d\n\n", sseRetry)); err != nil {
+		return
+	}
+	for _, message := range messages {
+		if err := writeMessage(message.seq, message.body); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(server.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-sub.events:
+			// events published before the broker's buffer was read were replayed already
+			if event.seq <= sub.seq || !sub.accept(event) {
+				continue
+			}
+			sub.seq = event.seq
+			if err := writeMessage(event.seq, event.toSubscriberEvent()); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := write(": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
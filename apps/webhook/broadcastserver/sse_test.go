@@ -0,0 +1,168 @@
+package broadcastserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+type sseMessage struct {
+	id      string
+	data    string
+	comment string
+}
+
+type sseClient struct {
+	res     *http.Response
+	scanner *bufio.Scanner
+}
+
+func newSseClient(ctx context.Context, url, lastEventId string) (*sseClient, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("expected %d but got %d", http.StatusOK, res.StatusCode)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected content type %s", contentType)
+	}
+	return &sseClient{res: res, scanner: bufio.NewScanner(res.Body)}, nil
+}
+
+// next returns the next event or comment, skipping the retry field
+func (client *sseClient) next() (sseMessage, error) {
+	var message sseMessage
+	for client.scanner.Scan() {
+		line := client.scanner.Text()
+		switch {
+		case line == "":
+			if message != (sseMessage{}) {
+				return message, nil
+			}
+		case strings.HasPrefix(line, ":"):
+			message.comment = strings.TrimSpace(strings.TrimPrefix(line, ":"))
+		case strings.HasPrefix(line, "id: "):
+			message.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			message.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if err := client.scanner.Err(); err != nil {
+		return message, err
+	}
+	return message, fmt.Errorf("stream closed")
+}
+
+// nextEvent skips heartbeats
+func (client *sseClient) nextEvent() (string, SubscriberEvent, error) {
+	for {
+		message, err := client.next()
+		if err != nil {
+			return "", SubscriberEvent{}, err
+		}
+		if message.data == "" {
+			continue
+		}
+		var event SubscriberEvent
+		err = json.Unmarshal([]byte(message.data), &event)
+		return message.id, event, err
+	}
+}
+
+func (client *sseClient) Close() error {
+	return client.res.Body.Close()
+}
+
+func Test_serverSentEvents(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	memoryStore := store.NewMemoryStore()
+	tester := setupStoreTester(test, memoryStore, 30*time.Second, WithHeartbeatInterval(20*time.Millisecond))
+	defer tester.close()
+
+	campaignId := "test-campaign"
+	eventsUrl := tester.subscribeUrl("/events/", campaignId)
+	client, err := newSseClient(ctx, eventsUrl, "")
+	assertSuccess(test, err)
+	defer client.Close()
+
+	donorIds := []string{"first-donor", "second-donor"}
+	for _, donorId := range donorIds {
+		memoryStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+		err = tester.publishEvent(ctx, campaignId, donorId, "email-"+donorId, events.Send)
+		assertSuccess(test, err)
+	}
+	for i, donorId := range donorIds {
+		id, event, err := client.nextEvent()
+		assertSuccess(test, err)
+		if id != fmt.Sprint(i+1) || event.DonorId != donorId || event.Status != events.StatusSent {
+			test.Errorf("expected event %d for %s but got %s %+v", i+1, donorId, id, event)
+		}
+	}
+
+	// idle streams get heartbeats
+	message, err := client.next()
+	assertSuccess(test, err)
+	if message.comment != "heartbeat" {
+		test.Errorf("expected a heartbeat but got %+v", message)
+	}
+
+	// reconnecting resumes after the last event received
+	resumed, err := newSseClient(ctx, eventsUrl, "1")
+	assertSuccess(test, err)
+	defer resumed.Close()
+	id, event, err := resumed.nextEvent()
+	assertSuccess(test, err)
+	if id != "2" || event.DonorId != "second-donor" {
+		test.Errorf("expected to resume from event 2 but got %s %+v", id, event)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, eventsUrl, nil)
+	assertSuccess(test, err)
+	req.Header.Set("Origin", "https://example.com")
+	res, err := http.DefaultClient.Do(req)
+	assertSuccess(test, err)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		test.Errorf("expected %d for another origin but got %d", http.StatusForbidden, res.StatusCode)
+	}
+}
+
+func Test_allowedOrigin(test *testing.T) {
+	test.Parallel()
+
+	for origin, expected := range map[string]bool{
+		"https://donationreceipt.online":         true,
+		"https://www.donationreceipt.online":     true,
+		"https://app-babyccino.vercel.app":       true,
+		"https://donationreceipt.online.example": false,
+		"https://example.com":                    false,
+		"not a url":                              false,
+	} {
+		if allowedOrigin(origin) != expected {
+			test.Errorf("expected allowedOrigin(%q) to be %t", origin, expected)
+		}
+	}
+}
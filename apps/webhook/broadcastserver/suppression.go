@@ -0,0 +1,186 @@
+package broadcastserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+// maxSuppressionCheck is the most addresses which can be checked in one request
+const maxSuppressionCheck = 1000
+
+// WithAdminToken sets the bearer token required by the admin endpoints, e.g. removing
+// a suppression. The endpoints reject every request if no token is set.
+func WithAdminToken(token string) Option {
+	return func(server *BroadcastServer) {
+		server.adminToken = token
+	}
+}
+
+// NormalizeEmail lower cases the address and strips any display name
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	if address, err := mail.ParseAddress(email); err == nil {
+		email = address.Address
+	}
+	return strings.ToLower(email)
+}
+
+// SuppressionsForEvent returns the suppressions caused by an event.
+// Only permanent bounces and complaints suppress an address.
+func SuppressionsForEvent(event events.ParsedEvent) []store.Suppression {
+	var emails []string
+	var reason store.SuppressionReason
+	var detail string
+	switch {
+	case event.Bounce != nil && event.Bounce.BounceType == "Permanent":
+		reason = store.SuppressionBounce
+		detail = event.Bounce.BounceSubType
+		for _, recipient := range event.Bounce.BouncedRecipients {
+			emails = append(emails, recipient.EmailAddress)
+		}
+	case event.Complaint != nil:
+		reason = store.SuppressionComplaint
+		detail = event.Complaint.ComplaintFeedbackType
+		for _, recipient := range event.Complaint.ComplainedRecipients {
+			emails = append(emails, recipient.EmailAddress)
+		}
+	default:
+		return nil
+	}
+
+	suppressions := make([]store.Suppression, 0, len(emails))
+	for _, email := range emails {
+		email = NormalizeEmail(email)
+		if email == "" {
+			continue
+		}
+		suppressions = append(suppressions, store.Suppression{
+			Email:        email,
+			Reason:       reason,
+			Detail:       detail,
+			CampaignId:   event.CampaignId,
+			DonorId:      event.DonorId,
+			EmailId:      event.EmailId,
+			SnsMessageId: event.SnsMessageId,
+		})
+	}
+	return suppressions
+}
+
+// WriteSuppressions records the addresses suppressed by the event, if any.
+// A suppressed address which is suppressed again is updated with the latest event.
+func (server *BroadcastServer) WriteSuppressions(ctx context.Context, event events.ParsedEvent) error {
+	for _, suppression := range SuppressionsForEvent(event) {
+		err := server.store.UpsertSuppression(ctx, suppression)
+		if err != nil {
+			server.log(ctx).Error("failed to write a suppression", campaignAttr(suppression.CampaignId), donorAttr(suppression.DonorId), errAttr(err))
+			return err
+		}
+		server.log(ctx).Info("suppressed an address", campaignAttr(suppression.CampaignId), donorAttr(suppression.DonorId), slog.String("reason", string(suppression.Reason)))
+	}
+	return nil
+}
+
+// ReadSuppressions returns the suppressions for the given addresses,
+// or every suppression if emails is nil
+func (server *BroadcastServer) ReadSuppressions(ctx context.Context, emails []string) ([]store.Suppression, error) {
+	if emails == nil {
+		return server.store.Suppressions(ctx, nil)
+	}
+	normalized := make([]string, 0, len(emails))
+	for _, email := range emails {
+		normalized = append(normalized, NormalizeEmail(email))
+	}
+	return server.store.Suppressions(ctx, normalized)
+}
+
+func writeJson(writer http.ResponseWriter, statusCode int, response any) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(body)
+}
+
+// GetSuppressionHandler responds with the suppression for the address or 404
+func (server *BroadcastServer) GetSuppressionHandler(writer http.ResponseWriter, req *http.Request) {
+	suppressions, err := server.ReadSuppressions(req.Context(), []string{req.PathValue("email")})
+	if err != nil {
+		server.log(req.Context()).Error("failed to read suppressions", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(suppressions) == 0 {
+		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	writeJson(writer, http.StatusOK, suppressions[0])
+}
+
+// CheckSuppressionsHandler takes a list of addresses and responds with those which are suppressed
+// so the sender can skip them
+func (server *BroadcastServer) CheckSuppressionsHandler(writer http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(writer, req.Body, 256*1024))
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var parsedBody struct {
+		Emails []string `json:"emails"`
+	}
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || parsedBody.Emails == nil || len(parsedBody.Emails) > maxSuppressionCheck {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	suppressions, err := server.ReadSuppressions(req.Context(), parsedBody.Emails)
+	if err != nil {
+		server.log(req.Context()).Error("failed to read suppressions", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJson(writer, http.StatusOK, struct {
+		Suppressed []store.Suppression `json:"suppressed"`
+	}{Suppressed: suppressions})
+}
+
+// ListSuppressionsHandler responds with every suppression
+func (server *BroadcastServer) ListSuppressionsHandler(writer http.ResponseWriter, req *http.Request) {
+	suppressions, err := server.ReadSuppressions(req.Context(), nil)
+	if err != nil {
+		server.log(req.Context()).Error("failed to read suppressions", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJson(writer, http.StatusOK, struct {
+		Suppressions []store.Suppression `json:"suppressions"`
+	}{Suppressions: suppressions})
+}
+
+// DeleteSuppressionHandler removes the suppression so the address can be emailed again
+func (server *BroadcastServer) DeleteSuppressionHandler(writer http.ResponseWriter, req *http.Request) {
+	deleted, err := server.store.DeleteSuppression(req.Context(), NormalizeEmail(req.PathValue("email")))
+	if err != nil {
+		server.log(req.Context()).Error("failed to delete suppression", errAttr(err))
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	server.log(req.Context()).Info("suppression removed by an admin")
+	writer.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,124 @@
+package broadcastserver
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"webhook/events"
+	"webhook/store"
+)
+
+// the recipient of every test email
+const testRecipient = "success@simulator.amazonses.com"
+
+func TestSuppressionsForEvent(test *testing.T) {
+	test.Parallel()
+
+	permanent := events.ParsedEvent{
+		CampaignId: "test-campaign",
+		DonorId:    "test-donor",
+		Bounce: &events.BounceObject{
+			BounceType:        "Permanent",
+			BounceSubType:     "General",
+			BouncedRecipients: []events.BouncedRecipient{{EmailAddress: "Donor <Donor@Example.com>"}},
+		},
+	}
+	suppressions := SuppressionsForEvent(permanent)
+	if len(suppressions) != 1 || suppressions[0].Email != "donor@example.com" || suppressions[0].Reason != store.SuppressionBounce {
+		test.Errorf("unexpected suppressions for a permanent bounce %+v", suppressions)
+	}
+
+	transient := permanent
+	transient.Bounce = &events.BounceObject{
+		BounceType:        "Transient",
+		BouncedRecipients: []events.BouncedRecipient{{EmailAddress: "donor@example.com"}},
+	}
+	if suppressions := SuppressionsForEvent(transient); len(suppressions) != 0 {
+		test.Errorf("expected transient bounces not to suppress, got %+v", suppressions)
+	}
+
+	complaint := events.ParsedEvent{
+		Complaint: &events.ComplaintObject{
+			ComplainedRecipients:  []events.ComplainedRecipient{{EmailAddress: "a@example.com"}, {EmailAddress: "b@example.com"}},
+			ComplaintFeedbackType: "abuse",
+		},
+	}
+	suppressions = SuppressionsForEvent(complaint)
+	if len(suppressions) != 2 || suppressions[1].Email != "b@example.com" || suppressions[1].Detail != "abuse" {
+		test.Errorf("unexpected suppressions for a complaint %+v", suppressions)
+	}
+}
+
+func Test_suppressions(test *testing.T) {
+	test.Parallel()
+
+	tester := setupBroadcastServerTester(test, 30*time.Second)
+	defer tester.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	suppressionPath := "/suppressions/" + url.PathEscape(testRecipient)
+	statusCode, err := tester.getJson(ctx, suppressionPath, testApiToken, nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusNotFound {
+		test.Fatalf("expected %d before the bounce but got %d", http.StatusNotFound, statusCode)
+	}
+
+	campaignId := "test-campaign"
+	donorId := randAlphaNumericString(10)
+	emailId := randAlphaNumericString(10)
+	err = tester.generateDbEntriesForEvent(campaignId, donorId, emailId)
+	assertSuccess(test, err)
+	err = tester.publishEvent(ctx, campaignId, donorId, emailId, string(events.Bounce))
+	assertSuccess(test, err)
+
+	var suppression store.Suppression
+	statusCode, err = tester.getJson(ctx, suppressionPath, testApiToken, &suppression)
+	assertSuccess(test, err)
+	if statusCode != http.StatusOK {
+		test.Fatalf("expected %d after the bounce but got %d", http.StatusOK, statusCode)
+	}
+	if suppression.Email != testRecipient || suppression.Reason != store.SuppressionBounce ||
+		suppression.CampaignId != campaignId || suppression.DonorId != donorId || suppression.EmailId != emailId {
+		test.Errorf("unexpected suppression %+v", suppression)
+	}
+
+	var check struct {
+		Suppressed []store.Suppression `json:"suppressed"`
+	}
+	body := map[string][]string{"emails": {"someone@example.com", "SUCCESS@simulator.amazonses.com"}}
+	statusCode, err = tester.requestJson(ctx, http.MethodPost, "/suppressions/check", testApiToken, body, &check)
+	assertSuccess(test, err)
+	if statusCode != http.StatusOK {
+		test.Fatalf("expected %d but got %d", http.StatusOK, statusCode)
+	}
+	if len(check.Suppressed) != 1 || check.Suppressed[0].Email != testRecipient {
+		test.Errorf("expected only %s to be suppressed but got %+v", testRecipient, check.Suppressed)
+	}
+
+	// removing requires the admin token
+	statusCode, err = tester.requestJson(ctx, http.MethodDelete, suppressionPath, testApiToken, nil, nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusUnauthorized {
+		test.Fatalf("expected %d with the api token but got %d", http.StatusUnauthorized, statusCode)
+	}
+	statusCode, err = tester.requestJson(ctx, http.MethodDelete, suppressionPath, testAdminToken, nil, nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusNoContent {
+		test.Fatalf("expected %d but got %d", http.StatusNoContent, statusCode)
+	}
+	statusCode, err = tester.getJson(ctx, suppressionPath, testApiToken, nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusNotFound {
+		test.Fatalf("expected %d after removal but got %d", http.StatusNotFound, statusCode)
+	}
+	statusCode, err = tester.requestJson(ctx, http.MethodDelete, suppressionPath, testAdminToken, nil, nil)
+	assertSuccess(test, err)
+	if statusCode != http.StatusNotFound {
+		test.Fatalf("expected %d removing twice but got %d", http.StatusNotFound, statusCode)
+	}
+}
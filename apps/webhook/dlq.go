@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"webhook/broadcastserver"
+	"webhook/store"
+)
+
+const dlqUsage = `usage: webhook dlq <command>
+
+  list [-limit n]         list dead letters, oldest first
+  show <id>               print a dead letter and its sns message body
+  replay <id>... | -all   apply dead letters again and remove those which succeed
+  purge <id>... | -all    remove dead letters without applying them`
+
+// runDlq inspects and replays the events which failed to parse or to be written.
+// Replayed events go through the same pipeline as publishes, so with REDIS_URL set
+// subscribers connected to any instance receive them.
+func runDlq(ctx context.Context, logger *slog.Logger, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(dlqUsage)
+	}
+	command, args := args[0], args[1:]
+	flags := flag.NewFlagSet("dlq "+command, flag.ContinueOnError)
+	limit := flags.Int("limit", 100, "the most dead letters to list")
+	all := flags.Bool("all", false, "every dead letter")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ids := flags.Args()
+
+	receiptStore, snsArn, err := openStoreFromEnv()
+	if err != nil {
+		return err
+	}
+	if command == "replay" {
+		// the replaying server closes the store when it shuts down
+		return replayDeadLetters(ctx, logger, receiptStore, snsArn, ids, *all, stdout)
+	}
+	defer receiptStore.Close()
+
+	switch command {
+	case "list":
+		return listDeadLetters(ctx, receiptStore, *limit, stdout)
+	case "show":
+		if len(ids) != 1 {
+			return errors.New(dlqUsage)
+		}
+		return showDeadLetter(ctx, receiptStore, ids[0], stdout)
+	case "purge":
+		if *all {
+			purged, err := receiptStore.PurgeDeadLetters(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "purged %d dead letters\n", purged)
+			return nil
+		}
+		if len(ids) == 0 {
+			return errors.New(dlqUsage)
+		}
+		for _, id := range ids {
+			deleted, err := receiptStore.DeleteDeadLetter(ctx, id)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				return fmt.Errorf("%s: %w", id, store.ErrDeadLetterNotFound)
+			}
+			fmt.Fprintf(stdout, "purged %s\n", id)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown dlq command %q\n%s", command, dlqUsage)
+	}
+}
+
+func listDeadLetters(ctx context.Context, receiptStore store.ReceiptStore, limit int, stdout io.Writer) error {
+	letters, err := receiptStore.DeadLetters(ctx, limit)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tREASON\tATTEMPTS\tUPDATED\tERROR")
+	for _, letter := range letters {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", letter.Id, letter.Reason, letter.Attempts, letter.UpdatedAt.Format(time.RFC3339), letter.Error)
+	}
+	return writer.Flush()
+}
+
+func showDeadLetter(ctx context.Context, receiptStore store.ReceiptStore, id string, stdout io.Writer) error {
+	letter, err := receiptStore.DeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	shown := struct {
+		store.DeadLetter
+		Raw any `json:"raw"`
+	}{DeadLetter: letter, Raw: string(letter.Raw)}
+	if json.Valid(letter.Raw) {
+		shown.Raw = json.RawMessage(letter.Raw)
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(shown)
+}
+
+// deadLetterIds returns the given ids or, with -all, the id of every dead letter
+func deadLetterIds(ctx context.Context, receiptStore store.ReceiptStore, ids []string, all bool) ([]string, error) {
+	if !all {
+		if len(ids) == 0 {
+			return nil, errors.New(dlqUsage)
+		}
+		return ids, nil
+	}
+	// dead letters which fail again stay, so they're listed once up front
+	letters, err := receiptStore.DeadLetters(ctx, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.Id)
+	}
+	return ids, nil
+}
+
+// replayDeadLetters replays each dead letter, carrying on after failures which are
+// recorded against the dead letter. It owns the store and closes it before returning.
+func replayDeadLetters(ctx context.Context, logger *slog.Logger, receiptStore store.ReceiptStore, snsArn string, ids []string, all bool, stdout io.Writer) error {
+	broker, err := openBroker(os.Getenv("REDIS_URL"), maxEventAge)
+	if err != nil {
+		receiptStore.Close()
+		return err
+	}
+	server, err := broadcastserver.NewBroadcastServer(
+		snsArn,
+		receiptStore,
+		maxEventAge,
+		broadcastserver.WithBroker(broker),
+		broadcastserver.WithLogger(logger),
+	)
+	if err != nil {
+		broker.Close()
+		receiptStore.Close()
+		return err
+	}
+	// shutting down closes the broker and the store
+	defer server.Shutdown(ctx)
+
+	ids, err = deadLetterIds(ctx, receiptStore, ids, all)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := server.ReplayDeadLetter(ctx, id); err != nil {
+			failed++
+			fmt.Fprintf(stdout, "failed to replay %s: %s\n", id, err)
+			continue
+		}
+		fmt.Fprintf(stdout, "replayed %s\n", id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to replay %d of %d dead letters", failed, len(ids))
+	}
+	return nil
+}
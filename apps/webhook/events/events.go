@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"time"
 )
 
 // Removes the first and last quotation marks if they exist.
@@ -39,38 +39,63 @@ func Truncate(rawBody []byte) []byte {
 	return rawBody[start : end-mv]
 }
 
-func ParseSnsEvent(rawBody []byte) (campaignId string, donorId string, emailId string, status string, err error) {
+// ParsedEvent is an SES email sending event received through SNS
+// along with the ids we attach to every email
+type ParsedEvent struct {
+	CampaignId string    `json:"campaignId"`
+	DonorId    string    `json:"donorId"`
+	EmailId    string    `json:"emailId"`
+	EventType  EventType `json:"eventType"`
+	// Status is the EventType mapped to the email statuses the web app uses
+	Status string `json:"status"`
+	// Timestamp is when SES says the event happened, not when it was received
+	Timestamp    time.Time  `json:"timestamp"`
+	SnsMessageId string     `json:"snsMessageId"`
+	Mail         MailObject `json:"mail"`
+
+	// only the object matching EventType is set
+	Bounce        *BounceObject           `json:"bounce,omitempty"`
+	Complaint     *ComplaintObject        `json:"complaint,omitempty"`
+	Delivery      *DeliveryObject         `json:"delivery,omitempty"`
+	Send          *SendObject             `json:"send,omitempty"`
+	Reject        *RejectObject           `json:"reject,omitempty"`
+	Open          *OpenObject             `json:"open,omitempty"`
+	Click         *ClickObject            `json:"click,omitempty"`
+	Failure       *RenderingFailureObject `json:"failure,omitempty"`
+	DeliveryDelay *DeliveryDelayObject    `json:"deliveryDelay,omitempty"`
+	Subscription  *SubscriptionObject     `json:"subscription,omitempty"`
+
+	// Raw is the sns message body as it was received
+	Raw json.RawMessage `json:"-"`
+}
+
+func ParseSnsEvent(rawBody []byte) (ParsedEvent, error) {
 	var parsedBody SnsEventStruct
-	err2 := json.Unmarshal(rawBody, &parsedBody)
-	if err2 != nil {
-		fmt.Fprintln(os.Stderr, "[debug][error] error parsing body\n[debug][error] raw body:", string(rawBody))
-		return "", "", "", "", err2
+	err := json.Unmarshal(rawBody, &parsedBody)
+	if err != nil {
+		return ParsedEvent{}, fmt.Errorf("failed to parse body: %w", err)
 	}
 	if parsedBody.Type != "Notification" {
-		fmt.Fprintln(os.Stderr, "[debug][error] invalid type\n[debug][error] raw body:", string(rawBody))
-		return "", "", "", "", errors.New("invalid type")
+		return ParsedEvent{}, fmt.Errorf("invalid type %q", parsedBody.Type)
 	}
 
 	rawMessage := parsedBody.Message
 	if len(rawMessage) == 0 {
-		fmt.Fprintln(os.Stderr, "[debug][error] empty message\n[debug][error] raw body:", string(rawBody))
-		return "", "", "", "", errors.New("empty message")
+		return ParsedEvent{}, errors.New("empty message")
 	}
 
 	var parsedMessage EmailSendingEvent
 	// removes newlines, etc.
 	rawMessage = Truncate(rawMessage)
-	err3 := json.Unmarshal(rawMessage, &parsedMessage)
-	if err3 != nil {
-		fmt.Fprintln(os.Stderr, "[debug][error] error parsing message\n[debug][error] raw message string:", string(rawMessage))
-		return "", "", "", "", err3
+	err = json.Unmarshal(rawMessage, &parsedMessage)
+	if err != nil {
+		return ParsedEvent{}, fmt.Errorf("failed to parse message: %w", err)
 	}
 
 	rawStatus := parsedMessage.EventType
-	emailId = parsedMessage.Mail.MessageID
+	emailId := parsedMessage.Mail.MessageID
 	if rawStatus == "" || emailId == "" {
-		fmt.Fprintln(os.Stderr, "[debug][error] invalid message\n[debug][error] raw message string:", string(rawMessage))
-		return "", "", "", "", errors.New("invalid message")
+		return ParsedEvent{}, errors.New("invalid message")
 	}
 
 	campaignIdIdx := -1
@@ -85,15 +110,90 @@ func ParseSnsEvent(rawBody []byte) (campaignId string, donorId string, emailId s
 	}
 
 	if campaignIdIdx == -1 || donorIdIdx == -1 {
-		fmt.Fprintln(os.Stderr, "[debug][error] missing data header\n[debug][error] headers:", parsedMessage.Mail.Headers)
-		return "", "", "", "", errors.New("missing data header")
+		return ParsedEvent{}, errors.New("missing data header")
 	}
 
-	campaignId = parsedMessage.Mail.Headers[campaignIdIdx].Value
-	donorId = parsedMessage.Mail.Headers[donorIdIdx].Value
+	return ParsedEvent{
+		CampaignId:    parsedMessage.Mail.Headers[campaignIdIdx].Value,
+		DonorId:       parsedMessage.Mail.Headers[donorIdIdx].Value,
+		EmailId:       emailId,
+		EventType:     rawStatus,
+		Status:        MapSnsEvent(rawStatus),
+		Timestamp:     EventTimestamp(&parsedMessage),
+		SnsMessageId:  parsedBody.MessageId,
+		Mail:          parsedMessage.Mail,
+		Bounce:        parsedMessage.Bounce,
+		Complaint:     parsedMessage.Complaint,
+		Delivery:      parsedMessage.Delivery,
+		Send:          parsedMessage.Send,
+		Reject:        parsedMessage.Reject,
+		Open:          parsedMessage.Open,
+		Click:         parsedMessage.Click,
+		Failure:       parsedMessage.Failure,
+		DeliveryDelay: parsedMessage.DeliveryDelay,
+		Subscription:  parsedMessage.Subscription,
+		Raw:           rawBody,
+	}, nil
+}
 
-	status = MapSnsEvent(rawStatus)
-	return
+// Detail returns the object describing the event, e.g. the BounceObject of a Bounce.
+// nil is returned if the event doesn't have one.
+func (event *ParsedEvent) Detail() any {
+	switch {
+	case event.Bounce != nil:
+		return event.Bounce
+	case event.Complaint != nil:
+		return event.Complaint
+	case event.Delivery != nil:
+		return event.Delivery
+	case event.Send != nil:
+		return event.Send
+	case event.Reject != nil:
+		return event.Reject
+	case event.Open != nil:
+		return event.Open
+	case event.Click != nil:
+		return event.Click
+	case event.Failure != nil:
+		return event.Failure
+	case event.DeliveryDelay != nil:
+		return event.DeliveryDelay
+	case event.Subscription != nil:
+		return event.Subscription
+	default:
+		return nil
+	}
+}
+
+// EventTimestamp returns the time SES recorded for the event. Events without
+// a timestamp of their own, e.g. Send, fall back to the time the email was sent.
+// The zero time is returned if no timestamp can be parsed.
+func EventTimestamp(message *EmailSendingEvent) time.Time {
+	var timestamp string
+	switch {
+	case message.Bounce != nil:
+		timestamp = message.Bounce.Timestamp
+	case message.Complaint != nil:
+		timestamp = message.Complaint.Timestamp
+	case message.Delivery != nil:
+		timestamp = message.Delivery.Timestamp
+	case message.Open != nil:
+		timestamp = message.Open.Timestamp
+	case message.Click != nil:
+		timestamp = message.Click.Timestamp
+	case message.DeliveryDelay != nil:
+		timestamp = message.DeliveryDelay.Timestamp
+	case message.Subscription != nil:
+		timestamp = message.Subscription.Timestamp
+	}
+
+	if parsed, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return parsed
+	}
+	if parsed, err := time.Parse(time.RFC3339Nano, message.Mail.Timestamp); err == nil {
+		return parsed
+	}
+	return time.Time{}
 }
 
 type SnsEventStruct struct {
@@ -101,6 +201,7 @@ type SnsEventStruct struct {
 	MessageId        string          `json:"MessageId"`
 	Token            string          `json:"Token"`
 	TopicArn         string          `json:"TopicArn"`
+	Subject          string          `json:"Subject,omitempty"`
 	Message          json.RawMessage `json:"Message"` // JSON string of EmailSendingEvent
 	SubscribeURL     string          `json:"SubscribeURL"`
 	Timestamp        string          `json:"Timestamp"`
@@ -131,27 +232,27 @@ const (
 func MapSnsEvent(eventType EventType) string {
 	switch eventType {
 	case Bounce:
-		return "bounced"
+		return StatusBounced
 	case Reject:
-		return "complained"
+		return StatusComplained
 	case Complaint:
-		return "complained"
+		return StatusComplained
 	case RenderingFailure:
-		return "complained"
+		return StatusComplained
 	case Delivery:
-		return "delivered"
+		return StatusDelivered
 	case Send:
-		return "sent"
+		return StatusSent
 	case Open:
-		return "opened"
+		return StatusOpened
 	case Click:
-		return "clicked"
+		return StatusClicked
 	case DeliveryDelay:
-		return "delivery_delayed"
+		return StatusDeliveryDelayed
 	case Subscription:
-		return "subscribed"
+		return StatusSubscribed
 	default:
-		return "not_sent"
+		return StatusNotSent
 	}
 }
 
@@ -3,6 +3,7 @@ package events
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTruncate(t *testing.T) {
@@ -54,21 +55,35 @@ func TestParseSnsEvent(t *testing.T) {
 "UnsubscribeURL" : "https://sns.test-region.amazonaws.com"
 }`
 	rawBody := []byte(replacer.Replace(rawString))
-	campaignId, donorId, emailId, status, err := ParseSnsEvent(rawBody)
+	event, err := ParseSnsEvent(rawBody)
 	if err != nil {
 		t.Errorf("ParseSnsEvent unexpectedly produced an error: %v", err)
 	}
-	if campaignId != testCampaignId {
-		t.Errorf("expected %v, got %v", testCampaignId, campaignId)
+	if event.CampaignId != testCampaignId {
+		t.Errorf("expected %v, got %v", testCampaignId, event.CampaignId)
 	}
-	if donorId != testDonorId {
-		t.Errorf("expected %v, got %v", testDonorId, donorId)
+	if event.DonorId != testDonorId {
+		t.Errorf("expected %v, got %v", testDonorId, event.DonorId)
 	}
-	if emailId != testEmailId {
-		t.Errorf("expected %v, got %v", testEmailId, emailId)
+	if event.EmailId != testEmailId {
+		t.Errorf("expected %v, got %v", testEmailId, event.EmailId)
 	}
-	if status != "sent" {
-		t.Errorf("expected sent, got %v", status)
+	if event.Status != "sent" {
+		t.Errorf("expected sent, got %v", event.Status)
+	}
+	if event.EventType != Send || event.Send == nil {
+		t.Errorf("expected a Send event, got %v", event.EventType)
+	}
+	// Send events don't have a timestamp of their own
+	expectedTimestamp := time.Date(2024, 3, 11, 14, 47, 59, 955000000, time.UTC)
+	if !event.Timestamp.Equal(expectedTimestamp) {
+		t.Errorf("expected %v, got %v", expectedTimestamp, event.Timestamp)
+	}
+	if event.SnsMessageId != testEmailId {
+		t.Errorf("expected %v, got %v", testEmailId, event.SnsMessageId)
+	}
+	if string(event.Raw) != string(rawBody) {
+		t.Errorf("expected the raw body to be kept")
 	}
 
 	testCampaignId2 := "test-campaign-id-2"
@@ -92,20 +107,69 @@ func TestParseSnsEvent(t *testing.T) {
   "UnsubscribeURL" : "https://sns.test-region.amazonaws.com"
 }`
 	rawBody2 := []byte(replacer2.Replace(rawString2))
-	campaignId2, donorId2, emailId2, status2, err2 := ParseSnsEvent(rawBody2)
+	event2, err2 := ParseSnsEvent(rawBody2)
 	if err2 != nil {
-		t.Errorf("ParseSnsEvent unexpectedly produced an error: %v", err)
+		t.Errorf("ParseSnsEvent unexpectedly produced an error: %v", err2)
+	}
+	if event2.CampaignId != testCampaignId2 {
+		t.Errorf("expected %v, got %v", testCampaignId2, event2.CampaignId)
+	}
+	if event2.DonorId != testDonorId2 {
+		t.Errorf("expected %v, got %v", testDonorId2, event2.DonorId)
+	}
+	if event2.EmailId != testEmailId2 {
+		t.Errorf("expected %v, got %v", testEmailId2, event2.EmailId)
+	}
+	if event2.Status != "delivered" {
+		t.Errorf("expected delivered, got %v", event2.Status)
+	}
+	if event2.Delivery == nil || event2.Delivery.ProcessingTimeMillis != 1261 {
+		t.Errorf("expected the delivery details to be parsed, got %+v", event2.Delivery)
+	}
+	expectedTimestamp2 := time.Date(2024, 3, 13, 11, 43, 2, 183000000, time.UTC)
+	if !event2.Timestamp.Equal(expectedTimestamp2) {
+		t.Errorf("expected %v, got %v", expectedTimestamp2, event2.Timestamp)
+	}
+	if event2.SnsMessageId != "test-sns-message-id" {
+		t.Errorf("expected test-sns-message-id, got %v", event2.SnsMessageId)
+	}
+}
+
+func TestParseSnsEventDetails(t *testing.T) {
+	t.Parallel()
+
+	rawString := `{
+  "Type" : "Notification",
+  "MessageId" : "test-sns-message-id",
+  "TopicArn" : "arn:aws:sns:test-region:test-iam-id:ses-events",
+  "Message" : "{\"eventType\":\"Bounce\",\"bounce\":{\"bounceType\":\"Permanent\",\"bounceSubType\":\"General\",\"bouncedRecipients\":[{\"emailAddress\":\"recipient@example.com\",\"action\":\"failed\",\"status\":\"5.1.1\",\"diagnosticCode\":\"smtp; 550 5.1.1 user unknown\"}],\"timestamp\":\"2024-03-13T11:43:03.000Z\",\"feedbackId\":\"test-feedback-id\",\"reportingMTA\":\"dsn; test-mta\"},\"mail\":{\"timestamp\":\"2024-03-13T11:43:00.921Z\",\"source\":\"noreply@test.online\",\"messageId\":\"test-message-id\",\"destination\":[\"recipient@example.com\"],\"headers\":[{\"name\":\"X-Data-Campaign-ID\",\"value\":\"test-campaign-id\"},{\"name\":\"X-Data-Donor-ID\",\"value\":\"test-donor-id\"}]}}\n",
+  "Timestamp" : "2024-03-13T11:43:03.262Z",
+  "SignatureVersion" : "1",
+  "Signature" : "test-signature-data-url",
+  "SigningCertURL" : "https://sns.test-region.amazonaws.com",
+  "UnsubscribeURL" : "https://sns.test-region.amazonaws.com"
+}`
+	event, err := ParseSnsEvent([]byte(rawString))
+	if err != nil {
+		t.Fatalf("ParseSnsEvent unexpectedly produced an error: %v", err)
+	}
+	if event.Status != "bounced" {
+		t.Errorf("expected bounced, got %v", event.Status)
+	}
+	if event.Bounce == nil {
+		t.Fatal("expected bounce details")
 	}
-	if campaignId2 != testCampaignId2 {
-		t.Errorf("expected %v, got %v", testCampaignId2, campaignId)
+	if event.Bounce.BounceType != "Permanent" || len(event.Bounce.BouncedRecipients) != 1 {
+		t.Errorf("unexpected bounce details %+v", event.Bounce)
 	}
-	if donorId2 != testDonorId2 {
-		t.Errorf("expected %v, got %v", testDonorId2, donorId)
+	if event.Bounce.BouncedRecipients[0].DiagnosticCode != "smtp; 550 5.1.1 user unknown" {
+		t.Errorf("unexpected diagnostic code %v", event.Bounce.BouncedRecipients[0].DiagnosticCode)
 	}
-	if emailId2 != testEmailId2 {
-		t.Errorf("expected %v, got %v", testEmailId2, emailId2)
+	if event.Delivery != nil || event.Click != nil {
+		t.Errorf("expected only the bounce details to be set")
 	}
-	if status2 != "delivered" {
-		t.Errorf("expected delivered, got %v", status)
+	expectedTimestamp := time.Date(2024, 3, 13, 11, 43, 3, 0, time.UTC)
+	if !event.Timestamp.Equal(expectedTimestamp) {
+		t.Errorf("expected %v, got %v", expectedTimestamp, event.Timestamp)
 	}
 }
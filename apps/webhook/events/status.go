@@ -0,0 +1,89 @@
+package events
+
+// Email statuses as produced by MapSnsEvent.
+// They match EmailStatus in packages/types, except for StatusSubscribed
+// which is never written to a receipt.
+const (
+	StatusNotSent         = "not_sent"
+	StatusSent            = "sent"
+	StatusDeliveryDelayed = "delivery_delayed"
+	StatusDelivered       = "delivered"
+	StatusOpened          = "opened"
+	StatusClicked         = "clicked"
+	StatusBounced         = "bounced"
+	StatusComplained      = "complained"
+	StatusSubscribed      = "subscribed"
+)
+
+// statusTransitions lists the statuses a receipt may move to from each status.
+// SES and SNS don't guarantee ordering so a status may only move forward,
+// e.g. a Send notification arriving after a Delivery is ignored.
+// Bounces and complaints are terminal.
+var statusTransitions = map[string][]string{
+	StatusNotSent:         {StatusSent, StatusDeliveryDelayed, StatusDelivered, StatusOpened, StatusClicked, StatusBounced, StatusComplained},
+	StatusSent:            {StatusDeliveryDelayed, StatusDelivered, StatusOpened, StatusClicked, StatusBounced, StatusComplained},
+	StatusDeliveryDelayed: {StatusDelivered, StatusOpened, StatusClicked, StatusBounced, StatusComplained},
+	StatusDelivered:       {StatusOpened, StatusClicked, StatusBounced, StatusComplained},
+	StatusOpened:          {StatusClicked, StatusComplained},
+	StatusClicked:         {StatusComplained},
+	StatusBounced:         {},
+	StatusComplained:      {},
+}
+
+// IsKnownStatus reports whether the status is part of the transition table
+func IsKnownStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// CanTransition reports whether a receipt with status from may be updated to status to.
+// Repeating the current status is allowed so duplicate events are idempotent.
+// A receipt with a status outside of the table may move to any status in the table.
+func CanTransition(from, to string) bool {
+	if !IsKnownStatus(to) {
+		return false
+	}
+	if from == to {
+		return true
+	}
+	next, ok := statusTransitions[from]
+	if !ok {
+		return true
+	}
+	for _, status := range next {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// PreviousStatuses returns every status in the table which may move to status,
+// including status itself.
+func PreviousStatuses(status string) []string {
+	if !IsKnownStatus(status) {
+		return nil
+	}
+	var previous []string
+	// iterate in a fixed order so generated queries are stable
+	for _, from := range KnownStatuses() {
+		if CanTransition(from, status) {
+			previous = append(previous, from)
+		}
+	}
+	return previous
+}
+
+// KnownStatuses returns every status in the transition table
+func KnownStatuses() []string {
+	return []string{
+		StatusNotSent,
+		StatusSent,
+		StatusDeliveryDelayed,
+		StatusDelivered,
+		StatusOpened,
+		StatusClicked,
+		StatusBounced,
+		StatusComplained,
+	}
+}
@@ -0,0 +1,58 @@
+package events
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		from     string
+		to       string
+		expected bool
+	}{
+		{StatusNotSent, StatusSent, true},
+		{StatusSent, StatusDelivered, true},
+		{StatusDelivered, StatusSent, false},
+		{StatusDeliveryDelayed, StatusDelivered, true},
+		{StatusDelivered, StatusDeliveryDelayed, false},
+		{StatusDelivered, StatusOpened, true},
+		{StatusOpened, StatusDelivered, false},
+		{StatusOpened, StatusClicked, true},
+		{StatusClicked, StatusOpened, false},
+		{StatusBounced, StatusDelivered, false},
+		{StatusBounced, StatusComplained, false},
+		{StatusComplained, StatusClicked, false},
+		{StatusClicked, StatusComplained, true},
+		{StatusOpened, StatusOpened, true},
+		{StatusBounced, StatusBounced, true},
+		{StatusNotSent, StatusSubscribed, false},
+		{"unknown", StatusSent, true},
+	}
+	for _, c := range cases {
+		if actual := CanTransition(c.from, c.to); actual != c.expected {
+			t.Errorf("CanTransition(%s, %s): expected %v, got %v", c.from, c.to, c.expected, actual)
+		}
+	}
+}
+
+func TestPreviousStatuses(t *testing.T) {
+	t.Parallel()
+
+	expected := []string{StatusNotSent, StatusSent, StatusDeliveryDelayed, StatusDelivered}
+	if actual := PreviousStatuses(StatusDelivered); !slices.Equal(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if actual := PreviousStatuses(StatusSubscribed); actual != nil {
+		t.Errorf("expected no previous statuses, got %v", actual)
+	}
+
+	// every event maps to a status in the table, apart from subscriptions
+	for _, eventType := range []EventType{Bounce, Complaint, Delivery, Send, Reject, Open, Click, RenderingFailure, DeliveryDelay} {
+		if status := MapSnsEvent(eventType); !IsKnownStatus(status) {
+			t.Errorf("%s maps to %s which isn't in the transition table", eventType, status)
+		}
+	}
+}
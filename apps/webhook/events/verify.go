@@ -0,0 +1,221 @@
+package events
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verification follows
+// https://docs.aws.amazon.com/sns/latest/dg/sns-verify-signature-of-message.html
+
+var (
+	ErrInvalidSignature            = errors.New("invalid sns message signature")
+	ErrUnsupportedSignatureVersion = errors.New("unsupported sns signature version")
+	ErrUntrustedCertUrl            = errors.New("untrusted sns signing cert url")
+	ErrCertFetch                   = errors.New("failed to fetch sns signing cert")
+)
+
+// DefaultCertHostPattern matches the hosts SNS serves its signing certificates from,
+// e.g. sns.us-east-1.amazonaws.com
+var DefaultCertHostPattern = regexp.MustCompile(`^sns\.[a-z0-9\-]+\.amazonaws\.com(\.cn)?$`)
+
+// CertFetcher returns the PEM encoded certificate found at certUrl
+type CertFetcher func(ctx context.Context, certUrl string) ([]byte, error)
+
+// HttpCertFetcher fetches certificates over http using the given client
+func HttpCertFetcher(client *http.Client) CertFetcher {
+	return func(ctx context.Context, certUrl string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, certUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	}
+}
+
+type Verifier struct {
+	fetchCert       CertFetcher
+	certHostPattern *regexp.Regexp
+	certsLock       sync.Mutex
+	certs           map[string]*x509.Certificate
+}
+
+// NewVerifier creates a verifier which only trusts certificates served over https
+// from hosts matching certHostPattern. Fetched certificates are cached in memory
+// until they expire.
+func NewVerifier(fetchCert CertFetcher, certHostPattern *regexp.Regexp) *Verifier {
+	return &Verifier{
+		fetchCert:       fetchCert,
+		certHostPattern: certHostPattern,
+		certs:           make(map[string]*x509.Certificate),
+	}
+}
+
+// Verify checks the signature of the message against the certificate found at
+// its SigningCertURL. Both signature version 1 (SHA1) and 2 (SHA256) are supported.
+func (verifier *Verifier) Verify(ctx context.Context, message *SnsEventStruct) error {
+	var hash crypto.Hash
+	switch message.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedSignatureVersion, message.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+
+	cert, err := verifier.getCert(ctx, message.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: cert does not contain an rsa public key", ErrInvalidSignature)
+	}
+
+	canonical, err := CanonicalString(message)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+
+	var hashed []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(canonical))
+		hashed = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(canonical))
+		hashed = sum[:]
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, hashed, signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (verifier *Verifier) getCert(ctx context.Context, certUrl string) (*x509.Certificate, error) {
+	parsedUrl, err := url.Parse(certUrl)
+	if err != nil || parsedUrl.Scheme != "https" || !verifier.certHostPattern.MatchString(parsedUrl.Hostname()) {
+		return nil, fmt.Errorf("%w: %q", ErrUntrustedCertUrl, certUrl)
+	}
+
+	now := time.Now()
+	verifier.certsLock.Lock()
+	cert, ok := verifier.certs[certUrl]
+	if ok && now.After(cert.NotAfter) {
+		delete(verifier.certs, certUrl)
+		ok = false
+	}
+	verifier.certsLock.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	rawCert, err := verifier.fetchCert(ctx, certUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCertFetch, err)
+	}
+	block, _ := pem.Decode(rawCert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: no certificate found in response", ErrCertFetch)
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCertFetch, err)
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("%w: cert is not currently valid", ErrInvalidSignature)
+	}
+
+	verifier.certsLock.Lock()
+	verifier.certs[certUrl] = cert
+	verifier.certsLock.Unlock()
+	return cert, nil
+}
+
+// CanonicalString builds the string SNS signs for the given message.
+// The set of fields depends on the message type.
+func CanonicalString(message *SnsEventStruct) (string, error) {
+	rawMessage, err := message.MessageString()
+	if err != nil {
+		return "", err
+	}
+
+	var fields [][2]string
+	switch message.Type {
+	case "Notification":
+		fields = [][2]string{
+			{"Message", rawMessage},
+			{"MessageId", message.MessageId},
+			{"Subject", message.Subject},
+			{"Timestamp", message.Timestamp},
+			{"TopicArn", message.TopicArn},
+			{"Type", message.Type},
+		}
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = [][2]string{
+			{"Message", rawMessage},
+			{"MessageId", message.MessageId},
+			{"SubscribeURL", message.SubscribeURL},
+			{"Timestamp", message.Timestamp},
+			{"Token", message.Token},
+			{"TopicArn", message.TopicArn},
+			{"Type", message.Type},
+		}
+	default:
+		return "", fmt.Errorf("unknown message type %q", message.Type)
+	}
+
+	var builder strings.Builder
+	for _, field := range fields {
+		// subject is the only optional field and is left out when missing
+		if field[0] == "Subject" && field[1] == "" {
+			continue
+		}
+		builder.WriteString(field[0])
+		builder.WriteByte('\n')
+		builder.WriteString(field[1])
+		builder.WriteByte('\n')
+	}
+	return builder.String(), nil
+}
+
+// MessageString returns the decoded Message field
+func (message *SnsEventStruct) MessageString() (string, error) {
+	if len(message.Message) == 0 {
+		return "", nil
+	}
+	var str string
+	if err := json.Unmarshal(message.Message, &str); err != nil {
+		return "", err
+	}
+	return str, nil
+}
@@ -0,0 +1,136 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"webhook/internal/snstest"
+)
+
+func signedTestMessage(test *testing.T, signer *snstest.Signer, signatureVersion string) *SnsEventStruct {
+	test.Helper()
+	message := &SnsEventStruct{
+		Type:             "Notification",
+		MessageId:        "test-sns-message-id",
+		TopicArn:         "arn:aws:sns:us-west-2:123456789012:MyTopic",
+		Subject:          "Amazon SES Email Event Notification",
+		Message:          []byte(`"{\"eventType\":\"Send\"}\n"`),
+		Timestamp:        "2024-03-11T14:48:00.136Z",
+		SignatureVersion: signatureVersion,
+		SigningCertURL:   snstest.CertUrl,
+	}
+	canonical, err := CanonicalString(message)
+	if err != nil {
+		test.Fatal(err)
+	}
+	message.Signature, err = signer.Sign(canonical, signatureVersion)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return message
+}
+
+func TestCanonicalString(test *testing.T) {
+	test.Parallel()
+
+	message := &SnsEventStruct{
+		Type:      "Notification",
+		MessageId: "id",
+		TopicArn:  "arn",
+		Message:   []byte(`"hello\nworld"`),
+		Timestamp: "time",
+	}
+	expected := "Message\nhello\nworld\nMessageId\nid\nTimestamp\ntime\nTopicArn\narn\nType\nNotification\n"
+	actual, err := CanonicalString(message)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if actual != expected {
+		test.Errorf("expected %q, got %q", expected, actual)
+	}
+
+	confirmation := &SnsEventStruct{
+		Type:         "SubscriptionConfirmation",
+		MessageId:    "id",
+		Token:        "token",
+		TopicArn:     "arn",
+		Message:      []byte(`"confirm"`),
+		SubscribeURL: "url",
+		Timestamp:    "time",
+	}
+	expected = "Message\nconfirm\nMessageId\nid\nSubscribeURL\nurl\nTimestamp\ntime\nToken\ntoken\nTopicArn\narn\nType\nSubscriptionConfirmation\n"
+	actual, err = CanonicalString(confirmation)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if actual != expected {
+		test.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestVerifier(test *testing.T) {
+	test.Parallel()
+
+	signer, err := snstest.NewSigner()
+	if err != nil {
+		test.Fatal(err)
+	}
+	var fetches atomic.Int32
+	fetchCert := func(ctx context.Context, certUrl string) ([]byte, error) {
+		fetches.Add(1)
+		return signer.Fetch(ctx, certUrl)
+	}
+	verifier := NewVerifier(fetchCert, DefaultCertHostPattern)
+	ctx := context.Background()
+
+	for _, version := range []string{"1", "2"} {
+		message := signedTestMessage(test, signer, version)
+		if err := verifier.Verify(ctx, message); err != nil {
+			test.Errorf("signature version %s: unexpected error: %v", version, err)
+		}
+	}
+	if fetches.Load() != 1 {
+		test.Errorf("expected the cert to be fetched once, was fetched %d times", fetches.Load())
+	}
+
+	tampered := signedTestMessage(test, signer, "2")
+	tampered.Message = []byte(`"{\"eventType\":\"Bounce\"}\n"`)
+	if err := verifier.Verify(ctx, tampered); !errors.Is(err, ErrInvalidSignature) {
+		test.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	downgraded := signedTestMessage(test, signer, "2")
+	downgraded.SignatureVersion = "1"
+	if err := verifier.Verify(ctx, downgraded); !errors.Is(err, ErrInvalidSignature) {
+		test.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	unsupported := signedTestMessage(test, signer, "2")
+	unsupported.SignatureVersion = "3"
+	if err := verifier.Verify(ctx, unsupported); !errors.Is(err, ErrUnsupportedSignatureVersion) {
+		test.Errorf("expected %v, got %v", ErrUnsupportedSignatureVersion, err)
+	}
+
+	for _, certUrl := range []string{
+		"http://sns.us-west-2.amazonaws.com/cert.pem",
+		"https://sns.us-west-2.amazonaws.com.evil.com/cert.pem",
+		"https://evil.com/sns.us-west-2.amazonaws.com/cert.pem",
+	} {
+		untrusted := signedTestMessage(test, signer, "2")
+		untrusted.SigningCertURL = certUrl
+		if err := verifier.Verify(ctx, untrusted); !errors.Is(err, ErrUntrustedCertUrl) {
+			test.Errorf("%s: expected %v, got %v", certUrl, ErrUntrustedCertUrl, err)
+		}
+	}
+
+	failingFetch := func(ctx context.Context, certUrl string) ([]byte, error) {
+		return nil, errors.New("network down")
+	}
+	failingVerifier := NewVerifier(failingFetch, regexp.MustCompile(`.*`))
+	if err := failingVerifier.Verify(ctx, signedTestMessage(test, signer, "1")); !errors.Is(err, ErrCertFetch) {
+		test.Errorf("expected %v, got %v", ErrCertFetch, err)
+	}
+}
@@ -0,0 +1,79 @@
+// Package snstest signs sns messages with a locally generated key so tests can
+// exercise signature verification without reaching out to aws.
+package snstest
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// CertUrl is a signing cert url which passes the default host allow-list
+const CertUrl = "https://sns.us-west-2.amazonaws.com/SimpleNotificationService-test.pem"
+
+type Signer struct {
+	key     *rsa.PrivateKey
+	certPem []byte
+}
+
+func NewSigner() (*Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert})
+	return &Signer{key: key, certPem: certPem}, nil
+}
+
+// Fetch can be used as an events.CertFetcher, it serves the signer's certificate
+// for CertUrl
+func (signer *Signer) Fetch(ctx context.Context, certUrl string) ([]byte, error) {
+	if certUrl != CertUrl {
+		return nil, fmt.Errorf("no cert at %s", certUrl)
+	}
+	return signer.certPem, nil
+}
+
+// Sign returns the base64 signature of the canonical string for the given
+// signature version
+func (signer *Signer) Sign(canonical string, signatureVersion string) (string, error) {
+	var hash crypto.Hash
+	var hashed []byte
+	switch signatureVersion {
+	case "1":
+		hash = crypto.SHA1
+		sum := sha1.Sum([]byte(canonical))
+		hashed = sum[:]
+	case "2":
+		hash = crypto.SHA256
+		sum := sha256.Sum256([]byte(canonical))
+		hashed = sum[:]
+	default:
+		return "", fmt.Errorf("unsupported signature version %s", signatureVersion)
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer.key, hash, hashed)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
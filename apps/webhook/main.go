@@ -5,27 +5,68 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"webhook/archive"
 	"webhook/broadcastserver"
+	"webhook/store"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/redis/go-redis/v9"
 	_ "github.com/tursodatabase/libsql-client-go/libsql"
 )
 
 func main() {
-	log.SetFlags(0)
+	logger, err := newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
 
-	err := run()
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "dlq":
+		err = runDlq(context.Background(), logger, os.Args[2:], os.Stdout)
+	case len(os.Args) > 1 && os.Args[1] == "rebuild":
+		err = runRebuild(context.Background(), logger, os.Args[2:], os.Stdout)
+	default:
+		err = run(logger)
+	}
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("exiting", slog.Any("error", err))
+		os.Exit(1)
 	}
 }
 
+// newLogger logs json at the info level with email and ip addresses masked.
+// LOG_DEBUG=true logs debug messages too and doesn't mask them, it's for local development.
+func newLogger(writer io.Writer) (*slog.Logger, error) {
+	debug, err := getBoolEnv("LOG_DEBUG", false)
+	if err != nil {
+		return nil, err
+	}
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	var handler slog.Handler = slog.NewJSONHandler(writer, &slog.HandlerOptions{Level: level})
+	if !debug {
+		handler = broadcastserver.NewRedactingHandler(handler)
+	}
+	return slog.New(handler), nil
+}
+
 func getEnv() (dbUrl string, dbAuthToken string, snsArn string, err error) {
 	dbUrl, dbUrlExists := os.LookupEnv("LIB_SQL_DB_URL")
 	dbAuthToken, dbAuthTokenExists := os.LookupEnv("LIB_SQL_AUTH_TOKEN")
@@ -33,7 +74,7 @@ func getEnv() (dbUrl string, dbAuthToken string, snsArn string, err error) {
 	if !dbUrlExists || !snsArnExists || !dbAuthTokenExists {
 		err := godotenv.Load("./.env")
 		if err != nil {
-			log.Fatal("env variables not found and .env file not found")
+			return "", "", "", errors.New("env variables not found and .env file not found")
 		}
 
 		dbUrl, dbUrlExists = os.LookupEnv("LIB_SQL_DB_URL")
@@ -47,55 +88,321 @@ func getEnv() (dbUrl string, dbAuthToken string, snsArn string, err error) {
 	return dbUrl, dbAuthToken, snsArn, nil
 }
 
+// getBoolEnv returns the parsed value of an optional boolean env variable
+func getBoolEnv(name string, defaultValue bool) (bool, error) {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return parsed, nil
+}
+
+// getDurationEnv returns an optional duration env variable, e.g. 10s
+func getDurationEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return parsed, nil
+}
+
+// getIntEnv returns an optional integer env variable
+func getIntEnv(name string, defaultValue int) (int, error) {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return parsed, nil
+}
+
+// getListEnv returns the non-empty items of an optional comma separated env variable
+func getListEnv(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// openStore opens a postgres store for postgres urls and a libsql store otherwise
+func openStore(dbUrl, dbAuthToken string) (store.ReceiptStore, error) {
+	if strings.HasPrefix(dbUrl, "postgres://") || strings.HasPrefix(dbUrl, "postgresql://") {
+		db, err := sql.Open("pgx", dbUrl)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewPostgresStore(db), nil
+	}
+
+	db, err := sql.Open("libsql", fmt.Sprintf("%s?authToken=%s", dbUrl, dbAuthToken))
+	if err != nil {
+		return nil, err
+	}
+	return store.NewLibsqlStore(db), nil
+}
+
+// defaultShutdownTimeout is how long in-flight requests and db writes are given to finish,
+// docker kills the container 10s after SIGTERM by default
+const defaultShutdownTimeout = 8 * time.Second
+
+// events are applied by INGEST_WORKERS workers which each queue up to INGEST_QUEUE_SIZE
+// events, INGEST_WORKERS=0 applies them within the publish request instead
+const (
+	defaultIngestWorkers   = 8
+	defaultIngestQueueSize = 1000
+)
+
+// maxEventAge is how long events are buffered for resuming subscribers
+const maxEventAge = 30 * time.Second
+
+// openBroker returns a redis broker so events reach subscribers connected to any instance,
+// or the memory broker if redisUrl is empty and there's only one instance
+func openBroker(redisUrl string, maxEventAge time.Duration) (broadcastserver.Broker, error) {
+	if redisUrl == "" {
+		return broadcastserver.NewMemoryBroker(maxEventAge), nil
+	}
+	options, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return broadcastserver.NewRedisBroker(redis.NewClient(options), "webhook:", maxEventAge), nil
+}
+
+// archive files are completed once ARCHIVE_MAX_BYTES of events have been written to them
+// or they're ARCHIVE_MAX_AGE old. Files being uploaded to S3 are buffered in memory.
+const (
+	defaultArchiveMaxBytes = 16 << 20
+	defaultArchiveMaxAge   = 15 * time.Minute
+)
+
+// archiveStore is an archive which can be read back
+type archiveStore interface {
+	archive.ArchiveSink
+	archive.Reader
+}
+
+// openArchive returns the archive in ARCHIVE_DIR or in the S3 compatible ARCHIVE_S3_BUCKET,
+// or nil if neither is set and events aren't archived
+func openArchive() (archiveStore, error) {
+	maxBytes, err := getIntEnv("ARCHIVE_MAX_BYTES", defaultArchiveMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	maxAge, err := getDurationEnv("ARCHIVE_MAX_AGE", defaultArchiveMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	dir := os.Getenv("ARCHIVE_DIR")
+	bucket := os.Getenv("ARCHIVE_S3_BUCKET")
+	switch {
+	case dir != "" && bucket != "":
+		return nil, errors.New("ARCHIVE_DIR and ARCHIVE_S3_BUCKET are both set, expected one")
+	case dir != "":
+		return archive.NewFileSink(dir, int64(maxBytes), maxAge)
+	case bucket != "":
+		insecure, err := getBoolEnv("ARCHIVE_S3_INSECURE", false)
+		if err != nil {
+			return nil, err
+		}
+		client, err := minio.New(os.Getenv("ARCHIVE_S3_ENDPOINT"), &minio.Options{
+			Creds:  credentials.NewStaticV4(os.Getenv("ARCHIVE_S3_ACCESS_KEY"), os.Getenv("ARCHIVE_S3_SECRET_KEY"), ""),
+			Secure: !insecure,
+			Region: os.Getenv("ARCHIVE_S3_REGION"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid ARCHIVE_S3_ENDPOINT: %w", err)
+		}
+		objects := archive.NewMinioStore(client, bucket)
+		return archive.NewS3Sink(objects, os.Getenv("ARCHIVE_S3_PREFIX"), int64(maxBytes), maxAge), nil
+	default:
+		return nil, nil
+	}
+}
+
+// subscribeAuthorizer returns the authorizer named by SUBSCRIBE_AUTH. Subscribers use
+// tokens minted by the web app with SUBSCRIBE_TOKEN_SECRET by default, or the web app's
+// session cookie, which needs the webhook to share the web app's db.
+func subscribeAuthorizer(receiptStore store.ReceiptStore) (broadcastserver.Authorizer, error) {
+	switch mode := os.Getenv("SUBSCRIBE_AUTH"); mode {
+	case "", "token":
+		secret := os.Getenv("SUBSCRIBE_TOKEN_SECRET")
+		if secret == "" {
+			return nil, errors.New("SUBSCRIBE_TOKEN_SECRET is required when SUBSCRIBE_AUTH is token, the default")
+		}
+		return broadcastserver.NewTokenAuthorizer([]byte(secret)), nil
+	case "session":
+		return broadcastserver.NewSessionAuthorizer(receiptStore, broadcastserver.DefaultSessionCacheTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown SUBSCRIBE_AUTH %q, expected token or session", mode)
+	}
+}
+
+// openStoreFromEnv opens and migrates the db configured by the env
+func openStoreFromEnv() (receiptStore store.ReceiptStore, snsArn string, err error) {
+	dbUrl, dbAuthToken, snsArn, err := getEnv()
+	if err != nil {
+		return nil, "", err
+	}
+
+	receiptStore, err = openStore(dbUrl, dbAuthToken)
+	if err != nil {
+		// the url isn't logged, it may have credentials in it
+		return nil, "", fmt.Errorf("failed to open db: %w", err)
+	}
+
+	err = receiptStore.Migrate(context.Background())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to migrate db: %w", err)
+	}
+	return receiptStore, snsArn, nil
+}
+
 // run initializes the chatServer and then
 // starts a http.Server for the passed in address.
-func run() error {
+func run(logger *slog.Logger) error {
 	if len(os.Args) < 2 {
 		return errors.New("please provide an address to listen on as the first argument")
 	}
 
-	dbUrl, dbAuthToken, snsArn, err := getEnv()
+	receiptStore, snsArn, err := openStoreFromEnv()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[fatal-error] %s",  err)
-		os.Exit(1)
+		return err
 	}
 
-	db, err := sql.Open("libsql", fmt.Sprintf("%s?authToken=%s", dbUrl, dbAuthToken))
+	autoConfirm, err := getBoolEnv("SNS_AUTO_CONFIRM", true)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[fatal-error] failed to open db %s: %s", dbUrl, err)
-		os.Exit(1)
+		return err
+	}
+
+	shutdownTimeout, err := getDurationEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		return err
+	}
+
+	ingestWorkers, err := getIntEnv("INGEST_WORKERS", defaultIngestWorkers)
+	if err != nil {
+		return err
+	}
+	ingestQueueSize, err := getIntEnv("INGEST_QUEUE_SIZE", defaultIngestQueueSize)
+	if err != nil {
+		return err
 	}
 
-	chatServer, err := broadcastserver.NewBroadcastServer(snsArn, db, 30*time.Second)
+	authorizer, err := subscribeAuthorizer(receiptStore)
 	if err != nil {
 		return err
 	}
 
+	broker, err := openBroker(os.Getenv("REDIS_URL"), maxEventAge)
+	if err != nil {
+		return err
+	}
+
+	options := []broadcastserver.Option{
+		broadcastserver.WithAutoConfirm(autoConfirm),
+		broadcastserver.WithAllowedTopics(getListEnv("SNS_ALLOWED_TOPIC_ARNS")...),
+		broadcastserver.WithApiToken(os.Getenv("WEBHOOK_API_TOKEN")),
+		broadcastserver.WithAdminToken(os.Getenv("WEBHOOK_ADMIN_TOKEN")),
+		broadcastserver.WithAuthorizer(authorizer),
+		broadcastserver.WithBroker(broker),
+		broadcastserver.WithLogger(logger),
+		broadcastserver.WithWorkerPool(ingestWorkers, ingestQueueSize),
+	}
+	eventArchive, err := openArchive()
+	if err != nil {
+		return err
+	}
+	if eventArchive != nil {
+		options = append(options, broadcastserver.WithArchive(eventArchive))
+	}
+
+	chatServer, err := broadcastserver.NewBroadcastServer(
+		snsArn,
+		receiptStore,
+		maxEventAge,
+		options...,
+	)
+	if err != nil {
+		return err
+	}
+
+	reconcilerCtx, stopReconciler := context.WithCancel(context.Background())
+	defer stopReconciler()
+	chatServer.StartReconciler(reconcilerCtx, 10*time.Second)
+	chatServer.StartJanitor(reconcilerCtx, time.Minute)
+	// events accepted before the last shutdown are applied before any new ones
+	err = chatServer.StartWorkers(reconcilerCtx)
+	if err != nil {
+		return fmt.Errorf("failed to start workers: %w", err)
+	}
+
 	httpServer := &http.Server{
 		Handler:      chatServer,
 		ReadTimeout:  time.Second * 10,
 		WriteTimeout: time.Second * 10,
 	}
-	httpServer.RegisterOnShutdown(chatServer.OnShutdown)
-	errc := make(chan error, 1)
+	// hijacked WebSockets aren't closed by Shutdown
+	httpServer.RegisterOnShutdown(chatServer.Drain)
+	errc := make(chan error, 2)
 	addr := os.Args[1]
 	httpServer.Addr = addr
 	go func() {
-		log.Printf("listening on http://%v", addr)
+		logger.Info("listening", slog.String("addr", addr))
 		errc <- httpServer.ListenAndServe()
 	}()
 
+	// metrics are served on their own listener so they aren't public
+	var metricsServer *http.Server
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", chatServer.MetricsHandler())
+		metricsServer = &http.Server{
+			Addr:         metricsAddr,
+			Handler:      metricsMux,
+			ReadTimeout:  time.Second * 10,
+			WriteTimeout: time.Second * 10,
+		}
+		go func() {
+			logger.Info("serving metrics", slog.String("addr", metricsAddr))
+			errc <- metricsServer.ListenAndServe()
+		}()
+	}
+
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	select {
 	case err := <-errc:
-		log.Printf("failed to serve: %v", err)
+		logger.Error("failed to serve", slog.Any("error", err))
 	case sig := <-sigs:
-		log.Printf("terminating: %v", sig)
+		logger.Info("terminating", slog.String("signal", sig.String()))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond*1)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
-	return httpServer.Shutdown(ctx)
+	// stop listening and wait for in-flight requests, then stop the reconciler, janitor
+	// and workers and wait for their writes before the db is closed. Events still queued
+	// are released to the next instance to start.
+	err = httpServer.Shutdown(ctx)
+	stopReconciler()
+	err = errors.Join(err, chatServer.Shutdown(ctx))
+	if metricsServer != nil {
+		err = errors.Join(err, metricsServer.Shutdown(ctx))
+	}
+	return err
 }
@@ -0,0 +1,145 @@
+// Package migrations creates the tables owned by the webhook.
+// Tables shared with the web app, e.g. receipts, are managed by packages/db.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dialect is the sql dialect of the database being migrated,
+// each dialect has its own directory of migrations
+type Dialect string
+
+const (
+	Sqlite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+//go:embed sqlite/*.sql postgres/*.sql
+var migrationFiles embed.FS
+
+// statementBreakpoint separates statements in a migration file, as in drizzle's migrations
+const statementBreakpoint = "--> statement-breakpoint"
+
+// Migrate applies every migration which hasn't been applied yet in filename order
+// and records it in webhook_migrations. Each migration is applied and recorded in a
+// single transaction so a failed migration leaves nothing behind. Instances starting
+// at the same time apply each migration once, on postgres they take turns with an
+// advisory lock and on sqlite the write lock serializes them.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	return migrate(ctx, db, dialect, migrationFiles)
+}
+
+func migrate(ctx context.Context, db *sql.DB, dialect Dialect, files fs.FS) error {
+	createMigrations := `CREATE TABLE IF NOT EXISTS webhook_migrations (
+	name text(191) PRIMARY KEY NOT NULL,
+	applied_at integer NOT NULL
+);`
+	insertMigration := `INSERT INTO webhook_migrations (name, applied_at) VALUES (?, ?) ON CONFLICT (name) DO NOTHING;`
+	lockMigrations := ""
+	switch dialect {
+	case Sqlite:
+	case Postgres:
+		createMigrations = `CREATE TABLE IF NOT EXISTS webhook_migrations (
+	name varchar(191) PRIMARY KEY NOT NULL,
+	applied_at bigint NOT NULL
+);`
+		insertMigration = `INSERT INTO webhook_migrations (name, applied_at) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING;`
+		// held until the transaction ends
+		lockMigrations = `SELECT pg_advisory_xact_lock(hashtext('webhook_migrations'));`
+	default:
+		return fmt.Errorf("unknown dialect %s", dialect)
+	}
+
+	err := inTx(ctx, db, lockMigrations, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, createMigrations)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create webhook_migrations: %w", err)
+	}
+
+	applied := make(map[string]struct{})
+	rows, err := db.QueryContext(ctx, `SELECT name FROM webhook_migrations;`)
+	if err != nil {
+		return fmt.Errorf("failed to read webhook_migrations: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[name] = struct{}{}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(files, string(dialect)+"/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := applied[name]; ok {
+			continue
+		}
+		migration, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		err = inTx(ctx, db, lockMigrations, func(tx *sql.Tx) error {
+			// recording it first claims it, if another instance applied it since it was
+			// read there's nothing left to do
+			res, err := tx.ExecContext(ctx, insertMigration, name, time.Now().UnixMilli())
+			if err != nil {
+				return fmt.Errorf("failed to record migration %s: %w", name, err)
+			}
+			if recorded, err := res.RowsAffected(); err != nil || recorded == 0 {
+				return err
+			}
+			for _, statement := range strings.Split(string(migration), statementBreakpoint) {
+				if strings.TrimSpace(statement) == "" {
+					continue
+				}
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("migration %s failed: %w", name, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, after taking the lock if there is one, and commits it
+// if fn succeeds
+func inTx(ctx context.Context, db *sql.DB, lock string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if lock != "" {
+		if _, err := tx.ExecContext(ctx, lock); err != nil {
+			return err
+		}
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
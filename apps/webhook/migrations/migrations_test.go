@@ -0,0 +1,126 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/tursodatabase/go-libsql"
+)
+
+func openLibsql(test *testing.T) *sql.DB {
+	test.Helper()
+	db, err := sql.Open("libsql", "file:"+filepath.Join(test.TempDir(), "migrations.db"))
+	if err != nil {
+		test.Fatalf("failed to open db: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	test.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(test *testing.T, db *sql.DB, table string) bool {
+	test.Helper()
+	var count int
+	err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&count)
+	if err != nil {
+		test.Fatalf("failed to check table: %s", err)
+	}
+	return count > 0
+}
+
+func TestMigrateFailure(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	db := openLibsql(test)
+	files := fstest.MapFS{
+		"sqlite/0001_first.sql": {Data: []byte(`CREATE TABLE first (id text PRIMARY KEY NOT NULL);`)},
+		// the second statement fails after the first has run
+		"sqlite/0002_second.sql": {Data: []byte(`CREATE TABLE second (id text PRIMARY KEY NOT NULL);
+--> statement-breakpoint
+ALTER TABLE missing ADD COLUMN name text;`)},
+	}
+	if err := migrate(ctx, db, Sqlite, files); err == nil || !strings.Contains(err.Error(), "0002_second.sql") {
+		test.Fatalf("expected the second migration to fail but got %v", err)
+	}
+	if !tableExists(test, db, "first") {
+		test.Errorf("expected the first migration to be applied")
+	}
+	if tableExists(test, db, "second") {
+		test.Errorf("expected the failed migration to be rolled back")
+	}
+
+	// once it's fixed it applies cleanly
+	files["sqlite/0002_second.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE second (id text PRIMARY KEY NOT NULL);
+--> statement-breakpoint
+ALTER TABLE second ADD COLUMN name text;`)}
+	if err := migrate(ctx, db, Sqlite, files); err != nil {
+		test.Fatalf("failed to migrate: %s", err)
+	}
+	var recorded int
+	if err := db.QueryRow(`SELECT count(*) FROM webhook_migrations;`).Scan(&recorded); err != nil || recorded != 2 {
+		test.Errorf("expected 2 recorded migrations but got %d, %v", recorded, err)
+	}
+}
+
+// TestMigrateConcurrently uses the database at TEST_POSTGRES_URL, the test is skipped if
+// it isn't set. The migrations have random names since the database is shared.
+func TestMigrateConcurrently(test *testing.T) {
+	test.Parallel()
+
+	postgresUrl := os.Getenv("TEST_POSTGRES_URL")
+	if postgresUrl == "" {
+		test.Skip("TEST_POSTGRES_URL not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	table := "migrate_" + strings.ReplaceAll(uuid.NewString(), "-", "_")
+	files := fstest.MapFS{
+		"postgres/" + table + "_1.sql": {Data: []byte(fmt.Sprintf(`CREATE TABLE %s (id varchar(191) PRIMARY KEY NOT NULL);`, table))},
+		// fails if it's applied twice
+		"postgres/" + table + "_2.sql": {Data: []byte(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN name text;`, table))},
+	}
+	test.Cleanup(func() {
+		db, err := sql.Open("pgx", postgresUrl)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		db.Exec(`DROP TABLE IF EXISTS ` + table + `;`)
+		db.Exec(`DELETE FROM webhook_migrations WHERE name LIKE $1;`, "postgres/"+table+"%")
+	})
+	var wait sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			db, err := sql.Open("pgx", postgresUrl)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer db.Close()
+			errs[i] = migrate(ctx, db, Postgres, files)
+		}()
+	}
+	wait.Wait()
+	for _, err := range errs {
+		if err != nil {
+			test.Errorf("expected every instance to migrate but got %s", err)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS receipt_events (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	campaign_id varchar(191) NOT NULL,
+	donor_id varchar(191) NOT NULL,
+	email_id varchar(191) NOT NULL,
+	event_type text NOT NULL,
+	status text NOT NULL,
+	sns_message_id varchar(191),
+	timestamp bigint NOT NULL,
+	detail text NOT NULL,
+	created_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS receipt_events__campaign_id__donor_id__idx ON receipt_events (campaign_id, donor_id, timestamp);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS suppressions (
+	email varchar(191) PRIMARY KEY NOT NULL,
+	reason text NOT NULL,
+	detail text NOT NULL,
+	campaign_id varchar(191) NOT NULL,
+	donor_id varchar(191) NOT NULL,
+	email_id varchar(191) NOT NULL,
+	sns_message_id varchar(191) NOT NULL,
+	created_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL,
+	updated_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS pending_events (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	campaign_id varchar(191) NOT NULL,
+	donor_id varchar(191) NOT NULL,
+	sns_message_id varchar(191) NOT NULL,
+	raw text NOT NULL,
+	expires_at bigint NOT NULL,
+	created_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS pending_events__expires_at__idx ON pending_events (expires_at);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS processed_events (
+	event_key varchar(191) PRIMARY KEY NOT NULL,
+	claimed_at bigint NOT NULL,
+	completed_at bigint
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS processed_events__claimed_at__idx ON processed_events (claimed_at);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS queued_events (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	campaign_id varchar(191) NOT NULL,
+	donor_id varchar(191) NOT NULL,
+	sns_message_id varchar(191) NOT NULL,
+	raw text NOT NULL,
+	created_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS queued_events__created_at__idx ON queued_events (created_at);
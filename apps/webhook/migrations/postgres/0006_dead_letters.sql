@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	reason varchar(191) NOT NULL,
+	error text NOT NULL,
+	raw text NOT NULL,
+	attempts integer DEFAULT 1 NOT NULL,
+	created_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL,
+	updated_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS dead_letters__created_at__idx ON dead_letters (created_at);
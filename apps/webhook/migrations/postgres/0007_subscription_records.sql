@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS subscription_records (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	type varchar(191) NOT NULL,
+	topic_arn text NOT NULL,
+	message_id varchar(191) NOT NULL,
+	subscription_arn text NOT NULL,
+	outcome varchar(191) NOT NULL,
+	error text NOT NULL,
+	created_at bigint DEFAULT (extract(epoch from now()) * 1000)::bigint NOT NULL
+);
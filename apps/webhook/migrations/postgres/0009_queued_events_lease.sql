@@ -0,0 +1,3 @@
+ALTER TABLE queued_events ADD COLUMN IF NOT EXISTS claimed_by varchar(191) DEFAULT '' NOT NULL;
+--> statement-breakpoint
+ALTER TABLE queued_events ADD COLUMN IF NOT EXISTS lease_until bigint DEFAULT 0 NOT NULL;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS receipt_events (
+	id text(191) PRIMARY KEY NOT NULL,
+	campaign_id text(191) NOT NULL,
+	donor_id text(191) NOT NULL,
+	email_id text(191) NOT NULL,
+	event_type text NOT NULL,
+	status text NOT NULL,
+	sns_message_id text(191),
+	timestamp integer NOT NULL,
+	detail text NOT NULL,
+	created_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS receipt_events__campaign_id__donor_id__idx ON receipt_events (campaign_id, donor_id, timestamp);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS suppressions (
+	email text(191) PRIMARY KEY NOT NULL,
+	reason text NOT NULL,
+	detail text NOT NULL,
+	campaign_id text(191) NOT NULL,
+	donor_id text(191) NOT NULL,
+	email_id text(191) NOT NULL,
+	sns_message_id text(191) NOT NULL,
+	created_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL,
+	updated_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS pending_events (
+	id text(191) PRIMARY KEY NOT NULL,
+	campaign_id text(191) NOT NULL,
+	donor_id text(191) NOT NULL,
+	sns_message_id text(191) NOT NULL,
+	raw text NOT NULL,
+	expires_at integer NOT NULL,
+	created_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS pending_events__expires_at__idx ON pending_events (expires_at);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id text(191) PRIMARY KEY NOT NULL,
+	reason text(191) NOT NULL,
+	error text NOT NULL,
+	raw text NOT NULL,
+	attempts integer DEFAULT 1 NOT NULL,
+	created_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL,
+	updated_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL
+);
+--> statement-breakpoint
+CREATE INDEX IF NOT EXISTS dead_letters__created_at__idx ON dead_letters (created_at);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS subscription_records (
+	id text(191) PRIMARY KEY NOT NULL,
+	type text(191) NOT NULL,
+	topic_arn text NOT NULL,
+	message_id text(191) NOT NULL,
+	subscription_arn text NOT NULL,
+	outcome text(191) NOT NULL,
+	error text NOT NULL,
+	created_at integer DEFAULT (cast(strftime('%s', 'now') as int) * 1000) NOT NULL
+);
@@ -0,0 +1,5 @@
+DELETE FROM receipt_events WHERE sns_message_id <> '' AND id NOT IN (
+	SELECT min(id) FROM receipt_events WHERE sns_message_id <> '' GROUP BY sns_message_id
+);
+--> statement-breakpoint
+CREATE UNIQUE INDEX IF NOT EXISTS receipt_events__sns_message_id__idx ON receipt_events (sns_message_id) WHERE sns_message_id <> '';
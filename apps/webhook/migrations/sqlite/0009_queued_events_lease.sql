@@ -0,0 +1,3 @@
+ALTER TABLE queued_events ADD COLUMN claimed_by text(191) DEFAULT '' NOT NULL;
+--> statement-breakpoint
+ALTER TABLE queued_events ADD COLUMN lease_until integer DEFAULT 0 NOT NULL;
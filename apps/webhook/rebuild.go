@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"webhook/rebuild"
+	"webhook/store"
+)
+
+const rebuildUsage = `usage: webhook rebuild -campaign <id> [-dry-run] [-allow-regress] [-source merged|archive|history]
+
+  recomputes the status of each of the campaign's receipts from the events received
+  for it with the current mapping rules, prints the receipts whose status changes and
+  applies the changes in a single transaction. Receipts without events are left alone.
+
+  -source defaults to merged, the history table and the archive together, if ARCHIVE_DIR
+  or ARCHIVE_S3_BUCKET is set and to the history table otherwise. Archived messages are
+  only used if they came from SNS_ARN or SNS_ALLOWED_TOPIC_ARNS.
+
+  changes which move a receipt backwards, e.g. from complained to delivered, are listed
+  separately and only applied with -allow-regress. They're how a mapping bug is repaired
+  but a source missing some of the receipt's events produces them too.
+
+  once the changes are applied the broker at REDIS_URL forgets the changed donors' latest
+  statuses, so their next events aren't dropped for moving backwards.`
+
+// runRebuild repairs statuses written by a bug in the mapping from SES events once it's
+// fixed. Changes aren't broadcast, subscribers see them when they next load the campaign.
+func runRebuild(ctx context.Context, logger *slog.Logger, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	campaignId := flags.String("campaign", "", "the campaign whose receipts are rebuilt")
+	dryRun := flags.Bool("dry-run", false, "print the changes without applying them")
+	allowRegress := flags.Bool("allow-regress", false, "apply changes which move receipts backwards")
+	sourceName := flags.String("source", "", "where events are read from, merged, archive or history")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *campaignId == "" || flags.NArg() > 0 {
+		return errors.New(rebuildUsage)
+	}
+
+	receiptStore, snsArn, err := openStoreFromEnv()
+	if err != nil {
+		return err
+	}
+	defer receiptStore.Close()
+
+	eventArchive, err := openArchive()
+	if err != nil {
+		return err
+	}
+	if eventArchive != nil {
+		defer eventArchive.Close(ctx)
+	}
+	if *sourceName == "" {
+		*sourceName = "history"
+		if eventArchive != nil {
+			*sourceName = "merged"
+		}
+	}
+	var source rebuild.Source
+	switch *sourceName {
+	case "history":
+		source = rebuild.HistorySource(receiptStore)
+	case "archive", "merged":
+		if eventArchive == nil {
+			return fmt.Errorf("-source %s needs ARCHIVE_DIR or ARCHIVE_S3_BUCKET", *sourceName)
+		}
+		// the same topics the webhook accepts events from
+		allowedTopics := append([]string{snsArn}, getListEnv("SNS_ALLOWED_TOPIC_ARNS")...)
+		source = rebuild.ArchiveSource(eventArchive, allowedTopics, logger)
+		if *sourceName == "merged" {
+			source = rebuild.MergedSource(rebuild.HistorySource(receiptStore), source)
+		}
+	default:
+		return fmt.Errorf("unknown source %q\n%s", *sourceName, rebuildUsage)
+	}
+
+	changes, err := rebuild.Plan(ctx, receiptStore, source, *campaignId)
+	if err != nil {
+		return err
+	}
+	forward, regressions := rebuild.SplitRegressions(changes)
+	if err := printStatusChanges(forward, stdout); err != nil {
+		return err
+	}
+	if len(regressions) > 0 {
+		fmt.Fprintf(stdout, "%d receipts move backwards, check the source has every event they received:\n", len(regressions))
+		if err := printStatusChanges(regressions, stdout); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(changes) == 0:
+		fmt.Fprintln(stdout, "no receipts to change")
+		return nil
+	case *dryRun:
+		fmt.Fprintf(stdout, "dry run, %d receipts not changed\n", len(changes))
+		return nil
+	}
+	if len(regressions) > 0 && !*allowRegress {
+		fmt.Fprintf(stdout, "not moving %d receipts backwards without -allow-regress\n", len(regressions))
+		changes = forward
+		if len(changes) == 0 {
+			return nil
+		}
+	}
+	if err := receiptStore.ApplyStatusChanges(ctx, *campaignId, changes); err != nil {
+		if errors.Is(err, store.ErrStatusChanged) {
+			return fmt.Errorf("no receipts changed, events were received during the rebuild, run it again: %w", err)
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "changed %d receipts\n", len(changes))
+
+	// brokers drop events which move a donor backwards from the latest status they've
+	// published, which the receipt may no longer have
+	if os.Getenv("REDIS_URL") == "" {
+		fmt.Fprintln(stdout, "REDIS_URL isn't set, restart the webhook so it forgets the statuses it has published")
+		return nil
+	}
+	broker, err := openBroker(os.Getenv("REDIS_URL"), maxEventAge)
+	if err != nil {
+		return err
+	}
+	defer broker.Close()
+	donorIds := make([]string, 0, len(changes))
+	for _, change := range changes {
+		donorIds = append(donorIds, change.DonorId)
+	}
+	if err := broker.ForgetStatuses(ctx, *campaignId, donorIds); err != nil {
+		return fmt.Errorf("failed to clear the broker's statuses, the changed donors' events may be dropped for a day: %w", err)
+	}
+	return nil
+}
+
+func printStatusChanges(changes []store.StatusChange, stdout io.Writer) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DONOR\tFROM\tTO")
+	for _, change := range changes {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", change.DonorId, change.From, change.To)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,190 @@
+// Package rebuild recomputes receipt statuses from the events received for them with the
+// current mapping rules. Events only ever move a status forward, so a status written by a
+// bug in the mapping stays wrong until it's rebuilt.
+package rebuild
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"webhook/archive"
+	"webhook/events"
+	"webhook/store"
+)
+
+// Event is an SES event received for a receipt
+type Event struct {
+	DonorId   string
+	EventType events.EventType
+	// Timestamp is when SES says the event happened, events are replayed in this order
+	Timestamp time.Time
+	// SnsMessageId identifies the message the event was received in, the same event read
+	// from different sources has the same id
+	SnsMessageId string
+}
+
+// Source returns the events received for a campaign. Events received more than once may
+// be returned more than once, replaying an event again doesn't change the status.
+type Source interface {
+	CampaignEvents(ctx context.Context, campaignId string) ([]Event, error)
+}
+
+type historySource struct {
+	store store.ReceiptStore
+}
+
+// HistorySource returns the events recorded in the receipts' history
+func HistorySource(receiptStore store.ReceiptStore) Source {
+	return &historySource{store: receiptStore}
+}
+
+func (source *historySource) CampaignEvents(ctx context.Context, campaignId string) ([]Event, error) {
+	history, err := source.store.CampaignHistory(ctx, campaignId)
+	if err != nil {
+		return nil, err
+	}
+	var campaignEvents []Event
+	for donorId, donorHistory := range history {
+		for _, event := range donorHistory {
+			// the status recorded with the event was mapped by the rules at the time
+			campaignEvents = append(campaignEvents, Event{DonorId: donorId, EventType: event.EventType, Timestamp: event.Timestamp, SnsMessageId: event.SnsMessageId})
+		}
+	}
+	return campaignEvents, nil
+}
+
+type archiveSource struct {
+	reader        archive.Reader
+	allowedTopics map[string]struct{}
+	logger        *slog.Logger
+}
+
+// ArchiveSource parses the sns messages kept in the archive again. Only messages from
+// the allowed topics are used, messages archived without their topic are refused since
+// it can't be told whether they were forged. Messages which are refused or still fail to
+// parse are logged and skipped.
+func ArchiveSource(reader archive.Reader, allowedTopics []string, logger *slog.Logger) Source {
+	source := &archiveSource{reader: reader, allowedTopics: make(map[string]struct{}), logger: logger}
+	for _, topicArn := range allowedTopics {
+		source.allowedTopics[topicArn] = struct{}{}
+	}
+	return source
+}
+
+func (source *archiveSource) CampaignEvents(ctx context.Context, campaignId string) ([]Event, error) {
+	var campaignEvents []Event
+	err := source.reader.Read(ctx, archive.Query{CampaignId: campaignId}, func(record archive.Record) error {
+		if _, ok := source.allowedTopics[record.TopicArn]; !ok {
+			source.logger.Warn("skipping archived message from a topic which isn't allowed", slog.String("sns_message_id", record.SnsMessageId), slog.String("topic_arn", record.TopicArn))
+			return nil
+		}
+		parsedEvent, err := events.ParseSnsEvent(record.Body)
+		if err != nil {
+			source.logger.Warn("skipping archived message which failed to parse", slog.String("sns_message_id", record.SnsMessageId), slog.Any("error", err))
+			return nil
+		}
+		campaignEvents = append(campaignEvents, Event{DonorId: parsedEvent.DonorId, EventType: parsedEvent.EventType, Timestamp: parsedEvent.Timestamp, SnsMessageId: parsedEvent.SnsMessageId})
+		return nil
+	})
+	return campaignEvents, err
+}
+
+type mergedSource struct {
+	sources []Source
+}
+
+// MergedSource returns the events of every source, an event found in more than one source
+// is returned once. Neither the history nor the archive is sure to hold every event, e.g.
+// the archive may have been turned on partway through a campaign, so reading both fills the
+// gaps of each.
+func MergedSource(sources ...Source) Source {
+	return &mergedSource{sources: sources}
+}
+
+func (source *mergedSource) CampaignEvents(ctx context.Context, campaignId string) ([]Event, error) {
+	seen := make(map[string]struct{})
+	var campaignEvents []Event
+	for _, each := range source.sources {
+		sourceEvents, err := each.CampaignEvents(ctx, campaignId)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range sourceEvents {
+			// events without an id can't be matched, replaying one again is harmless
+			if event.SnsMessageId != "" {
+				if _, ok := seen[event.SnsMessageId]; ok {
+					continue
+				}
+				seen[event.SnsMessageId] = struct{}{}
+			}
+			campaignEvents = append(campaignEvents, event)
+		}
+	}
+	return campaignEvents, nil
+}
+
+// Plan rebuilds the status of each of the campaign's receipts and returns the changes
+// to the receipts whose status differs, ordered by donor id. Receipts without any events
+// are left as they are, as are events without a receipt.
+func Plan(ctx context.Context, receiptStore store.ReceiptStore, source Source, campaignId string) ([]store.StatusChange, error) {
+	campaignEvents, err := source.CampaignEvents(ctx, campaignId)
+	if err != nil {
+		return nil, err
+	}
+	byDonor := make(map[string][]Event)
+	for _, event := range campaignEvents {
+		byDonor[event.DonorId] = append(byDonor[event.DonorId], event)
+	}
+
+	receipts, err := receiptStore.CampaignReceipts(ctx, campaignId)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]store.StatusChange, 0)
+	for _, receipt := range receipts {
+		donorEvents, ok := byDonor[receipt.DonorId]
+		if !ok {
+			continue
+		}
+		status := replay(donorEvents)
+		if status != receipt.Status {
+			changes = append(changes, store.StatusChange{DonorId: receipt.DonorId, From: receipt.Status, To: status})
+		}
+	}
+	return changes, nil
+}
+
+// replay applies the events in timestamp order to a receipt which hasn't been sent,
+// following the same transitions as events received by the webhook
+func replay(donorEvents []Event) string {
+	// stable so events with the same timestamp stay in the order they were received
+	sort.SliceStable(donorEvents, func(i, j int) bool {
+		return donorEvents[i].Timestamp.Before(donorEvents[j].Timestamp)
+	})
+	status := events.StatusNotSent
+	for _, event := range donorEvents {
+		next := events.MapSnsEvent(event.EventType)
+		if events.CanTransition(status, next) {
+			status = next
+		}
+	}
+	return status
+}
+
+// SplitRegressions separates the changes which move a receipt to a status events can't move
+// it to, e.g. from complained back to delivered, from the rest. Regressions are expected when
+// the mapping had a bug but they're also what a source missing some of a receipt's events
+// produces, so they should be checked before they're applied.
+func SplitRegressions(changes []store.StatusChange) (forward, regressions []store.StatusChange) {
+	forward, regressions = make([]store.StatusChange, 0), make([]store.StatusChange, 0)
+	for _, change := range changes {
+		if events.CanTransition(change.From, change.To) {
+			forward = append(forward, change)
+		} else {
+			regressions = append(regressions, change)
+		}
+	}
+	return forward, regressions
+}
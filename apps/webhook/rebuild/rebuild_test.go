@@ -0,0 +1,226 @@
+package rebuild
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"webhook/archive"
+	"webhook/events"
+	"webhook/store"
+
+	"github.com/google/uuid"
+)
+
+// snsBody returns an sns notification of an SES event for the donor, it isn't signed
+func snsBody(test *testing.T, campaignId, donorId string, eventType events.EventType, timestamp time.Time) []byte {
+	test.Helper()
+	message, err := json.Marshal(events.EmailSendingEvent{
+		EventType: eventType,
+		Mail: events.MailObject{
+			Timestamp: timestamp.UTC().Format(time.RFC3339Nano),
+			MessageID: "email-" + donorId,
+			Headers: []events.Header{
+				{Name: "X-Data-Campaign-ID", Value: campaignId},
+				{Name: "X-Data-Donor-ID", Value: donorId},
+			},
+		},
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	quoted, err := json.Marshal(string(message))
+	if err != nil {
+		test.Fatal(err)
+	}
+	body, err := json.Marshal(events.SnsEventStruct{Type: "Notification", MessageId: uuid.NewString(), Message: quoted})
+	if err != nil {
+		test.Fatal(err)
+	}
+	return body
+}
+
+func TestPlan(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	topicArn := "arn:aws:sns:us-west-2:123456789012:TestTopic"
+	start := time.Now().Add(-time.Hour)
+	received := []struct {
+		donorId   string
+		eventType events.EventType
+		at        time.Duration
+	}{
+		// a delivery which was mapped to complained by a bug
+		{"mapped-wrongly", events.Send, 0},
+		{"mapped-wrongly", events.Delivery, time.Second},
+		// received out of order and twice
+		{"out-of-order", events.Open, 2 * time.Second},
+		{"out-of-order", events.Send, 0},
+		{"out-of-order", events.Delivery, time.Second},
+		{"out-of-order", events.Delivery, time.Second},
+		{"unchanged", events.Send, 0},
+		{"unchanged", events.Bounce, time.Second},
+		{"unchanged", events.Open, 2 * time.Second},
+		// events without a receipt are ignored
+		{"no-receipt", events.Send, 0},
+	}
+	receipts := map[string]string{
+		"mapped-wrongly": events.StatusComplained,
+		"out-of-order":   events.StatusDelivered,
+		"unchanged":      events.StatusBounced,
+		// receipts without events are left as they are
+		"no-events": events.StatusSent,
+	}
+	expected := []store.StatusChange{
+		{DonorId: "mapped-wrongly", From: events.StatusComplained, To: events.StatusDelivered},
+		{DonorId: "out-of-order", From: events.StatusDelivered, To: events.StatusOpened},
+	}
+
+	receiptStore := store.NewMemoryStore()
+	for donorId, status := range receipts {
+		receiptStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: donorId, Status: status})
+	}
+	sink, err := archive.NewFileSink(test.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, event := range received {
+		body := snsBody(test, campaignId, event.donorId, event.eventType, start.Add(event.at))
+		parsedEvent, err := events.ParseSnsEvent(body)
+		if err != nil {
+			test.Fatal(err)
+		}
+		// the history keeps the status as it was mapped when the event was received
+		parsedEvent.Status = events.StatusComplained
+		if err := receiptStore.AppendHistory(ctx, parsedEvent); err != nil {
+			test.Fatal(err)
+		}
+		err = sink.Write(ctx, archive.Record{ReceivedAt: time.Now(), SnsMessageId: parsedEvent.SnsMessageId, TopicArn: topicArn, CampaignId: campaignId, Body: body})
+		if err != nil {
+			test.Fatal(err)
+		}
+	}
+	// archived messages which still can't be parsed are skipped
+	err = sink.Write(ctx, archive.Record{ReceivedAt: time.Now(), SnsMessageId: "bad-payload", TopicArn: topicArn, CampaignId: campaignId, Body: []byte(`{"Type": "Notification"}`)})
+	if err != nil {
+		test.Fatal(err)
+	}
+	// as are messages from other topics and messages archived without their topic
+	for _, otherTopic := range []string{"arn:aws:sns:us-west-2:123456789012:OtherTopic", ""} {
+		body := snsBody(test, campaignId, "no-events", events.Delivery, start)
+		err = sink.Write(ctx, archive.Record{ReceivedAt: time.Now(), SnsMessageId: uuid.NewString(), TopicArn: otherTopic, CampaignId: campaignId, Body: body})
+		if err != nil {
+			test.Fatal(err)
+		}
+	}
+	if err := sink.Close(ctx); err != nil {
+		test.Fatal(err)
+	}
+
+	sources := map[string]Source{
+		"history": HistorySource(receiptStore),
+		"archive": ArchiveSource(sink, []string{topicArn}, slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}
+	sources["merged"] = MergedSource(sources["history"], sources["archive"])
+	for name, source := range sources {
+		changes, err := Plan(ctx, receiptStore, source, campaignId)
+		if err != nil {
+			test.Fatalf("%s: %s", name, err)
+		}
+		if len(changes) != len(expected) {
+			test.Fatalf("%s: expected %+v but got %+v", name, expected, changes)
+		}
+		for i, change := range changes {
+			if change != expected[i] {
+				test.Errorf("%s: expected %+v but got %+v", name, expected[i], change)
+			}
+		}
+	}
+
+	// applying the changes leaves nothing to rebuild
+	changes, err := Plan(ctx, receiptStore, sources["archive"], campaignId)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := receiptStore.ApplyStatusChanges(ctx, campaignId, changes); err != nil {
+		test.Fatal(err)
+	}
+	changes, err = Plan(ctx, receiptStore, sources["history"], campaignId)
+	if err != nil || len(changes) != 0 {
+		test.Errorf("expected no changes but got %+v, %v", changes, err)
+	}
+}
+
+func TestPlanWithGap(test *testing.T) {
+	test.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	campaignId := "test-campaign"
+	topicArn := "arn:aws:sns:us-west-2:123456789012:TestTopic"
+	start := time.Now().Add(-time.Hour)
+	receiptStore := store.NewMemoryStore()
+	receiptStore.InsertReceipt(store.Receipt{CampaignId: campaignId, DonorId: "test-donor", Status: events.StatusOpened})
+	sink, err := archive.NewFileSink(test.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		test.Fatal(err)
+	}
+	for i, eventType := range []events.EventType{events.Send, events.Delivery, events.Open} {
+		body := snsBody(test, campaignId, "test-donor", eventType, start.Add(time.Duration(i)*time.Second))
+		parsedEvent, err := events.ParseSnsEvent(body)
+		if err != nil {
+			test.Fatal(err)
+		}
+		parsedEvent.Status = events.MapSnsEvent(eventType)
+		if err := receiptStore.AppendHistory(ctx, parsedEvent); err != nil {
+			test.Fatal(err)
+		}
+		// the open wasn't archived, e.g. its write failed
+		if eventType == events.Open {
+			continue
+		}
+		err = sink.Write(ctx, archive.Record{ReceivedAt: time.Now(), SnsMessageId: parsedEvent.SnsMessageId, TopicArn: topicArn, CampaignId: campaignId, Body: body})
+		if err != nil {
+			test.Fatal(err)
+		}
+	}
+	if err := sink.Close(ctx); err != nil {
+		test.Fatal(err)
+	}
+	history := HistorySource(receiptStore)
+	archived := ArchiveSource(sink, []string{topicArn}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// the archive alone moves the receipt backwards, which is reported as a regression
+	changes, err := Plan(ctx, receiptStore, archived, campaignId)
+	if err != nil {
+		test.Fatal(err)
+	}
+	forward, regressions := SplitRegressions(changes)
+	expected := store.StatusChange{DonorId: "test-donor", From: events.StatusOpened, To: events.StatusDelivered}
+	if len(forward) != 0 || len(regressions) != 1 || regressions[0] != expected {
+		test.Errorf("expected the regression %+v but got %+v and %+v", expected, forward, regressions)
+	}
+
+	// merged with the history, which has the open, there's nothing to change
+	merged := MergedSource(history, archived)
+	changes, err = Plan(ctx, receiptStore, merged, campaignId)
+	if err != nil || len(changes) != 0 {
+		test.Errorf("expected no changes but got %+v, %v", changes, err)
+	}
+	// and events in both sources are only returned once
+	mergedEvents, err := merged.CampaignEvents(ctx, campaignId)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(mergedEvents) != 3 {
+		test.Errorf("expected 3 events but got %+v", mergedEvents)
+	}
+}
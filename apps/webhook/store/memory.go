@@ -0,0 +1,546 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"webhook/events"
+)
+
+// processedEvent is a claimed event, completedAt is zero until it's processed
+type processedEvent struct {
+	claimedAt   time.Time
+	completedAt time.Time
+}
+
+type receiptKey struct {
+	campaignId string
+	donorId    string
+}
+
+// MemoryStore keeps everything in memory, it's used in tests and for local development
+type MemoryStore struct {
+	lock     sync.Mutex
+	receipts map[receiptKey]Receipt
+	history  map[receiptKey][]HistoryEvent
+	// sns message ids in the history
+	historyMessageIds map[string]struct{}
+	suppressions      map[string]Suppression
+	pending           []PendingEvent
+	queued            []QueuedEvent
+	deadLetters       map[string]DeadLetter
+	sessions          map[string]Session
+	processed         map[string]processedEvent
+	// subscription records ordered by id
+	subscriptionRecords []SubscriptionRecord
+	// account id to user id and campaign id to account id
+	accounts  map[string]string
+	campaigns map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		receipts:          make(map[receiptKey]Receipt),
+		history:           make(map[receiptKey][]HistoryEvent),
+		historyMessageIds: make(map[string]struct{}),
+		suppressions:      make(map[string]Suppression),
+		sessions:          make(map[string]Session),
+		processed:         make(map[string]processedEvent),
+		deadLetters:       make(map[string]DeadLetter),
+		accounts:          make(map[string]string),
+		campaigns:         make(map[string]string),
+	}
+}
+
+// InsertReceipt adds or replaces a receipt, in the sql stores receipts are created by the web app
+func (store *MemoryStore) InsertReceipt(receipt Receipt) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.receipts[receiptKey{receipt.CampaignId, receipt.DonorId}] = receipt
+}
+
+// InsertSession adds or replaces a session, in the sql stores sessions are created by the web app
+func (store *MemoryStore) InsertSession(session Session) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.sessions[session.SessionToken] = session
+}
+
+// InsertCampaign adds the campaign and its account, in the sql stores they're created by the web app
+func (store *MemoryStore) InsertCampaign(campaignId, accountId, userId string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.accounts[accountId] = userId
+	store.campaigns[campaignId] = accountId
+}
+
+func (store *MemoryStore) UpdateStatus(ctx context.Context, event events.ParsedEvent) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	key := receiptKey{event.CampaignId, event.DonorId}
+	receipt, ok := store.receipts[key]
+	if !ok {
+		return ErrReceiptNotFound
+	}
+	if !events.CanTransition(receipt.Status, event.Status) {
+		return ErrTransitionIgnored
+	}
+	receipt.Status = event.Status
+	receipt.EmailId = event.EmailId
+	store.receipts[key] = receipt
+	return nil
+}
+
+func (store *MemoryStore) Receipt(ctx context.Context, campaignId, donorId string) (Receipt, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	receipt, ok := store.receipts[receiptKey{campaignId, donorId}]
+	if !ok {
+		return Receipt{}, ErrReceiptNotFound
+	}
+	return receipt, nil
+}
+
+func (store *MemoryStore) CampaignReceipts(ctx context.Context, campaignId string) ([]Receipt, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	receipts := make([]Receipt, 0)
+	for key, receipt := range store.receipts {
+		if key.campaignId == campaignId {
+			receipts = append(receipts, receipt)
+		}
+	}
+	sort.Slice(receipts, func(i, j int) bool {
+		return receipts[i].DonorId < receipts[j].DonorId
+	})
+	return receipts, nil
+}
+
+func (store *MemoryStore) SessionUser(ctx context.Context, sessionToken string, now time.Time) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	session, ok := store.sessions[sessionToken]
+	if !ok || !now.Before(session.Expires) {
+		return "", ErrSessionNotFound
+	}
+	return session.UserId, nil
+}
+
+func (store *MemoryStore) UserOwnsCampaign(ctx context.Context, userId, campaignId string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	accountId, ok := store.campaigns[campaignId]
+	return ok && store.accounts[accountId] == userId, nil
+}
+
+func (store *MemoryStore) AppendHistory(ctx context.Context, event events.ParsedEvent) error {
+	historyEvent, err := historyEvent(event)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if historyEvent.SnsMessageId != "" {
+		if _, ok := store.historyMessageIds[historyEvent.SnsMessageId]; ok {
+			return nil
+		}
+		store.historyMessageIds[historyEvent.SnsMessageId] = struct{}{}
+	}
+	key := receiptKey{event.CampaignId, event.DonorId}
+	history := append(store.history[key], historyEvent)
+	// stable so events with the same timestamp stay in the order they were received
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Timestamp.Before(history[j].Timestamp)
+	})
+	store.history[key] = history
+	return nil
+}
+
+func (store *MemoryStore) History(ctx context.Context, campaignId, donorId string) ([]HistoryEvent, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	history := store.history[receiptKey{campaignId, donorId}]
+	return append(make([]HistoryEvent, 0, len(history)), history...), nil
+}
+
+func (store *MemoryStore) CampaignHistory(ctx context.Context, campaignId string) (map[string][]HistoryEvent, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	history := make(map[string][]HistoryEvent)
+	for key, donorHistory := range store.history {
+		if key.campaignId == campaignId {
+			history[key.donorId] = append(make([]HistoryEvent, 0, len(donorHistory)), donorHistory...)
+		}
+	}
+	return history, nil
+}
+
+func (store *MemoryStore) ApplyStatusChanges(ctx context.Context, campaignId string, changes []StatusChange) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// every change is checked before any is applied, like a rolled back transaction
+	for _, change := range changes {
+		receipt, ok := store.receipts[receiptKey{campaignId, change.DonorId}]
+		if !ok {
+			return fmt.Errorf("%s: %w", change.DonorId, ErrReceiptNotFound)
+		}
+		if receipt.Status != change.From {
+			return fmt.Errorf("%s is %s rather than %s: %w", change.DonorId, receipt.Status, change.From, ErrStatusChanged)
+		}
+	}
+	for _, change := range changes {
+		key := receiptKey{campaignId, change.DonorId}
+		receipt := store.receipts[key]
+		receipt.Status = change.To
+		store.receipts[key] = receipt
+	}
+	return nil
+}
+
+func (store *MemoryStore) UpsertSuppression(ctx context.Context, suppression Suppression) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	suppression.CreatedAt = now
+	suppression.UpdatedAt = now
+	if existing, ok := store.suppressions[suppression.Email]; ok {
+		suppression.CreatedAt = existing.CreatedAt
+	}
+	store.suppressions[suppression.Email] = suppression
+	return nil
+}
+
+func (store *MemoryStore) Suppressions(ctx context.Context, emails []string) ([]Suppression, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	suppressions := make([]Suppression, 0)
+	if emails == nil {
+		for _, suppression := range store.suppressions {
+			suppressions = append(suppressions, suppression)
+		}
+	} else {
+		seen := make(map[string]struct{}, len(emails))
+		for _, email := range emails {
+			if _, ok := seen[email]; ok {
+				continue
+			}
+			seen[email] = struct{}{}
+			if suppression, ok := store.suppressions[email]; ok {
+				suppressions = append(suppressions, suppression)
+			}
+		}
+	}
+	sort.Slice(suppressions, func(i, j int) bool {
+		return suppressions[i].Email < suppressions[j].Email
+	})
+	return suppressions, nil
+}
+
+func (store *MemoryStore) DeleteSuppression(ctx context.Context, email string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, ok := store.suppressions[email]
+	delete(store.suppressions, email)
+	return ok, nil
+}
+
+func (store *MemoryStore) ParkPendingEvent(ctx context.Context, event PendingEvent) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.CreatedAt = event.CreatedAt.UTC().Truncate(time.Millisecond)
+	event.ExpiresAt = event.ExpiresAt.UTC().Truncate(time.Millisecond)
+	store.pending = append(store.pending, event)
+	sort.SliceStable(store.pending, func(i, j int) bool {
+		return store.pending[i].CreatedAt.Before(store.pending[j].CreatedAt)
+	})
+	return nil
+}
+
+func (store *MemoryStore) PendingEvents(ctx context.Context, now time.Time, limit int) ([]PendingEvent, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	pending := make([]PendingEvent, 0)
+	for _, event := range store.pending {
+		if len(pending) == limit {
+			break
+		}
+		if event.ExpiresAt.After(now) {
+			pending = append(pending, event)
+		}
+	}
+	return pending, nil
+}
+
+func (store *MemoryStore) CountPendingEvents(ctx context.Context) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return int64(len(store.pending)), nil
+}
+
+func (store *MemoryStore) DeletePendingEvent(ctx context.Context, id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, event := range store.pending {
+		if event.Id == id {
+			store.pending = append(store.pending[:i], store.pending[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) ExpirePendingEvents(ctx context.Context, now time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	kept := store.pending[:0]
+	for _, event := range store.pending {
+		if event.ExpiresAt.After(now) {
+			kept = append(kept, event)
+		}
+	}
+	expired := int64(len(store.pending) - len(kept))
+	store.pending = kept
+	return expired, nil
+}
+
+func (store *MemoryStore) EnqueueEvent(ctx context.Context, event QueuedEvent) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	store.queued = append(store.queued, event)
+	return nil
+}
+
+func (store *MemoryStore) QueuedEvents(ctx context.Context) ([]QueuedEvent, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// events are queued in order
+	queued := make([]QueuedEvent, len(store.queued))
+	copy(queued, store.queued)
+	return queued, nil
+}
+
+func (store *MemoryStore) ClaimQueuedEvents(ctx context.Context, owner string, now, leaseUntil time.Time) ([]QueuedEvent, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	claimed := make([]QueuedEvent, 0)
+	for i, event := range store.queued {
+		if event.ClaimedBy == owner || (event.ClaimedBy != "" && !event.LeaseUntil.Before(now)) {
+			continue
+		}
+		event.ClaimedBy = owner
+		event.LeaseUntil = leaseUntil
+		store.queued[i] = event
+		claimed = append(claimed, event)
+	}
+	return claimed, nil
+}
+
+func (store *MemoryStore) RenewQueuedEvents(ctx context.Context, owner string, leaseUntil time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, event := range store.queued {
+		if event.ClaimedBy == owner {
+			store.queued[i].LeaseUntil = leaseUntil
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) ReleaseQueuedEvents(ctx context.Context, owner string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, event := range store.queued {
+		if event.ClaimedBy == owner {
+			store.queued[i].ClaimedBy = ""
+			store.queued[i].LeaseUntil = time.Time{}
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) DeleteQueuedEvent(ctx context.Context, id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, event := range store.queued {
+		if event.Id == id {
+			store.queued = append(store.queued[:i], store.queued[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) RecordDeadLetter(ctx context.Context, letter DeadLetter) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	letter.Attempts = 1
+	letter.CreatedAt = now
+	letter.UpdatedAt = now
+	if existing, ok := store.deadLetters[letter.Id]; ok {
+		letter.Attempts = existing.Attempts + 1
+		letter.CreatedAt = existing.CreatedAt
+	}
+	store.deadLetters[letter.Id] = letter
+	return nil
+}
+
+func (store *MemoryStore) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	letters := make([]DeadLetter, 0, len(store.deadLetters))
+	for _, letter := range store.deadLetters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		if !letters[i].CreatedAt.Equal(letters[j].CreatedAt) {
+			return letters[i].CreatedAt.Before(letters[j].CreatedAt)
+		}
+		return letters[i].Id < letters[j].Id
+	})
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (store *MemoryStore) DeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	letter, ok := store.deadLetters[id]
+	if !ok {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+func (store *MemoryStore) DeleteDeadLetter(ctx context.Context, id string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	_, ok := store.deadLetters[id]
+	delete(store.deadLetters, id)
+	return ok, nil
+}
+
+func (store *MemoryStore) PurgeDeadLetters(ctx context.Context) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	purged := int64(len(store.deadLetters))
+	store.deadLetters = make(map[string]DeadLetter)
+	return purged, nil
+}
+
+func (store *MemoryStore) RecordSubscription(ctx context.Context, record SubscriptionRecord) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	record.CreatedAt = record.CreatedAt.UTC().Truncate(time.Millisecond)
+	store.subscriptionRecords = append(store.subscriptionRecords, record)
+	sort.SliceStable(store.subscriptionRecords, func(i, j int) bool {
+		return store.subscriptionRecords[i].Id < store.subscriptionRecords[j].Id
+	})
+	return nil
+}
+
+func (store *MemoryStore) SubscriptionRecords(ctx context.Context, limit int) ([]SubscriptionRecord, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	recent := store.subscriptionRecords[max(len(store.subscriptionRecords)-limit, 0):]
+	return append(make([]SubscriptionRecord, 0, len(recent)), recent...), nil
+}
+
+func (store *MemoryStore) ClaimEvent(ctx context.Context, key string, now, staleBefore time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if event, ok := store.processed[key]; ok {
+		if !event.completedAt.IsZero() {
+			return ErrEventProcessed
+		}
+		if !event.claimedAt.Before(staleBefore) {
+			return ErrEventInProgress
+		}
+	}
+	store.processed[key] = processedEvent{claimedAt: now}
+	return nil
+}
+
+func (store *MemoryStore) CompleteEvent(ctx context.Context, key string, now time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if event, ok := store.processed[key]; ok {
+		event.completedAt = now
+		store.processed[key] = event
+	}
+	return nil
+}
+
+func (store *MemoryStore) ReleaseEvent(ctx context.Context, key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if event, ok := store.processed[key]; ok && event.completedAt.IsZero() {
+		delete(store.processed, key)
+	}
+	return nil
+}
+
+func (store *MemoryStore) ExpireProcessedEvents(ctx context.Context, before time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var expired int64
+	for key, event := range store.processed {
+		if event.claimedAt.Before(before) {
+			delete(store.processed, key)
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (store *MemoryStore) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
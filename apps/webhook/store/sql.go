@@ -0,0 +1,753 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"webhook/events"
+	"webhook/migrations"
+
+	"github.com/google/uuid"
+)
+
+// SQLStore stores receipts in a sql database. Queries are written with ? placeholders
+// and rebound for dialects which don't support them.
+type SQLStore struct {
+	db      *sql.DB
+	dialect migrations.Dialect
+}
+
+// NewLibsqlStore returns a store backed by libsql or sqlite
+func NewLibsqlStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: migrations.Sqlite}
+}
+
+// NewPostgresStore returns a store backed by postgres
+func NewPostgresStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: migrations.Postgres}
+}
+
+// DB returns the underlying connection
+func (store *SQLStore) DB() *sql.DB {
+	return store.db
+}
+
+// rebind replaces ? placeholders with $1, $2... for postgres
+func (store *SQLStore) rebind(query string) string {
+	if store.dialect != migrations.Postgres {
+		return query
+	}
+	var builder strings.Builder
+	param := 0
+	for _, char := range query {
+		if char != '?' {
+			builder.WriteRune(char)
+			continue
+		}
+		param++
+		builder.WriteString("$" + strconv.Itoa(param))
+	}
+	return builder.String()
+}
+
+func (store *SQLStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return store.db.ExecContext(ctx, store.rebind(query), args...)
+}
+
+func (store *SQLStore) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return store.db.QueryContext(ctx, store.rebind(query), args...)
+}
+
+func (store *SQLStore) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return store.db.QueryRowContext(ctx, store.rebind(query), args...)
+}
+
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
+
+func (store *SQLStore) UpdateStatus(ctx context.Context, event events.ParsedEvent) error {
+	previousStatuses := events.PreviousStatuses(event.Status)
+	if len(previousStatuses) == 0 {
+		return ErrTransitionIgnored
+	}
+	knownStatuses := events.KnownStatuses()
+
+	args := []any{event.Status, event.EmailId, event.CampaignId, event.DonorId}
+	// receipts with statuses outside of the table can move to any status
+	for _, status := range previousStatuses {
+		args = append(args, status)
+	}
+	for _, status := range knownStatuses {
+		args = append(args, status)
+	}
+	res, err := store.exec(ctx, fmt.Sprintf(`
+UPDATE receipts
+		SET email_status = ?,
+			email_id = ?
+		WHERE campaign_id = ? AND donor_id = ?
+			AND (email_status IN (%s) OR email_status NOT IN (%s));
+`, placeholders(len(previousStatuses)), placeholders(len(knownStatuses))), args...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+
+	// either the receipt doesn't exist or its status is ahead of the event
+	_, err = store.Receipt(ctx, event.CampaignId, event.DonorId)
+	if err != nil {
+		return err
+	}
+	return ErrTransitionIgnored
+}
+
+func (store *SQLStore) Receipt(ctx context.Context, campaignId, donorId string) (Receipt, error) {
+	receipt := Receipt{CampaignId: campaignId, DonorId: donorId}
+	var emailId, status sql.NullString
+	err := store.queryRow(
+		ctx,
+		`SELECT email_id, email_status FROM receipts WHERE campaign_id = ? AND donor_id = ?;`,
+		campaignId,
+		donorId,
+	).Scan(&emailId, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Receipt{}, ErrReceiptNotFound
+	}
+	receipt.EmailId = emailId.String
+	receipt.Status = status.String
+	return receipt, err
+}
+
+func (store *SQLStore) CampaignReceipts(ctx context.Context, campaignId string) ([]Receipt, error) {
+	rows, err := store.query(
+		ctx,
+		`SELECT donor_id, email_id, email_status FROM receipts WHERE campaign_id = ? ORDER BY donor_id;`,
+		campaignId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := make([]Receipt, 0)
+	for rows.Next() {
+		receipt := Receipt{CampaignId: campaignId}
+		var emailId, status sql.NullString
+		if err := rows.Scan(&receipt.DonorId, &emailId, &status); err != nil {
+			return nil, err
+		}
+		receipt.EmailId = emailId.String
+		receipt.Status = status.String
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+func (store *SQLStore) SessionUser(ctx context.Context, sessionToken string, now time.Time) (string, error) {
+	var userId string
+	err := store.queryRow(
+		ctx,
+		`SELECT user_id FROM sessions WHERE session_token = ? AND expires > ?;`,
+		sessionToken,
+		now.UnixMilli(),
+	).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrSessionNotFound
+	}
+	return userId, err
+}
+
+func (store *SQLStore) UserOwnsCampaign(ctx context.Context, userId, campaignId string) (bool, error) {
+	var id string
+	err := store.queryRow(
+		ctx,
+		`SELECT campaigns.id FROM campaigns
+		JOIN accounts ON accounts.id = campaigns.account_id
+		WHERE campaigns.id = ? AND accounts.user_id = ?;`,
+		campaignId,
+		userId,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (store *SQLStore) AppendHistory(ctx context.Context, event events.ParsedEvent) error {
+	historyEvent, err := historyEvent(event)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec(ctx, `
+INSERT INTO receipt_events (id, campaign_id, donor_id, email_id, event_type, status, sns_message_id, timestamp, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING;
+`,
+		uuid.New().String(),
+		event.CampaignId,
+		event.DonorId,
+		historyEvent.EmailId,
+		string(historyEvent.EventType),
+		historyEvent.Status,
+		historyEvent.SnsMessageId,
+		historyEvent.Timestamp.UnixMilli(),
+		string(historyEvent.Detail),
+		time.Now().UnixMilli(),
+	)
+	return err
+}
+
+func (store *SQLStore) History(ctx context.Context, campaignId, donorId string) ([]HistoryEvent, error) {
+	rows, err := store.query(ctx, `
+SELECT donor_id, email_id, event_type, status, sns_message_id, timestamp, detail
+		FROM receipt_events
+		WHERE campaign_id = ? AND donor_id = ?
+		ORDER BY timestamp ASC, created_at ASC;
+`, campaignId, donorId)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]HistoryEvent, 0)
+	err = scanHistory(rows, func(donorId string, event HistoryEvent) {
+		history = append(history, event)
+	})
+	return history, err
+}
+
+func (store *SQLStore) CampaignHistory(ctx context.Context, campaignId string) (map[string][]HistoryEvent, error) {
+	rows, err := store.query(ctx, `
+SELECT donor_id, email_id, event_type, status, sns_message_id, timestamp, detail
+		FROM receipt_events
+		WHERE campaign_id = ?
+		ORDER BY donor_id ASC, timestamp ASC, created_at ASC;
+`, campaignId)
+	if err != nil {
+		return nil, err
+	}
+	history := make(map[string][]HistoryEvent)
+	err = scanHistory(rows, func(donorId string, event HistoryEvent) {
+		history[donorId] = append(history[donorId], event)
+	})
+	return history, err
+}
+
+// scanHistory calls fn with each receipt_events row and closes the rows
+func scanHistory(rows *sql.Rows, fn func(donorId string, event HistoryEvent)) error {
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			donorId      string
+			event        HistoryEvent
+			eventType    string
+			snsMessageId sql.NullString
+			timestamp    int64
+			detail       string
+		)
+		if err := rows.Scan(&donorId, &event.EmailId, &eventType, &event.Status, &snsMessageId, &timestamp, &detail); err != nil {
+			return err
+		}
+		event.EventType = events.EventType(eventType)
+		event.SnsMessageId = snsMessageId.String
+		event.Timestamp = time.UnixMilli(timestamp).UTC()
+		event.Detail = json.RawMessage(detail)
+		fn(donorId, event)
+	}
+	return rows.Err()
+}
+
+func (store *SQLStore) ApplyStatusChanges(ctx context.Context, campaignId string, changes []StatusChange) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, change := range changes {
+		res, err := tx.ExecContext(ctx, store.rebind(`
+UPDATE receipts
+		SET email_status = ?
+		WHERE campaign_id = ? AND donor_id = ? AND email_status = ?;
+`), change.To, campaignId, change.DonorId, change.From)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected > 0 {
+			continue
+		}
+		var status string
+		err = tx.QueryRowContext(
+			ctx,
+			store.rebind(`SELECT email_status FROM receipts WHERE campaign_id = ? AND donor_id = ?;`),
+			campaignId,
+			change.DonorId,
+		).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", change.DonorId, ErrReceiptNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%s is %s rather than %s: %w", change.DonorId, status, change.From, ErrStatusChanged)
+	}
+	return tx.Commit()
+}
+
+func (store *SQLStore) UpsertSuppression(ctx context.Context, suppression Suppression) error {
+	now := time.Now().UnixMilli()
+	_, err := store.exec(ctx, `
+INSERT INTO suppressions (email, reason, detail, campaign_id, donor_id, email_id, sns_message_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (email) DO UPDATE SET
+			reason = excluded.reason,
+			detail = excluded.detail,
+			campaign_id = excluded.campaign_id,
+			donor_id = excluded.donor_id,
+			email_id = excluded.email_id,
+			sns_message_id = excluded.sns_message_id,
+			updated_at = excluded.updated_at;
+`,
+		suppression.Email,
+		string(suppression.Reason),
+		suppression.Detail,
+		suppression.CampaignId,
+		suppression.DonorId,
+		suppression.EmailId,
+		suppression.SnsMessageId,
+		now,
+		now,
+	)
+	return err
+}
+
+const selectSuppressions = `SELECT email, reason, detail, campaign_id, donor_id, email_id, sns_message_id, created_at, updated_at FROM suppressions`
+
+func scanSuppression(row interface{ Scan(...any) error }) (Suppression, error) {
+	var suppression Suppression
+	var reason string
+	var createdAt, updatedAt int64
+	err := row.Scan(
+		&suppression.Email,
+		&reason,
+		&suppression.Detail,
+		&suppression.CampaignId,
+		&suppression.DonorId,
+		&suppression.EmailId,
+		&suppression.SnsMessageId,
+		&createdAt,
+		&updatedAt,
+	)
+	suppression.Reason = SuppressionReason(reason)
+	suppression.CreatedAt = time.UnixMilli(createdAt).UTC()
+	suppression.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	return suppression, err
+}
+
+func (store *SQLStore) Suppressions(ctx context.Context, emails []string) ([]Suppression, error) {
+	query := selectSuppressions + ` ORDER BY email;`
+	var args []any
+	if emails != nil {
+		if len(emails) == 0 {
+			return []Suppression{}, nil
+		}
+		for _, email := range emails {
+			args = append(args, email)
+		}
+		query = fmt.Sprintf(`%s WHERE email IN (%s) ORDER BY email;`, selectSuppressions, placeholders(len(emails)))
+	}
+
+	rows, err := store.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suppressions := make([]Suppression, 0)
+	for rows.Next() {
+		suppression, err := scanSuppression(rows)
+		if err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, rows.Err()
+}
+
+func (store *SQLStore) DeleteSuppression(ctx context.Context, email string) (bool, error) {
+	res, err := store.exec(ctx, `DELETE FROM suppressions WHERE email = ?;`, email)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (store *SQLStore) ParkPendingEvent(ctx context.Context, event PendingEvent) error {
+	createdAt := event.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	_, err := store.exec(ctx, `
+INSERT INTO pending_events (id, campaign_id, donor_id, sns_message_id, raw, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?);
+`,
+		event.Id,
+		event.CampaignId,
+		event.DonorId,
+		event.SnsMessageId,
+		string(event.Raw),
+		event.ExpiresAt.UnixMilli(),
+		createdAt.UnixMilli(),
+	)
+	return err
+}
+
+func (store *SQLStore) PendingEvents(ctx context.Context, now time.Time, limit int) ([]PendingEvent, error) {
+	rows, err := store.query(ctx, `
+SELECT id, campaign_id, donor_id, sns_message_id, raw, expires_at, created_at
+		FROM pending_events
+		WHERE expires_at > ?
+		ORDER BY created_at ASC, id ASC
+		LIMIT ?;
+`, now.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := make([]PendingEvent, 0)
+	for rows.Next() {
+		var (
+			event     PendingEvent
+			raw       string
+			expiresAt int64
+			createdAt int64
+		)
+		if err := rows.Scan(&event.Id, &event.CampaignId, &event.DonorId, &event.SnsMessageId, &raw, &expiresAt, &createdAt); err != nil {
+			return nil, err
+		}
+		event.Raw = []byte(raw)
+		event.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+		event.CreatedAt = time.UnixMilli(createdAt).UTC()
+		pending = append(pending, event)
+	}
+	return pending, rows.Err()
+}
+
+func (store *SQLStore) CountPendingEvents(ctx context.Context) (int64, error) {
+	var count int64
+	err := store.queryRow(ctx, `SELECT count(*) FROM pending_events;`).Scan(&count)
+	return count, err
+}
+
+func (store *SQLStore) DeletePendingEvent(ctx context.Context, id string) error {
+	_, err := store.exec(ctx, `DELETE FROM pending_events WHERE id = ?;`, id)
+	return err
+}
+
+func (store *SQLStore) ExpirePendingEvents(ctx context.Context, now time.Time) (int64, error) {
+	res, err := store.exec(ctx, `DELETE FROM pending_events WHERE expires_at <= ?;`, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (store *SQLStore) EnqueueEvent(ctx context.Context, event QueuedEvent) error {
+	createdAt := event.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	var leaseUntil int64
+	if !event.LeaseUntil.IsZero() {
+		leaseUntil = event.LeaseUntil.UnixMilli()
+	}
+	_, err := store.exec(ctx, `
+INSERT INTO queued_events (id, campaign_id, donor_id, sns_message_id, raw, claimed_by, lease_until, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+`,
+		event.Id,
+		event.CampaignId,
+		event.DonorId,
+		event.SnsMessageId,
+		string(event.Raw),
+		event.ClaimedBy,
+		leaseUntil,
+		createdAt.UnixMilli(),
+	)
+	return err
+}
+
+func (store *SQLStore) QueuedEvents(ctx context.Context) ([]QueuedEvent, error) {
+	rows, err := store.query(ctx, `
+SELECT id, campaign_id, donor_id, sns_message_id, raw, claimed_by, lease_until, created_at
+		FROM queued_events
+		ORDER BY created_at ASC, id ASC;
+`)
+	if err != nil {
+		return nil, err
+	}
+	return scanQueuedEvents(rows)
+}
+
+// ClaimQueuedEvents claims the events in a single statement so instances starting at
+// the same time never claim the same event
+func (store *SQLStore) ClaimQueuedEvents(ctx context.Context, owner string, now, leaseUntil time.Time) ([]QueuedEvent, error) {
+	rows, err := store.query(ctx, `
+UPDATE queued_events
+		SET claimed_by = ?, lease_until = ?
+		WHERE claimed_by <> ? AND (claimed_by = '' OR lease_until < ?)
+		RETURNING id, campaign_id, donor_id, sns_message_id, raw, claimed_by, lease_until, created_at;
+`, owner, leaseUntil.UnixMilli(), owner, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := scanQueuedEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING doesn't follow an order
+	sort.Slice(claimed, func(i, j int) bool {
+		if !claimed[i].CreatedAt.Equal(claimed[j].CreatedAt) {
+			return claimed[i].CreatedAt.Before(claimed[j].CreatedAt)
+		}
+		return claimed[i].Id < claimed[j].Id
+	})
+	return claimed, nil
+}
+
+func (store *SQLStore) RenewQueuedEvents(ctx context.Context, owner string, leaseUntil time.Time) error {
+	_, err := store.exec(ctx, `UPDATE queued_events SET lease_until = ? WHERE claimed_by = ?;`, leaseUntil.UnixMilli(), owner)
+	return err
+}
+
+func (store *SQLStore) ReleaseQueuedEvents(ctx context.Context, owner string) error {
+	_, err := store.exec(ctx, `UPDATE queued_events SET claimed_by = '', lease_until = 0 WHERE claimed_by = ?;`, owner)
+	return err
+}
+
+func scanQueuedEvents(rows *sql.Rows) ([]QueuedEvent, error) {
+	defer rows.Close()
+
+	queued := make([]QueuedEvent, 0)
+	for rows.Next() {
+		var (
+			event      QueuedEvent
+			raw        string
+			leaseUntil int64
+			createdAt  int64
+		)
+		if err := rows.Scan(&event.Id, &event.CampaignId, &event.DonorId, &event.SnsMessageId, &raw, &event.ClaimedBy, &leaseUntil, &createdAt); err != nil {
+			return nil, err
+		}
+		event.Raw = []byte(raw)
+		if leaseUntil != 0 {
+			event.LeaseUntil = time.UnixMilli(leaseUntil).UTC()
+		}
+		event.CreatedAt = time.UnixMilli(createdAt).UTC()
+		queued = append(queued, event)
+	}
+	return queued, rows.Err()
+}
+
+func (store *SQLStore) DeleteQueuedEvent(ctx context.Context, id string) error {
+	_, err := store.exec(ctx, `DELETE FROM queued_events WHERE id = ?;`, id)
+	return err
+}
+
+func (store *SQLStore) RecordDeadLetter(ctx context.Context, letter DeadLetter) error {
+	now := time.Now().UnixMilli()
+	_, err := store.exec(ctx, `
+INSERT INTO dead_letters (id, reason, error, raw, attempts, created_at, updated_at)
+		VALUES (?, ?, ?, ?, 1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			reason = excluded.reason,
+			error = excluded.error,
+			raw = excluded.raw,
+			attempts = dead_letters.attempts + 1,
+			updated_at = excluded.updated_at;
+`,
+		letter.Id,
+		string(letter.Reason),
+		letter.Error,
+		string(letter.Raw),
+		now,
+		now,
+	)
+	return err
+}
+
+const selectDeadLetters = `SELECT id, reason, error, raw, attempts, created_at, updated_at FROM dead_letters`
+
+func scanDeadLetter(row interface{ Scan(...any) error }) (DeadLetter, error) {
+	var letter DeadLetter
+	var reason, raw string
+	var createdAt, updatedAt int64
+	err := row.Scan(&letter.Id, &reason, &letter.Error, &raw, &letter.Attempts, &createdAt, &updatedAt)
+	letter.Reason = DeadLetterReason(reason)
+	letter.Raw = []byte(raw)
+	letter.CreatedAt = time.UnixMilli(createdAt).UTC()
+	letter.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	return letter, err
+}
+
+func (store *SQLStore) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	rows, err := store.query(ctx, selectDeadLetters+` ORDER BY created_at ASC, id ASC LIMIT ?;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]DeadLetter, 0)
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (store *SQLStore) DeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	letter, err := scanDeadLetter(store.queryRow(ctx, selectDeadLetters+` WHERE id = ?;`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, err
+}
+
+func (store *SQLStore) DeleteDeadLetter(ctx context.Context, id string) (bool, error) {
+	res, err := store.exec(ctx, `DELETE FROM dead_letters WHERE id = ?;`, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (store *SQLStore) PurgeDeadLetters(ctx context.Context) (int64, error) {
+	res, err := store.exec(ctx, `DELETE FROM dead_letters;`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (store *SQLStore) RecordSubscription(ctx context.Context, record SubscriptionRecord) error {
+	_, err := store.exec(ctx, `
+INSERT INTO subscription_records (id, type, topic_arn, message_id, subscription_arn, outcome, error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+`,
+		record.Id,
+		record.Type,
+		record.TopicArn,
+		record.MessageId,
+		record.SubscriptionArn,
+		string(record.Outcome),
+		record.Error,
+		record.CreatedAt.UnixMilli(),
+	)
+	return err
+}
+
+func (store *SQLStore) SubscriptionRecords(ctx context.Context, limit int) ([]SubscriptionRecord, error) {
+	rows, err := store.query(ctx, `
+SELECT id, type, topic_arn, message_id, subscription_arn, outcome, error, created_at FROM (
+		SELECT * FROM subscription_records ORDER BY id DESC LIMIT ?
+	) AS recent ORDER BY id ASC;
+`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]SubscriptionRecord, 0)
+	for rows.Next() {
+		var record SubscriptionRecord
+		var outcome string
+		var createdAt int64
+		err := rows.Scan(&record.Id, &record.Type, &record.TopicArn, &record.MessageId, &record.SubscriptionArn, &outcome, &record.Error, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		record.Outcome = SubscriptionOutcome(outcome)
+		record.CreatedAt = time.UnixMilli(createdAt).UTC()
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *SQLStore) ClaimEvent(ctx context.Context, key string, now, staleBefore time.Time) error {
+	res, err := store.exec(ctx, `
+INSERT INTO processed_events (event_key, claimed_at)
+		VALUES (?, ?)
+		ON CONFLICT (event_key) DO UPDATE SET
+			claimed_at = excluded.claimed_at
+		WHERE processed_events.completed_at IS NULL AND processed_events.claimed_at < ?;
+`,
+		key,
+		now.UnixMilli(),
+		staleBefore.UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+
+	var completedAt sql.NullInt64
+	err = store.queryRow(ctx, `SELECT completed_at FROM processed_events WHERE event_key = ?;`, key).Scan(&completedAt)
+	if err != nil {
+		return err
+	}
+	if completedAt.Valid {
+		return ErrEventProcessed
+	}
+	return ErrEventInProgress
+}
+
+func (store *SQLStore) CompleteEvent(ctx context.Context, key string, now time.Time) error {
+	_, err := store.exec(ctx, `UPDATE processed_events SET completed_at = ? WHERE event_key = ?;`, now.UnixMilli(), key)
+	return err
+}
+
+func (store *SQLStore) ReleaseEvent(ctx context.Context, key string) error {
+	_, err := store.exec(ctx, `DELETE FROM processed_events WHERE event_key = ? AND completed_at IS NULL;`, key)
+	return err
+}
+
+func (store *SQLStore) ExpireProcessedEvents(ctx context.Context, before time.Time) (int64, error) {
+	res, err := store.exec(ctx, `DELETE FROM processed_events WHERE claimed_at < ?;`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (store *SQLStore) Migrate(ctx context.Context) error {
+	return migrations.Migrate(ctx, store.db, store.dialect)
+}
+
+func (store *SQLStore) Close() error {
+	return store.db.Close()
+}
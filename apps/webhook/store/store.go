@@ -0,0 +1,263 @@
+// Package store persists receipt statuses and everything the webhook records
+// about them. The receipts table is owned by the web app, the webhook only
+// updates statuses, and the sessions, accounts and campaigns tables are only read
+// to authorize subscribers. Every other table is created by the webhook's migrations.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"webhook/events"
+)
+
+var (
+	ErrReceiptNotFound    = errors.New("no rows affected")
+	ErrTransitionIgnored  = errors.New("status transition ignored")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrEventProcessed     = errors.New("event already processed")
+	ErrEventInProgress    = errors.New("event being processed")
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrStatusChanged      = errors.New("receipt status changed")
+)
+
+// ReceiptStore is implemented by every storage backend
+type ReceiptStore interface {
+	// UpdateStatus moves the receipt to the event's status if the current status
+	// may move to it, see events.CanTransition. ErrTransitionIgnored is returned if it may not
+	// and ErrReceiptNotFound if the receipt doesn't exist.
+	UpdateStatus(ctx context.Context, event events.ParsedEvent) error
+	// Receipt returns the receipt or ErrReceiptNotFound
+	Receipt(ctx context.Context, campaignId, donorId string) (Receipt, error)
+	// CampaignReceipts returns every receipt in the campaign ordered by donor id
+	CampaignReceipts(ctx context.Context, campaignId string) ([]Receipt, error)
+
+	// AppendHistory records the event in the receipt's history. Events already recorded
+	// with the same sns message id are ignored.
+	AppendHistory(ctx context.Context, event events.ParsedEvent) error
+	// History returns the donor's events in a campaign ordered by their SES timestamp
+	History(ctx context.Context, campaignId, donorId string) ([]HistoryEvent, error)
+	// CampaignHistory returns the events of every donor in the campaign by donor id,
+	// each ordered by their SES timestamp
+	CampaignHistory(ctx context.Context, campaignId string) (map[string][]HistoryEvent, error)
+	// ApplyStatusChanges sets the status of each receipt in a single transaction. If any
+	// receipt's status is no longer the change's From none are applied and ErrStatusChanged
+	// is returned, ErrReceiptNotFound is returned if a receipt doesn't exist.
+	ApplyStatusChanges(ctx context.Context, campaignId string, changes []StatusChange) error
+
+	// UpsertSuppression suppresses the address, replacing any existing suppression
+	UpsertSuppression(ctx context.Context, suppression Suppression) error
+	// Suppressions returns the suppressions for the given normalized addresses
+	// or every suppression if emails is nil
+	Suppressions(ctx context.Context, emails []string) ([]Suppression, error)
+	// DeleteSuppression removes the suppression, returning false if there wasn't one
+	DeleteSuppression(ctx context.Context, email string) (bool, error)
+
+	// ParkPendingEvent stores an event whose receipt doesn't exist yet so it can be reapplied later
+	ParkPendingEvent(ctx context.Context, event PendingEvent) error
+	// PendingEvents returns up to limit pending events which haven't expired, oldest first
+	PendingEvents(ctx context.Context, now time.Time, limit int) ([]PendingEvent, error)
+	// CountPendingEvents returns the number of pending events, including expired ones
+	// which haven't been removed yet
+	CountPendingEvents(ctx context.Context) (int64, error)
+	DeletePendingEvent(ctx context.Context, id string) error
+	// ExpirePendingEvents removes the events which expired before now, returning how many were removed
+	ExpirePendingEvents(ctx context.Context, now time.Time) (int64, error)
+
+	// EnqueueEvent stores an accepted event until a worker has applied it
+	EnqueueEvent(ctx context.Context, event QueuedEvent) error
+	// QueuedEvents returns every queued event in the order they were queued
+	QueuedEvents(ctx context.Context) ([]QueuedEvent, error)
+	// ClaimQueuedEvents claims the events which aren't owned by an instance or whose
+	// lease expired before now for owner until leaseUntil, and returns them in the order
+	// they were queued. Events already owned by owner aren't returned.
+	ClaimQueuedEvents(ctx context.Context, owner string, now, leaseUntil time.Time) ([]QueuedEvent, error)
+	// RenewQueuedEvents extends the lease of every event owned by owner until leaseUntil
+	RenewQueuedEvents(ctx context.Context, owner string, leaseUntil time.Time) error
+	// ReleaseQueuedEvents gives up owner's events so another instance can claim them
+	ReleaseQueuedEvents(ctx context.Context, owner string) error
+	DeleteQueuedEvent(ctx context.Context, id string) error
+
+	// RecordDeadLetter stores an event which failed to parse or to be applied. If it
+	// failed before its reason and error are replaced and another attempt is counted.
+	RecordDeadLetter(ctx context.Context, letter DeadLetter) error
+	// DeadLetters returns up to limit dead letters, oldest first
+	DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+	// DeadLetter returns the dead letter or ErrDeadLetterNotFound
+	DeadLetter(ctx context.Context, id string) (DeadLetter, error)
+	// DeleteDeadLetter removes the dead letter, returning false if there wasn't one
+	DeleteDeadLetter(ctx context.Context, id string) (bool, error)
+	// PurgeDeadLetters removes every dead letter, returning how many were removed
+	PurgeDeadLetters(ctx context.Context) (int64, error)
+
+	// ClaimEvent records that the event with the dedupe key is being processed.
+	// ErrEventProcessed is returned if it has been processed and ErrEventInProgress
+	// if it's claimed by another request and the claim is newer than staleBefore.
+	ClaimEvent(ctx context.Context, key string, now, staleBefore time.Time) error
+	// CompleteEvent marks the claimed event as processed
+	CompleteEvent(ctx context.Context, key string, now time.Time) error
+	// ReleaseEvent removes the claim so the event can be processed again
+	ReleaseEvent(ctx context.Context, key string) error
+	// ExpireProcessedEvents removes the events claimed before the given time,
+	// returning how many were removed
+	ExpireProcessedEvents(ctx context.Context, before time.Time) (int64, error)
+
+	// RecordSubscription stores the outcome of a subscription message
+	RecordSubscription(ctx context.Context, record SubscriptionRecord) error
+	// SubscriptionRecords returns the most recent limit subscription records, oldest first
+	SubscriptionRecords(ctx context.Context, limit int) ([]SubscriptionRecord, error)
+
+	// SessionUser returns the id of the user signed in with the web app's session token
+	// or ErrSessionNotFound if there's no such session or it expired before now
+	SessionUser(ctx context.Context, sessionToken string, now time.Time) (string, error)
+	// UserOwnsCampaign reports whether the campaign belongs to one of the user's accounts
+	UserOwnsCampaign(ctx context.Context, userId, campaignId string) (bool, error)
+
+	// Migrate creates the tables owned by the webhook
+	Migrate(ctx context.Context) error
+	Close() error
+}
+
+type Receipt struct {
+	CampaignId string
+	DonorId    string
+	EmailId    string
+	Status     string
+}
+
+// StatusChange moves a receipt from one status to another regardless of the transitions
+// events may make, e.g. to repair a status which was mapped wrongly
+type StatusChange struct {
+	DonorId string `json:"donorId"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// HistoryEvent is a single SES event recorded for a receipt
+type HistoryEvent struct {
+	EmailId      string           `json:"emailId"`
+	EventType    events.EventType `json:"eventType"`
+	Status       string           `json:"status"`
+	SnsMessageId string           `json:"snsMessageId"`
+	Timestamp    time.Time        `json:"timestamp"`
+	Detail       json.RawMessage  `json:"detail"`
+}
+
+type SuppressionReason string
+
+const (
+	SuppressionBounce    SuppressionReason = "bounce"
+	SuppressionComplaint SuppressionReason = "complaint"
+)
+
+// Suppression is an address which shouldn't be emailed again,
+// either because it hard bounced or because the recipient complained
+type Suppression struct {
+	Email  string            `json:"email"`
+	Reason SuppressionReason `json:"reason"`
+	// the bounce sub type or complaint feedback type
+	Detail       string    `json:"detail"`
+	CampaignId   string    `json:"campaignId"`
+	DonorId      string    `json:"donorId"`
+	EmailId      string    `json:"emailId"`
+	SnsMessageId string    `json:"snsMessageId"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// PendingEvent is an event which arrived before its receipt was inserted
+type PendingEvent struct {
+	Id           string
+	CampaignId   string
+	DonorId      string
+	SnsMessageId string
+	// Raw is the sns message body, it's parsed again when the event is reapplied
+	Raw       []byte
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// QueuedEvent is an event which was accepted but hasn't been applied yet.
+// Ids should sort in the order events are queued, e.g. uuid v7s, so events
+// queued in the same millisecond keep their order.
+type QueuedEvent struct {
+	Id           string
+	CampaignId   string
+	DonorId      string
+	SnsMessageId string
+	// Raw is the sns message body, it's parsed again if the event is recovered
+	Raw []byte
+	// ClaimedBy is the instance applying the event, it's empty once released.
+	// Other instances only recover the event once LeaseUntil has passed.
+	ClaimedBy  string
+	LeaseUntil time.Time
+	CreatedAt  time.Time
+}
+
+type DeadLetterReason string
+
+const (
+	// DeadLetterParse is an sns notification whose SES event couldn't be parsed
+	DeadLetterParse DeadLetterReason = "parse"
+	// DeadLetterWrite is an event which couldn't be applied to the db
+	DeadLetterWrite DeadLetterReason = "write"
+)
+
+// DeadLetter is an event which failed, kept so it can be replayed once the
+// parser or the data has been fixed
+type DeadLetter struct {
+	// Id is the sns message id, so redeliveries of a failing event are counted as attempts
+	Id     string           `json:"id"`
+	Reason DeadLetterReason `json:"reason"`
+	Error  string           `json:"error"`
+	// Raw is the sns message body
+	Raw       []byte    `json:"-"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type SubscriptionOutcome string
+
+// SubscriptionRecord is the outcome of handling a SubscriptionConfirmation
+// or UnsubscribeConfirmation message. Ids should sort in the order records are
+// made, e.g. uuid v7s.
+type SubscriptionRecord struct {
+	Id              string              `json:"id"`
+	Type            string              `json:"type"`
+	TopicArn        string              `json:"topicArn"`
+	MessageId       string              `json:"messageId"`
+	SubscriptionArn string              `json:"subscriptionArn,omitempty"`
+	Outcome         SubscriptionOutcome `json:"outcome"`
+	Error           string              `json:"error,omitempty"`
+	CreatedAt       time.Time           `json:"createdAt"`
+}
+
+// historyEvent converts a parsed event into the form it's stored in
+func historyEvent(event events.ParsedEvent) (HistoryEvent, error) {
+	detail := []byte("{}")
+	if eventDetail := event.Detail(); eventDetail != nil {
+		var err error
+		detail, err = json.Marshal(eventDetail)
+		if err != nil {
+			return HistoryEvent{}, err
+		}
+	}
+	return HistoryEvent{
+		EmailId:      event.EmailId,
+		EventType:    event.EventType,
+		Status:       event.Status,
+		SnsMessageId: event.SnsMessageId,
+		Timestamp:    event.Timestamp.UTC().Truncate(time.Millisecond),
+		Detail:       detail,
+	}, nil
+}
+
+// Session is a web app session, only the memory store creates them
+type Session struct {
+	SessionToken string
+	UserId       string
+	Expires      time.Time
+}
@@ -0,0 +1,935 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webhook/events"
+
+	"github.com/google/uuid"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/tursodatabase/go-libsql"
+)
+
+// the receipts table is created by the web app's migrations so the tests create it themselves
+const createReceipts = `CREATE TABLE IF NOT EXISTS receipts (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	email_id varchar(191),
+	campaign_id varchar(191) NOT NULL,
+	email_status text NOT NULL,
+	donor_id varchar(191) NOT NULL
+);`
+
+// the web app's auth tables, with only the columns the webhook reads
+var createAuthTables = []string{
+	`CREATE TABLE IF NOT EXISTS sessions (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	session_token varchar(191) NOT NULL,
+	user_id varchar(191) NOT NULL,
+	expires bigint NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS accounts (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	user_id varchar(191) NOT NULL
+);`,
+	`CREATE TABLE IF NOT EXISTS campaigns (
+	id varchar(191) PRIMARY KEY NOT NULL,
+	account_id varchar(191) NOT NULL
+);`,
+}
+
+// storeTester creates receipts, sessions and campaigns directly since they're owned by the web app
+type storeTester struct {
+	store          ReceiptStore
+	insertReceipt  func(receipt Receipt) error
+	insertSession  func(session Session) error
+	insertCampaign func(campaignId, accountId, userId string) error
+}
+
+func newMemoryTester(test *testing.T) storeTester {
+	memoryStore := NewMemoryStore()
+	return storeTester{
+		store: memoryStore,
+		insertReceipt: func(receipt Receipt) error {
+			memoryStore.InsertReceipt(receipt)
+			return nil
+		},
+		insertSession: func(session Session) error {
+			memoryStore.InsertSession(session)
+			return nil
+		},
+		insertCampaign: func(campaignId, accountId, userId string) error {
+			memoryStore.InsertCampaign(campaignId, accountId, userId)
+			return nil
+		},
+	}
+}
+
+func newSQLTester(test *testing.T, sqlStore *SQLStore) storeTester {
+	test.Helper()
+	_, err := sqlStore.db.Exec(createReceipts)
+	if err != nil {
+		test.Fatalf("failed to create receipts: %s", err)
+	}
+	for _, createTable := range createAuthTables {
+		if _, err := sqlStore.db.Exec(createTable); err != nil {
+			test.Fatalf("failed to create auth tables: %s", err)
+		}
+	}
+	err = sqlStore.Migrate(context.Background())
+	if err != nil {
+		test.Fatalf("failed to migrate: %s", err)
+	}
+	test.Cleanup(func() { sqlStore.Close() })
+	return storeTester{
+		store: sqlStore,
+		insertReceipt: func(receipt Receipt) error {
+			_, err := sqlStore.exec(
+				context.Background(),
+				`INSERT INTO receipts (id, email_id, campaign_id, email_status, donor_id) VALUES (?, ?, ?, ?, ?);`,
+				uuid.New().String(),
+				receipt.EmailId,
+				receipt.CampaignId,
+				receipt.Status,
+				receipt.DonorId,
+			)
+			return err
+		},
+		insertSession: func(session Session) error {
+			_, err := sqlStore.exec(
+				context.Background(),
+				`INSERT INTO sessions (id, session_token, user_id, expires) VALUES (?, ?, ?, ?);`,
+				uuid.New().String(),
+				session.SessionToken,
+				session.UserId,
+				session.Expires.UnixMilli(),
+			)
+			return err
+		},
+		insertCampaign: func(campaignId, accountId, userId string) error {
+			ctx := context.Background()
+			_, err := sqlStore.exec(ctx, `INSERT INTO accounts (id, user_id) VALUES (?, ?);`, accountId, userId)
+			if err != nil {
+				return err
+			}
+			_, err = sqlStore.exec(ctx, `INSERT INTO campaigns (id, account_id) VALUES (?, ?);`, campaignId, accountId)
+			return err
+		},
+	}
+}
+
+func newLibsqlTester(test *testing.T) storeTester {
+	test.Helper()
+	db, err := sql.Open("libsql", "file:"+filepath.Join(test.TempDir(), "store.db"))
+	if err != nil {
+		test.Fatalf("failed to open db: %s", err)
+	}
+	// a local sqlite file only allows one writer at a time
+	db.SetMaxOpenConns(1)
+	return newSQLTester(test, NewLibsqlStore(db))
+}
+
+// newPostgresTester uses the database at TEST_POSTGRES_URL, the test is skipped if it isn't set.
+// Tests share the database so they use random campaign ids.
+func newPostgresTester(test *testing.T) storeTester {
+	test.Helper()
+	postgresUrl := os.Getenv("TEST_POSTGRES_URL")
+	if postgresUrl == "" {
+		test.Skip("TEST_POSTGRES_URL not set")
+	}
+	db, err := sql.Open("pgx", postgresUrl)
+	if err != nil {
+		test.Fatalf("failed to open db: %s", err)
+	}
+	return newSQLTester(test, NewPostgresStore(db))
+}
+
+var storeTesters = map[string]func(test *testing.T) storeTester{
+	"memory":   newMemoryTester,
+	"libsql":   newLibsqlTester,
+	"postgres": newPostgresTester,
+}
+
+func testEvent(campaignId, donorId, status string, eventType events.EventType, timestamp time.Time) events.ParsedEvent {
+	return events.ParsedEvent{
+		CampaignId:   campaignId,
+		DonorId:      donorId,
+		EmailId:      "email-" + donorId,
+		EventType:    eventType,
+		Status:       status,
+		Timestamp:    timestamp,
+		SnsMessageId: uuid.New().String(),
+	}
+}
+
+func TestReceiptStore(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+			donorId := "donor"
+
+			_, err := tester.store.Receipt(ctx, campaignId, donorId)
+			if !errors.Is(err, ErrReceiptNotFound) {
+				test.Fatalf("expected ErrReceiptNotFound but got %v", err)
+			}
+			now := time.Now()
+			err = tester.store.UpdateStatus(ctx, testEvent(campaignId, donorId, events.StatusSent, events.Send, now))
+			if !errors.Is(err, ErrReceiptNotFound) {
+				test.Fatalf("expected ErrReceiptNotFound updating a missing receipt but got %v", err)
+			}
+
+			err = tester.insertReceipt(Receipt{CampaignId: campaignId, DonorId: donorId, Status: events.StatusNotSent})
+			if err != nil {
+				test.Fatal(err)
+			}
+
+			err = tester.insertReceipt(Receipt{CampaignId: campaignId, DonorId: "another-donor", Status: events.StatusNotSent})
+			if err != nil {
+				test.Fatal(err)
+			}
+			receipts, err := tester.store.CampaignReceipts(ctx, campaignId)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if len(receipts) != 2 || receipts[0].DonorId != "another-donor" || receipts[1].DonorId != donorId || receipts[1].Status != events.StatusNotSent {
+				test.Fatalf("unexpected campaign receipts %+v", receipts)
+			}
+
+			steps := []struct {
+				status   string
+				expected string
+				err      error
+			}{
+				{events.StatusDelivered, events.StatusDelivered, nil},
+				{events.StatusSent, events.StatusDelivered, ErrTransitionIgnored},
+				{events.StatusOpened, events.StatusOpened, nil},
+				{events.StatusSubscribed, events.StatusOpened, ErrTransitionIgnored},
+				{events.StatusComplained, events.StatusComplained, nil},
+				{events.StatusClicked, events.StatusComplained, ErrTransitionIgnored},
+			}
+			for i, step := range steps {
+				err := tester.store.UpdateStatus(ctx, testEvent(campaignId, donorId, step.status, events.Send, now))
+				if !errors.Is(err, step.err) {
+					test.Fatalf("step %d: expected error %v moving to %s but got %v", i, step.err, step.status, err)
+				}
+				receipt, err := tester.store.Receipt(ctx, campaignId, donorId)
+				if err != nil {
+					test.Fatal(err)
+				}
+				if receipt.Status != step.expected || receipt.EmailId != "email-"+donorId {
+					test.Fatalf("step %d: expected status %s but got %+v", i, step.expected, receipt)
+				}
+			}
+		})
+	}
+}
+
+func TestHistory(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+
+			start := time.Now()
+			click := testEvent(campaignId, "donor", events.StatusClicked, events.Click, start.Add(2*time.Second))
+			click.Click = &events.ClickObject{Link: "https://donationreceipt.online"}
+			appended := []events.ParsedEvent{
+				testEvent(campaignId, "donor", events.StatusDelivered, events.Delivery, start.Add(time.Second)),
+				testEvent(campaignId, "donor", events.StatusSent, events.Send, start),
+				click,
+				// redeliveries of an event already recorded are ignored
+				click,
+				testEvent(campaignId, "other-donor", events.StatusSent, events.Send, start),
+			}
+			for _, event := range appended {
+				if err := tester.store.AppendHistory(ctx, event); err != nil {
+					test.Fatal(err)
+				}
+			}
+
+			history, err := tester.store.History(ctx, campaignId, "donor")
+			if err != nil {
+				test.Fatal(err)
+			}
+			expected := []events.EventType{events.Send, events.Delivery, events.Click}
+			if len(history) != len(expected) {
+				test.Fatalf("expected %d events but got %+v", len(expected), history)
+			}
+			for i, event := range history {
+				if event.EventType != expected[i] {
+					test.Errorf("event %d: expected %s but got %s", i, expected[i], event.EventType)
+				}
+			}
+			if !history[0].Timestamp.Equal(start.UTC().Truncate(time.Millisecond)) {
+				test.Errorf("expected timestamp %s but got %s", start, history[0].Timestamp)
+			}
+			var clickDetail events.ClickObject
+			err = json.Unmarshal(history[2].Detail, &clickDetail)
+			if err != nil || clickDetail.Link != "https://donationreceipt.online" {
+				test.Errorf("expected the click detail but got %s", history[2].Detail)
+			}
+
+			history, err = tester.store.History(ctx, campaignId, "missing-donor")
+			if err != nil || history == nil || len(history) != 0 {
+				test.Errorf("expected an empty history but got %+v, %v", history, err)
+			}
+		})
+	}
+}
+
+func TestCampaignHistory(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+
+			start := time.Now()
+			appended := []events.ParsedEvent{
+				testEvent(campaignId, "donor", events.StatusDelivered, events.Delivery, start.Add(time.Second)),
+				testEvent(campaignId, "other-donor", events.StatusSent, events.Send, start),
+				testEvent(campaignId, "donor", events.StatusSent, events.Send, start),
+				testEvent("campaign-"+uuid.New().String(), "donor", events.StatusSent, events.Send, start),
+			}
+			for _, event := range appended {
+				if err := tester.store.AppendHistory(ctx, event); err != nil {
+					test.Fatal(err)
+				}
+			}
+
+			history, err := tester.store.CampaignHistory(ctx, campaignId)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if len(history) != 2 || len(history["donor"]) != 2 || len(history["other-donor"]) != 1 {
+				test.Fatalf("expected the campaign's events by donor but got %+v", history)
+			}
+			if history["donor"][0].EventType != events.Send || history["donor"][1].EventType != events.Delivery {
+				test.Errorf("expected the donor's events in timestamp order but got %+v", history["donor"])
+			}
+
+			history, err = tester.store.CampaignHistory(ctx, "campaign-"+uuid.New().String())
+			if err != nil || len(history) != 0 {
+				test.Errorf("expected no history but got %+v, %v", history, err)
+			}
+		})
+	}
+}
+
+func TestApplyStatusChanges(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+
+			for donorId, status := range map[string]string{"opened": events.StatusOpened, "bounced": events.StatusBounced} {
+				err := tester.insertReceipt(Receipt{CampaignId: campaignId, DonorId: donorId, Status: status})
+				if err != nil {
+					test.Fatal(err)
+				}
+			}
+			assertStatuses := func(expected map[string]string) {
+				test.Helper()
+				for donorId, status := range expected {
+					receipt, err := tester.store.Receipt(ctx, campaignId, donorId)
+					if err != nil {
+						test.Fatal(err)
+					}
+					if receipt.Status != status {
+						test.Errorf("expected %s to be %s but got %s", donorId, status, receipt.Status)
+					}
+				}
+			}
+
+			// a change whose receipt moved on since rolls back every change
+			err := tester.store.ApplyStatusChanges(ctx, campaignId, []StatusChange{
+				{DonorId: "opened", From: events.StatusOpened, To: events.StatusDelivered},
+				{DonorId: "bounced", From: events.StatusDelivered, To: events.StatusSent},
+			})
+			if !errors.Is(err, ErrStatusChanged) {
+				test.Fatalf("expected %v but got %v", ErrStatusChanged, err)
+			}
+			assertStatuses(map[string]string{"opened": events.StatusOpened, "bounced": events.StatusBounced})
+
+			err = tester.store.ApplyStatusChanges(ctx, campaignId, []StatusChange{
+				{DonorId: "opened", From: events.StatusOpened, To: events.StatusDelivered},
+				{DonorId: "missing", From: events.StatusSent, To: events.StatusDelivered},
+			})
+			if !errors.Is(err, ErrReceiptNotFound) {
+				test.Fatalf("expected %v but got %v", ErrReceiptNotFound, err)
+			}
+			assertStatuses(map[string]string{"opened": events.StatusOpened})
+
+			// statuses may move backwards, unlike with UpdateStatus
+			err = tester.store.ApplyStatusChanges(ctx, campaignId, []StatusChange{
+				{DonorId: "opened", From: events.StatusOpened, To: events.StatusDelivered},
+				{DonorId: "bounced", From: events.StatusBounced, To: events.StatusSent},
+			})
+			if err != nil {
+				test.Fatal(err)
+			}
+			assertStatuses(map[string]string{"opened": events.StatusDelivered, "bounced": events.StatusSent})
+		})
+	}
+}
+
+func TestSuppressions(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			// postgres tests share a database
+			suffix := uuid.New().String()
+			bounced := fmt.Sprintf("bounced-%s@example.com", suffix)
+			complained := fmt.Sprintf("complained-%s@example.com", suffix)
+
+			err := tester.store.UpsertSuppression(ctx, Suppression{Email: bounced, Reason: SuppressionBounce, Detail: "General"})
+			if err != nil {
+				test.Fatal(err)
+			}
+			err = tester.store.UpsertSuppression(ctx, Suppression{Email: complained, Reason: SuppressionComplaint, Detail: "abuse"})
+			if err != nil {
+				test.Fatal(err)
+			}
+			// suppressing again replaces the suppression
+			err = tester.store.UpsertSuppression(ctx, Suppression{Email: bounced, Reason: SuppressionComplaint, Detail: "abuse"})
+			if err != nil {
+				test.Fatal(err)
+			}
+
+			suppressions, err := tester.store.Suppressions(ctx, []string{bounced, "someone@example.com"})
+			if err != nil {
+				test.Fatal(err)
+			}
+			if len(suppressions) != 1 || suppressions[0].Email != bounced || suppressions[0].Reason != SuppressionComplaint {
+				test.Fatalf("unexpected suppressions %+v", suppressions)
+			}
+			if suppressions[0].CreatedAt.IsZero() || suppressions[0].UpdatedAt.Before(suppressions[0].CreatedAt) {
+				test.Errorf("unexpected timestamps %+v", suppressions[0])
+			}
+
+			suppressions, err = tester.store.Suppressions(ctx, []string{})
+			if err != nil || len(suppressions) != 0 {
+				test.Errorf("expected no suppressions but got %+v, %v", suppressions, err)
+			}
+			suppressions, err = tester.store.Suppressions(ctx, nil)
+			if err != nil || len(suppressions) < 2 {
+				test.Errorf("expected every suppression but got %+v, %v", suppressions, err)
+			}
+
+			deleted, err := tester.store.DeleteSuppression(ctx, bounced)
+			if err != nil || !deleted {
+				test.Fatalf("expected the suppression to be deleted but got %t, %v", deleted, err)
+			}
+			deleted, err = tester.store.DeleteSuppression(ctx, bounced)
+			if err != nil || deleted {
+				test.Fatalf("expected nothing to delete but got %t, %v", deleted, err)
+			}
+		})
+	}
+}
+
+func TestRebind(test *testing.T) {
+	test.Parallel()
+
+	query := `SELECT a FROM b WHERE c = ? AND d IN (?, ?);`
+	if rebound := NewLibsqlStore(nil).rebind(query); rebound != query {
+		test.Errorf("expected libsql queries to be unchanged but got %s", rebound)
+	}
+	expected := `SELECT a FROM b WHERE c = $1 AND d IN ($2, $3);`
+	if rebound := NewPostgresStore(nil).rebind(query); rebound != expected {
+		test.Errorf("expected %s but got %s", expected, rebound)
+	}
+}
+
+func TestPendingEvents(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+			now := time.Now()
+
+			parked := []PendingEvent{
+				{Id: uuid.New().String(), DonorId: "expired", ExpiresAt: now.Add(-time.Second), CreatedAt: now.Add(-time.Minute)},
+				{Id: uuid.New().String(), DonorId: "second", ExpiresAt: now.Add(time.Minute), CreatedAt: now.Add(-time.Second)},
+				{Id: uuid.New().String(), DonorId: "first", ExpiresAt: now.Add(time.Minute), CreatedAt: now.Add(-2 * time.Second)},
+			}
+			for _, event := range parked {
+				event.CampaignId = campaignId
+				event.SnsMessageId = uuid.New().String()
+				event.Raw = []byte(`{"Type":"Notification"}`)
+				if err := tester.store.ParkPendingEvent(ctx, event); err != nil {
+					test.Fatal(err)
+				}
+			}
+
+			pending, err := tester.store.PendingEvents(ctx, now, 10)
+			if err != nil {
+				test.Fatal(err)
+			}
+			// postgres tests share a database
+			var ours []PendingEvent
+			for _, event := range pending {
+				if event.CampaignId == campaignId {
+					ours = append(ours, event)
+				}
+			}
+			if len(ours) != 2 || ours[0].DonorId != "first" || ours[1].DonorId != "second" {
+				test.Fatalf("expected the unexpired events oldest first but got %+v", ours)
+			}
+			if string(ours[0].Raw) != `{"Type":"Notification"}` {
+				test.Errorf("unexpected raw event %s", ours[0].Raw)
+			}
+
+			if err := tester.store.DeletePendingEvent(ctx, ours[0].Id); err != nil {
+				test.Fatal(err)
+			}
+			expired, err := tester.store.ExpirePendingEvents(ctx, now)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if expired < 1 {
+				test.Errorf("expected the expired event to be removed but %d were", expired)
+			}
+			if name != "postgres" {
+				count, err := tester.store.CountPendingEvents(ctx)
+				if err != nil || count != 1 {
+					test.Errorf("expected 1 pending event but got %d, %v", count, err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueuedEvents(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+			now := time.Now()
+
+			var ids []string
+			for _, donorId := range []string{"first", "second", "third"} {
+				event := QueuedEvent{
+					Id:           uuid.Must(uuid.NewV7()).String(),
+					CampaignId:   campaignId,
+					DonorId:      donorId,
+					SnsMessageId: uuid.New().String(),
+					Raw:          []byte(`{"Type":"Notification"}`),
+					// queued in the same millisecond
+					CreatedAt: now,
+				}
+				if err := tester.store.EnqueueEvent(ctx, event); err != nil {
+					test.Fatal(err)
+				}
+				ids = append(ids, event.Id)
+			}
+			if err := tester.store.DeleteQueuedEvent(ctx, ids[1]); err != nil {
+				test.Fatal(err)
+			}
+
+			queued, err := tester.store.QueuedEvents(ctx)
+			if err != nil {
+				test.Fatal(err)
+			}
+			// postgres tests share a database
+			var ours []QueuedEvent
+			for _, event := range queued {
+				if event.CampaignId == campaignId {
+					ours = append(ours, event)
+				}
+			}
+			if len(ours) != 2 || ours[0].DonorId != "first" || ours[1].DonorId != "third" {
+				test.Fatalf("expected the remaining events in the order they were queued but got %+v", ours)
+			}
+			if string(ours[0].Raw) != `{"Type":"Notification"}` || ours[0].CreatedAt.UnixMilli() != now.UnixMilli() {
+				test.Errorf("unexpected queued event %+v", ours[0])
+			}
+		})
+	}
+}
+
+func TestClaimQueuedEvents(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			campaignId := "campaign-" + uuid.New().String()
+			owner := "instance-" + uuid.New().String()
+			other := "instance-" + uuid.New().String()
+			now := time.Now()
+
+			// postgres tests share a database
+			ours := func(queued []QueuedEvent) map[string]QueuedEvent {
+				byDonor := make(map[string]QueuedEvent)
+				for _, event := range queued {
+					if event.CampaignId == campaignId {
+						byDonor[event.DonorId] = event
+					}
+				}
+				return byDonor
+			}
+			for _, event := range []QueuedEvent{
+				{DonorId: "unowned"},
+				{DonorId: "expired", ClaimedBy: other, LeaseUntil: now.Add(-time.Minute)},
+				{DonorId: "leased", ClaimedBy: other, LeaseUntil: now.Add(time.Minute)},
+				{DonorId: "own", ClaimedBy: owner, LeaseUntil: now.Add(-time.Minute)},
+			} {
+				event.Id = uuid.Must(uuid.NewV7()).String()
+				event.CampaignId = campaignId
+				event.SnsMessageId = uuid.New().String()
+				event.Raw = []byte(`{"Type":"Notification"}`)
+				if err := tester.store.EnqueueEvent(ctx, event); err != nil {
+					test.Fatal(err)
+				}
+			}
+
+			// only unowned and expired events are claimed, in the order they were queued
+			leaseUntil := now.Add(time.Minute)
+			claimed, err := tester.store.ClaimQueuedEvents(ctx, owner, now, leaseUntil)
+			if err != nil {
+				test.Fatal(err)
+			}
+			var donorIds []string
+			for _, event := range claimed {
+				if event.CampaignId == campaignId {
+					donorIds = append(donorIds, event.DonorId)
+				}
+			}
+			if len(donorIds) != 2 || donorIds[0] != "unowned" || donorIds[1] != "expired" {
+				test.Fatalf("expected the unowned and expired events but got %v", donorIds)
+			}
+			// another instance only claims the expired event the owner skipped
+			claimed, err = tester.store.ClaimQueuedEvents(ctx, other+"-restarted", now, leaseUntil)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if byDonor := ours(claimed); len(byDonor) != 1 || byDonor["own"].Id == "" {
+				test.Fatalf("expected leased events not to be claimed again but got %+v", claimed)
+			}
+
+			queued, err := tester.store.QueuedEvents(ctx)
+			if err != nil {
+				test.Fatal(err)
+			}
+			byDonor := ours(queued)
+			if event := byDonor["expired"]; event.ClaimedBy != owner || event.LeaseUntil.UnixMilli() != leaseUntil.UnixMilli() {
+				test.Errorf("expected the expired event to be claimed but got %+v", event)
+			}
+			if event := byDonor["leased"]; event.ClaimedBy != other {
+				test.Errorf("expected the leased event to keep its owner but got %+v", event)
+			}
+
+			// renewing extends every lease the owner holds
+			renewedUntil := now.Add(time.Hour)
+			if err := tester.store.RenewQueuedEvents(ctx, owner, renewedUntil); err != nil {
+				test.Fatal(err)
+			}
+			queued, err = tester.store.QueuedEvents(ctx)
+			if err != nil {
+				test.Fatal(err)
+			}
+			for _, donorId := range []string{"unowned", "expired"} {
+				if event := ours(queued)[donorId]; event.LeaseUntil.UnixMilli() != renewedUntil.UnixMilli() {
+					test.Errorf("expected %s's lease to be renewed but got %+v", donorId, event)
+				}
+			}
+
+			// released events can be claimed straight away
+			if err := tester.store.ReleaseQueuedEvents(ctx, owner); err != nil {
+				test.Fatal(err)
+			}
+			claimed, err = tester.store.ClaimQueuedEvents(ctx, other, now, leaseUntil)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if byDonor := ours(claimed); len(byDonor) != 2 || byDonor["unowned"].Id == "" || byDonor["expired"].Id == "" {
+				test.Errorf("expected the released events to be claimed but got %+v", claimed)
+			}
+		})
+	}
+}
+
+func TestDeadLetters(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			id := uuid.New().String()
+
+			letter := DeadLetter{Id: id, Reason: DeadLetterParse, Error: "failed to parse", Raw: []byte(`{"Type":"Notification"}`)}
+			if err := tester.store.RecordDeadLetter(ctx, letter); err != nil {
+				test.Fatal(err)
+			}
+			// a redelivery which fails again counts another attempt
+			letter.Reason = DeadLetterWrite
+			letter.Error = "db unavailable"
+			if err := tester.store.RecordDeadLetter(ctx, letter); err != nil {
+				test.Fatal(err)
+			}
+
+			stored, err := tester.store.DeadLetter(ctx, id)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if stored.Reason != DeadLetterWrite || stored.Error != "db unavailable" || stored.Attempts != 2 {
+				test.Errorf("expected the latest failure after 2 attempts but got %+v", stored)
+			}
+			if string(stored.Raw) != `{"Type":"Notification"}` || stored.UpdatedAt.Before(stored.CreatedAt) {
+				test.Errorf("unexpected dead letter %+v", stored)
+			}
+
+			letters, err := tester.store.DeadLetters(ctx, 1000)
+			if err != nil {
+				test.Fatal(err)
+			}
+			found := false
+			for _, letter := range letters {
+				found = found || letter.Id == id
+			}
+			if !found {
+				test.Errorf("expected the dead letter to be listed in %+v", letters)
+			}
+
+			deleted, err := tester.store.DeleteDeadLetter(ctx, id)
+			if err != nil || !deleted {
+				test.Fatalf("expected the dead letter to be deleted but got %v, %v", deleted, err)
+			}
+			if _, err := tester.store.DeadLetter(ctx, id); !errors.Is(err, ErrDeadLetterNotFound) {
+				test.Errorf("expected %v but got %v", ErrDeadLetterNotFound, err)
+			}
+			if deleted, err := tester.store.DeleteDeadLetter(ctx, id); err != nil || deleted {
+				test.Errorf("expected nothing to delete but got %v, %v", deleted, err)
+			}
+
+			// postgres tests share a database
+			if name != "postgres" {
+				for _, id := range []string{"first", "second"} {
+					if err := tester.store.RecordDeadLetter(ctx, DeadLetter{Id: id, Reason: DeadLetterParse}); err != nil {
+						test.Fatal(err)
+					}
+				}
+				purged, err := tester.store.PurgeDeadLetters(ctx)
+				if err != nil || purged != 2 {
+					test.Errorf("expected 2 dead letters to be purged but got %d, %v", purged, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriptionRecords(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			topicArn := "arn:aws:sns:us-west-2:123456789012:" + uuid.New().String()
+
+			var ids []string
+			for _, outcome := range []SubscriptionOutcome{"confirmed", "confirm_failed", "unsubscribed"} {
+				record := SubscriptionRecord{
+					Id:        uuid.Must(uuid.NewV7()).String(),
+					Type:      "SubscriptionConfirmation",
+					TopicArn:  topicArn,
+					MessageId: uuid.New().String(),
+					Outcome:   outcome,
+					CreatedAt: time.Now(),
+				}
+				if outcome == "confirm_failed" {
+					record.Error = "unexpected status code 500"
+				}
+				if err := tester.store.RecordSubscription(ctx, record); err != nil {
+					test.Fatal(err)
+				}
+				ids = append(ids, record.Id)
+			}
+
+			// the most recent records are returned oldest first
+			records, err := tester.store.SubscriptionRecords(ctx, 2)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if len(records) != 2 || records[0].Id >= records[1].Id {
+				test.Fatalf("expected the 2 most recent records oldest first but got %+v", records)
+			}
+			if records[1].Id != ids[2] || records[1].Outcome != "unsubscribed" || records[1].TopicArn != topicArn {
+				test.Errorf("expected the latest record last but got %+v", records[1])
+			}
+
+			records, err = tester.store.SubscriptionRecords(ctx, 1000)
+			if err != nil {
+				test.Fatal(err)
+			}
+			var ours []SubscriptionRecord
+			for _, record := range records {
+				if record.TopicArn == topicArn {
+					ours = append(ours, record)
+				}
+			}
+			if len(ours) != 3 || ours[0].Id != ids[0] || ours[1].Id != ids[1] || ours[2].Id != ids[2] {
+				test.Fatalf("expected the records in the order they were made but got %+v", ours)
+			}
+			if ours[1].Error != "unexpected status code 500" || ours[1].CreatedAt.IsZero() {
+				test.Errorf("unexpected record %+v", ours[1])
+			}
+		})
+	}
+}
+
+func TestProcessedEvents(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			key := "sns:" + uuid.New().String()
+			now := time.Now()
+
+			if err := tester.store.ClaimEvent(ctx, key, now, now.Add(-time.Minute)); err != nil {
+				test.Fatal(err)
+			}
+			// a redelivery while the first is still processing is refused
+			err := tester.store.ClaimEvent(ctx, key, now.Add(time.Second), now.Add(-time.Minute))
+			if !errors.Is(err, ErrEventInProgress) {
+				test.Errorf("expected %v but got %v", ErrEventInProgress, err)
+			}
+			// until the claim is stale
+			if err := tester.store.ClaimEvent(ctx, key, now.Add(2*time.Minute), now.Add(time.Minute)); err != nil {
+				test.Errorf("expected the stale claim to be taken over but got %v", err)
+			}
+
+			// a released claim can be claimed again
+			if err := tester.store.ReleaseEvent(ctx, key); err != nil {
+				test.Fatal(err)
+			}
+			if err := tester.store.ClaimEvent(ctx, key, now, now.Add(-time.Minute)); err != nil {
+				test.Fatalf("expected the released event to be claimed but got %v", err)
+			}
+
+			// a processed event is never claimed again, even once its claim is stale
+			if err := tester.store.CompleteEvent(ctx, key, now); err != nil {
+				test.Fatal(err)
+			}
+			if err := tester.store.ReleaseEvent(ctx, key); err != nil {
+				test.Fatal(err)
+			}
+			err = tester.store.ClaimEvent(ctx, key, now.Add(time.Hour), now.Add(time.Hour))
+			if !errors.Is(err, ErrEventProcessed) {
+				test.Errorf("expected %v but got %v", ErrEventProcessed, err)
+			}
+
+			// until it expires
+			expired, err := tester.store.ExpireProcessedEvents(ctx, now.Add(time.Millisecond))
+			if err != nil {
+				test.Fatal(err)
+			}
+			if expired < 1 {
+				test.Errorf("expected the processed event to be removed but %d were", expired)
+			}
+			if err := tester.store.ClaimEvent(ctx, key, now, now); err != nil {
+				test.Errorf("expected the expired event to be claimed but got %v", err)
+			}
+		})
+	}
+}
+
+func TestSessions(test *testing.T) {
+	test.Parallel()
+
+	for name, newTester := range storeTesters {
+		test.Run(name, func(test *testing.T) {
+			test.Parallel()
+			tester := newTester(test)
+			ctx := context.Background()
+			now := time.Now()
+			userId := "user-" + uuid.New().String()
+			token := "token-" + uuid.New().String()
+			expiredToken := "token-" + uuid.New().String()
+			campaignId := "campaign-" + uuid.New().String()
+			otherCampaignId := "campaign-" + uuid.New().String()
+
+			for _, session := range []Session{
+				{SessionToken: token, UserId: userId, Expires: now.Add(time.Hour)},
+				{SessionToken: expiredToken, UserId: userId, Expires: now.Add(-time.Hour)},
+			} {
+				if err := tester.insertSession(session); err != nil {
+					test.Fatal(err)
+				}
+			}
+			if err := tester.insertCampaign(campaignId, "account-"+uuid.New().String(), userId); err != nil {
+				test.Fatal(err)
+			}
+			if err := tester.insertCampaign(otherCampaignId, "account-"+uuid.New().String(), "another-user"); err != nil {
+				test.Fatal(err)
+			}
+
+			sessionUser, err := tester.store.SessionUser(ctx, token, now)
+			if err != nil {
+				test.Fatal(err)
+			}
+			if sessionUser != userId {
+				test.Errorf("expected user %s but got %s", userId, sessionUser)
+			}
+			for _, missing := range []string{expiredToken, "not-a-token"} {
+				if _, err := tester.store.SessionUser(ctx, missing, now); !errors.Is(err, ErrSessionNotFound) {
+					test.Errorf("expected ErrSessionNotFound but got %v", err)
+				}
+			}
+
+			for campaign, expected := range map[string]bool{campaignId: true, otherCampaignId: false, "missing-campaign": false} {
+				owns, err := tester.store.UserOwnsCampaign(ctx, userId, campaign)
+				if err != nil {
+					test.Fatal(err)
+				}
+				if owns != expected {
+					test.Errorf("expected UserOwnsCampaign(%s) to be %t", campaign, expected)
+				}
+			}
+		})
+	}
+}